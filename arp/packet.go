@@ -0,0 +1,67 @@
+package arp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/unixpickle/wifistack/frames"
+)
+
+// ErrUnsupportedPacket is returned when decoding an ARP packet
+// which is not for IPv4 over Ethernet.
+var ErrUnsupportedPacket = errors.New("unsupported ARP packet")
+
+const packetSize = 28
+
+// These are the operations defined in RFC 826.
+const (
+	OperationRequest = 1
+	OperationReply   = 2
+)
+
+// A Packet is an ARP packet for resolving IPv4 addresses to
+// Ethernet addresses.
+type Packet struct {
+	Operation int
+	SenderMAC frames.MAC
+	SenderIP  net.IP
+	TargetMAC frames.MAC
+	TargetIP  net.IP
+}
+
+// DecodePacket decodes an ARP packet.
+func DecodePacket(data []byte) (*Packet, error) {
+	if len(data) < packetSize {
+		return nil, frames.ErrBufferUnderflow
+	}
+	hardwareType := binary.BigEndian.Uint16(data[0:2])
+	protocolType := binary.BigEndian.Uint16(data[2:4])
+	if hardwareType != 1 || protocolType != frames.EtherTypeIPv4 ||
+		data[4] != 6 || data[5] != 4 {
+		return nil, ErrUnsupportedPacket
+	}
+	res := &Packet{
+		Operation: int(binary.BigEndian.Uint16(data[6:8])),
+		SenderIP:  net.IP(append([]byte{}, data[14:18]...)),
+		TargetIP:  net.IP(append([]byte{}, data[24:28]...)),
+	}
+	copy(res.SenderMAC[:], data[8:14])
+	copy(res.TargetMAC[:], data[18:24])
+	return res, nil
+}
+
+// Encode generates the binary representation of the packet.
+func (p *Packet) Encode() []byte {
+	res := make([]byte, packetSize)
+	binary.BigEndian.PutUint16(res[0:2], 1)
+	binary.BigEndian.PutUint16(res[2:4], frames.EtherTypeIPv4)
+	res[4] = 6
+	res[5] = 4
+	binary.BigEndian.PutUint16(res[6:8], uint16(p.Operation))
+	copy(res[8:14], p.SenderMAC[:])
+	copy(res[14:18], p.SenderIP.To4())
+	copy(res[18:24], p.TargetMAC[:])
+	copy(res[24:28], p.TargetIP.To4())
+	return res
+}
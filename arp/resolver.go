@@ -0,0 +1,492 @@
+// Package arp implements the Address Resolution Protocol from RFC 826
+// on top of a wifistack.EthernetStream.
+package arp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/frames"
+)
+
+const (
+	defaultCacheTimeout   = time.Minute
+	defaultRequestTimeout = time.Second
+	defaultMaxRequests    = 3
+	defaultMaxPending     = 16
+
+	announceCount    = 2
+	announceInterval = time.Second * 2
+
+	incomingBufferSize = 16
+	outgoingBufferSize = 16
+)
+
+var (
+	ErrResolveFailed = errors.New("ARP resolution failed")
+	ErrClosed        = errors.New("ARP resolver closed")
+)
+
+var broadcastMAC = frames.MAC{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// Config stores the configuration for a Resolver.
+type Config struct {
+	// Stream is used to send and receive ARP packets, as well as the
+	// packets which are queued while their destinations are resolved.
+	// The resolver handles the stream's ARP frames, so the stream may
+	// be shared with other protocols. The resolver never closes it.
+	Stream *wifistack.EthernetStream
+
+	// MAC is the hardware address of this station.
+	MAC frames.MAC
+
+	// CacheTimeout is how long a resolved address is remembered.
+	// If this is 0, a default value is used.
+	CacheTimeout time.Duration
+
+	// RequestTimeout is how long to wait for a reply before resending
+	// a request. If this is 0, a default value is used.
+	RequestTimeout time.Duration
+
+	// MaxRequests is the number of requests to send before giving up.
+	// If this is 0, a default value is used.
+	MaxRequests int
+
+	// MaxPending is the number of packets which may be queued for an
+	// unresolved address. If more packets arrive, the oldest ones are
+	// dropped. If this is 0, a default value is used.
+	MaxPending int
+}
+
+// A Resolver maintains a neighbor cache, resolves IPv4 addresses to MAC
+// addresses, and answers requests for the local IPv4 address.
+type Resolver struct {
+	// hasClosed is used to atomically ensure that closeChan is closed only once.
+	hasClosed uint32
+	closeChan chan struct{}
+
+	config        Config
+	removeHandler func()
+	incoming      chan *frames.EthernetFrame
+	outgoing      chan *frames.EthernetFrame
+
+	lock    sync.Mutex
+	address net.IP
+	entries map[[4]byte]*entry
+
+	wg sync.WaitGroup
+}
+
+type entry struct {
+	ip       net.IP
+	mac      frames.MAC
+	resolved bool
+	expiry   time.Time
+
+	requests int
+	timer    *time.Timer
+	pending  []pendingPacket
+	waiters  []chan struct{}
+}
+
+type pendingPacket struct {
+	etherType int
+	payload   []byte
+}
+
+// NewResolver creates a Resolver and starts processing the stream.
+// You must call Close once you are done with the resolver.
+func NewResolver(c Config) *Resolver {
+	if c.CacheTimeout == 0 {
+		c.CacheTimeout = defaultCacheTimeout
+	}
+	if c.RequestTimeout == 0 {
+		c.RequestTimeout = defaultRequestTimeout
+	}
+	if c.MaxRequests == 0 {
+		c.MaxRequests = defaultMaxRequests
+	}
+	if c.MaxPending == 0 {
+		c.MaxPending = defaultMaxPending
+	}
+	res := &Resolver{
+		closeChan: make(chan struct{}),
+		config:    c,
+		incoming:  make(chan *frames.EthernetFrame, incomingBufferSize),
+		outgoing:  make(chan *frames.EthernetFrame, outgoingBufferSize),
+		entries:   map[[4]byte]*entry{},
+	}
+	res.removeHandler = c.Stream.HandleEtherType(frames.EtherTypeARP, func(f *frames.EthernetFrame) {
+		select {
+		case res.incoming <- f:
+		default:
+		}
+	})
+	res.wg.Add(2)
+	go res.incomingLoop()
+	go res.outgoingLoop()
+	return res
+}
+
+// Address returns the local IPv4 address, or nil if none is set.
+func (r *Resolver) Address() net.IP {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.address
+}
+
+// SetAddress sets the local IPv4 address, for which the resolver answers
+// requests. If ip is nil, the resolver stops answering requests.
+//
+// When a new address is set, it is announced with gratuitous ARP, as
+// described in section 2.3 of RFC 5227, so that neighbors update their
+// caches.
+func (r *Resolver) SetAddress(ip net.IP) {
+	r.lock.Lock()
+	if ip != nil {
+		ip = ip.To4()
+	}
+	changed := !ip.Equal(r.address)
+	r.address = ip
+	r.lock.Unlock()
+
+	if ip != nil && changed {
+		go r.announce(ip)
+	}
+}
+
+// Lookup returns the MAC address for an IPv4 address if it is cached.
+func (r *Resolver) Lookup(ip net.IP) (frames.MAC, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if e, ok := r.entries[ipKey(ip)]; ok && e.resolved && time.Now().Before(e.expiry) {
+		return e.mac, true
+	}
+	return frames.MAC{}, false
+}
+
+// Resolve finds the MAC address for an IPv4 address, sending requests
+// if the address is not cached.
+//
+// The limited broadcast address and multicast addresses are mapped
+// directly to group MAC addresses.
+func (r *Resolver) Resolve(ctx context.Context, ip net.IP) (frames.MAC, error) {
+	if mac, ok := groupMAC(ip); ok {
+		return mac, nil
+	}
+
+	waiter := make(chan struct{})
+	r.lock.Lock()
+	e, mac, ok := r.entryForSend(ip)
+	if ok {
+		r.lock.Unlock()
+		return mac, nil
+	}
+	e.waiters = append(e.waiters, waiter)
+	toSend := r.startResolving(e)
+	r.lock.Unlock()
+	r.sendAll(toSend)
+
+	select {
+	case <-waiter:
+	case <-ctx.Done():
+		return frames.MAC{}, ctx.Err()
+	case <-r.closeChan:
+		return frames.MAC{}, ErrClosed
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !e.resolved {
+		return frames.MAC{}, ErrResolveFailed
+	}
+	return e.mac, nil
+}
+
+// Send sends a packet to an IPv4 address on the local network.
+//
+// If the address is not cached, the packet is queued until the address
+// is resolved, and it is dropped if the address cannot be resolved.
+// The limited broadcast address and multicast addresses are mapped
+// directly to group MAC addresses.
+func (r *Resolver) Send(ip net.IP, etherType int, payload []byte) {
+	if mac, ok := groupMAC(ip); ok {
+		r.sendAll([]*frames.EthernetFrame{r.frame(mac, etherType, payload)})
+		return
+	}
+
+	r.lock.Lock()
+	e, mac, ok := r.entryForSend(ip)
+	if ok {
+		r.lock.Unlock()
+		r.sendAll([]*frames.EthernetFrame{r.frame(mac, etherType, payload)})
+		return
+	}
+	e.pending = append(e.pending, pendingPacket{etherType, payload})
+	if len(e.pending) > r.config.MaxPending {
+		e.pending = e.pending[1:]
+	}
+	toSend := r.startResolving(e)
+	r.lock.Unlock()
+	r.sendAll(toSend)
+}
+
+// Close stops the resolver and removes its handler from the stream.
+// Pending resolutions fail, and queued packets are dropped.
+func (r *Resolver) Close() {
+	if atomic.SwapUint32(&r.hasClosed, 1) == 0 {
+		close(r.closeChan)
+	}
+	r.removeHandler()
+	r.lock.Lock()
+	for _, e := range r.entries {
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+	}
+	r.lock.Unlock()
+	r.wg.Wait()
+}
+
+// entryForSend finds the cache entry for an address, creating it or
+// resetting it if necessary.
+// If the entry is resolved and fresh, its MAC is returned with ok set.
+//
+// The caller must hold the lock.
+func (r *Resolver) entryForSend(ip net.IP) (e *entry, mac frames.MAC, ok bool) {
+	key := ipKey(ip)
+	e = r.entries[key]
+	if e != nil && e.resolved {
+		if time.Now().Before(e.expiry) {
+			return e, e.mac, true
+		}
+		delete(r.entries, key)
+		e = nil
+	}
+	if e == nil {
+		e = &entry{ip: ip.To4()}
+		r.entries[key] = e
+	}
+	return e, frames.MAC{}, false
+}
+
+// startResolving sends the first request for an entry if no request
+// is in progress.
+// It returns the frames to send once the lock is released.
+//
+// The caller must hold the lock.
+func (r *Resolver) startResolving(e *entry) []*frames.EthernetFrame {
+	if e.timer != nil {
+		return nil
+	}
+	e.requests = 1
+	e.timer = time.AfterFunc(r.config.RequestTimeout, func() {
+		r.retry(e)
+	})
+	return []*frames.EthernetFrame{r.requestFrame(e.ip)}
+}
+
+// retry resends a request for an entry, or fails the entry after
+// too many requests.
+func (r *Resolver) retry(e *entry) {
+	r.lock.Lock()
+	if e.resolved || r.entries[ipKey(e.ip)] != e {
+		r.lock.Unlock()
+		return
+	}
+	if e.requests >= r.config.MaxRequests {
+		delete(r.entries, ipKey(e.ip))
+		for _, w := range e.waiters {
+			close(w)
+		}
+		e.waiters = nil
+		e.pending = nil
+		r.lock.Unlock()
+		return
+	}
+	e.requests++
+	e.timer.Reset(r.config.RequestTimeout)
+	frame := r.requestFrame(e.ip)
+	r.lock.Unlock()
+	r.sendAll([]*frames.EthernetFrame{frame})
+}
+
+// resolve records the MAC of an entry, waking up waiters and
+// flushing queued packets.
+// It returns the frames to send once the lock is released.
+//
+// The caller must hold the lock.
+func (r *Resolver) resolve(e *entry, mac frames.MAC) []*frames.EthernetFrame {
+	e.mac = mac
+	e.resolved = true
+	e.expiry = time.Now().Add(r.config.CacheTimeout)
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	for _, w := range e.waiters {
+		close(w)
+	}
+	e.waiters = nil
+
+	var res []*frames.EthernetFrame
+	for _, p := range e.pending {
+		res = append(res, r.frame(mac, p.etherType, p.payload))
+	}
+	e.pending = nil
+	return res
+}
+
+func (r *Resolver) handlePacket(p *Packet) {
+	if p.SenderIP.Equal(net.IPv4zero) || p.SenderMAC == r.config.MAC {
+		return
+	}
+
+	var toSend []*frames.EthernetFrame
+
+	r.lock.Lock()
+
+	// NOTE: this is the merge step from the packet reception
+	// algorithm in RFC 826.
+	key := ipKey(p.SenderIP)
+	merged := false
+	if e, ok := r.entries[key]; ok {
+		toSend = append(toSend, r.resolve(e, p.SenderMAC)...)
+		merged = true
+	}
+
+	if r.address != nil && p.TargetIP.Equal(r.address) {
+		if !merged {
+			e := &entry{ip: p.SenderIP.To4()}
+			r.entries[key] = e
+			r.resolve(e, p.SenderMAC)
+		}
+		if p.Operation == OperationRequest {
+			reply := &Packet{
+				Operation: OperationReply,
+				SenderMAC: r.config.MAC,
+				SenderIP:  r.address,
+				TargetMAC: p.SenderMAC,
+				TargetIP:  p.SenderIP,
+			}
+			toSend = append(toSend, r.frame(p.SenderMAC, frames.EtherTypeARP, reply.Encode()))
+		}
+	}
+
+	r.lock.Unlock()
+	r.sendAll(toSend)
+}
+
+func (r *Resolver) announce(ip net.IP) {
+	for i := 0; i < announceCount; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(announceInterval):
+			case <-r.closeChan:
+				return
+			}
+		}
+		if !r.Address().Equal(ip) {
+			return
+		}
+		packet := &Packet{
+			Operation: OperationRequest,
+			SenderMAC: r.config.MAC,
+			SenderIP:  ip,
+			TargetIP:  ip,
+		}
+		frame := r.frame(broadcastMAC, frames.EtherTypeARP, packet.Encode())
+		r.sendAll([]*frames.EthernetFrame{frame})
+	}
+}
+
+func (r *Resolver) requestFrame(ip net.IP) *frames.EthernetFrame {
+	sender := r.address
+	if sender == nil {
+		sender = net.IPv4zero
+	}
+	packet := &Packet{
+		Operation: OperationRequest,
+		SenderMAC: r.config.MAC,
+		SenderIP:  sender,
+		TargetIP:  ip,
+	}
+	return r.frame(broadcastMAC, frames.EtherTypeARP, packet.Encode())
+}
+
+func (r *Resolver) frame(dest frames.MAC, etherType int, payload []byte) *frames.EthernetFrame {
+	return &frames.EthernetFrame{
+		Destination: dest,
+		Source:      r.config.MAC,
+		EtherType:   etherType,
+		Payload:     payload,
+	}
+}
+
+func (r *Resolver) sendAll(toSend []*frames.EthernetFrame) {
+	for _, f := range toSend {
+		select {
+		case r.outgoing <- f:
+		case <-r.closeChan:
+			return
+		}
+	}
+}
+
+func (r *Resolver) incomingLoop() {
+	defer r.wg.Done()
+	for {
+		select {
+		case frame := <-r.incoming:
+			if packet, err := DecodePacket(frame.Payload); err == nil {
+				r.handlePacket(packet)
+			}
+		case <-r.config.Stream.Done():
+			return
+		case <-r.closeChan:
+			return
+		}
+	}
+}
+
+func (r *Resolver) outgoingLoop() {
+	defer r.wg.Done()
+	for {
+		select {
+		case frame := <-r.outgoing:
+			select {
+			case r.config.Stream.Outgoing() <- frame:
+			case <-r.closeChan:
+				return
+			}
+		case <-r.closeChan:
+			return
+		}
+	}
+}
+
+// groupMAC maps the limited broadcast address and multicast addresses
+// to MAC addresses, as described in section 6.4 of RFC 1112.
+func groupMAC(ip net.IP) (frames.MAC, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return frames.MAC{}, false
+	}
+	if ip4.Equal(net.IPv4bcast) {
+		return broadcastMAC, true
+	} else if ip4.IsMulticast() {
+		return frames.MAC{0x01, 0x00, 0x5e, ip4[1] & 0x7f, ip4[2], ip4[3]}, true
+	}
+	return frames.MAC{}, false
+}
+
+func ipKey(ip net.IP) [4]byte {
+	var res [4]byte
+	copy(res[:], ip.To4())
+	return res
+}
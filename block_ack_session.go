@@ -0,0 +1,188 @@
+package wifistack
+
+import (
+	"time"
+
+	"github.com/unixpickle/wifistack/frames"
+)
+
+// statusRequestDeclined is the status code used to refuse an ADDBA request.
+const statusRequestDeclined = 37
+
+// reasonBlockAckTimeout is the reason code of a DELBA which tears down an
+// agreement after its inactivity timeout.
+const reasonBlockAckTimeout = 39
+
+// timeUnit is the 802.11 time unit, in which block ack timeouts are given.
+const timeUnit = time.Microsecond * 1024
+
+// blockAckSession stores the recipient state for one block ack agreement.
+type blockAckSession struct {
+	params  frames.BlockAckParams
+	timeout uint16
+	reorder *reorderBuffer
+
+	// lastActivity is the last time that a frame arrived under the agreement.
+	lastActivity time.Time
+}
+
+// expired returns true if the agreement has been inactive for longer than
+// its timeout.
+func (b *blockAckSession) expired(now time.Time) bool {
+	return b.timeout != 0 && now.Sub(b.lastActivity) > time.Duration(b.timeout)*timeUnit
+}
+
+// handleIncomingAction processes an action frame addressed to us.
+// It is used by the incoming data loop.
+func (o *OpenMSDUStream) handleIncomingAction(f *frames.Frame) bool {
+	if !o.sendControlFrame(&frames.Frame{
+		Type:      frames.FrameTypeACK,
+		Addresses: []frames.MAC{f.Addresses[1]},
+	}) {
+		return false
+	}
+
+	action, err := frames.DecodeAction(f)
+	if err != nil || action.Category != frames.ActionCategoryBlockAck {
+		return true
+	}
+
+	switch action.Action {
+	case frames.BlockAckActionADDBARequest:
+		req, err := frames.DecodeADDBARequest(f)
+		if err != nil {
+			return true
+		}
+		return o.handleADDBARequest(req)
+	case frames.BlockAckActionDELBA:
+		delba, err := frames.DecodeDELBA(f)
+		if err != nil {
+			return true
+		}
+		if session, ok := o.blockAckSessions[delba.TID]; ok {
+			delete(o.blockAckSessions, delba.TID)
+			return o.deliverMSDUs(session.reorder.flushAll())
+		}
+	}
+	return true
+}
+
+func (o *OpenMSDUStream) handleADDBARequest(req *frames.ADDBARequest) bool {
+	params := req.Params
+	params.AMSDUSupported = false
+	if params.BufferSize <= 0 || params.BufferSize > maxReorderWindow {
+		params.BufferSize = maxReorderWindow
+	}
+
+	resp := &frames.ADDBAResponse{
+		Addresses:   []frames.MAC{o.config.BSSID, o.config.Client, o.config.BSSID},
+		DialogToken: req.DialogToken,
+		Params:      params,
+		Timeout:     req.Timeout,
+	}
+
+	if !params.Immediate {
+		// We only support the immediate block ack policy, since we
+		// respond to block ack requests as soon as they arrive.
+		resp.StatusCode = statusRequestDeclined
+	} else {
+		if old, ok := o.blockAckSessions[params.TID]; ok {
+			if !o.deliverMSDUs(old.reorder.flushAll()) {
+				return false
+			}
+		}
+		o.blockAckSessions[params.TID] = &blockAckSession{
+			params:       params,
+			timeout:      req.Timeout,
+			reorder:      newReorderBuffer(req.StartingSequence, params.BufferSize),
+			lastActivity: time.Now(),
+		}
+	}
+
+	respFrame := resp.EncodeToFrame()
+	respFrame.DurationID = HandshakeDurationID
+	respFrame.SequenceControl = o.sequences.NextControl()
+	return o.queueWithAck(respFrame)
+}
+
+// handleBlockAckRequest processes a BAR by moving the reorder window
+// and replying with a block ack.
+func (o *OpenMSDUStream) handleBlockAckRequest(f *frames.Frame) bool {
+	bar, err := frames.DecodeBlockAckRequest(f)
+	if err != nil {
+		return true
+	}
+	session, ok := o.blockAckSessions[bar.Control.TID]
+	if !ok {
+		return true
+	}
+
+	session.lastActivity = time.Now()
+	if !o.deliverMSDUs(session.reorder.moveWindow(bar.StartingSequence)) {
+		return false
+	}
+
+	if bar.Control.NoAck {
+		return true
+	}
+	return o.sendBlockAck(bar.Transmitter, bar.Control.TID, bar.StartingSequence, session)
+}
+
+// sendBlockAck sends a compressed block ack for an agreement, whose bitmap
+// begins at the given sequence number.
+func (o *OpenMSDUStream) sendBlockAck(receiver frames.MAC, tid, startSeq int,
+	session *blockAckSession) bool {
+	blockAck := &frames.BlockAck{
+		Receiver:    receiver,
+		Transmitter: o.config.Client,
+		Control: frames.BlockAckControl{
+			Compressed: true,
+			TID:        tid,
+		},
+		StartingSequence: startSeq,
+		Bitmap:           session.reorder.bitmap(startSeq),
+	}
+	return o.sendControlFrame(blockAck.EncodeToFrame())
+}
+
+// expireBlockAckSessions tears down the agreements whose inactivity timeout
+// has passed, telling the AP with a DELBA, as described in section 10.5.4 of
+// the IEEE 802.11-2012 spec.
+func (o *OpenMSDUStream) expireBlockAckSessions() bool {
+	now := time.Now()
+	for tid, session := range o.blockAckSessions {
+		if !session.expired(now) {
+			continue
+		}
+		delete(o.blockAckSessions, tid)
+		if !o.deliverMSDUs(session.reorder.flushAll()) {
+			return false
+		}
+		delba := &frames.DELBA{
+			Addresses:  []frames.MAC{o.config.BSSID, o.config.Client, o.config.BSSID},
+			TID:        tid,
+			ReasonCode: reasonBlockAckTimeout,
+		}
+		delbaFrame := delba.EncodeToFrame()
+		delbaFrame.DurationID = HandshakeDurationID
+		delbaFrame.SequenceControl = o.sequences.NextControl()
+		if !o.queueWithAck(delbaFrame) {
+			return false
+		}
+	}
+	return true
+}
+
+// flushReorderBuffers releases MSDUs which have been waiting too long
+// for a missing MSDU.
+func (o *OpenMSDUStream) flushReorderBuffers() bool {
+	now := time.Now()
+	for _, session := range o.blockAckSessions {
+		if session.reorder.hasBuffered() {
+			if !o.deliverMSDUs(session.reorder.flushTimedOut(now)) {
+				return false
+			}
+		}
+	}
+	return true
+}
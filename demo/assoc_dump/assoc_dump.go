@@ -6,12 +6,13 @@ import (
 	"strconv"
 
 	"github.com/unixpickle/gofi"
+	"github.com/unixpickle/wifistack/filter"
 	"github.com/unixpickle/wifistack/frames"
 )
 
 func main() {
-	if len(os.Args) != 2 {
-		log.Fatalln("Usage: assoc_dump <channel>")
+	if len(os.Args) != 2 && len(os.Args) != 3 {
+		log.Fatalln("Usage: assoc_dump <channel> [filter]")
 	}
 
 	channel, err := strconv.Atoi(os.Args[1])
@@ -28,17 +29,21 @@ func main() {
 		log.Fatalln("could not open handle:", err)
 	}
 
+	filterExpr := "type == assoc-req || type == assoc-resp || type == auth"
+	if len(os.Args) == 3 {
+		filterExpr = os.Args[2]
+	}
+	predicate, err := filter.Compile(filterExpr)
+	if err != nil {
+		log.Fatalln("invalid filter:", err)
+	}
+
 	if err := handle.SetChannel(gofi.Channel{Number: channel}); err != nil {
 		log.Fatalln("could not set channel:", err)
 	}
 
-	packetTypes := []frames.FrameType{
-		frames.FrameTypeAssocRequest,
-		frames.FrameTypeAssocResponse,
-		frames.FrameTypeAuthentication,
-	}
 	for {
-		rawFrame, _, err := handle.Receive()
+		rawFrame, radioInfo, err := handle.Receive()
 		if err != nil {
 			log.Fatalln("failed to receive:", err)
 		}
@@ -53,14 +58,7 @@ func main() {
 			continue
 		}
 
-		shouldDrop := true
-		for _, t := range packetTypes {
-			if t == frame.Type {
-				shouldDrop = false
-				break
-			}
-		}
-		if shouldDrop {
+		if !predicate(frame, gofi.RadioPacket{Frame: rawFrame, RadioInfo: radioInfo}) {
 			continue
 		}
 		switch frame.Type {
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/unixpickle/gofi"
+	"github.com/unixpickle/wifistack"
 	"github.com/unixpickle/wifistack/frames"
 )
 
@@ -30,8 +31,11 @@ func main() {
 		{frames.ElementIDSSID, []byte("Spoofed Network")},
 		{frames.ElementIDDSSSParameterSet, []byte{11}},
 	}
-	frameData := beacon.EncodeToFrame().Encode()
+	var sequences wifistack.SequenceAllocator
 	for {
+		frame := beacon.EncodeToFrame()
+		frame.SequenceControl = sequences.NextControl()
+		frameData := frame.Encode()
 		if err := handle.Send(frameData, 0); err != nil {
 			log.Fatalln("failed to send beacon:", err)
 		}
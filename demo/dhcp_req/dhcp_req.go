@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -9,10 +10,15 @@ import (
 
 	"github.com/unixpickle/gofi"
 	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/arp"
+	"github.com/unixpickle/wifistack/dhcp"
 	"github.com/unixpickle/wifistack/frames"
 )
 
-const Timeout = time.Second * 5
+const (
+	Timeout     = time.Second * 5
+	DHCPTimeout = time.Second * 30
+)
 
 func main() {
 	interfaceName, err := gofi.DefaultInterfaceName()
@@ -27,13 +33,19 @@ func main() {
 
 	fmt.Println("BSS Descriptions:")
 
-	stream := wifistack.NewRawStream(handle)
-	scanRes, _ := wifistack.ScanNetworks(stream)
+	mux := wifistack.NewStreamMux(wifistack.NewRawStream(handle))
+	defer mux.Close()
+
+	scanStream := mux.Subscribe(wifistack.SubscriberConfig{
+		Filter: wifistack.FrameTypeFilter(frames.FrameTypeBeacon),
+	})
+	scanRes, _ := wifistack.ScanNetworks(scanStream)
 	descriptions := []frames.BSSDescription{}
 	for desc := range scanRes {
 		fmt.Println(len(descriptions), "-", desc.BSSID, desc.SSID)
 		descriptions = append(descriptions, desc)
 	}
+	close(scanStream.Outgoing())
 
 	fmt.Print("Pick a number from the list: ")
 	choice := readChoice()
@@ -41,31 +53,77 @@ func main() {
 		log.Fatalln("choice out of bounds.")
 	}
 
+	client := frames.MAC{0, 1, 2, 3, 4, 5}
+
+	handshakeStream := mux.Subscribe(wifistack.SubscriberConfig{
+		Filter: wifistack.AddressFilter(client),
+	})
 	handshaker := wifistack.Handshaker{
-		Stream: stream,
-		Client: frames.MAC{0, 1, 2, 3, 4, 5},
+		Stream: handshakeStream,
+		Client: client,
 		BSS:    descriptions[choice],
 	}
-	if err := handshaker.HandshakeOpen(time.Second * 5); err != nil {
+	link, err := handshaker.HandshakeOpen(time.Second * 5)
+	if err != nil {
 		log.Fatalln("handshake failed:", err)
-	} else {
-		log.Println("handshake successful!")
 	}
+	log.Println("handshake successful!")
+	close(handshakeStream.Outgoing())
+
+	// NOTE: the MSDU stream subscribes once the handshake is done, and only
+	// to frames of our link, so that its buffer does not fill up with
+	// unrelated frames.
+	msduSubscriber := mux.Subscribe(wifistack.SubscriberConfig{
+		Filter: wifistack.LinkFilter(link),
+	})
+
+	msduConfig := wifistack.NewOpenMSDUStreamConfig(msduSubscriber, link)
+	msduConfig.FragmentThreshold = 1000
+	ethernet := wifistack.NewEthernetStream(wifistack.NewOpenMSDUStream(msduConfig), client)
+	defer close(ethernet.Outgoing())
+
+	resolver := arp.NewResolver(arp.Config{
+		Stream: ethernet,
+		MAC:    client,
+	})
+	defer resolver.Close()
 
-	msduConfig := wifistack.OpenMSDUStreamConfig{
-		FragmentThreshold: 1000,
-		DataRate:          2,
-		BSSID:             handshaker.BSS.BSSID,
-		Client:            handshaker.Client,
-		Stream:            stream,
+	dhcpClient := &dhcp.Client{
+		Stream: ethernet,
+		MAC:    client,
+		OnRenew: func(l *dhcp.Lease) {
+			log.Println("renewed lease until", l.Expiry())
+		},
+		OnExpire: func(l *dhcp.Lease) {
+			log.Println("lease expired")
+		},
 	}
-	msduStream := wifistack.NewOpenMSDUStream(msduConfig)
-	msduStream.Outgoing() <- wifistack.MSDU{
-		Remote:  frames.MAC{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
-		Payload: []byte("\xAA\xAA\x03\x00\x00\x00\x08\x00\x45\x00\x01\x67\x85\xF7\x00\x00\x40\x11\xF3\x8F\x00\x00\x00\x00\xFF\xFF\xFF\xFF\x00\x44\x00\x43\x01\x53\xA9\xC5\x01\x01\x06\x00\x5F\xB0\xC2\x5F\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x24\xF5\xAA\x28\x2E\xE4\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x63\x82\x53\x63\x35\x01\x03\x3D\x07\x01\x24\xF5\xAA\x28\x2E\xE4\x32\x04\xAC\x14\x14\x14\x36\x04\xAC\x14\x14\x01\x39\x02\x05\xDC\x3C\x28\x64\x68\x63\x70\x63\x64\x2D\x36\x2E\x38\x2E\x32\x3A\x4C\x69\x6E\x75\x78\x2D\x33\x2E\x38\x2E\x31\x31\x3A\x61\x72\x6D\x76\x37\x6C\x3A\x53\x41\x4D\x53\x55\x4E\x47\x91\x01\x01\x37\x0F\x01\x79\x21\x03\x06\x0C\x0F\x1A\x1C\x33\x36\x3A\x3B\x77\xFC\xFF"),
+	ctx, cancel := context.WithTimeout(context.Background(), DHCPTimeout)
+	defer cancel()
+	lease, err := dhcpClient.Acquire(ctx)
+	if err != nil {
+		log.Fatalln("DHCP failed:", err)
+	}
+	fmt.Println("address:", lease.Address)
+	fmt.Println("network:", lease.Network())
+	fmt.Println("routers:", lease.Routers)
+	fmt.Println("DNS servers:", lease.DNSServers)
+	fmt.Println("lease time:", lease.LeaseTime)
+
+	resolver.SetAddress(lease.Address)
+	for _, router := range lease.Routers {
+		ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+		mac, err := resolver.Resolve(ctx, router)
+		cancel()
+		if err != nil {
+			log.Println("could not resolve router", router, "-", err)
+		} else {
+			fmt.Println("router", router, "is at", mac)
+		}
 	}
-	for msdu := range msduStream.Incoming() {
-		fmt.Println("got MSDU:", msdu)
+
+	if err := dhcpClient.Release(); err != nil {
+		log.Println("release failed:", err)
 	}
 }
 
@@ -46,11 +46,13 @@ func main() {
 		Client: frames.MAC{0, 1, 2, 3, 4, 5},
 		BSS:    descriptions[choice],
 	}
-	if err := handshaker.HandshakeOpen(time.Second * 5); err != nil {
+	link, err := handshaker.HandshakeOpen(time.Second * 5)
+	if err != nil {
 		log.Fatalln("handshake failed:", err)
-	} else {
-		log.Println("handshake successful!")
 	}
+	log.Println("handshake successful!")
+	log.Println("association ID:", link.AssociationID, "rates:", link.Rates,
+		"QoS:", link.WMM != nil)
 }
 
 func readChoice() int {
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/frames"
+	"github.com/unixpickle/wifistack/netstack"
+	"github.com/unixpickle/wifistack/sim"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+const (
+	Timeout   = time.Second * 5
+	NIC       = 1
+	PrefixLen = 24
+	HTTPPort  = 80
+)
+
+var (
+	BSSID     = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	ServerMAC = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	Client    = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x03}
+
+	ServerIP = [4]byte{10, 0, 0, 1}
+	ClientIP = [4]byte{10, 0, 0, 2}
+)
+
+func main() {
+	medium := sim.NewMedium()
+	ap, err := sim.NewAccessPoint(medium.NewStream(), sim.AccessPointConfig{
+		SSID:    "wifistack",
+		BSSID:   BSSID,
+		Channel: 6,
+	})
+	if err != nil {
+		log.Fatalln("could not start AP:", err)
+	}
+	defer ap.Close()
+
+	// NOTE: the server is a netstack behind the AP's distribution system,
+	// which is also an MSDUStream.
+	serverEthernet := wifistack.NewEthernetStream(ap.DS(), ServerMAC)
+	server := newStack(netstack.NewEndpoint(serverEthernet, ServerMAC), ServerIP)
+	defer server.Close()
+	listener, err := gonet.ListenTCP(server, tcpip.FullAddress{
+		NIC:  NIC,
+		Addr: tcpip.AddrFrom4(ServerIP),
+		Port: HTTPPort,
+	}, ipv4.ProtocolNumber)
+	if err != nil {
+		log.Fatalln("could not listen:", err)
+	}
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello from netstack over", r.RemoteAddr)
+	}))
+
+	stream := medium.NewStream()
+	scanRes, _ := wifistack.ScanNetworks(stream)
+	var bss *frames.BSSDescription
+	for desc := range scanRes {
+		if desc.BSSID == BSSID {
+			desc := desc
+			bss = &desc
+		}
+	}
+	if bss == nil {
+		log.Fatalln("simulated AP not found")
+	}
+
+	handshaker := wifistack.Handshaker{Stream: stream, Client: Client, BSS: *bss}
+	link, err := handshaker.HandshakeOpen(Timeout)
+	if err != nil {
+		log.Fatalln("handshake failed:", err)
+	}
+	log.Println("handshake successful!")
+
+	msduStream := wifistack.NewOpenMSDUStream(wifistack.NewOpenMSDUStreamConfig(stream, link))
+	clientEthernet := wifistack.NewEthernetStream(msduStream, Client)
+	client := newStack(netstack.NewEndpoint(clientEthernet, Client), ClientIP)
+	defer client.Close()
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				tcpAddr, err := net.ResolveTCPAddr(network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return gonet.DialContextTCP(ctx, client, tcpip.FullAddress{
+					NIC:  NIC,
+					Addr: tcpip.AddrFromSlice(tcpAddr.IP.To4()),
+					Port: uint16(tcpAddr.Port),
+				}, ipv4.ProtocolNumber)
+			},
+		},
+		Timeout: Timeout,
+	}
+	resp, err := httpClient.Get(fmt.Sprintf("http://%s/", net.IP(ServerIP[:])))
+	if err != nil {
+		log.Fatalln("request failed:", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalln("could not read body:", err)
+	}
+	fmt.Println("status:", resp.Status)
+	fmt.Print("body: ", string(body))
+}
+
+func newStack(endpoint stack.LinkEndpoint, addr [4]byte) *stack.Stack {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, arp.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+	})
+	if err := s.CreateNIC(NIC, endpoint); err != nil {
+		log.Fatalln("could not create NIC:", err)
+	}
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol: ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.AddrFrom4(addr),
+			PrefixLen: PrefixLen,
+		},
+	}
+	if err := s.AddProtocolAddress(NIC, protocolAddr, stack.AddressProperties{}); err != nil {
+		log.Fatalln("could not add address:", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: NIC}})
+	return s
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/frames"
+	"github.com/unixpickle/wifistack/ipv4"
+	"github.com/unixpickle/wifistack/sim"
+	"github.com/unixpickle/wifistack/tcp"
+	"github.com/unixpickle/wifistack/wifinet"
+)
+
+const (
+	Timeout  = time.Second * 5
+	PageSize = 100000
+)
+
+var (
+	BSSID     = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	ServerMAC = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	Client    = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x03}
+
+	ServerIP = net.IPv4(10, 0, 0, 1)
+	ClientIP = net.IPv4(10, 0, 0, 2)
+	Mask     = net.CIDRMask(24, 32)
+)
+
+func main() {
+	medium := sim.NewMedium()
+	ap, err := sim.NewAccessPoint(medium.NewStream(), sim.AccessPointConfig{
+		SSID:    "wifistack",
+		BSSID:   BSSID,
+		Channel: 6,
+	})
+	if err != nil {
+		log.Fatalln("could not start AP:", err)
+	}
+	defer ap.Close()
+
+	serverEthernet := wifistack.NewEthernetStream(ap.DS(), ServerMAC)
+	defer close(serverEthernet.Outgoing())
+	serverIP := ipv4.NewStack(ipv4.Config{
+		Stream:     serverEthernet,
+		MAC:        ServerMAC,
+		Address:    ServerIP,
+		SubnetMask: Mask,
+	})
+	defer serverIP.Close()
+	serverTCP := tcp.NewStack(serverIP)
+	defer serverTCP.Close()
+
+	listener, err := serverTCP.Listen(80)
+	if err != nil {
+		log.Fatalln("could not listen:", err)
+	}
+	go http.Serve(listener, http.HandlerFunc(servePage))
+
+	stream := medium.NewStream()
+	scanRes, _ := wifistack.ScanNetworks(stream)
+	var bss *frames.BSSDescription
+	for desc := range scanRes {
+		if desc.BSSID == BSSID {
+			desc := desc
+			bss = &desc
+		}
+	}
+	if bss == nil {
+		log.Fatalln("simulated AP not found")
+	}
+
+	handshaker := wifistack.Handshaker{Stream: stream, Client: Client, BSS: *bss}
+	link, err := handshaker.HandshakeOpen(Timeout)
+	if err != nil {
+		log.Fatalln("handshake failed:", err)
+	}
+	log.Println("handshake successful!")
+
+	msduStream := wifistack.NewOpenMSDUStream(wifistack.NewOpenMSDUStreamConfig(stream, link))
+	clientEthernet := wifistack.NewEthernetStream(msduStream, Client)
+	defer close(clientEthernet.Outgoing())
+	clientIP := ipv4.NewStack(ipv4.Config{
+		Stream:     clientEthernet,
+		MAC:        Client,
+		Address:    ClientIP,
+		SubnetMask: Mask,
+	})
+	defer clientIP.Close()
+	clientTCP := tcp.NewStack(clientIP)
+	defer clientTCP.Close()
+
+	dialer := &wifinet.Dialer{IP: clientIP, TCP: clientTCP}
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		Timeout:   Timeout,
+	}
+
+	start := time.Now()
+	resp, err := client.Get("http://" + ServerIP.String() + "/")
+	if err != nil {
+		log.Fatalln("request failed:", err)
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		log.Fatalln("could not read body:", err)
+	}
+	fmt.Println("status:", resp.Status)
+	fmt.Println("received", n, "bytes in", time.Since(start))
+}
+
+func servePage(w http.ResponseWriter, r *http.Request) {
+	log.Println("serving", r.URL, "to", r.RemoteAddr)
+	page := make([]byte, PageSize)
+	for i := range page {
+		page[i] = 'a' + byte(i%26)
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(page)
+}
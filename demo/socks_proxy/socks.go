@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/unixpickle/wifistack/ipv4"
+	"github.com/unixpickle/wifistack/tcp"
+	"github.com/unixpickle/wifistack/wifinet"
+)
+
+// These constants come from RFC 1928.
+const (
+	socksVersion = 5
+
+	methodNoAuth       = 0
+	methodNoAcceptable = 0xff
+
+	commandConnect      = 1
+	commandBind         = 2
+	commandUDPAssociate = 3
+
+	addressIPv4   = 1
+	addressDomain = 3
+	addressIPv6   = 4
+
+	replySuccess                 = 0
+	replyGeneralFailure          = 1
+	replyNetworkUnreachable      = 3
+	replyHostUnreachable         = 4
+	replyConnectionRefused       = 5
+	replyCommandNotSupported     = 7
+	replyAddressTypeNotSupported = 8
+)
+
+const (
+	RequestTimeout = time.Second * 30
+	MaxDatagram    = 0x10000
+)
+
+var (
+	errBadVersion  = errors.New("unsupported SOCKS version")
+	errAddressType = errors.New("unsupported address type")
+)
+
+// A SOCKSServer serves SOCKS5 clients, making their connections with a
+// wifinet.Dialer so that they leave through a wifistack association.
+type SOCKSServer struct {
+	Dialer *wifinet.Dialer
+}
+
+// Serve accepts clients until the listener is closed.
+func (s *SOCKSServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.serveConn(conn); err != nil {
+				log.Println("client", conn.RemoteAddr(), "-", err)
+			}
+		}()
+	}
+}
+
+func (s *SOCKSServer) serveConn(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(RequestTimeout))
+	if err := negotiateMethod(conn); err != nil {
+		return err
+	}
+
+	var header [3]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return errBadVersion
+	}
+	host, port, err := readAddress(conn)
+	if err == errAddressType {
+		writeReply(conn, replyAddressTypeNotSupported, nil)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	switch header[1] {
+	case commandConnect:
+		return s.connect(conn, net.JoinHostPort(host, strconv.Itoa(port)))
+	case commandUDPAssociate:
+		return s.associate(conn)
+	default:
+		// NOTE: BIND would need a listener on the association which the
+		// remote host connects to, which FTP-style protocols rarely
+		// need nowadays.
+		return writeReply(conn, replyCommandNotSupported, nil)
+	}
+}
+
+// connect handles the CONNECT command, relaying data between the client
+// and a TCP connection over the association.
+func (s *SOCKSServer) connect(conn net.Conn, address string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	remote, err := s.Dialer.DialContext(ctx, "tcp", address)
+	cancel()
+	if err != nil {
+		writeReply(conn, replyCode(err), nil)
+		return err
+	}
+	defer remote.Close()
+	if err := writeReply(conn, replySuccess, remote.LocalAddr()); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(remote, conn)
+		closeWrite(remote)
+	}()
+	io.Copy(conn, remote)
+	closeWrite(conn)
+	<-done
+	return nil
+}
+
+// associate handles the UDP ASSOCIATE command, relaying datagrams
+// between a local UDP socket and a UDP socket on the association until
+// the client closes the control connection.
+func (s *SOCKSServer) associate(conn net.Conn) error {
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		writeReply(conn, replyGeneralFailure, nil)
+		return err
+	}
+	defer local.Close()
+	remote, err := s.Dialer.ListenPacket("udp", ":0")
+	if err != nil {
+		writeReply(conn, replyGeneralFailure, nil)
+		return err
+	}
+	defer remote.Close()
+	if err := writeReply(conn, replySuccess, local.LocalAddr()); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	// NOTE: the client's UDP port is learned from its first datagram,
+	// and replies are sent there.
+	clientAddr := make(chan *net.UDPAddr, 1)
+	go s.relayOutgoing(local, remote, clientIP, clientAddr)
+	go relayIncoming(remote, local, clientAddr)
+
+	// The association lasts as long as the control connection.
+	io.Copy(io.Discard, conn)
+	return nil
+}
+
+// relayOutgoing sends the client's datagrams over the association.
+func (s *SOCKSServer) relayOutgoing(local *net.UDPConn, remote net.PacketConn,
+	clientIP net.IP, clientAddr chan<- *net.UDPAddr) {
+	buf := make([]byte, MaxDatagram)
+	var client *net.UDPAddr
+	for {
+		n, addr, err := local.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !addr.IP.Equal(clientIP) || (client != nil && addr.Port != client.Port) {
+			continue
+		}
+		host, port, payload, err := decodeDatagram(buf[:n])
+		if err != nil {
+			continue
+		}
+		if client == nil {
+			client = addr
+			clientAddr <- addr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			ip, err = s.lookup(host)
+			if err != nil {
+				log.Println("could not resolve", host, "-", err)
+				continue
+			}
+		}
+		remote.WriteTo(payload, &net.UDPAddr{IP: ip, Port: port})
+	}
+}
+
+// relayIncoming sends datagrams from the association to the client.
+func relayIncoming(remote net.PacketConn, local *net.UDPConn, clientAddr <-chan *net.UDPAddr) {
+	buf := make([]byte, MaxDatagram)
+	var client *net.UDPAddr
+	for {
+		n, addr, err := remote.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if client == nil {
+			select {
+			case client = <-clientAddr:
+			default:
+				continue
+			}
+		}
+		local.WriteToUDP(encodeDatagram(addr.(*net.UDPAddr), buf[:n]), client)
+	}
+}
+
+func (s *SOCKSServer) lookup(host string) (net.IP, error) {
+	if s.Dialer.Resolver == nil {
+		return nil, wifinet.ErrNoResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+	ips, err := s.Dialer.Resolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return nil, err
+	} else if len(ips) == 0 {
+		return nil, wifinet.ErrNoAddresses
+	}
+	return ips[0], nil
+}
+
+// negotiateMethod reads the client's greeting and selects the "no
+// authentication required" method.
+func negotiateMethod(conn net.Conn) error {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return errBadVersion
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	for _, method := range methods {
+		if method == methodNoAuth {
+			_, err := conn.Write([]byte{socksVersion, methodNoAuth})
+			return err
+		}
+	}
+	conn.Write([]byte{socksVersion, methodNoAcceptable})
+	return errors.New("client requires authentication")
+}
+
+// readAddress reads the ATYP, DST.ADDR, and DST.PORT fields of a request.
+func readAddress(r io.Reader) (host string, port int, err error) {
+	var addrType [1]byte
+	if _, err := io.ReadFull(r, addrType[:]); err != nil {
+		return "", 0, err
+	}
+	var addr []byte
+	switch addrType[0] {
+	case addressIPv4:
+		addr = make([]byte, net.IPv4len)
+	case addressIPv6:
+		addr = make([]byte, net.IPv6len)
+	case addressDomain:
+		var size [1]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return "", 0, err
+		}
+		addr = make([]byte, size[0])
+	default:
+		return "", 0, errAddressType
+	}
+	var portData [2]byte
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", 0, err
+	}
+	if _, err := io.ReadFull(r, portData[:]); err != nil {
+		return "", 0, err
+	}
+	port = int(binary.BigEndian.Uint16(portData[:]))
+	if addrType[0] == addressDomain {
+		return string(addr), port, nil
+	}
+	return net.IP(addr).String(), port, nil
+}
+
+// appendAddress encodes the ATYP, ADDR, and PORT fields of a reply or
+// a UDP datagram.
+func appendAddress(data []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		data = append(append(data, addressIPv4), ip4...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		data = append(append(data, addressIPv6), ip16...)
+	} else {
+		data = append(append(data, addressIPv4), net.IPv4zero.To4()...)
+	}
+	return binary.BigEndian.AppendUint16(data, uint16(port))
+}
+
+func writeReply(conn net.Conn, code byte, bound net.Addr) error {
+	var ip net.IP
+	var port int
+	switch addr := bound.(type) {
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	}
+	_, err := conn.Write(appendAddress([]byte{socksVersion, code, 0}, ip, port))
+	return err
+}
+
+// decodeDatagram parses the header which precedes each datagram that a
+// client sends to the UDP relay, as described in section 7 of RFC 1928.
+func decodeDatagram(data []byte) (host string, port int, payload []byte, err error) {
+	if len(data) < 4 {
+		return "", 0, nil, io.ErrUnexpectedEOF
+	}
+	// NOTE: fragmentation is optional, and fragments are dropped.
+	if data[2] != 0 {
+		return "", 0, nil, errors.New("fragmented datagram")
+	}
+	r := bytes.NewReader(data[3:])
+	host, port, err = readAddress(r)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return host, port, data[len(data)-r.Len():], nil
+}
+
+func encodeDatagram(source *net.UDPAddr, payload []byte) []byte {
+	return append(appendAddress([]byte{0, 0, 0}, source.IP, source.Port), payload...)
+}
+
+// replyCode chooses the REP field for a failed connection.
+func replyCode(err error) byte {
+	var dnsErr *net.DNSError
+	var addrErr *net.AddrError
+	switch {
+	case errors.Is(err, tcp.ErrConnectionRefused):
+		return replyConnectionRefused
+	case errors.Is(err, ipv4.ErrNoRoute):
+		return replyNetworkUnreachable
+	case errors.As(err, &addrErr):
+		return replyAddressTypeNotSupported
+	case errors.As(err, &dnsErr), errors.Is(err, tcp.ErrTimeout),
+		errors.Is(err, context.DeadlineExceeded):
+		return replyHostUnreachable
+	default:
+		return replyGeneralFailure
+	}
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
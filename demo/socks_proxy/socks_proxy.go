@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/unixpickle/gofi"
+	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/dhcp"
+	"github.com/unixpickle/wifistack/dns"
+	"github.com/unixpickle/wifistack/frames"
+	"github.com/unixpickle/wifistack/ipv4"
+	"github.com/unixpickle/wifistack/tcp"
+	"github.com/unixpickle/wifistack/wifinet"
+)
+
+const (
+	Timeout        = time.Second * 5
+	DHCPTimeout    = time.Second * 30
+	DefaultAddress = "127.0.0.1:1080"
+)
+
+func main() {
+	if len(os.Args) != 2 && len(os.Args) != 3 {
+		log.Fatalln("Usage: socks_proxy <ssid> [listen address]")
+	}
+	ssid := os.Args[1]
+	listenAddress := DefaultAddress
+	if len(os.Args) == 3 {
+		listenAddress = os.Args[2]
+	}
+
+	interfaceName, err := gofi.DefaultInterfaceName()
+	if err != nil {
+		log.Fatalln("no default interface:", err)
+	}
+	handle, err := gofi.NewHandle(interfaceName)
+	if err != nil {
+		log.Fatalln("could not open handle to "+interfaceName+":", err)
+	}
+	defer handle.Close()
+
+	mux := wifistack.NewStreamMux(wifistack.NewRawStream(handle))
+	defer mux.Close()
+
+	scanStream := mux.Subscribe(wifistack.SubscriberConfig{
+		Filter: wifistack.FrameTypeFilter(frames.FrameTypeBeacon),
+	})
+	scanRes, _ := wifistack.ScanNetworks(scanStream)
+	var bss *frames.BSSDescription
+	for desc := range scanRes {
+		if desc.SSID == ssid && bss == nil {
+			desc := desc
+			bss = &desc
+		}
+	}
+	close(scanStream.Outgoing())
+	if bss == nil {
+		log.Fatalln("network not found:", ssid)
+	}
+	log.Println("joining", bss.SSID, "at", bss.BSSID)
+
+	client := frames.MAC{2, 1, 2, 3, 4, 5}
+
+	handshakeStream := mux.Subscribe(wifistack.SubscriberConfig{
+		Filter: wifistack.AddressFilter(client),
+	})
+	handshaker := wifistack.Handshaker{
+		Stream: handshakeStream,
+		Client: client,
+		BSS:    *bss,
+	}
+	link, err := handshaker.HandshakeOpen(Timeout)
+	if err != nil {
+		log.Fatalln("handshake failed:", err)
+	}
+	log.Println("handshake successful!")
+	close(handshakeStream.Outgoing())
+
+	msduSubscriber := mux.Subscribe(wifistack.SubscriberConfig{
+		Filter: wifistack.LinkFilter(link),
+	})
+
+	ethernet := wifistack.NewEthernetStream(wifistack.NewOpenMSDUStream(
+		wifistack.NewOpenMSDUStreamConfig(msduSubscriber, link)), client)
+	defer close(ethernet.Outgoing())
+
+	ipStack := ipv4.NewStack(ipv4.Config{
+		Stream: ethernet,
+		MAC:    client,
+	})
+	defer ipStack.Close()
+
+	// NOTE: DHCP replies reach the IP stack as well as the DHCP client,
+	// so the client port is bound to keep the stack from answering
+	// unicast renewals with ICMP port unreachable messages.
+	dhcpPort, err := ipStack.ListenUDP(68)
+	if err != nil {
+		log.Fatalln("could not bind DHCP port:", err)
+	}
+	defer dhcpPort.Close()
+
+	dhcpClient := &dhcp.Client{
+		Stream: ethernet,
+		MAC:    client,
+		OnRenew: func(l *dhcp.Lease) {
+			log.Println("renewed lease until", l.Expiry())
+			setAddress(ipStack, l)
+		},
+		OnExpire: func(l *dhcp.Lease) {
+			log.Println("lease expired")
+			ipStack.SetAddress(nil, nil, nil)
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DHCPTimeout)
+	lease, err := dhcpClient.Acquire(ctx)
+	cancel()
+	if err != nil {
+		log.Fatalln("DHCP failed:", err)
+	}
+	defer dhcpClient.Release()
+	log.Println("address:", lease.Address, "routers:", lease.Routers,
+		"DNS servers:", lease.DNSServers)
+	setAddress(ipStack, lease)
+
+	tcpStack := tcp.NewStack(ipStack)
+	defer tcpStack.Close()
+	dialer := &wifinet.Dialer{IP: ipStack, TCP: tcpStack, Timeout: Timeout}
+	resolver := dns.NewResolver(dns.Config{Dial: dialer.DialContext, DHCP: dhcpClient})
+	dialer.Resolver = resolver.NetResolver()
+
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		log.Fatalln("could not listen:", err)
+	}
+	log.Println("SOCKS5 proxy listening on", listener.Addr(), "- press Ctrl+C to stop")
+
+	go func() {
+		interrupts := make(chan os.Signal, 1)
+		signal.Notify(interrupts, os.Interrupt)
+		<-interrupts
+		listener.Close()
+	}()
+
+	server := &SOCKSServer{Dialer: dialer}
+	server.Serve(listener)
+}
+
+func setAddress(s *ipv4.Stack, l *dhcp.Lease) {
+	var gateway net.IP
+	if len(l.Routers) > 0 {
+		gateway = l.Routers[0]
+	}
+	s.SetAddress(l.Address, l.SubnetMask, gateway)
+}
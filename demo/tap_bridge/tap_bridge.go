@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"github.com/unixpickle/gofi"
+	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/frames"
+	"github.com/unixpickle/wifistack/tap"
+)
+
+func main() {
+	interfaceName, err := gofi.DefaultInterfaceName()
+	if err != nil {
+		log.Fatalln("no default interface:", err)
+	}
+	handle, err := gofi.NewHandle(interfaceName)
+	if err != nil {
+		log.Fatalln("could not open handle to "+interfaceName+":", err)
+	}
+	defer handle.Close()
+
+	fmt.Println("BSS Descriptions:")
+
+	mux := wifistack.NewStreamMux(wifistack.NewRawStream(handle))
+	defer mux.Close()
+
+	scanStream := mux.Subscribe(wifistack.SubscriberConfig{
+		Filter: wifistack.FrameTypeFilter(frames.FrameTypeBeacon),
+	})
+	scanRes, _ := wifistack.ScanNetworks(scanStream)
+	descriptions := []frames.BSSDescription{}
+	for desc := range scanRes {
+		fmt.Println(len(descriptions), "-", desc.BSSID, desc.SSID)
+		descriptions = append(descriptions, desc)
+	}
+	close(scanStream.Outgoing())
+
+	fmt.Print("Pick a number from the list: ")
+	choice := readChoice()
+	if choice < 0 || choice >= len(descriptions) {
+		log.Fatalln("choice out of bounds.")
+	}
+
+	client := frames.MAC{2, 1, 2, 3, 4, 5}
+
+	handshakeStream := mux.Subscribe(wifistack.SubscriberConfig{
+		Filter: wifistack.AddressFilter(client),
+	})
+	handshaker := wifistack.Handshaker{
+		Stream: handshakeStream,
+		Client: client,
+		BSS:    descriptions[choice],
+	}
+	link, err := handshaker.HandshakeOpen(time.Second * 5)
+	if err != nil {
+		log.Fatalln("handshake failed:", err)
+	}
+	log.Println("handshake successful!")
+	close(handshakeStream.Outgoing())
+	msduSubscriber := mux.Subscribe(wifistack.SubscriberConfig{
+		Filter: wifistack.LinkFilter(link),
+	})
+
+	device, err := tap.Open("")
+	if err != nil {
+		log.Fatalln("could not create TAP device:", err)
+	}
+	log.Println("bridging to", device.Name(), "- press Ctrl+C to stop")
+
+	go func() {
+		interrupts := make(chan os.Signal, 1)
+		signal.Notify(interrupts, os.Interrupt)
+		<-interrupts
+		device.Close()
+	}()
+
+	msduStream := wifistack.NewOpenMSDUStream(wifistack.NewOpenMSDUStreamConfig(msduSubscriber, link))
+	if err := tap.Bridge(device, msduStream, client); err != nil {
+		log.Fatalln("bridge failed:", err)
+	}
+}
+
+func readChoice() int {
+	s := ""
+	for {
+		b := make([]byte, 1)
+		if _, err := os.Stdin.Read(b); err != nil {
+			log.Fatalln(err)
+		}
+		if b[0] == '\n' {
+			break
+		} else if b[0] == '\r' {
+			continue
+		} else {
+			s += string(b)
+		}
+	}
+
+	num, err := strconv.Atoi(s)
+	if err != nil {
+		log.Fatalln("invalid number:", s)
+	}
+	return num
+}
@@ -0,0 +1,408 @@
+// Package dhcp implements a DHCP client which runs directly on top of
+// a wifistack.EthernetStream.
+package dhcp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/frames"
+)
+
+const (
+	initialRetransmitTimeout = time.Second * 4
+	maxRetransmitTimeout     = time.Second * 64
+	minRenewalRetransmit     = time.Second * 60
+	maxRequestAttempts       = 4
+	nakBackoff               = time.Second
+)
+
+var (
+	ErrStreamClosed = errors.New("Ethernet stream closed")
+	ErrNoLease      = errors.New("no active DHCP lease")
+	ErrLeaseActive  = errors.New("DHCP lease already active")
+)
+
+var (
+	errNak       = errors.New("DHCPNAK received")
+	errNoReply   = errors.New("no reply")
+	errCancelled = errors.New("cancelled")
+)
+
+var broadcastMAC = frames.MAC{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// requestedParameters is the parameter request list which the
+// client sends to servers.
+var requestedParameters = []byte{
+	OptionSubnetMask,
+	OptionRouter,
+	OptionDomainNameServer,
+	OptionDomainName,
+	OptionInterfaceMTU,
+	OptionLeaseTime,
+	OptionRenewalTime,
+	OptionRebindingTime,
+}
+
+// A Client obtains a lease from a DHCP server and keeps it alive,
+// as described in RFC 2131.
+//
+// The client handles the IPv4 frames of its Stream from the first call
+// to Acquire onwards, ignoring the ones which are not DHCP replies, so the
+// Stream may be shared with an ipv4.Stack.
+type Client struct {
+	// Stream is used to send and receive DHCP messages.
+	// The client never closes it.
+	Stream *wifistack.EthernetStream
+
+	// MAC is the hardware address of this station.
+	MAC frames.MAC
+
+	// Hostname is sent to the server if it is non-empty.
+	Hostname string
+
+	// OnRenew is called with the new lease whenever the lease is
+	// renewed or rebound.
+	OnRenew func(l *Lease)
+
+	// OnExpire is called with the old lease if the lease expires
+	// or the server refuses to renew it.
+	OnExpire func(l *Lease)
+
+	startOnce sync.Once
+	replies   chan reply
+
+	lock  sync.Mutex
+	lease *Lease
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+type reply struct {
+	message *Message
+	source  frames.MAC
+}
+
+// Acquire obtains a lease by running the DISCOVER, OFFER, REQUEST, ACK
+// exchange, retransmitting messages until ctx is done.
+//
+// Once a lease is obtained, the client renews it in the background
+// until it expires or until Release is called.
+func (c *Client) Acquire(ctx context.Context) (*Lease, error) {
+	c.startOnce.Do(func() {
+		c.replies = make(chan reply, 16)
+		c.Stream.HandleEtherType(frames.EtherTypeIPv4, c.handleFrame)
+	})
+
+	c.lock.Lock()
+	if c.lease != nil {
+		c.lock.Unlock()
+		return nil, ErrLeaseActive
+	}
+	c.lock.Unlock()
+
+	for {
+		lease, err := c.negotiate(ctx)
+		if err == errNak || err == errNoReply {
+			select {
+			case <-time.After(nakBackoff):
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		} else if err == errCancelled {
+			return nil, ctx.Err()
+		} else if err != nil {
+			return nil, err
+		}
+
+		c.lock.Lock()
+		c.lease = lease
+		c.stop = make(chan struct{})
+		c.done = make(chan struct{})
+		go c.maintain(lease, c.stop, c.done)
+		c.lock.Unlock()
+
+		return lease, nil
+	}
+}
+
+// Lease returns the current lease, or nil if there is none.
+func (c *Client) Lease() *Lease {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lease
+}
+
+// Release gives up the current lease, telling the server that the
+// address is no longer in use.
+func (c *Client) Release() error {
+	c.lock.Lock()
+	if c.lease == nil {
+		c.lock.Unlock()
+		return ErrNoLease
+	}
+	stop, done := c.stop, c.done
+	c.stop = nil
+	c.lock.Unlock()
+
+	if stop == nil {
+		return ErrNoLease
+	}
+	close(stop)
+	<-done
+
+	c.lock.Lock()
+	lease := c.lease
+	c.lease = nil
+	c.lock.Unlock()
+	if lease == nil {
+		return ErrNoLease
+	}
+
+	msg := c.newMessage(MessageTypeRelease)
+	msg.ClientIP = lease.Address
+	msg.Options = append(msg.Options, Option{
+		Code: OptionServerIdentifier,
+		Data: lease.Server.To4(),
+	})
+	c.send(msg, lease.Address, lease.Server, lease.ServerMAC)
+	return nil
+}
+
+// negotiate runs the full exchange to obtain a new lease.
+func (c *Client) negotiate(ctx context.Context) (*Lease, error) {
+	start := time.Now()
+
+	discover := c.newMessage(MessageTypeDiscover)
+	offer, err := c.exchange(discover, start, net.IPv4bcast, broadcastMAC, 0,
+		ctx.Done(), MessageTypeOffer)
+	if err != nil {
+		return nil, err
+	}
+
+	server := offer.message.Options.IP(OptionServerIdentifier)
+	request := c.newMessage(MessageTypeRequest)
+	request.XID = discover.XID
+	request.Options = append(request.Options,
+		Option{Code: OptionRequestedAddress, Data: offer.message.YourIP.To4()},
+		Option{Code: OptionServerIdentifier, Data: server.To4()})
+	sent := time.Now()
+	ack, err := c.exchange(request, start, net.IPv4bcast, broadcastMAC, maxRequestAttempts,
+		ctx.Done(), MessageTypeAck, MessageTypeNak)
+	if err != nil {
+		return nil, err
+	}
+	if ack.message.Type() == MessageTypeNak {
+		return nil, errNak
+	}
+
+	// TODO: probe the address with ARP and send a DHCPDECLINE if
+	// it is already in use, as suggested in section 4.4.1 of RFC 2131.
+
+	return newLease(ack.message, ack.source, sent), nil
+}
+
+// maintain renews a lease until it expires or stop is closed.
+func (c *Client) maintain(lease *Lease, stop, done chan struct{}) {
+	defer close(done)
+	for {
+		now := time.Now()
+		if !now.Before(lease.Expiry()) {
+			c.expire(lease)
+			return
+		}
+
+		if now.Before(lease.RenewAt()) {
+			select {
+			case <-time.After(lease.RenewAt().Sub(now)):
+				continue
+			case <-stop:
+				return
+			case <-c.Stream.Done():
+				return
+			}
+		}
+
+		// NOTE: section 4.4.5 of RFC 2131 says to wait half of the remaining
+		// time until T2 (or expiry), down to a minimum of 60 seconds.
+		rebinding := !now.Before(lease.RebindAt())
+		deadline := lease.RebindAt()
+		if rebinding {
+			deadline = lease.Expiry()
+		}
+		wait := deadline.Sub(now) / 2
+		if wait < minRenewalRetransmit {
+			wait = deadline.Sub(now)
+		}
+
+		request := c.newMessage(MessageTypeRequest)
+		request.ClientIP = lease.Address
+		sent := time.Now()
+		if rebinding {
+			c.send(request, lease.Address, net.IPv4bcast, broadcastMAC)
+		} else {
+			c.send(request, lease.Address, lease.Server, lease.ServerMAC)
+		}
+
+		res, err := c.awaitReply(request.XID, time.After(wait), stop,
+			MessageTypeAck, MessageTypeNak)
+		if err == errNoReply {
+			continue
+		} else if err != nil {
+			return
+		}
+		if res.message.Type() == MessageTypeNak {
+			c.expire(lease)
+			return
+		}
+
+		lease = newLease(res.message, res.source, sent)
+		c.lock.Lock()
+		c.lease = lease
+		c.lock.Unlock()
+		if c.OnRenew != nil {
+			c.OnRenew(lease)
+		}
+	}
+}
+
+func (c *Client) expire(lease *Lease) {
+	c.lock.Lock()
+	if c.lease == lease {
+		c.lease = nil
+	}
+	c.lock.Unlock()
+	if c.OnExpire != nil {
+		c.OnExpire(lease)
+	}
+}
+
+// exchange sends a broadcast message and retransmits it with an
+// exponential backoff until an acceptable reply arrives.
+// If maxAttempts is 0, the message is retransmitted indefinitely.
+func (c *Client) exchange(msg *Message, start time.Time, dest net.IP, destMAC frames.MAC,
+	maxAttempts int, cancel <-chan struct{}, types ...MessageType) (*reply, error) {
+	timeout := initialRetransmitTimeout
+	for attempt := 0; maxAttempts == 0 || attempt < maxAttempts; attempt++ {
+		msg.Secs = uint16(time.Since(start) / time.Second)
+		if !c.send(msg, net.IPv4zero, dest, destMAC) {
+			return nil, ErrStreamClosed
+		}
+
+		// NOTE: section 4.1 of RFC 2131 says to randomize the timeout
+		// by plus or minus one second.
+		jitter := time.Duration(rand.Int63n(int64(time.Second*2))) - time.Second
+		res, err := c.awaitReply(msg.XID, time.After(timeout+jitter), cancel, types...)
+		if err != errNoReply {
+			return res, err
+		}
+
+		timeout *= 2
+		if timeout > maxRetransmitTimeout {
+			timeout = maxRetransmitTimeout
+		}
+	}
+	return nil, errNoReply
+}
+
+// awaitReply waits for a reply with a given transaction ID and
+// one of the given types.
+func (c *Client) awaitReply(xid uint32, timeout <-chan time.Time, cancel <-chan struct{},
+	types ...MessageType) (*reply, error) {
+	for {
+		select {
+		case r := <-c.replies:
+			if r.message.XID != xid {
+				continue
+			}
+			for _, t := range types {
+				if r.message.Type() == t {
+					return &r, nil
+				}
+			}
+		case <-timeout:
+			return nil, errNoReply
+		case <-cancel:
+			return nil, errCancelled
+		case <-c.Stream.Done():
+			return nil, ErrStreamClosed
+		}
+	}
+}
+
+func (c *Client) newMessage(t MessageType) *Message {
+	res := &Message{
+		Op:        OpRequest,
+		XID:       rand.Uint32(),
+		ClientIP:  net.IPv4zero,
+		YourIP:    net.IPv4zero,
+		ServerIP:  net.IPv4zero,
+		RelayIP:   net.IPv4zero,
+		ClientMAC: c.MAC,
+		Options: Options{
+			{Code: OptionMessageType, Data: []byte{byte(t)}},
+			{Code: OptionClientIdentifier, Data: append([]byte{1}, c.MAC[:]...)},
+		},
+	}
+	if t != MessageTypeRelease {
+		res.Options = append(res.Options, Option{
+			Code: OptionParameterRequest,
+			Data: requestedParameters,
+		})
+		if c.Hostname != "" {
+			res.Options = append(res.Options, Option{
+				Code: OptionHostName,
+				Data: []byte(c.Hostname),
+			})
+		}
+	}
+	return res
+}
+
+// send sends a message to a DHCP server.
+// It returns false if the stream has closed.
+func (c *Client) send(msg *Message, source, dest net.IP, destMAC frames.MAC) bool {
+	packet := encodeUDPPacket(&udpPacket{
+		Source:          source,
+		Destination:     dest,
+		SourcePort:      clientPort,
+		DestinationPort: serverPort,
+		Payload:         msg.Encode(),
+	})
+	frame := &frames.EthernetFrame{
+		Destination: destMAC,
+		Source:      c.MAC,
+		EtherType:   frames.EtherTypeIPv4,
+		Payload:     packet,
+	}
+	select {
+	case c.Stream.Outgoing() <- frame:
+		return true
+	case <-c.Stream.Done():
+		return false
+	}
+}
+
+// handleFrame passes DHCP replies to the client.
+// It is called from the stream's receive goroutine.
+func (c *Client) handleFrame(frame *frames.EthernetFrame) {
+	packet, err := decodeUDPPacket(frame.Payload)
+	if err != nil || packet.SourcePort != serverPort ||
+		packet.DestinationPort != clientPort {
+		return
+	}
+	msg, err := DecodeMessage(packet.Payload)
+	if err != nil || msg.Op != OpReply || msg.ClientMAC != c.MAC {
+		return
+	}
+	select {
+	case c.replies <- reply{message: msg, source: frame.Source}:
+	default:
+	}
+}
@@ -0,0 +1,117 @@
+package dhcp
+
+import (
+	"net"
+	"time"
+
+	"github.com/unixpickle/wifistack/frames"
+)
+
+const defaultLeaseTime = time.Hour
+
+// A Lease is an IPv4 address lease and the network configuration
+// which came with it.
+type Lease struct {
+	// Address is the leased address.
+	Address net.IP
+
+	// SubnetMask is the mask of the local network.
+	// It is nil if the server did not provide one.
+	SubnetMask net.IPMask
+
+	// Routers lists the default gateways in order of preference.
+	Routers []net.IP
+
+	// DNSServers lists the DNS servers in order of preference.
+	DNSServers []net.IP
+
+	// DomainName is the domain name of the network, if any.
+	DomainName string
+
+	// MTU is the interface MTU, or 0 if the server did not provide one.
+	MTU int
+
+	// Server is the identifier of the DHCP server.
+	Server net.IP
+
+	// ServerMAC is the MAC address from which the server's
+	// acknowledgment was sent.
+	ServerMAC frames.MAC
+
+	// Acquired is the time when the lease was granted.
+	Acquired time.Time
+
+	// LeaseTime is the length of the lease.
+	LeaseTime time.Duration
+
+	// RenewalTime (T1) is the time after Acquired at which the lease
+	// should be renewed with the server which granted it.
+	RenewalTime time.Duration
+
+	// RebindingTime (T2) is the time after Acquired at which the lease
+	// should be renewed with any server.
+	RebindingTime time.Duration
+}
+
+// newLease creates a lease from a DHCPACK.
+func newLease(ack *Message, serverMAC frames.MAC, acquired time.Time) *Lease {
+	res := &Lease{
+		Address:    ack.YourIP,
+		Routers:    ack.Options.IPs(OptionRouter),
+		DNSServers: ack.Options.IPs(OptionDomainNameServer),
+		DomainName: string(ack.Options.Get(OptionDomainName)),
+		Server:     ack.Options.IP(OptionServerIdentifier),
+		ServerMAC:  serverMAC,
+		Acquired:   acquired,
+		LeaseTime:  defaultLeaseTime,
+	}
+	if mask := ack.Options.Get(OptionSubnetMask); len(mask) == 4 {
+		res.SubnetMask = net.IPMask(append([]byte{}, mask...))
+	}
+	if mtu := ack.Options.Get(OptionInterfaceMTU); len(mtu) == 2 {
+		res.MTU = int(mtu[0])<<8 | int(mtu[1])
+	}
+	if res.Server == nil {
+		res.Server = ack.ServerIP
+	}
+
+	if secs, ok := ack.Options.Uint32(OptionLeaseTime); ok {
+		res.LeaseTime = time.Duration(secs) * time.Second
+	}
+
+	// NOTE: these defaults are given in section 4.4.5 of RFC 2131.
+	res.RenewalTime = res.LeaseTime / 2
+	res.RebindingTime = res.LeaseTime * 7 / 8
+	if secs, ok := ack.Options.Uint32(OptionRenewalTime); ok {
+		res.RenewalTime = time.Duration(secs) * time.Second
+	}
+	if secs, ok := ack.Options.Uint32(OptionRebindingTime); ok {
+		res.RebindingTime = time.Duration(secs) * time.Second
+	}
+
+	return res
+}
+
+// Network returns the local network of the lease, or nil if the
+// lease has no subnet mask.
+func (l *Lease) Network() *net.IPNet {
+	if l.SubnetMask == nil {
+		return nil
+	}
+	return &net.IPNet{IP: l.Address.Mask(l.SubnetMask), Mask: l.SubnetMask}
+}
+
+// Expiry returns the time at which the lease expires.
+func (l *Lease) Expiry() time.Time {
+	return l.Acquired.Add(l.LeaseTime)
+}
+
+// RenewAt returns the time at which the lease should be renewed.
+func (l *Lease) RenewAt() time.Time {
+	return l.Acquired.Add(l.RenewalTime)
+}
+
+// RebindAt returns the time at which the lease should be rebound.
+func (l *Lease) RebindAt() time.Time {
+	return l.Acquired.Add(l.RebindingTime)
+}
@@ -0,0 +1,208 @@
+package dhcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/unixpickle/wifistack/frames"
+)
+
+var (
+	ErrMessageTooShort = errors.New("DHCP message too short")
+	ErrBadMagicCookie  = errors.New("bad DHCP magic cookie")
+	ErrBadOptions      = errors.New("malformed DHCP options")
+)
+
+var magicCookie = []byte{99, 130, 83, 99}
+
+// These are the values of a message's Op field.
+const (
+	OpRequest = 1
+	OpReply   = 2
+)
+
+// A MessageType is the value of the DHCP message type option,
+// as defined in RFC 2132, section 9.6.
+type MessageType int
+
+const (
+	MessageTypeDiscover MessageType = 1
+	MessageTypeOffer                = 2
+	MessageTypeRequest              = 3
+	MessageTypeDecline              = 4
+	MessageTypeAck                  = 5
+	MessageTypeNak                  = 6
+	MessageTypeRelease              = 7
+	MessageTypeInform               = 8
+)
+
+// An OptionCode identifies a DHCP option, as defined in RFC 2132.
+type OptionCode int
+
+const (
+	OptionPad              OptionCode = 0
+	OptionSubnetMask                  = 1
+	OptionRouter                      = 3
+	OptionDomainNameServer            = 6
+	OptionHostName                    = 12
+	OptionDomainName                  = 15
+	OptionInterfaceMTU                = 26
+	OptionBroadcastAddress            = 28
+	OptionRequestedAddress            = 50
+	OptionLeaseTime                   = 51
+	OptionMessageType                 = 53
+	OptionServerIdentifier            = 54
+	OptionParameterRequest            = 55
+	OptionMessage                     = 56
+	OptionRenewalTime                 = 58
+	OptionRebindingTime               = 59
+	OptionClientIdentifier            = 61
+	OptionEnd                         = 255
+)
+
+// An Option is a single DHCP option.
+type Option struct {
+	Code OptionCode
+	Data []byte
+}
+
+// Options is an ordered list of DHCP options.
+type Options []Option
+
+// Get returns the data for an option, or nil if the option is absent.
+func (o Options) Get(code OptionCode) []byte {
+	for _, opt := range o {
+		if opt.Code == code {
+			return opt.Data
+		}
+	}
+	return nil
+}
+
+// IP decodes an option containing a single IPv4 address.
+func (o Options) IP(code OptionCode) net.IP {
+	if data := o.Get(code); len(data) == 4 {
+		return net.IP(append([]byte{}, data...))
+	}
+	return nil
+}
+
+// IPs decodes an option containing a list of IPv4 addresses.
+func (o Options) IPs(code OptionCode) []net.IP {
+	data := o.Get(code)
+	var res []net.IP
+	for i := 0; i+4 <= len(data); i += 4 {
+		res = append(res, net.IP(append([]byte{}, data[i:i+4]...)))
+	}
+	return res
+}
+
+// Uint32 decodes an option containing a 32-bit number.
+func (o Options) Uint32(code OptionCode) (uint32, bool) {
+	if data := o.Get(code); len(data) == 4 {
+		return binary.BigEndian.Uint32(data), true
+	}
+	return 0, false
+}
+
+// A Message is a DHCP message, as described in section 2 of RFC 2131.
+type Message struct {
+	Op    int
+	XID   uint32
+	Secs  uint16
+	Flags uint16
+
+	ClientIP net.IP
+	YourIP   net.IP
+	ServerIP net.IP
+	RelayIP  net.IP
+
+	ClientMAC frames.MAC
+
+	Options Options
+}
+
+// Type returns the message's DHCP message type, or 0 if the message
+// has no message type option.
+func (m *Message) Type() MessageType {
+	if data := m.Options.Get(OptionMessageType); len(data) == 1 {
+		return MessageType(data[0])
+	}
+	return 0
+}
+
+// DecodeMessage decodes a DHCP message from the payload of a UDP packet.
+func DecodeMessage(data []byte) (*Message, error) {
+	if len(data) < 240 {
+		return nil, ErrMessageTooShort
+	}
+	if !bytes.Equal(data[236:240], magicCookie) {
+		return nil, ErrBadMagicCookie
+	}
+	res := &Message{
+		Op:       int(data[0]),
+		XID:      binary.BigEndian.Uint32(data[4:8]),
+		Secs:     binary.BigEndian.Uint16(data[8:10]),
+		Flags:    binary.BigEndian.Uint16(data[10:12]),
+		ClientIP: net.IP(append([]byte{}, data[12:16]...)),
+		YourIP:   net.IP(append([]byte{}, data[16:20]...)),
+		ServerIP: net.IP(append([]byte{}, data[20:24]...)),
+		RelayIP:  net.IP(append([]byte{}, data[24:28]...)),
+	}
+	copy(res.ClientMAC[:], data[28:34])
+
+	options := data[240:]
+	for len(options) > 0 {
+		code := OptionCode(options[0])
+		if code == OptionPad {
+			options = options[1:]
+			continue
+		} else if code == OptionEnd {
+			break
+		}
+		if len(options) < 2 || len(options) < 2+int(options[1]) {
+			return nil, ErrBadOptions
+		}
+		length := int(options[1])
+		res.Options = append(res.Options, Option{
+			Code: code,
+			Data: append([]byte{}, options[2:2+length]...),
+		})
+		options = options[2+length:]
+	}
+
+	return res, nil
+}
+
+// Encode generates the binary representation of the message.
+func (m *Message) Encode() []byte {
+	res := make([]byte, 240, 300)
+	res[0] = byte(m.Op)
+	res[1] = 1 // Ethernet
+	res[2] = 6 // hardware address length
+	binary.BigEndian.PutUint32(res[4:8], m.XID)
+	binary.BigEndian.PutUint16(res[8:10], m.Secs)
+	binary.BigEndian.PutUint16(res[10:12], m.Flags)
+	copy(res[12:16], m.ClientIP.To4())
+	copy(res[16:20], m.YourIP.To4())
+	copy(res[20:24], m.ServerIP.To4())
+	copy(res[24:28], m.RelayIP.To4())
+	copy(res[28:34], m.ClientMAC[:])
+	copy(res[236:240], magicCookie)
+
+	for _, opt := range m.Options {
+		res = append(res, byte(opt.Code), byte(len(opt.Data)))
+		res = append(res, opt.Data...)
+	}
+	res = append(res, byte(OptionEnd))
+
+	// NOTE: some servers ignore messages shorter than the 300 byte
+	// minimum BOOTP message.
+	for len(res) < 300 {
+		res = append(res, 0)
+	}
+
+	return res
+}
@@ -0,0 +1,88 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/unixpickle/wifistack/ipv4"
+)
+
+const (
+	clientPort = 68
+	serverPort = 67
+
+	udpHeaderSize = 8
+	defaultTTL    = 64
+)
+
+var errNotUDP = errors.New("not a UDP packet")
+
+var ipIdentification uint32
+
+// A udpPacket is a UDP datagram along with the addresses from
+// its IPv4 header.
+type udpPacket struct {
+	Source          net.IP
+	Destination     net.IP
+	SourcePort      int
+	DestinationPort int
+	Payload         []byte
+}
+
+// encodeUDPPacket generates an IPv4 packet containing a UDP datagram.
+func encodeUDPPacket(p *udpPacket) []byte {
+	sum := ipv4.PseudoHeaderSum(p.Source, p.Destination, ipv4.ProtocolUDP,
+		udpHeaderSize+len(p.Payload))
+	packet := &ipv4.Packet{
+		Header: ipv4.Header{
+			ID:          int(uint16(atomic.AddUint32(&ipIdentification, 1))),
+			TTL:         defaultTTL,
+			Protocol:    ipv4.ProtocolUDP,
+			Source:      p.Source,
+			Destination: p.Destination,
+		},
+		Payload: ipv4.EncodeUDP(sum, p.SourcePort, p.DestinationPort, p.Payload),
+	}
+	return packet.Encode()
+}
+
+// decodeUDPPacket decodes an unfragmented IPv4 packet containing a
+// UDP datagram.
+func decodeUDPPacket(data []byte) (*udpPacket, error) {
+	packet, err := ipv4.DecodePacket(data)
+	if err != nil || packet.Protocol != ipv4.ProtocolUDP {
+		return nil, errNotUDP
+	}
+
+	// NOTE: DHCP messages are never fragmented in practice.
+	if packet.MoreFragments || packet.FragmentOffset != 0 {
+		return nil, errNotUDP
+	}
+
+	udp := packet.Payload
+	if len(udp) < udpHeaderSize {
+		return nil, errNotUDP
+	}
+	udpSize := int(binary.BigEndian.Uint16(udp[4:6]))
+	if udpSize < udpHeaderSize || udpSize > len(udp) {
+		return nil, errNotUDP
+	}
+	udp = udp[:udpSize]
+	if binary.BigEndian.Uint16(udp[6:8]) != 0 {
+		sum := ipv4.PseudoHeaderSum(packet.Source, packet.Destination,
+			ipv4.ProtocolUDP, len(udp))
+		if ipv4.Checksum(udp, sum) != 0 {
+			return nil, errNotUDP
+		}
+	}
+
+	return &udpPacket{
+		Source:          packet.Source,
+		Destination:     packet.Destination,
+		SourcePort:      int(binary.BigEndian.Uint16(udp[0:2])),
+		DestinationPort: int(binary.BigEndian.Uint16(udp[2:4])),
+		Payload:         udp[udpHeaderSize:],
+	}, nil
+}
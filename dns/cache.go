@@ -0,0 +1,130 @@
+package dns
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// maxCacheTTL limits how long a record is cached, regardless of its
+// TTL, as recommended by section 5 of RFC 8767.
+const maxCacheTTL = time.Hour * 24
+
+// soaFixedSize is the size of the fields after the names in an SOA
+// record.
+const soaFixedSize = 20
+
+type cacheKey struct {
+	name  string
+	qtype int
+}
+
+// A cacheEntry is a cached response to a question.
+type cacheEntry struct {
+	rcode       int
+	answers     []Resource
+	authorities []Resource
+	expiry      time.Time
+}
+
+// cacheLookup finds a cached response, returning a copy whose TTLs are
+// reduced by the time which has passed since it was cached.
+func (r *Resolver) cacheLookup(key cacheKey) (*cacheEntry, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry, ok := r.cache[key]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	if !now.Before(entry.expiry) {
+		delete(r.cache, key)
+		return nil, false
+	}
+	remaining := uint32(entry.expiry.Sub(now) / time.Second)
+	res := &cacheEntry{
+		rcode:       entry.rcode,
+		answers:     withTTL(entry.answers, remaining),
+		authorities: withTTL(entry.authorities, remaining),
+		expiry:      entry.expiry,
+	}
+	return res, true
+}
+
+// cacheStore caches a response.
+//
+// Positive responses are cached for their smallest TTL. Negative
+// responses are cached using the SOA record in the authority section,
+// as described in section 5 of RFC 2308, and they are not cached if
+// there is no SOA record.
+func (r *Resolver) cacheStore(key cacheKey, response *Message) {
+	var ttl uint32
+	var found bool
+	if response.RCode == RCodeSuccess && len(response.Answers) > 0 {
+		for i, answer := range response.Answers {
+			if i == 0 || answer.TTL < ttl {
+				ttl = answer.TTL
+			}
+		}
+		found = true
+	} else {
+		for _, authority := range response.Authorities {
+			if authority.Type == TypeSOA && len(authority.Data) >= soaFixedSize {
+				minimum := soaMinimum(authority.Data)
+				ttl = authority.TTL
+				if minimum < ttl {
+					ttl = minimum
+				}
+				found = true
+				break
+			}
+		}
+	}
+	if !found || ttl == 0 {
+		return
+	}
+	duration := time.Duration(ttl) * time.Second
+	if duration > maxCacheTTL {
+		duration = maxCacheTTL
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	if len(r.cache) >= r.config.CacheSize {
+		for k, entry := range r.cache {
+			if !now.Before(entry.expiry) {
+				delete(r.cache, k)
+			}
+		}
+		// NOTE: if nothing has expired, an arbitrary entry is evicted.
+		for k := range r.cache {
+			if len(r.cache) < r.config.CacheSize {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+	r.cache[key] = &cacheEntry{
+		rcode:       response.RCode,
+		answers:     response.Answers,
+		authorities: response.Authorities,
+		expiry:      now.Add(duration),
+	}
+}
+
+func withTTL(resources []Resource, ttl uint32) []Resource {
+	res := make([]Resource, len(resources))
+	for i, r := range resources {
+		res[i] = r
+		if r.TTL > ttl {
+			res[i].TTL = ttl
+		}
+	}
+	return res
+}
+
+// soaMinimum reads the MINIMUM field, which is the last field of the
+// data of an SOA record.
+func soaMinimum(data []byte) uint32 {
+	return binary.BigEndian.Uint32(data[len(data)-4:])
+}
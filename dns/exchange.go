@@ -0,0 +1,163 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+)
+
+const (
+	dnsPort    = 53
+	maxUDPSize = 512
+	maxTCPSize = 0xffff
+)
+
+// exchange sends a query to each server in turn until one of them
+// answers, or until every server has failed Attempts times.
+//
+// Responses with a name error are answers, while server failures and
+// refusals move on to the next server.
+func (r *Resolver) exchange(ctx context.Context, q Question) (*Message, error) {
+	servers := r.servers()
+	if len(servers) == 0 {
+		return nil, ErrNoServers
+	}
+	query := &Message{
+		ID:               rand.Intn(0x10000),
+		RecursionDesired: true,
+		Questions:        []Question{q},
+	}
+	var lastErr error
+	for attempt := 0; attempt < r.config.Attempts; attempt++ {
+		for _, server := range servers {
+			response, err := r.exchangeServer(ctx, server, query)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if response.RCode != RCodeSuccess && response.RCode != RCodeNameError {
+				lastErr = ErrServerFailure
+				continue
+			}
+			return response, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// exchangeServer sends a query to one server with UDP, falling back to
+// TCP if the response is truncated.
+func (r *Resolver) exchangeServer(ctx context.Context, server net.IP,
+	query *Message) (*Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+
+	data, err := query.Encode()
+	if err != nil {
+		return nil, err
+	}
+	address := net.JoinHostPort(server.String(), strconv.Itoa(dnsPort))
+
+	response, err := r.exchangeUDP(ctx, address, query, data)
+	if err != nil || !response.Truncated {
+		return response, err
+	}
+	return r.exchangeTCP(ctx, address, query, data)
+}
+
+func (r *Resolver) exchangeUDP(ctx context.Context, address string, query *Message,
+	data []byte) (*Message, error) {
+	conn, err := r.config.Dial(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+
+	if _, err := conn.Write(data); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// NOTE: responses which do not match the query are ignored
+		// rather than treated as failures, so that a spoofed response
+		// cannot cause one, as described in section 9 of RFC 5452.
+		response, err := DecodeMessage(buf[:n])
+		if err == nil && matchesQuery(query, response) {
+			return response, nil
+		}
+	}
+}
+
+func (r *Resolver) exchangeTCP(ctx context.Context, address string, query *Message,
+	data []byte) (*Message, error) {
+	conn, err := r.config.Dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+
+	if err := writeStreamMessage(conn, data); err != nil {
+		return nil, err
+	}
+	reply, err := readStreamMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	response, err := DecodeMessage(reply)
+	if err != nil {
+		return nil, err
+	}
+	if !matchesQuery(query, response) {
+		return nil, ErrBadMessage
+	}
+	return response, nil
+}
+
+// readStreamMessage reads a message with the two byte length prefix
+// used over TCP, as described in section 4.2.2 of RFC 1035.
+func readStreamMessage(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// writeStreamMessage writes a message with a two byte length prefix.
+func writeStreamMessage(w io.Writer, data []byte) error {
+	if len(data) > maxTCPSize {
+		return ErrBadMessage
+	}
+	packet := binary.BigEndian.AppendUint16(nil, uint16(len(data)))
+	_, err := w.Write(append(packet, data...))
+	return err
+}
+
+func matchesQuery(query, response *Message) bool {
+	if !response.Response || response.ID != query.ID || len(response.Questions) != 1 {
+		return false
+	}
+	q, a := query.Questions[0], response.Questions[0]
+	return q.Type == a.Type && q.Class == a.Class && CanonicalName(q.Name) == CanonicalName(a.Name)
+}
+
+func setDeadline(ctx context.Context, conn net.Conn) {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+}
@@ -0,0 +1,518 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// These are the resource record types used by wifistack.
+const (
+	TypeA     = 1
+	TypeNS    = 2
+	TypeCNAME = 5
+	TypeSOA   = 6
+	TypePTR   = 12
+	TypeMX    = 15
+	TypeTXT   = 16
+	TypeAAAA  = 28
+	TypeSRV   = 33
+	TypeOPT   = 41
+	TypeANY   = 255
+)
+
+// ClassINET is the Internet class.
+const ClassINET = 1
+
+// These are the response codes from section 4.1.1 of RFC 1035.
+const (
+	RCodeSuccess        = 0
+	RCodeFormatError    = 1
+	RCodeServerFailure  = 2
+	RCodeNameError      = 3
+	RCodeNotImplemented = 4
+	RCodeRefused        = 5
+)
+
+const (
+	headerSize     = 12
+	maxNameSize    = 255
+	maxLabelSize   = 63
+	maxPointerHops = 32
+)
+
+var (
+	ErrBadMessage = errors.New("invalid DNS message")
+	ErrBadName    = errors.New("invalid domain name")
+)
+
+// A Message is a DNS message, as described in section 4 of RFC 1035.
+type Message struct {
+	ID                 int
+	Response           bool
+	Opcode             int
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	RCode              int
+
+	Questions   []Question
+	Answers     []Resource
+	Authorities []Resource
+	Additionals []Resource
+}
+
+// A Question is an entry in the question section of a message.
+type Question struct {
+	Name  string
+	Type  int
+	Class int
+}
+
+// A Resource is a resource record.
+//
+// Names are absolute and in presentation format, e.g. "example.com.",
+// with dots and backslashes inside of labels escaped by a backslash.
+//
+// NOTE: the names inside of the data of the record types in this
+// package are decompressed while decoding, so Data never refers to
+// other parts of the message it came from.
+type Resource struct {
+	Name  string
+	Type  int
+	Class int
+	TTL   uint32
+	Data  []byte
+}
+
+// IP decodes the address of an A or AAAA record.
+func (r *Resource) IP() net.IP {
+	if (r.Type == TypeA && len(r.Data) == net.IPv4len) ||
+		(r.Type == TypeAAAA && len(r.Data) == net.IPv6len) {
+		return net.IP(append([]byte{}, r.Data...))
+	}
+	return nil
+}
+
+// Target decodes the domain name of a CNAME, PTR, or NS record.
+func (r *Resource) Target() (string, error) {
+	name, next, err := decodeName(r.Data, 0)
+	if err != nil {
+		return "", err
+	} else if next != len(r.Data) {
+		return "", ErrBadMessage
+	}
+	return name, nil
+}
+
+// Texts decodes the character strings of a TXT record.
+func (r *Resource) Texts() ([]string, error) {
+	var res []string
+	data := r.Data
+	for len(data) > 0 {
+		size := int(data[0])
+		if 1+size > len(data) {
+			return nil, ErrBadMessage
+		}
+		res = append(res, string(data[1:1+size]))
+		data = data[1+size:]
+	}
+	return res, nil
+}
+
+// SRV decodes an SRV record, as described in RFC 2782.
+func (r *Resource) SRV() (*net.SRV, error) {
+	if len(r.Data) < 7 {
+		return nil, ErrBadMessage
+	}
+	target, next, err := decodeName(r.Data, 6)
+	if err != nil {
+		return nil, err
+	} else if next != len(r.Data) {
+		return nil, ErrBadMessage
+	}
+	return &net.SRV{
+		Priority: binary.BigEndian.Uint16(r.Data[0:2]),
+		Weight:   binary.BigEndian.Uint16(r.Data[2:4]),
+		Port:     binary.BigEndian.Uint16(r.Data[4:6]),
+		Target:   target,
+	}, nil
+}
+
+// DecodeMessage decodes a DNS message.
+func DecodeMessage(data []byte) (*Message, error) {
+	if len(data) < headerSize {
+		return nil, ErrBadMessage
+	}
+	flags := binary.BigEndian.Uint16(data[2:4])
+	res := &Message{
+		ID:                 int(binary.BigEndian.Uint16(data[0:2])),
+		Response:           flags&0x8000 != 0,
+		Opcode:             int(flags>>11) & 0xf,
+		Authoritative:      flags&0x0400 != 0,
+		Truncated:          flags&0x0200 != 0,
+		RecursionDesired:   flags&0x0100 != 0,
+		RecursionAvailable: flags&0x0080 != 0,
+		RCode:              int(flags & 0xf),
+	}
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(data[4+i*2:]))
+	}
+
+	offset := headerSize
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := decodeName(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(data) {
+			return nil, ErrBadMessage
+		}
+		res.Questions = append(res.Questions, Question{
+			Name:  name,
+			Type:  int(binary.BigEndian.Uint16(data[next:])),
+			Class: int(binary.BigEndian.Uint16(data[next+2:])),
+		})
+		offset = next + 4
+	}
+
+	sections := []*[]Resource{&res.Answers, &res.Authorities, &res.Additionals}
+	for i, section := range sections {
+		for j := 0; j < counts[i+1]; j++ {
+			var r Resource
+			var err error
+			r, offset, err = decodeResource(data, offset)
+			if err != nil {
+				return nil, err
+			}
+			*section = append(*section, r)
+		}
+	}
+	return res, nil
+}
+
+// Encode generates the binary representation of the message.
+//
+// Owner names are compressed as described in section 4.1.4 of RFC 1035.
+func (m *Message) Encode() ([]byte, error) {
+	res := make([]byte, headerSize, 512)
+	binary.BigEndian.PutUint16(res[0:2], uint16(m.ID))
+	flags := uint16(m.Opcode&0xf)<<11 | uint16(m.RCode&0xf)
+	for _, flag := range []struct {
+		set  bool
+		mask uint16
+	}{
+		{m.Response, 0x8000},
+		{m.Authoritative, 0x0400},
+		{m.Truncated, 0x0200},
+		{m.RecursionDesired, 0x0100},
+		{m.RecursionAvailable, 0x0080},
+	} {
+		if flag.set {
+			flags |= flag.mask
+		}
+	}
+	binary.BigEndian.PutUint16(res[2:4], flags)
+	binary.BigEndian.PutUint16(res[4:6], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(res[6:8], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(res[8:10], uint16(len(m.Authorities)))
+	binary.BigEndian.PutUint16(res[10:12], uint16(len(m.Additionals)))
+
+	compression := map[string]int{}
+	var err error
+	for _, q := range m.Questions {
+		res, err = appendName(res, q.Name, compression)
+		if err != nil {
+			return nil, err
+		}
+		res = binary.BigEndian.AppendUint16(res, uint16(q.Type))
+		res = binary.BigEndian.AppendUint16(res, uint16(q.Class))
+	}
+	for _, section := range [][]Resource{m.Answers, m.Authorities, m.Additionals} {
+		for _, r := range section {
+			res, err = appendName(res, r.Name, compression)
+			if err != nil {
+				return nil, err
+			}
+			res = binary.BigEndian.AppendUint16(res, uint16(r.Type))
+			res = binary.BigEndian.AppendUint16(res, uint16(r.Class))
+			res = binary.BigEndian.AppendUint32(res, r.TTL)
+			res = binary.BigEndian.AppendUint16(res, uint16(len(r.Data)))
+			res = append(res, r.Data...)
+		}
+	}
+	return res, nil
+}
+
+func decodeResource(data []byte, offset int) (Resource, int, error) {
+	name, next, err := decodeName(data, offset)
+	if err != nil {
+		return Resource{}, 0, err
+	}
+	if next+10 > len(data) {
+		return Resource{}, 0, ErrBadMessage
+	}
+	r := Resource{
+		Name:  name,
+		Type:  int(binary.BigEndian.Uint16(data[next:])),
+		Class: int(binary.BigEndian.Uint16(data[next+2:])),
+		TTL:   binary.BigEndian.Uint32(data[next+4:]),
+	}
+	size := int(binary.BigEndian.Uint16(data[next+8:]))
+	start := next + 10
+	end := start + size
+	if end > len(data) {
+		return Resource{}, 0, ErrBadMessage
+	}
+
+	// The number of bytes before and after the names in the data.
+	var prefix, suffix, names int
+	switch r.Type {
+	case TypeCNAME, TypePTR, TypeNS:
+		names = 1
+	case TypeMX:
+		prefix, names = 2, 1
+	case TypeSRV:
+		prefix, names = 6, 1
+	case TypeSOA:
+		names, suffix = 2, soaFixedSize
+	}
+	if names == 0 {
+		r.Data = append([]byte{}, data[start:end]...)
+		return r, end, nil
+	}
+
+	if start+prefix > end {
+		return Resource{}, 0, ErrBadMessage
+	}
+	r.Data = append([]byte{}, data[start:start+prefix]...)
+	offset = start + prefix
+	for i := 0; i < names; i++ {
+		name, next, err := decodeName(data[:end], offset)
+		if err != nil {
+			return Resource{}, 0, err
+		}
+		r.Data, _ = appendName(r.Data, name, nil)
+		offset = next
+	}
+	if offset+suffix != end {
+		return Resource{}, 0, ErrBadMessage
+	}
+	r.Data = append(r.Data, data[offset:end]...)
+	return r, end, nil
+}
+
+// decodeName decodes a possibly compressed name, returning the name and
+// the offset after it.
+func decodeName(data []byte, offset int) (string, int, error) {
+	var builder strings.Builder
+	next := -1
+	size := 0
+	for hops := 0; ; {
+		if offset >= len(data) {
+			return "", 0, ErrBadMessage
+		}
+		length := int(data[offset])
+		switch length & 0xc0 {
+		case 0:
+		case 0xc0:
+			if offset+1 >= len(data) {
+				return "", 0, ErrBadMessage
+			}
+			if next == -1 {
+				next = offset + 2
+			}
+			hops++
+			if hops > maxPointerHops {
+				return "", 0, ErrBadMessage
+			}
+			offset = int(binary.BigEndian.Uint16(data[offset:]) & 0x3fff)
+			continue
+		default:
+			return "", 0, ErrBadMessage
+		}
+		offset++
+		if length == 0 {
+			break
+		}
+		if offset+length > len(data) {
+			return "", 0, ErrBadMessage
+		}
+		size += length + 1
+		if size > maxNameSize {
+			return "", 0, ErrBadName
+		}
+		writeLabel(&builder, data[offset:offset+length])
+		builder.WriteByte('.')
+		offset += length
+	}
+	if next == -1 {
+		next = offset
+	}
+	if builder.Len() == 0 {
+		return ".", next, nil
+	}
+	return builder.String(), next, nil
+}
+
+func writeLabel(b *strings.Builder, label []byte) {
+	for _, c := range label {
+		switch {
+		case c == '.' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			b.WriteByte('\\')
+			digits := strconv.Itoa(int(c))
+			b.WriteString(strings.Repeat("0", 3-len(digits)) + digits)
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+// splitName splits a name in presentation format into its labels,
+// handling the escapes from section 5.1 of RFC 1035.
+// A trailing dot is optional.
+func splitName(name string) ([][]byte, error) {
+	if name == "." || name == "" {
+		return nil, nil
+	}
+	var labels [][]byte
+	var label []byte
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch c {
+		case '.':
+			if len(label) == 0 {
+				return nil, ErrBadName
+			}
+			labels = append(labels, label)
+			label = nil
+			continue
+		case '\\':
+			if i+1 >= len(name) {
+				return nil, ErrBadName
+			}
+			if isDigit(name[i+1]) {
+				if i+3 >= len(name) || !isDigit(name[i+2]) || !isDigit(name[i+3]) {
+					return nil, ErrBadName
+				}
+				value, _ := strconv.Atoi(name[i+1 : i+4])
+				if value > 0xff {
+					return nil, ErrBadName
+				}
+				c = byte(value)
+				i += 3
+			} else {
+				i++
+				c = name[i]
+			}
+		}
+		label = append(label, c)
+		if len(label) > maxLabelSize {
+			return nil, ErrBadName
+		}
+	}
+	if len(label) > 0 {
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+// SplitName splits a name in presentation format into its labels,
+// removing escapes.
+func SplitName(name string) ([]string, error) {
+	labels, err := splitName(name)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, len(labels))
+	for i, label := range labels {
+		res[i] = string(label)
+	}
+	return res, nil
+}
+
+// JoinName creates an absolute name in presentation format from
+// labels, escaping them as necessary.
+func JoinName(labels ...string) string {
+	if len(labels) == 0 {
+		return "."
+	}
+	var b strings.Builder
+	for _, label := range labels {
+		writeLabel(&b, []byte(label))
+		b.WriteByte('.')
+	}
+	return b.String()
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// appendName encodes a name, using and updating a compression table if
+// it is non-nil.
+func appendName(data []byte, name string, compression map[string]int) ([]byte, error) {
+	labels, err := splitName(name)
+	if err != nil {
+		return nil, err
+	}
+	size := 1
+	for _, label := range labels {
+		size += len(label) + 1
+	}
+	if size > maxNameSize {
+		return nil, ErrBadName
+	}
+	for i, label := range labels {
+		if compression != nil {
+			suffix := strings.ToLower(string(joinLabels(labels[i:])))
+			if offset, ok := compression[suffix]; ok {
+				return binary.BigEndian.AppendUint16(data, 0xc000|uint16(offset)), nil
+			}
+			if len(data) < 0x4000 {
+				compression[suffix] = len(data)
+			}
+		}
+		data = append(data, byte(len(label)))
+		data = append(data, label...)
+	}
+	return append(data, 0), nil
+}
+
+func joinLabels(labels [][]byte) []byte {
+	var res []byte
+	for _, label := range labels {
+		res = append(res, byte(len(label)))
+		res = append(res, label...)
+	}
+	return res
+}
+
+// CanonicalName converts a name to lowercase and makes it absolute by
+// adding a trailing dot if it is missing.
+func CanonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !IsAbsolute(name) {
+		name += "."
+	}
+	return name
+}
+
+// IsAbsolute checks if a name ends with an unescaped dot.
+func IsAbsolute(name string) bool {
+	if !strings.HasSuffix(name, ".") {
+		return false
+	}
+	backslashes := 0
+	for i := len(name) - 2; i >= 0 && name[i] == '\\'; i-- {
+		backslashes++
+	}
+	return backslashes%2 == 0
+}
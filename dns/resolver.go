@@ -0,0 +1,393 @@
+// Package dns implements a DNS stub resolver which reaches DNS servers
+// over a wifistack association.
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/wifistack/dhcp"
+)
+
+const (
+	defaultTimeout   = time.Second * 2
+	defaultAttempts  = 2
+	defaultNdots     = 1
+	defaultCacheSize = 256
+
+	maxCNAMEs = 8
+)
+
+var (
+	ErrNoServers     = errors.New("no DNS servers")
+	ErrNotFound      = errors.New("no such host")
+	ErrNoRecords     = errors.New("no records of the requested type")
+	ErrServerFailure = errors.New("server misbehaving")
+	ErrCNAMELoop     = errors.New("CNAME chain too long")
+)
+
+// Config stores the configuration for a Resolver.
+type Config struct {
+	// Dial connects to DNS servers with the networks "udp" and "tcp".
+	// This is typically the DialContext method of a wifinet.Dialer, so
+	// that queries are sent over a wifistack association.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// Servers lists the DNS servers in order of preference.
+	// If this is empty, the servers of the current lease of DHCP are
+	// used.
+	Servers []net.IP
+
+	// DHCP is the client whose lease provides the DNS servers and the
+	// default search domain. It may be nil if Servers is set.
+	DHCP *dhcp.Client
+
+	// SearchDomains are appended to names which are not absolute, like
+	// the search list in resolv.conf.
+	// If this is nil, the domain name of the DHCP lease is used.
+	SearchDomains []string
+
+	// Ndots is the number of dots which a name must have for it to be
+	// tried as an absolute name before the search domains are.
+	// If this is 0, a default value is used.
+	Ndots int
+
+	// Timeout is how long to wait for each response.
+	// If this is 0, a default value is used.
+	Timeout time.Duration
+
+	// Attempts is the number of times each server is tried.
+	// If this is 0, a default value is used.
+	Attempts int
+
+	// CacheSize is the maximum number of cached responses.
+	// If this is 0, a default value is used.
+	CacheSize int
+}
+
+// A Resolver is a stub resolver, which sends recursive queries to DNS
+// servers and caches the responses according to their TTLs.
+//
+// Queries are sent with UDP, and they are retried with TCP when a
+// response is truncated, as described in section 4.2 of RFC 1035.
+//
+// A Resolver may be used directly, or through a net.Resolver using
+// the Dial method.
+type Resolver struct {
+	config Config
+
+	lock  sync.Mutex
+	cache map[cacheKey]*cacheEntry
+}
+
+// NewResolver creates a Resolver.
+func NewResolver(c Config) *Resolver {
+	if c.Ndots == 0 {
+		c.Ndots = defaultNdots
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultTimeout
+	}
+	if c.Attempts == 0 {
+		c.Attempts = defaultAttempts
+	}
+	if c.CacheSize == 0 {
+		c.CacheSize = defaultCacheSize
+	}
+	return &Resolver{
+		config: c,
+		cache:  map[cacheKey]*cacheEntry{},
+	}
+}
+
+// NetResolver creates a net.Resolver which sends its queries to r.
+func (r *Resolver) NetResolver() *net.Resolver {
+	return &net.Resolver{PreferGo: true, Dial: r.Dial}
+}
+
+// Lookup finds the records of a type for a name, following CNAME
+// records and trying the search domains if the name is not absolute.
+func (r *Resolver) Lookup(ctx context.Context, name string, qtype int) ([]Resource, error) {
+	_, records, err := r.search(ctx, name, qtype)
+	return records, err
+}
+
+// LookupIP finds the addresses of a host.
+// The network must be "ip", "ip4", or "ip6".
+func (r *Resolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	var types []int
+	switch network {
+	case "ip":
+		types = []int{TypeA, TypeAAAA}
+	case "ip4":
+		types = []int{TypeA}
+	case "ip6":
+		types = []int{TypeAAAA}
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	var res []net.IP
+	var firstErr error
+	for _, qtype := range types {
+		records, err := r.Lookup(ctx, host, qtype)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, record := range records {
+			if ip := record.IP(); ip != nil {
+				res = append(res, ip)
+			}
+		}
+	}
+	if len(res) == 0 {
+		return nil, firstErr
+	}
+	return res, nil
+}
+
+// LookupHost finds the addresses of a host as strings.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	ips, err := r.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, len(ips))
+	for i, ip := range ips {
+		res[i] = ip.String()
+	}
+	return res, nil
+}
+
+// LookupCNAME finds the canonical name of a host by following its
+// CNAME records.
+func (r *Resolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	canonical, _, err := r.search(ctx, host, TypeA)
+	if errors.Is(err, ErrNoRecords) {
+		canonical, _, err = r.search(ctx, host, TypeAAAA)
+	}
+	if err != nil && !errors.Is(err, ErrNoRecords) {
+		return "", err
+	}
+	return canonical, nil
+}
+
+// LookupAddr finds the names of an address with PTR records.
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	name, err := ReverseName(net.ParseIP(addr))
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: addr}
+	}
+	records, err := r.Lookup(ctx, name, TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, record := range records {
+		if target, err := record.Target(); err == nil {
+			res = append(res, target)
+		}
+	}
+	return res, nil
+}
+
+// LookupTXT finds the TXT records of a name.
+// The character strings of each record are concatenated.
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, err := r.Lookup(ctx, name, TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, record := range records {
+		if texts, err := record.Texts(); err == nil {
+			res = append(res, strings.Join(texts, ""))
+		}
+	}
+	return res, nil
+}
+
+// ReverseName creates the name for the PTR records of an address, in
+// the in-addr.arpa domain for IPv4 (RFC 1035) or the ip6.arpa domain
+// for IPv6 (RFC 3596).
+func ReverseName(ip net.IP) (string, error) {
+	if ip == nil {
+		return "", ErrBadName
+	}
+	var b strings.Builder
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			b.WriteString(strconv.Itoa(int(ip4[i])))
+			b.WriteByte('.')
+		}
+		b.WriteString("in-addr.arpa.")
+		return b.String(), nil
+	}
+	const hex = "0123456789abcdef"
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hex[ip[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hex[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String(), nil
+}
+
+// search tries the candidate names for a name in order, returning the
+// first result with records.
+func (r *Resolver) search(ctx context.Context, name string, qtype int) (string, []Resource, error) {
+	var lastErr error
+	for _, candidate := range r.candidates(name) {
+		canonical, records, err := r.resolve(ctx, candidate, qtype)
+		if err == nil {
+			return canonical, records, nil
+		}
+		lastErr = err
+		if !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrNoRecords) {
+			break
+		}
+	}
+	return "", nil, &net.DNSError{
+		Err:        lastErr.Error(),
+		Name:       name,
+		IsNotFound: errors.Is(lastErr, ErrNotFound) || errors.Is(lastErr, ErrNoRecords),
+		IsTimeout:  errors.Is(lastErr, context.DeadlineExceeded) || isTimeout(lastErr),
+	}
+}
+
+// candidates lists the absolute names to try for a name, following
+// the rules of the ndots option in resolv.conf.
+func (r *Resolver) candidates(name string) []string {
+	if IsAbsolute(name) {
+		return []string{name}
+	}
+	var res []string
+	for _, domain := range r.searchDomains() {
+		res = append(res, name+"."+CanonicalName(domain))
+	}
+	if strings.Count(name, ".") >= r.config.Ndots {
+		return append([]string{name + "."}, res...)
+	}
+	return append(res, name+".")
+}
+
+func (r *Resolver) searchDomains() []string {
+	if r.config.SearchDomains != nil {
+		return r.config.SearchDomains
+	}
+	if r.config.DHCP != nil {
+		if lease := r.config.DHCP.Lease(); lease != nil && lease.DomainName != "" {
+			return []string{lease.DomainName}
+		}
+	}
+	return nil
+}
+
+func (r *Resolver) servers() []net.IP {
+	if len(r.config.Servers) > 0 {
+		return r.config.Servers
+	}
+	if r.config.DHCP != nil {
+		if lease := r.config.DHCP.Lease(); lease != nil {
+			return lease.DNSServers
+		}
+	}
+	return nil
+}
+
+// resolve finds the records of a type for an absolute name, following
+// the CNAME records in the answers and querying their targets if
+// necessary.
+// It returns the canonical name along with the records.
+func (r *Resolver) resolve(ctx context.Context, name string, qtype int) (string, []Resource, error) {
+	name = CanonicalName(name)
+	for queries := 0; queries <= maxCNAMEs; queries++ {
+		response, err := r.query(ctx, name, qtype)
+		if err != nil {
+			return "", nil, err
+		}
+		if response.rcode == RCodeNameError {
+			return "", nil, ErrNotFound
+		}
+
+		// NOTE: the answers of a recursive server contain the CNAME
+		// chain followed by the records of the canonical name, as
+		// described in section 3.6.2 of RFC 1034.
+		var records []Resource
+		followed := 0
+		for {
+			records = recordsFor(response.answers, name, qtype)
+			if len(records) > 0 || qtype == TypeCNAME {
+				break
+			}
+			cname := recordsFor(response.answers, name, TypeCNAME)
+			if len(cname) == 0 {
+				break
+			}
+			if followed++; followed > maxCNAMEs {
+				return "", nil, ErrCNAMELoop
+			}
+			target, err := cname[0].Target()
+			if err != nil {
+				return "", nil, ErrServerFailure
+			}
+			name = CanonicalName(target)
+		}
+		if len(records) > 0 {
+			return name, records, nil
+		} else if followed == 0 {
+			return name, nil, ErrNoRecords
+		}
+
+		// The chain ended at a name whose records were not included, so
+		// the name is queried directly.
+	}
+	return "", nil, ErrCNAMELoop
+}
+
+// query finds the response to a question in the cache, or by asking
+// the servers.
+func (r *Resolver) query(ctx context.Context, name string, qtype int) (*cacheEntry, error) {
+	key := cacheKey{name: CanonicalName(name), qtype: qtype}
+	if entry, ok := r.cacheLookup(key); ok {
+		return entry, nil
+	}
+	response, err := r.exchange(ctx, Question{Name: name, Type: qtype, Class: ClassINET})
+	if err != nil {
+		return nil, err
+	}
+	r.cacheStore(key, response)
+	return &cacheEntry{
+		rcode:       response.RCode,
+		answers:     response.Answers,
+		authorities: response.Authorities,
+	}, nil
+}
+
+func recordsFor(resources []Resource, name string, qtype int) []Resource {
+	var res []Resource
+	for _, resource := range resources {
+		if resource.Type == qtype && resource.Class == ClassINET &&
+			CanonicalName(resource.Name) == name {
+			res = append(res, resource)
+		}
+	}
+	return res
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
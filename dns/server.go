@@ -0,0 +1,80 @@
+package dns
+
+import (
+	"context"
+	"net"
+)
+
+// Dial connects to a DNS server inside of the resolver, which answers
+// queries from the cache or by querying the configured servers.
+// The network and address are ignored.
+//
+// Dial can be used as the Dial function of a net.Resolver whose
+// PreferGo field is set, as done by NetResolver. In this case, the
+// net.Resolver applies its own search domains from the host, and only
+// uses the resolver for the resulting absolute queries.
+//
+// NOTE: the connection is not a net.PacketConn, so the net package
+// frames messages with the two byte length prefix of TCP even for UDP.
+// As a result, responses are never truncated.
+func (r *Resolver) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go r.serve(ctx, server)
+	return client, nil
+}
+
+// serve answers queries on a connection until it is closed.
+func (r *Resolver) serve(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	for {
+		data, err := readStreamMessage(conn)
+		if err != nil {
+			return
+		}
+		query, err := DecodeMessage(data)
+		if err != nil || query.Response {
+			continue
+		}
+		response, err := r.answer(ctx, query).Encode()
+		if err != nil {
+			return
+		}
+		if err := writeStreamMessage(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+// answer creates the response to a query.
+func (r *Resolver) answer(ctx context.Context, query *Message) *Message {
+	response := &Message{
+		ID:                 query.ID,
+		Response:           true,
+		Opcode:             query.Opcode,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+		Questions:          query.Questions,
+	}
+	if query.Opcode != 0 {
+		response.RCode = RCodeNotImplemented
+		return response
+	} else if len(query.Questions) != 1 {
+		response.RCode = RCodeFormatError
+		return response
+	}
+
+	q := query.Questions[0]
+	if q.Class != ClassINET {
+		response.RCode = RCodeNotImplemented
+		return response
+	}
+	entry, err := r.query(ctx, CanonicalName(q.Name), q.Type)
+	if err != nil {
+		response.RCode = RCodeServerFailure
+		return response
+	}
+	response.RCode = entry.rcode
+	response.Answers = entry.answers
+	response.Authorities = entry.authorities
+	return response
+}
@@ -0,0 +1,183 @@
+package wifistack
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/unixpickle/wifistack/frames"
+)
+
+// ethernetIncomingBufferSize is the number of unhandled frames which
+// may wait on an EthernetStream's Incoming channel.
+const ethernetIncomingBufferSize = 64
+
+// An EthernetStream sends and receives Ethernet II frames over an MSDUStream.
+//
+// Outgoing frames are encapsulated in 802.2 LLC/SNAP headers, and incoming
+// MSDUs without a supported LLC/SNAP header are dropped.
+//
+// An EthernetStream can be shared by several protocols, such as ARP, IPv4
+// and IPv6, each of which handles its own EtherTypes with HandleEtherType.
+type EthernetStream struct {
+	// hasClosed is used to atomically ensure that closeChan is closed only once.
+	hasClosed uint32
+	closeChan chan struct{}
+	done      chan struct{}
+
+	msdus MSDUStream
+	local frames.MAC
+
+	handlersLock sync.RWMutex
+	handlers     map[int][]*etherTypeHandler
+
+	incoming chan *frames.EthernetFrame
+	outgoing chan *frames.EthernetFrame
+}
+
+type etherTypeHandler struct {
+	handle func(*frames.EthernetFrame)
+}
+
+// NewEthernetStream creates an EthernetStream on top of an MSDUStream.
+// The local argument is the MAC address of this station.
+//
+// The EthernetStream takes ownership of the MSDUStream, so you should
+// not use the MSDUStream directly after calling this.
+func NewEthernetStream(s MSDUStream, local frames.MAC) *EthernetStream {
+	res := &EthernetStream{
+		closeChan: make(chan struct{}),
+		done:      make(chan struct{}),
+		msdus:     s,
+		local:     local,
+		handlers:  map[int][]*etherTypeHandler{},
+		incoming:  make(chan *frames.EthernetFrame, ethernetIncomingBufferSize),
+		outgoing:  make(chan *frames.EthernetFrame),
+	}
+	go res.incomingLoop()
+	go res.outgoingLoop()
+	return res
+}
+
+// Incoming returns the channel of incoming frames which do not have
+// a handler for their EtherType.
+// This channel is closed when the underlying MSDUStream is closed.
+//
+// Frames are buffered on this channel, and they are dropped if the
+// buffer is full, so unread frames never block frames for handlers.
+func (e *EthernetStream) Incoming() <-chan *frames.EthernetFrame {
+	return e.incoming
+}
+
+// Outgoing returns the channel of outgoing frames.
+// You should close this once you are done with the stream.
+// Closing this will close the outgoing channel of the MSDUStream.
+//
+// If the Source of an outgoing frame is zero, the local address is used.
+func (e *EthernetStream) Outgoing() chan<- *frames.EthernetFrame {
+	return e.outgoing
+}
+
+// ForceClose forces the underlying MSDUStream to close and stops
+// delivering incoming frames.
+// You should close the outgoing channel before using this.
+func (e *EthernetStream) ForceClose() {
+	if atomic.SwapUint32(&e.hasClosed, 1) == 0 {
+		close(e.closeChan)
+	}
+	e.msdus.ForceClose()
+}
+
+// Done returns a channel which is closed once the stream stops delivering
+// incoming frames, either because the underlying MSDUStream was closed or
+// because of ForceClose.
+func (e *EthernetStream) Done() <-chan struct{} {
+	return e.done
+}
+
+// HandleEtherType registers a handler for incoming frames with a given
+// EtherType, and returns a function which removes the handler.
+// Frames with a handler are not sent to the Incoming() channel.
+//
+// An EtherType may have several handlers (e.g. an IPv4 stack and a DHCP
+// client), in which case each of them is called with the same frame, so
+// handlers must not modify frames.
+//
+// Handlers are called on the stream's receive goroutine, so they should
+// not block. In particular, they should not send on the Outgoing()
+// channel directly.
+func (e *EthernetStream) HandleEtherType(etherType int,
+	handler func(*frames.EthernetFrame)) (remove func()) {
+	h := &etherTypeHandler{handle: handler}
+	e.handlersLock.Lock()
+	e.handlers[etherType] = append(e.handlers[etherType], h)
+	e.handlersLock.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			e.handlersLock.Lock()
+			defer e.handlersLock.Unlock()
+			var remaining []*etherTypeHandler
+			for _, x := range e.handlers[etherType] {
+				if x != h {
+					remaining = append(remaining, x)
+				}
+			}
+			if len(remaining) == 0 {
+				delete(e.handlers, etherType)
+			} else {
+				e.handlers[etherType] = remaining
+			}
+		})
+	}
+}
+
+func (e *EthernetStream) incomingLoop() {
+	defer close(e.done)
+	defer close(e.incoming)
+	for msdu := range e.msdus.Incoming() {
+		etherType, payload, err := frames.DecodeLLCSNAP(msdu.Payload)
+		if err != nil {
+			continue
+		}
+		frame := &frames.EthernetFrame{
+			Destination: msdu.DA,
+			Source:      msdu.SA,
+			EtherType:   etherType,
+			Payload:     payload,
+		}
+
+		e.handlersLock.RLock()
+		handlers := e.handlers[etherType]
+		e.handlersLock.RUnlock()
+		if len(handlers) > 0 {
+			for _, h := range handlers {
+				h.handle(frame)
+			}
+			continue
+		}
+
+		select {
+		case e.incoming <- frame:
+		case <-e.closeChan:
+			return
+		default:
+		}
+	}
+}
+
+func (e *EthernetStream) outgoingLoop() {
+	defer close(e.msdus.Outgoing())
+	for frame := range e.outgoing {
+		source := frame.Source
+		if source == (frames.MAC{}) {
+			source = e.local
+		}
+		e.msdus.Outgoing() <- MSDU{
+			Remote:  frame.Destination,
+			DA:      frame.Destination,
+			SA:      source,
+			Payload: frames.EncodeLLCSNAP(frame.EtherType, frame.Payload),
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package filter
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/unixpickle/gofi"
+	"github.com/unixpickle/wifistack/frames"
+)
+
+var flagFields = map[string]func(f *frames.Frame) bool{
+	"tods":      func(f *frames.Frame) bool { return f.ToDS },
+	"fromds":    func(f *frames.Frame) bool { return f.FromDS },
+	"morefrag":  func(f *frames.Frame) bool { return f.MoreFrag },
+	"retry":     func(f *frames.Frame) bool { return f.Retry },
+	"pwrmgt":    func(f *frames.Frame) bool { return f.PowerManagement },
+	"moredata":  func(f *frames.Frame) bool { return f.MoreData },
+	"protected": func(f *frames.Frame) bool { return f.Encrypted },
+	"order":     func(f *frames.Frame) bool { return f.Order },
+}
+
+var elementNames = map[string]frames.ElementID{
+	"ssid":      frames.ElementIDSSID,
+	"rates":     frames.ElementIDSupportedRates,
+	"ds":        frames.ElementIDDSSSParameterSet,
+	"tim":       frames.ElementIDTIM,
+	"country":   frames.ElementIDCountry,
+	"erp":       frames.ElementIDERP,
+	"ht-cap":    frames.ElementIDHTCapabilities,
+	"ht-op":     frames.ElementIDHTOperation,
+	"rsn":       frames.ElementIDRSN,
+	"ext-rates": frames.ElementIDExtendedSupportedRates,
+	"vht-cap":   frames.ElementIDVHTCapabilities,
+	"vht-op":    frames.ElementIDVHTOperation,
+	"vendor":    frames.ElementIDVendorSpecific,
+}
+
+var typeNames = map[string]frames.FrameType{
+	"assoc-req":    frames.FrameTypeAssocRequest,
+	"assoc-resp":   frames.FrameTypeAssocResponse,
+	"reassoc-req":  frames.FrameTypeReassocRequest,
+	"reassoc-resp": frames.FrameTypeReassocResponse,
+	"probe-req":    frames.FrameTypeProbeRequest,
+	"probe-resp":   frames.FrameTypeProbeResponse,
+	"beacon":       frames.FrameTypeBeacon,
+	"atim":         frames.FrameTypeATIM,
+	"disassoc":     frames.FrameTypeDisassoc,
+	"auth":         frames.FrameTypeAuthentication,
+	"deauth":       frames.FrameTypeDeauthentication,
+	"action":       frames.FrameTypeAction,
+	"bar":          frames.FrameTypeBlockAckRequest,
+	"ba":           frames.FrameTypeBlockAck,
+	"ps-poll":      frames.FrameTypePSPoll,
+	"rts":          frames.FrameTypeRTS,
+	"cts":          frames.FrameTypeCTS,
+	"ack":          frames.FrameTypeACK,
+	"cf-end":       frames.FrameTypeCFEnd,
+	"data":         frames.FrameTypeData,
+	"null":         frames.FrameTypeNull,
+	"qos-data":     frames.FrameTypeQoSData,
+	"qos-null":     frames.FrameTypeQoSNull,
+}
+
+var majorTypeNames = map[string]int{
+	"mgmt": frames.FrameMajorTypeManagement,
+	"ctrl": frames.FrameMajorTypeControl,
+	"data": frames.FrameMajorTypeData,
+}
+
+// elementOffsets maps management frame types to the length of
+// the fixed fields which precede their elements.
+var elementOffsets = map[frames.FrameType]int{
+	frames.FrameTypeAssocRequest:    4,
+	frames.FrameTypeAssocResponse:   6,
+	frames.FrameTypeReassocRequest:  10,
+	frames.FrameTypeReassocResponse: 6,
+	frames.FrameTypeProbeRequest:    0,
+	frames.FrameTypeProbeResponse:   12,
+	frames.FrameTypeBeacon:          12,
+	frames.FrameTypeAuthentication:  6,
+}
+
+// frameElements returns the elements of a management frame,
+// or nil if the frame has no (valid) elements.
+func frameElements(f *frames.Frame) frames.Elements {
+	offset, ok := elementOffsets[f.Type]
+	if !ok || len(f.Payload) < offset {
+		return nil
+	}
+	res, err := frames.DecodeElements(f.Payload[offset:])
+	if err != nil {
+		return nil
+	}
+	return res
+}
+
+func compileComparison(field, op, value token) (Predicate, error) {
+	name := strings.ToLower(field.text)
+	switch name {
+	case "type":
+		return compileTypeComparison(op, value)
+	case "addr1", "addr2", "addr3", "addr4", "addr", "bssid":
+		return compileAddressComparison(name, op, value)
+	case "ssid":
+		if op.text != "==" && op.text != "!=" {
+			return nil, unsupportedOperator(op, field)
+		}
+		ssid := value.text
+		return func(f *frames.Frame, p gofi.RadioPacket) bool {
+			if f == nil {
+				return false
+			}
+			value := frameElements(f).Get(frames.ElementIDSSID)
+			if value == nil {
+				return false
+			}
+			return (string(value) == ssid) == (op.text == "==")
+		}, nil
+	}
+
+	getter, ok := numberFields[name]
+	if !ok {
+		return nil, &SyntaxError{Index: field.index, Message: "unknown field " +
+			strconv.Quote(field.text)}
+	}
+	num, err := strconv.Atoi(value.text)
+	if err != nil {
+		return nil, &SyntaxError{Index: value.index, Message: "expected number but got " +
+			strconv.Quote(value.text)}
+	}
+	compare, err := numberComparison(op)
+	if err != nil {
+		return nil, err
+	}
+	return func(f *frames.Frame, p gofi.RadioPacket) bool {
+		actual, ok := getter(f, p)
+		return ok && compare(actual, num)
+	}, nil
+}
+
+func compileTypeComparison(op, value token) (Predicate, error) {
+	if op.text != "==" && op.text != "!=" {
+		return nil, unsupportedOperator(op, token{text: "type"})
+	}
+	equal := op.text == "=="
+	name := strings.ToLower(value.text)
+
+	// "data" is both a major type and a frame type; it refers to
+	// the major type, since "qos-data" names the QoS subtype.
+	if major, ok := majorTypeNames[name]; ok {
+		return func(f *frames.Frame, p gofi.RadioPacket) bool {
+			return f != nil && (f.Type.Type() == major) == equal
+		}, nil
+	}
+	if t, ok := typeNames[name]; ok {
+		return func(f *frames.Frame, p gofi.RadioPacket) bool {
+			return f != nil && (f.Type == t) == equal
+		}, nil
+	}
+	return nil, &SyntaxError{Index: value.index, Message: "unknown frame type " +
+		strconv.Quote(value.text)}
+}
+
+func compileAddressComparison(name string, op, value token) (Predicate, error) {
+	if op.text != "==" && op.text != "!=" {
+		return nil, unsupportedOperator(op, token{text: name})
+	}
+	equal := op.text == "=="
+	mac, err := frames.ParseMAC(value.text)
+	if err != nil {
+		return nil, &SyntaxError{Index: value.index, Message: "invalid MAC address " +
+			strconv.Quote(value.text)}
+	}
+
+	switch name {
+	case "addr":
+		return func(f *frames.Frame, p gofi.RadioPacket) bool {
+			if f == nil {
+				return false
+			}
+			for _, a := range f.Addresses {
+				if a == mac {
+					return equal
+				}
+			}
+			return !equal
+		}, nil
+	case "bssid":
+		return func(f *frames.Frame, p gofi.RadioPacket) bool {
+			if f == nil || f.Type.Type() != frames.FrameMajorTypeManagement ||
+				len(f.Addresses) < 3 {
+				return false
+			}
+			return (f.Addresses[2] == mac) == equal
+		}, nil
+	default:
+		idx := int(name[len(name)-1] - '1')
+		return func(f *frames.Frame, p gofi.RadioPacket) bool {
+			if f == nil || idx >= len(f.Addresses) {
+				return false
+			}
+			return (f.Addresses[idx] == mac) == equal
+		}, nil
+	}
+}
+
+var numberFields = map[string]func(f *frames.Frame, p gofi.RadioPacket) (int, bool){
+	"subtype": func(f *frames.Frame, p gofi.RadioPacket) (int, bool) {
+		if f == nil {
+			return 0, false
+		}
+		return f.Type.Subtype(), true
+	},
+	"seq": func(f *frames.Frame, p gofi.RadioPacket) (int, bool) {
+		if f == nil || f.SequenceControl == nil {
+			return 0, false
+		}
+		return int(*f.SequenceControl >> 4), true
+	},
+	"rssi": func(f *frames.Frame, p gofi.RadioPacket) (int, bool) {
+		if p.RadioInfo == nil {
+			return 0, false
+		}
+		return p.SignalPower, true
+	},
+	"rate": func(f *frames.Frame, p gofi.RadioPacket) (int, bool) {
+		if p.RadioInfo == nil {
+			return 0, false
+		}
+		return int(p.Rate), true
+	},
+	"freq": func(f *frames.Frame, p gofi.RadioPacket) (int, bool) {
+		if p.RadioInfo == nil {
+			return 0, false
+		}
+		return p.Frequency, true
+	},
+}
+
+func numberComparison(op token) (func(a, b int) bool, error) {
+	switch op.text {
+	case "==":
+		return func(a, b int) bool { return a == b }, nil
+	case "!=":
+		return func(a, b int) bool { return a != b }, nil
+	case "<":
+		return func(a, b int) bool { return a < b }, nil
+	case "<=":
+		return func(a, b int) bool { return a <= b }, nil
+	case ">":
+		return func(a, b int) bool { return a > b }, nil
+	case ">=":
+		return func(a, b int) bool { return a >= b }, nil
+	}
+	return nil, &SyntaxError{Index: op.index, Message: "unknown operator " + op.text}
+}
+
+func unsupportedOperator(op, field token) error {
+	return &SyntaxError{Index: op.index, Message: "operator " + op.text +
+		" cannot be used with " + field.text}
+}
@@ -0,0 +1,93 @@
+// Package filter implements a small expression language for selecting
+// 802.11 frames.
+//
+// An expression is made up of comparisons joined by &&, ||, and !, with
+// parentheses for grouping. For example:
+//
+//	type == beacon && addr2 == 00:11:22:33:44:55 && rssi > -70
+//
+// The following fields may be compared with == and !=, and the numeric
+// ones may also be compared with <, <=, >, and >=:
+//
+//	type      the frame type, as a name (e.g. beacon, ack, qos-data)
+//	          or as a major type (mgmt, ctrl, data)
+//	subtype   the four-bit subtype number
+//	addr1-4   one of the frame's addresses
+//	addr      any of the frame's addresses
+//	bssid     the BSSID of a management frame
+//	ssid      the SSID of a beacon, probe, or association request
+//	seq       the sequence number
+//	rssi      the signal power in dBm
+//	rate      the data rate in units of 500Kb/s
+//	freq      the frequency in MHz
+//
+// The following flags may be used on their own:
+//
+//	tods, fromds, morefrag, retry, pwrmgt, moredata, protected, order
+//
+// Finally, has(element) checks if a management frame contains an
+// element, where element is either a number or one of the names
+// ssid, rates, ds, tim, country, erp, ht-cap, ht-op, rsn, ext-rates,
+// vht-cap, vht-op, or vendor.
+package filter
+
+import (
+	"strconv"
+
+	"github.com/unixpickle/gofi"
+	"github.com/unixpickle/wifistack/frames"
+)
+
+// A Predicate decides whether or not to accept a packet.
+// The frame argument is the decoded packet, or nil if the
+// packet could not be decoded.
+//
+// A Predicate can be used directly as the Filter of a
+// wifistack.SubscriberConfig.
+type Predicate func(f *frames.Frame, p gofi.RadioPacket) bool
+
+// A SyntaxError is returned when an expression cannot be compiled.
+type SyntaxError struct {
+	Index   int
+	Message string
+}
+
+// Error returns a description of the error and its location.
+func (s *SyntaxError) Error() string {
+	return "filter: " + s.Message + " at offset " + strconv.Itoa(s.Index)
+}
+
+// Compile compiles a filter expression into a Predicate.
+func Compile(expr string) (Predicate, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	res, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEnd {
+		return nil, p.unexpected()
+	}
+	return res, nil
+}
+
+// MustCompile is like Compile, but it panics if the expression is invalid.
+func MustCompile(expr string) Predicate {
+	res, err := Compile(expr)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// Match decodes a packet and checks if it matches the predicate.
+func (p Predicate) Match(packet gofi.RadioPacket) bool {
+	frame, err := frames.DecodeFrame(packet.Frame)
+	if err != nil {
+		frame = nil
+	}
+	return p(frame, packet)
+}
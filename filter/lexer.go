@@ -0,0 +1,88 @@
+package filter
+
+import (
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenOperator
+	tokenOpenParen
+	tokenCloseParen
+	tokenEnd
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	index int
+}
+
+// tokenize splits a filter expression into tokens.
+func tokenize(expr string) ([]token, error) {
+	var res []token
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			res = append(res, token{tokenOpenParen, "(", i})
+			i++
+		case c == ')':
+			res = append(res, token{tokenCloseParen, ")", i})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(expr) && expr[end] != '"' {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, &SyntaxError{Index: i, Message: "unterminated string"}
+			}
+			str, err := strconv.Unquote(expr[i : end+1])
+			if err != nil {
+				return nil, &SyntaxError{Index: i, Message: "invalid string"}
+			}
+			res = append(res, token{tokenString, str, i})
+			i = end + 1
+		case strings.ContainsRune("=!<>&|", rune(c)):
+			op := string(c)
+			if i+1 < len(expr) {
+				two := expr[i : i+2]
+				switch two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					op = two
+				}
+			}
+			if op == "=" || op == "&" || op == "|" {
+				return nil, &SyntaxError{Index: i, Message: "unknown operator " + op}
+			}
+			res = append(res, token{tokenOperator, op, i})
+			i += len(op)
+		case isWordChar(c):
+			end := i
+			for end < len(expr) && isWordChar(expr[end]) {
+				end++
+			}
+			res = append(res, token{tokenWord, expr[i:end], i})
+			i = end
+		default:
+			return nil, &SyntaxError{Index: i, Message: "unexpected character " + strconv.Quote(string(c))}
+		}
+	}
+	return append(res, token{tokenEnd, "", len(expr)}), nil
+}
+
+func isWordChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		c == '_' || c == '-' || c == ':' || c == '.'
+}
@@ -0,0 +1,191 @@
+package filter
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/unixpickle/gofi"
+	"github.com/unixpickle/wifistack/frames"
+)
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	res := p.tokens[p.pos]
+	if res.kind != tokenEnd {
+		p.pos++
+	}
+	return res
+}
+
+func (p *parser) unexpected() error {
+	t := p.peek()
+	if t.kind == tokenEnd {
+		return &SyntaxError{Index: t.index, Message: "unexpected end of expression"}
+	}
+	return &SyntaxError{Index: t.index, Message: "unexpected " + strconv.Quote(t.text)}
+}
+
+func (p *parser) isOperator(ops ...string) bool {
+	t := p.peek()
+	if t.kind == tokenOperator {
+		for _, op := range ops {
+			if t.text == op {
+				return true
+			}
+		}
+	} else if t.kind == tokenWord {
+		word := strings.ToLower(t.text)
+		for _, op := range ops {
+			if (op == "&&" && word == "and") || (op == "||" && word == "or") ||
+				(op == "!" && word == "not") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *parser) parseOr() (Predicate, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(f *frames.Frame, pk gofi.RadioPacket) bool {
+			return l(f, pk) || right(f, pk)
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Predicate, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(f *frames.Frame, pk gofi.RadioPacket) bool {
+			return l(f, pk) && right(f, pk)
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (Predicate, error) {
+	if p.isOperator("!") {
+		p.next()
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(f *frames.Frame, pk gofi.RadioPacket) bool {
+			return !inner(f, pk)
+		}, nil
+	}
+
+	t := p.peek()
+	switch t.kind {
+	case tokenOpenParen:
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != tokenCloseParen {
+			return nil, p.unexpected()
+		}
+		p.next()
+		return inner, nil
+	case tokenWord:
+		return p.parseTerm()
+	default:
+		return nil, p.unexpected()
+	}
+}
+
+// parseTerm parses a flag, a has() call, or a comparison.
+func (p *parser) parseTerm() (Predicate, error) {
+	nameToken := p.next()
+	name := strings.ToLower(nameToken.text)
+
+	if name == "has" {
+		return p.parseHas()
+	}
+
+	if flag, ok := flagFields[name]; ok {
+		return func(f *frames.Frame, pk gofi.RadioPacket) bool {
+			return f != nil && flag(f)
+		}, nil
+	}
+
+	if p.peek().kind != tokenOperator || p.isOperator("&&", "||", "!") {
+		return nil, &SyntaxError{Index: nameToken.index, Message: "unknown flag " +
+			strconv.Quote(nameToken.text)}
+	}
+	opToken := p.next()
+	valueToken := p.peek()
+	if valueToken.kind != tokenWord && valueToken.kind != tokenString {
+		return nil, p.unexpected()
+	}
+	p.next()
+
+	return compileComparison(nameToken, opToken, valueToken)
+}
+
+func (p *parser) parseHas() (Predicate, error) {
+	if p.peek().kind != tokenOpenParen {
+		return nil, p.unexpected()
+	}
+	p.next()
+	arg := p.peek()
+	if arg.kind != tokenWord {
+		return nil, p.unexpected()
+	}
+	p.next()
+	if p.peek().kind != tokenCloseParen {
+		return nil, p.unexpected()
+	}
+	p.next()
+
+	var id frames.ElementID
+	if named, ok := elementNames[strings.ToLower(arg.text)]; ok {
+		id = named
+	} else if num, err := strconv.Atoi(arg.text); err == nil && num >= 0 && num < 256 {
+		id = frames.ElementID(num)
+	} else {
+		return nil, &SyntaxError{Index: arg.index, Message: "unknown element " +
+			strconv.Quote(arg.text)}
+	}
+
+	return func(f *frames.Frame, pk gofi.RadioPacket) bool {
+		if f == nil {
+			return false
+		}
+		for _, e := range frameElements(f) {
+			if e.ID == id {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
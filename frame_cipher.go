@@ -0,0 +1,41 @@
+package wifistack
+
+import "github.com/unixpickle/wifistack/frames"
+
+// A FrameCipher protects the frames which carry MSDUs, such as the
+// data frames of an OpenMSDUStream.
+//
+// Each MPDU is protected separately, so fragments are encrypted after
+// an MSDU is fragmented and decrypted before it is reassembled.
+type FrameCipher interface {
+	// EncryptFrame replaces the payload of an outgoing frame with its
+	// protected form and sets the frame's Encrypted flag.
+	// The frame's header must not change afterwards, except for the
+	// Retry flag.
+	EncryptFrame(f *frames.Frame) error
+
+	// DecryptFrame replaces the payload of an incoming protected frame
+	// with its plaintext and clears the frame's Encrypted flag.
+	// It returns an error if the frame cannot be decrypted or fails its
+	// integrity check, in which case the frame should be dropped.
+	DecryptFrame(f *frames.Frame) error
+}
+
+// An MSDUCipher is a FrameCipher which also protects the integrity of
+// whole MSDUs, such as with the Michael MIC of TKIP.
+//
+// The addresses and priority of an MSDU are part of its protection, so
+// they are set on outgoing MSDUs before ProtectMSDU is called.
+type MSDUCipher interface {
+	FrameCipher
+
+	// ProtectMSDU adds integrity protection to the payload of an
+	// outgoing MSDU before it is fragmented.
+	// It returns an error if the MSDU should not be sent.
+	ProtectMSDU(m *MSDU) error
+
+	// VerifyMSDU checks and removes the integrity protection of an
+	// incoming MSDU once it has been reassembled.
+	// It returns an error if the MSDU should be dropped.
+	VerifyMSDU(m *MSDU) error
+}
@@ -0,0 +1,64 @@
+package frames
+
+import "bytes"
+
+// An ActionCategory identifies the category of an action frame.
+// These categories are defined in section 8.4.1.11 of the IEEE 802.11-2012 spec.
+type ActionCategory int
+
+const (
+	ActionCategorySpectrumManagement ActionCategory = 0
+	ActionCategoryQoS                               = 1
+	ActionCategoryDLS                               = 2
+	ActionCategoryBlockAck                          = 3
+	ActionCategoryPublic                            = 4
+	ActionCategoryRadioMeasurement                  = 5
+	ActionCategoryFastBSSTransition                 = 6
+	ActionCategoryHT                                = 7
+	ActionCategorySAQuery                           = 8
+	ActionCategoryWNM                               = 10
+	ActionCategoryWMM                               = 17
+	ActionCategoryVendorSpecific                    = 127
+)
+
+// An Action holds information about an action management frame.
+type Action struct {
+	Addresses []MAC
+
+	Category ActionCategory
+	Action   int
+
+	// Body contains the category-specific fields which follow
+	// the category and action fields.
+	Body []byte
+}
+
+// DecodeAction extracts action information from a Frame.
+func DecodeAction(f *Frame) (*Action, error) {
+	if len(f.Payload) < 2 {
+		return nil, ErrBufferUnderflow
+	}
+	return &Action{
+		Addresses: f.Addresses,
+		Category:  ActionCategory(f.Payload[0]),
+		Action:    int(f.Payload[1]),
+		Body:      f.Payload[2:],
+	}, nil
+}
+
+// EncodeToFrame generates an 802.11 frame which represents this action.
+func (a *Action) EncodeToFrame() *Frame {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(a.Category))
+	buf.WriteByte(byte(a.Action))
+	buf.Write(a.Body)
+
+	var seqControl uint16
+	return &Frame{
+		Version:         0,
+		Type:            FrameTypeAction,
+		SequenceControl: &seqControl,
+		Addresses:       a.Addresses,
+		Payload:         buf.Bytes(),
+	}
+}
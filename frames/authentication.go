@@ -5,6 +5,13 @@ import (
 	"encoding/binary"
 )
 
+// These are the authentication algorithm numbers from section 8.4.1.1
+// of the IEEE 802.11-2012 spec.
+const (
+	AuthAlgorithmOpen      = 0
+	AuthAlgorithmSharedKey = 1
+)
+
 // Authentication frames are used at the beginning of a new client-router connection.
 type Authentication struct {
 	Addresses []MAC
@@ -26,6 +33,14 @@ func NewAuthenticationOpen(bssid, client MAC) *Authentication {
 	}
 }
 
+// NewAuthenticationSharedKey generates an initial authentication frame
+// for a WEP network which uses shared key authentication.
+func NewAuthenticationSharedKey(bssid, client MAC) *Authentication {
+	res := NewAuthenticationOpen(bssid, client)
+	res.Algorithm = AuthAlgorithmSharedKey
+	return res
+}
+
 // DecodeAuthentication decodes an authentication frame.
 func DecodeAuthentication(f *Frame) (auth *Authentication, err error) {
 	if len(f.Payload) < 6 {
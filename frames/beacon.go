@@ -58,6 +58,7 @@ func (f *Beacon) BSSDescription() BSSDescription {
 		BSSID:   f.BSSID,
 		SSID:    f.SSID(),
 		Channel: f.Channel(),
+		WPA:     DecodeWPAElement(f.Elements),
 	}
 
 	// NOTE: see section 8.4.1.4 of the IEEE 802.11-2012 spec.
@@ -0,0 +1,343 @@
+package frames
+
+import "encoding/binary"
+
+// These are the block ack action codes defined in section 8.5.5.1
+// of the IEEE 802.11-2012 spec.
+const (
+	BlockAckActionADDBARequest  = 0
+	BlockAckActionADDBAResponse = 1
+	BlockAckActionDELBA         = 2
+)
+
+// BlockAckParams represents a Block Ack Parameter Set field, as described
+// in section 8.4.1.14 of the IEEE 802.11-2012 spec.
+type BlockAckParams struct {
+	AMSDUSupported bool
+
+	// Immediate is true for the immediate block ack policy and false
+	// for the delayed block ack policy.
+	Immediate bool
+
+	TID        int
+	BufferSize int
+}
+
+func decodeBlockAckParams(n uint16) BlockAckParams {
+	return BlockAckParams{
+		AMSDUSupported: (n & 1) != 0,
+		Immediate:      (n & 2) != 0,
+		TID:            int(n>>2) & 0xf,
+		BufferSize:     int(n >> 6),
+	}
+}
+
+func (b BlockAckParams) encode() uint16 {
+	var res uint16
+	if b.AMSDUSupported {
+		res |= 1
+	}
+	if b.Immediate {
+		res |= 2
+	}
+	res |= uint16(b.TID&0xf) << 2
+	res |= uint16(b.BufferSize&0x3ff) << 6
+	return res
+}
+
+// An ADDBARequest holds information about an ADDBA Request action frame.
+type ADDBARequest struct {
+	Addresses []MAC
+
+	DialogToken byte
+	Params      BlockAckParams
+
+	// Timeout is the block ack timeout in TUs, or 0 if there is none.
+	Timeout uint16
+
+	// StartingSequence is the sequence number of the first MSDU
+	// covered by the agreement.
+	StartingSequence int
+}
+
+// DecodeADDBARequest extracts ADDBA request information from a Frame.
+func DecodeADDBARequest(f *Frame) (*ADDBARequest, error) {
+	action, err := decodeBlockAckAction(f, BlockAckActionADDBARequest)
+	if err != nil {
+		return nil, err
+	}
+	if len(action.Body) < 7 {
+		return nil, ErrBufferUnderflow
+	}
+	return &ADDBARequest{
+		Addresses:        f.Addresses,
+		DialogToken:      action.Body[0],
+		Params:           decodeBlockAckParams(binary.LittleEndian.Uint16(action.Body[1:])),
+		Timeout:          binary.LittleEndian.Uint16(action.Body[3:]),
+		StartingSequence: int(binary.LittleEndian.Uint16(action.Body[5:]) >> 4),
+	}, nil
+}
+
+// EncodeToFrame generates an 802.11 frame which represents this ADDBA request.
+func (a *ADDBARequest) EncodeToFrame() *Frame {
+	body := make([]byte, 7)
+	body[0] = a.DialogToken
+	binary.LittleEndian.PutUint16(body[1:], a.Params.encode())
+	binary.LittleEndian.PutUint16(body[3:], a.Timeout)
+	binary.LittleEndian.PutUint16(body[5:], uint16(a.StartingSequence<<4))
+	action := &Action{
+		Addresses: a.Addresses,
+		Category:  ActionCategoryBlockAck,
+		Action:    BlockAckActionADDBARequest,
+		Body:      body,
+	}
+	return action.EncodeToFrame()
+}
+
+// An ADDBAResponse holds information about an ADDBA Response action frame.
+type ADDBAResponse struct {
+	Addresses []MAC
+
+	DialogToken byte
+	StatusCode  uint16
+	Params      BlockAckParams
+	Timeout     uint16
+}
+
+// DecodeADDBAResponse extracts ADDBA response information from a Frame.
+func DecodeADDBAResponse(f *Frame) (*ADDBAResponse, error) {
+	action, err := decodeBlockAckAction(f, BlockAckActionADDBAResponse)
+	if err != nil {
+		return nil, err
+	}
+	if len(action.Body) < 7 {
+		return nil, ErrBufferUnderflow
+	}
+	return &ADDBAResponse{
+		Addresses:   f.Addresses,
+		DialogToken: action.Body[0],
+		StatusCode:  binary.LittleEndian.Uint16(action.Body[1:]),
+		Params:      decodeBlockAckParams(binary.LittleEndian.Uint16(action.Body[3:])),
+		Timeout:     binary.LittleEndian.Uint16(action.Body[5:]),
+	}, nil
+}
+
+// EncodeToFrame generates an 802.11 frame which represents this ADDBA response.
+func (a *ADDBAResponse) EncodeToFrame() *Frame {
+	body := make([]byte, 7)
+	body[0] = a.DialogToken
+	binary.LittleEndian.PutUint16(body[1:], a.StatusCode)
+	binary.LittleEndian.PutUint16(body[3:], a.Params.encode())
+	binary.LittleEndian.PutUint16(body[5:], a.Timeout)
+	action := &Action{
+		Addresses: a.Addresses,
+		Category:  ActionCategoryBlockAck,
+		Action:    BlockAckActionADDBAResponse,
+		Body:      body,
+	}
+	return action.EncodeToFrame()
+}
+
+// Success returns true if the ADDBA response accepts the agreement.
+func (a *ADDBAResponse) Success() bool {
+	return a.StatusCode == 0
+}
+
+// A DELBA holds information about a DELBA action frame, which tears
+// down a block ack agreement.
+type DELBA struct {
+	Addresses []MAC
+
+	// Initiator is true if the sender of the DELBA is the originator
+	// of the block ack agreement.
+	Initiator bool
+
+	TID        int
+	ReasonCode uint16
+}
+
+// DecodeDELBA extracts DELBA information from a Frame.
+func DecodeDELBA(f *Frame) (*DELBA, error) {
+	action, err := decodeBlockAckAction(f, BlockAckActionDELBA)
+	if err != nil {
+		return nil, err
+	}
+	if len(action.Body) < 4 {
+		return nil, ErrBufferUnderflow
+	}
+	params := binary.LittleEndian.Uint16(action.Body)
+	return &DELBA{
+		Addresses:  f.Addresses,
+		Initiator:  (params & (1 << 11)) != 0,
+		TID:        int(params >> 12),
+		ReasonCode: binary.LittleEndian.Uint16(action.Body[2:]),
+	}, nil
+}
+
+// EncodeToFrame generates an 802.11 frame which represents this DELBA.
+func (d *DELBA) EncodeToFrame() *Frame {
+	params := uint16(d.TID&0xf) << 12
+	if d.Initiator {
+		params |= 1 << 11
+	}
+	body := make([]byte, 4)
+	binary.LittleEndian.PutUint16(body, params)
+	binary.LittleEndian.PutUint16(body[2:], d.ReasonCode)
+	action := &Action{
+		Addresses: d.Addresses,
+		Category:  ActionCategoryBlockAck,
+		Action:    BlockAckActionDELBA,
+		Body:      body,
+	}
+	return action.EncodeToFrame()
+}
+
+func decodeBlockAckAction(f *Frame, actionCode int) (*Action, error) {
+	action, err := DecodeAction(f)
+	if err != nil {
+		return nil, err
+	}
+	if action.Category != ActionCategoryBlockAck || action.Action != actionCode {
+		return nil, ErrUnexpectedAction
+	}
+	return action, nil
+}
+
+// BlockAckControl represents the BAR Control and BA Control fields
+// from sections 8.3.1.8 and 8.3.1.9 of the IEEE 802.11-2012 spec.
+// Only the basic and compressed variants are supported.
+type BlockAckControl struct {
+	// NoAck is the BAR/BA Ack Policy bit.
+	NoAck bool
+
+	Compressed bool
+	TID        int
+}
+
+func decodeBlockAckControl(n uint16) BlockAckControl {
+	return BlockAckControl{
+		NoAck:      (n & 1) != 0,
+		Compressed: (n & 4) != 0,
+		TID:        int(n >> 12),
+	}
+}
+
+func (b BlockAckControl) encode() uint16 {
+	res := uint16(b.TID&0xf) << 12
+	if b.NoAck {
+		res |= 1
+	}
+	if b.Compressed {
+		res |= 4
+	}
+	return res
+}
+
+// A BlockAckRequest holds information about a Block Ack Request control frame.
+type BlockAckRequest struct {
+	Receiver    MAC
+	Transmitter MAC
+
+	Control          BlockAckControl
+	StartingSequence int
+}
+
+// DecodeBlockAckRequest extracts block ack request information from a Frame.
+func DecodeBlockAckRequest(f *Frame) (*BlockAckRequest, error) {
+	if len(f.Payload) < 4 {
+		return nil, ErrBufferUnderflow
+	}
+	control := decodeBlockAckControl(binary.LittleEndian.Uint16(f.Payload))
+	if (binary.LittleEndian.Uint16(f.Payload) & 2) != 0 {
+		return nil, ErrUnsupportedBlockAck
+	}
+	return &BlockAckRequest{
+		Receiver:         f.Addresses[0],
+		Transmitter:      f.Addresses[1],
+		Control:          control,
+		StartingSequence: int(binary.LittleEndian.Uint16(f.Payload[2:]) >> 4),
+	}, nil
+}
+
+// EncodeToFrame generates an 802.11 frame which represents this block ack request.
+func (b *BlockAckRequest) EncodeToFrame() *Frame {
+	payload := make([]byte, 4)
+	binary.LittleEndian.PutUint16(payload, b.Control.encode())
+	binary.LittleEndian.PutUint16(payload[2:], uint16(b.StartingSequence<<4))
+	return &Frame{
+		Version:   0,
+		Type:      FrameTypeBlockAckRequest,
+		Addresses: []MAC{b.Receiver, b.Transmitter},
+		Payload:   payload,
+	}
+}
+
+// A BlockAck holds information about a Block Ack control frame.
+type BlockAck struct {
+	Receiver    MAC
+	Transmitter MAC
+
+	Control          BlockAckControl
+	StartingSequence int
+
+	// Bitmap indicates which MSDUs have been received.
+	// Bit i of a compressed bitmap corresponds to the MSDU with sequence
+	// number StartingSequence+i.
+	// A basic bitmap is 128 bytes, with two bytes per MSDU (one bit per fragment).
+	Bitmap []byte
+}
+
+// DecodeBlockAck extracts block ack information from a Frame.
+func DecodeBlockAck(f *Frame) (*BlockAck, error) {
+	if len(f.Payload) < 4 {
+		return nil, ErrBufferUnderflow
+	}
+	control := decodeBlockAckControl(binary.LittleEndian.Uint16(f.Payload))
+	if (binary.LittleEndian.Uint16(f.Payload) & 2) != 0 {
+		return nil, ErrUnsupportedBlockAck
+	}
+	bitmapSize := 128
+	if control.Compressed {
+		bitmapSize = 8
+	}
+	if len(f.Payload) < 4+bitmapSize {
+		return nil, ErrBufferUnderflow
+	}
+	return &BlockAck{
+		Receiver:         f.Addresses[0],
+		Transmitter:      f.Addresses[1],
+		Control:          control,
+		StartingSequence: int(binary.LittleEndian.Uint16(f.Payload[2:]) >> 4),
+		Bitmap:           f.Payload[4 : 4+bitmapSize],
+	}, nil
+}
+
+// EncodeToFrame generates an 802.11 frame which represents this block ack.
+func (b *BlockAck) EncodeToFrame() *Frame {
+	payload := make([]byte, 4+len(b.Bitmap))
+	binary.LittleEndian.PutUint16(payload, b.Control.encode())
+	binary.LittleEndian.PutUint16(payload[2:], uint16(b.StartingSequence<<4))
+	copy(payload[4:], b.Bitmap)
+	return &Frame{
+		Version:   0,
+		Type:      FrameTypeBlockAck,
+		Addresses: []MAC{b.Receiver, b.Transmitter},
+		Payload:   payload,
+	}
+}
+
+// Acknowledged returns whether or not the block ack acknowledges
+// the MSDU with the given sequence number.
+func (b *BlockAck) Acknowledged(seq int) bool {
+	offset := (seq - b.StartingSequence) & 0xfff
+	if b.Control.Compressed {
+		if offset >= 64 {
+			return false
+		}
+		return (b.Bitmap[offset/8] & (1 << uint(offset%8))) != 0
+	}
+	if offset >= 64 {
+		return false
+	}
+	return binary.LittleEndian.Uint16(b.Bitmap[offset*2:]) != 0
+}
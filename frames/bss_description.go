@@ -18,4 +18,8 @@ type BSSDescription struct {
 	OperationalRates []byte
 
 	Channel int
+
+	// WPA is the WPA element from the beacon, or nil if the network
+	// does not advertise WPA.
+	WPA *WPAElement
 }
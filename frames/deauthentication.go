@@ -0,0 +1,61 @@
+package frames
+
+import "encoding/binary"
+
+// A Deauthentication holds information about a deauthentication frame.
+type Deauthentication struct {
+	Addresses  []MAC
+	ReasonCode uint16
+}
+
+// DecodeDeauthentication extracts deauthentication information from a Frame.
+func DecodeDeauthentication(f *Frame) (*Deauthentication, error) {
+	if len(f.Payload) < 2 {
+		return nil, ErrBufferUnderflow
+	}
+	return &Deauthentication{
+		Addresses:  f.Addresses,
+		ReasonCode: binary.LittleEndian.Uint16(f.Payload),
+	}, nil
+}
+
+// EncodeToFrame generates an 802.11 frame which represents this deauthentication.
+func (d *Deauthentication) EncodeToFrame() *Frame {
+	return encodeReasonFrame(FrameTypeDeauthentication, d.Addresses, d.ReasonCode)
+}
+
+// A Disassociation holds information about a disassociation frame.
+type Disassociation struct {
+	Addresses  []MAC
+	ReasonCode uint16
+}
+
+// DecodeDisassociation extracts disassociation information from a Frame.
+func DecodeDisassociation(f *Frame) (*Disassociation, error) {
+	if len(f.Payload) < 2 {
+		return nil, ErrBufferUnderflow
+	}
+	return &Disassociation{
+		Addresses:  f.Addresses,
+		ReasonCode: binary.LittleEndian.Uint16(f.Payload),
+	}, nil
+}
+
+// EncodeToFrame generates an 802.11 frame which represents this disassociation.
+func (d *Disassociation) EncodeToFrame() *Frame {
+	return encodeReasonFrame(FrameTypeDisassoc, d.Addresses, d.ReasonCode)
+}
+
+func encodeReasonFrame(t FrameType, addrs []MAC, reason uint16) *Frame {
+	payload := make([]byte, 2)
+	binary.LittleEndian.PutUint16(payload, reason)
+
+	var seqControl uint16
+	return &Frame{
+		Version:         0,
+		Type:            t,
+		SequenceControl: &seqControl,
+		Addresses:       addrs,
+		Payload:         payload,
+	}
+}
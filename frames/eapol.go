@@ -0,0 +1,85 @@
+package frames
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+)
+
+const (
+	eapolVersion         = 1
+	eapolTypeKey         = 3
+	eapolHeaderSize      = 4
+	eapolKeyBodySize     = 95
+	eapolKeyNonceSize    = 32
+	eapolKeyIVSize       = 16
+	eapolKeyMICSize      = 16
+	eapolKeyReservedSize = 8
+)
+
+// EAPOLKeyDescriptorWPA is the descriptor type of EAPOL-Key frames on
+// WPA (version 1) networks.
+const EAPOLKeyDescriptorWPA = 254
+
+// These are the bits of the Key Information field of an EAPOL-Key
+// frame, as described in section 11.6.2 of the IEEE 802.11-2012 spec.
+const (
+	KeyInfoVersionHMACMD5 = 1
+	KeyInfoPairwise       = 0x0008
+	KeyInfoInstall        = 0x0040
+	KeyInfoAck            = 0x0080
+	KeyInfoMIC            = 0x0100
+	KeyInfoSecure         = 0x0200
+	KeyInfoError          = 0x0400
+	KeyInfoRequest        = 0x0800
+)
+
+// An EAPOLKey is an EAPOL-Key frame, which carries the key exchanges
+// of WPA networks.
+type EAPOLKey struct {
+	DescriptorType int
+	KeyInfo        uint16
+	KeyLength      int
+	ReplayCounter  uint64
+	Nonce          [eapolKeyNonceSize]byte
+	IV             [eapolKeyIVSize]byte
+
+	// RSC is the receive sequence counter, such as a TKIP TSC.
+	RSC uint64
+
+	MIC  [eapolKeyMICSize]byte
+	Data []byte
+}
+
+// Encode encodes the frame with its 802.1X header, so that the result
+// is the payload of an MSDU with the EtherType EtherTypeEAPOL.
+func (k *EAPOLKey) Encode() []byte {
+	res := make([]byte, 0, eapolHeaderSize+eapolKeyBodySize+len(k.Data))
+	res = append(res, eapolVersion, eapolTypeKey)
+	res = binary.BigEndian.AppendUint16(res, uint16(eapolKeyBodySize+len(k.Data)))
+	res = append(res, byte(k.DescriptorType))
+	res = binary.BigEndian.AppendUint16(res, k.KeyInfo)
+	res = binary.BigEndian.AppendUint16(res, uint16(k.KeyLength))
+	res = binary.BigEndian.AppendUint64(res, k.ReplayCounter)
+	res = append(res, k.Nonce[:]...)
+	res = append(res, k.IV[:]...)
+
+	// NOTE: the RSC is stored with its least significant octet first.
+	res = binary.LittleEndian.AppendUint64(res, k.RSC)
+
+	res = append(res, make([]byte, eapolKeyReservedSize)...)
+	res = append(res, k.MIC[:]...)
+	res = binary.BigEndian.AppendUint16(res, uint16(len(k.Data)))
+	return append(res, k.Data...)
+}
+
+// SetMIC computes the MIC of the frame with a key confirmation key,
+// using HMAC-MD5 as required by KeyInfoVersionHMACMD5, and sets the
+// KeyInfoMIC bit.
+func (k *EAPOLKey) SetMIC(kck []byte) {
+	k.KeyInfo |= KeyInfoMIC
+	k.MIC = [eapolKeyMICSize]byte{}
+	mac := hmac.New(md5.New, kck)
+	mac.Write(k.Encode())
+	copy(k.MIC[:], mac.Sum(nil))
+}
@@ -122,6 +122,8 @@ const (
 	ElementIDDestinationURI                              = 141
 	ElementIDUAPSDCoexistence                            = 142
 	ElementIDMCCAOPAdvertisementOverview                 = 174
+	ElementIDVHTCapabilities                             = 191
+	ElementIDVHTOperation                                = 192
 	ElementIDVendorSpecific                              = 221
 )
 
@@ -241,6 +243,8 @@ var elementIDNames = map[ElementID]string{
 	ElementIDDestinationURI:                    "Destination URI",
 	ElementIDUAPSDCoexistence:                  "U-APSD Coexistence",
 	ElementIDMCCAOPAdvertisementOverview:       "MCCAOP Advertisement Overview",
+	ElementIDVHTCapabilities:                   "VHT Capabilities",
+	ElementIDVHTOperation:                      "VHT Operation",
 	ElementIDVendorSpecific:                    "Vendor Specific",
 }
 
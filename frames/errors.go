@@ -9,4 +9,8 @@ var (
 	ErrInvalidMAC          = errors.New("invalid MAC")
 	ErrUnknownFrameType    = errors.New("unknown frame type")
 	ErrUnknownFrameVersion = errors.New("unknown frame version")
+	ErrUnexpectedAction    = errors.New("unexpected action")
+	ErrUnsupportedBlockAck = errors.New("unsupported block ack variant")
+	ErrNotSNAP             = errors.New("not an LLC/SNAP encapsulated MSDU")
+	ErrNotEthernetII       = errors.New("not an Ethernet II frame")
 )
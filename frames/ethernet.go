@@ -0,0 +1,51 @@
+package frames
+
+import "encoding/binary"
+
+const ethernetHeaderSize = 14
+
+// These are common EtherTypes.
+const (
+	EtherTypeIPv4  = 0x0800
+	EtherTypeARP   = 0x0806
+	EtherTypeIPv6  = 0x86dd
+	EtherTypeEAPOL = 0x888e
+)
+
+// An EthernetFrame is an Ethernet II frame, without a checksum.
+type EthernetFrame struct {
+	Destination MAC
+	Source      MAC
+	EtherType   int
+	Payload     []byte
+}
+
+// DecodeEthernetFrame decodes an Ethernet II frame.
+// The data should not include a checksum.
+func DecodeEthernetFrame(data []byte) (*EthernetFrame, error) {
+	if len(data) < ethernetHeaderSize {
+		return nil, ErrBufferUnderflow
+	}
+	var res EthernetFrame
+	copy(res.Destination[:], data[0:6])
+	copy(res.Source[:], data[6:12])
+	res.EtherType = int(binary.BigEndian.Uint16(data[12:14]))
+
+	// NOTE: values below 0x600 are 802.3 lengths rather than EtherTypes.
+	if res.EtherType < 0x600 {
+		return nil, ErrNotEthernetII
+	}
+
+	res.Payload = data[ethernetHeaderSize:]
+	return &res, nil
+}
+
+// Encode encodes the frame as binary data.
+func (e *EthernetFrame) Encode() []byte {
+	res := make([]byte, ethernetHeaderSize+len(e.Payload))
+	copy(res[0:6], e.Destination[:])
+	copy(res[6:12], e.Source[:])
+	binary.BigEndian.PutUint16(res[12:14], uint16(e.EtherType))
+	copy(res[ethernetHeaderSize:], e.Payload)
+	return res
+}
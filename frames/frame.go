@@ -260,7 +260,7 @@ func (f *Frame) Encode() []byte {
 	buf.WriteByte(flagByte)
 
 	numBuf := make([]byte, 2)
-	binary.BigEndian.PutUint16(numBuf, f.DurationID)
+	binary.LittleEndian.PutUint16(numBuf, f.DurationID)
 	buf.Write(numBuf)
 
 	for i := 0; i < 3 && i < len(f.Addresses); i++ {
@@ -268,7 +268,7 @@ func (f *Frame) Encode() []byte {
 	}
 
 	if f.SequenceControl != nil {
-		binary.BigEndian.PutUint16(numBuf, *f.SequenceControl)
+		binary.LittleEndian.PutUint16(numBuf, *f.SequenceControl)
 		buf.Write(numBuf)
 	}
 
@@ -277,18 +277,18 @@ func (f *Frame) Encode() []byte {
 	}
 
 	if f.CarriedFrameControl != nil {
-		binary.BigEndian.PutUint16(numBuf, *f.CarriedFrameControl)
+		binary.LittleEndian.PutUint16(numBuf, *f.CarriedFrameControl)
 		buf.Write(numBuf)
 	}
 
 	if f.QoSControl != nil {
-		binary.BigEndian.PutUint16(numBuf, *f.QoSControl)
+		binary.LittleEndian.PutUint16(numBuf, *f.QoSControl)
 		buf.Write(numBuf)
 	}
 
 	if f.HTControlField != nil {
 		bigNumBuf := make([]byte, 4)
-		binary.BigEndian.PutUint32(bigNumBuf, *f.HTControlField)
+		binary.LittleEndian.PutUint32(bigNumBuf, *f.HTControlField)
 		buf.Write(bigNumBuf)
 	}
 
@@ -0,0 +1,68 @@
+package frames
+
+import "encoding/binary"
+
+// HTOperation stores the contents of an HT Operation element,
+// as described in section 8.4.2.59 of the IEEE 802.11-2012 spec.
+type HTOperation struct {
+	PrimaryChannel int
+
+	// SecondaryChannelOffset is 0 for no secondary channel, 1 if the secondary
+	// channel is above the primary channel, and 3 if it is below.
+	SecondaryChannelOffset int
+
+	// AnyChannelWidth is true if the AP allows 40MHz transmissions.
+	AnyChannelWidth bool
+
+	// HTProtection is the 2-bit HT protection mode.
+	HTProtection int
+
+	NonGreenfieldPresent bool
+
+	// BasicMCSSet is the 16-byte bitmap of MCS values which every
+	// HT station in the BSS must support.
+	BasicMCSSet []byte
+}
+
+// DecodeHTOperation decodes the value of an HT Operation element.
+func DecodeHTOperation(value []byte) (*HTOperation, error) {
+	if len(value) < 22 {
+		return nil, ErrBufferUnderflow
+	}
+	return &HTOperation{
+		PrimaryChannel:         int(value[0]),
+		SecondaryChannelOffset: int(value[1] & 3),
+		AnyChannelWidth:        (value[1] & 4) != 0,
+		HTProtection:           int(value[2] & 3),
+		NonGreenfieldPresent:   (value[2] & 4) != 0,
+		BasicMCSSet:            value[6:22],
+	}, nil
+}
+
+// VHTOperation stores the contents of a VHT Operation element,
+// as described in section 8.4.2.161 of the IEEE 802.11ac-2013 spec.
+type VHTOperation struct {
+	// ChannelWidth is 0 for 20/40MHz, 1 for 80MHz, 2 for 160MHz,
+	// and 3 for 80+80MHz.
+	ChannelWidth int
+
+	CenterFrequencySegment0 int
+	CenterFrequencySegment1 int
+
+	// BasicMCSNSSSet encodes the maximum VHT-MCS for each number of
+	// spatial streams which every VHT station must support.
+	BasicMCSNSSSet uint16
+}
+
+// DecodeVHTOperation decodes the value of a VHT Operation element.
+func DecodeVHTOperation(value []byte) (*VHTOperation, error) {
+	if len(value) < 5 {
+		return nil, ErrBufferUnderflow
+	}
+	return &VHTOperation{
+		ChannelWidth:            int(value[0]),
+		CenterFrequencySegment0: int(value[1]),
+		CenterFrequencySegment1: int(value[2]),
+		BasicMCSNSSSet:          binary.LittleEndian.Uint16(value[3:]),
+	}, nil
+}
@@ -0,0 +1,63 @@
+package frames
+
+import "encoding/binary"
+
+// These EtherTypes are encapsulated with the bridge tunnel OUI
+// rather than the RFC 1042 OUI, as described in IEEE 802.1H.
+const (
+	EtherTypeAppleTalkARP = 0x80f3
+	EtherTypeIPX          = 0x8137
+)
+
+// These are the organizationally unique identifiers used in the
+// SNAP headers of MSDUs which carry Ethernet II payloads.
+var (
+	OUIRFC1042      = [3]byte{0, 0, 0}
+	OUIBridgeTunnel = [3]byte{0, 0, 0xf8}
+)
+
+const (
+	llcSAPSNAP   = 0xaa
+	llcControlUI = 0x03
+	llcSNAPSize  = 8
+)
+
+// EncodeLLCSNAP wraps a payload with an 802.2 LLC/SNAP header
+// for the given EtherType.
+//
+// The bridge tunnel OUI is used for AppleTalk ARP and IPX, and the
+// RFC 1042 OUI is used for everything else.
+func EncodeLLCSNAP(etherType int, payload []byte) []byte {
+	res := make([]byte, llcSNAPSize+len(payload))
+	res[0] = llcSAPSNAP
+	res[1] = llcSAPSNAP
+	res[2] = llcControlUI
+	if etherType == EtherTypeAppleTalkARP || etherType == EtherTypeIPX {
+		copy(res[3:6], OUIBridgeTunnel[:])
+	} else {
+		copy(res[3:6], OUIRFC1042[:])
+	}
+	binary.BigEndian.PutUint16(res[6:8], uint16(etherType))
+	copy(res[llcSNAPSize:], payload)
+	return res
+}
+
+// DecodeLLCSNAP extracts the EtherType and payload from an MSDU
+// with an 802.2 LLC/SNAP header.
+//
+// Only the RFC 1042 and bridge tunnel encapsulations are supported.
+func DecodeLLCSNAP(data []byte) (etherType int, payload []byte, err error) {
+	if len(data) < llcSNAPSize {
+		return 0, nil, ErrBufferUnderflow
+	}
+	if data[0] != llcSAPSNAP || data[1] != llcSAPSNAP || data[2] != llcControlUI {
+		return 0, nil, ErrNotSNAP
+	}
+	var oui [3]byte
+	copy(oui[:], data[3:6])
+	if oui != OUIRFC1042 && oui != OUIBridgeTunnel {
+		return 0, nil, ErrNotSNAP
+	}
+	etherType = int(binary.BigEndian.Uint16(data[6:8]))
+	return etherType, data[llcSNAPSize:], nil
+}
@@ -0,0 +1,69 @@
+package frames
+
+// A TIM stores the contents of a traffic indication map element,
+// as described in section 8.4.2.7 of the IEEE 802.11-2012 spec.
+type TIM struct {
+	DTIMCount     int
+	DTIMPeriod    int
+	BitmapControl byte
+
+	PartialVirtualBitmap []byte
+}
+
+// DecodeTIM decodes the value of a TIM element.
+func DecodeTIM(value []byte) (*TIM, error) {
+	if len(value) < 4 {
+		return nil, ErrBufferUnderflow
+	}
+	return &TIM{
+		DTIMCount:            int(value[0]),
+		DTIMPeriod:           int(value[1]),
+		BitmapControl:        value[2],
+		PartialVirtualBitmap: value[3:],
+	}, nil
+}
+
+// Encode generates the value of a TIM element.
+func (t *TIM) Encode() []byte {
+	res := []byte{byte(t.DTIMCount), byte(t.DTIMPeriod), t.BitmapControl}
+	if len(t.PartialVirtualBitmap) == 0 {
+		return append(res, 0)
+	}
+	return append(res, t.PartialVirtualBitmap...)
+}
+
+// DTIM returns true if the beacon carrying this TIM is a DTIM beacon.
+func (t *TIM) DTIM() bool {
+	return t.DTIMCount == 0
+}
+
+// GroupTraffic returns true if group addressed frames are buffered at the AP.
+// This is only meaningful for DTIM beacons.
+func (t *TIM) GroupTraffic() bool {
+	return (t.BitmapControl & 1) != 0
+}
+
+// HasTraffic returns true if the AP has buffered frames for the station with
+// the given association ID.
+func (t *TIM) HasTraffic(aid uint16) bool {
+	aid &= 0x3fff
+	offset := int(t.BitmapControl & 0xfe)
+	idx := int(aid/8) - offset
+	if idx < 0 || idx >= len(t.PartialVirtualBitmap) {
+		return false
+	}
+	return (t.PartialVirtualBitmap[idx] & (1 << (aid % 8))) != 0
+}
+
+// NewPSPoll generates a PS-Poll frame which asks an AP for one buffered frame.
+func NewPSPoll(bssid, client MAC, aid uint16) *Frame {
+	// NOTE: the two most significant bits of the AID are set in the
+	// DurationID field, as per section 8.2.4.2 of the IEEE 802.11-2012 spec.
+	return &Frame{
+		Version:         0,
+		Type:            FrameTypePSPoll,
+		PowerManagement: true,
+		DurationID:      aid | 0xc000,
+		Addresses:       []MAC{bssid, client},
+	}
+}
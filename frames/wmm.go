@@ -0,0 +1,106 @@
+package frames
+
+import "encoding/binary"
+
+// wmmOUI is the Microsoft OUI used by vendor specific WMM and WPA
+// elements.
+var wmmOUI = []byte{0x00, 0x50, 0xf2}
+
+const (
+	wmmOUIType            = 2
+	wmmSubtypeInformation = 0
+	wmmSubtypeParameter   = 1
+	wmmVersion            = 1
+)
+
+// These are the U-APSD flags from the QoS Info field of a station's
+// WMM information element.
+const (
+	WMMQoSInfoUAPSDVoice      = 1
+	WMMQoSInfoUAPSDVideo      = 2
+	WMMQoSInfoUAPSDBackground = 4
+	WMMQoSInfoUAPSDBestEffort = 8
+	WMMQoSInfoUAPSDAll        = 0xf
+)
+
+// NewWMMInformationElement generates a WMM information element which
+// a station includes in an association request.
+func NewWMMInformationElement(qosInfo byte) Element {
+	value := append([]byte{}, wmmOUI...)
+	value = append(value, wmmOUIType, wmmSubtypeInformation, wmmVersion, qosInfo)
+	return Element{ID: ElementIDVendorSpecific, Value: value}
+}
+
+// These are the indices of the access categories in WMMParameters.AC.
+const (
+	AccessCategoryBestEffort = 0
+	AccessCategoryBackground = 1
+	AccessCategoryVideo      = 2
+	AccessCategoryVoice      = 3
+)
+
+// EDCAParams stores the contention parameters for one access category,
+// as described in section 8.4.2.31 of the IEEE 802.11-2012 spec.
+type EDCAParams struct {
+	AIFSN int
+
+	// ACM is true if admission control is mandatory for the access category.
+	ACM bool
+
+	// CWMin and CWMax are the minimum and maximum contention windows.
+	CWMin int
+	CWMax int
+
+	// TXOPLimit is the transmit opportunity limit in units of 32 microseconds.
+	TXOPLimit uint16
+}
+
+// WMMParameters stores the QoS parameters which an AP advertises in an EDCA
+// Parameter Set element or in a WMM parameter element.
+type WMMParameters struct {
+	QoSInfo byte
+	AC      [4]EDCAParams
+}
+
+// UAPSD returns true if the AP supports U-APSD.
+// This is only meaningful for parameters sent by an AP.
+func (w *WMMParameters) UAPSD() bool {
+	return (w.QoSInfo & 0x80) != 0
+}
+
+// DecodeWMMParameters finds and decodes the QoS parameters from a list
+// of elements.
+// It returns nil if the elements contain no QoS parameters.
+func DecodeWMMParameters(elements Elements) *WMMParameters {
+	if edca := elements.Get(ElementIDEDCAParameterSet); len(edca) >= 18 {
+		return decodeACParameters(edca[0], edca[2:])
+	}
+	for _, element := range elements {
+		if element.ID != ElementIDVendorSpecific || len(element.Value) < 24 {
+			continue
+		}
+		v := element.Value
+		if v[0] != wmmOUI[0] || v[1] != wmmOUI[1] || v[2] != wmmOUI[2] ||
+			v[3] != wmmOUIType || v[4] != wmmSubtypeParameter {
+			continue
+		}
+		return decodeACParameters(v[6], v[8:])
+	}
+	return nil
+}
+
+func decodeACParameters(qosInfo byte, records []byte) *WMMParameters {
+	res := &WMMParameters{QoSInfo: qosInfo}
+	for i := 0; i < 4; i++ {
+		record := records[i*4 : (i+1)*4]
+		aci := int(record[0]>>5) & 3
+		res.AC[aci] = EDCAParams{
+			AIFSN:     int(record[0] & 0xf),
+			ACM:       (record[0] & 0x10) != 0,
+			CWMin:     (1 << (record[1] & 0xf)) - 1,
+			CWMax:     (1 << (record[1] >> 4)) - 1,
+			TXOPLimit: binary.LittleEndian.Uint16(record[2:]),
+		}
+	}
+	return res
+}
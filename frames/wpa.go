@@ -0,0 +1,120 @@
+package frames
+
+import "encoding/binary"
+
+const (
+	wpaOUIType = 1
+	wpaVersion = 1
+)
+
+// These are the cipher suite types of the WPA element, which follow
+// the Microsoft OUI (00:50:f2) in each suite selector.
+const (
+	WPACipherWEP40  = 1
+	WPACipherTKIP   = 2
+	WPACipherCCMP   = 4
+	WPACipherWEP104 = 5
+)
+
+// These are the AKM suite types of the WPA element.
+const (
+	WPAAKM8021X = 1
+	WPAAKMPSK   = 2
+)
+
+// A WPAElement is the vendor specific element which advertises and
+// negotiates ciphers on WPA (version 1) networks.
+//
+// Its layout matches the RSN element of section 8.4.2.27 of the IEEE
+// 802.11-2012 spec, except that suite selectors use the Microsoft OUI.
+type WPAElement struct {
+	GroupCipher     int
+	PairwiseCiphers []int
+	AKMs            []int
+}
+
+// DecodeWPAElement finds and decodes the WPA element from a list of
+// elements.
+// It returns nil if the elements contain no valid WPA element.
+//
+// As in the RSN element, missing trailing fields take their default
+// values: TKIP ciphers and 802.1X authentication.
+func DecodeWPAElement(elements Elements) *WPAElement {
+	for _, element := range elements {
+		if element.ID != ElementIDVendorSpecific || len(element.Value) < 6 {
+			continue
+		}
+		v := element.Value
+		if v[0] != wmmOUI[0] || v[1] != wmmOUI[1] || v[2] != wmmOUI[2] ||
+			v[3] != wpaOUIType || binary.LittleEndian.Uint16(v[4:]) != wpaVersion {
+			continue
+		}
+		if res, ok := decodeWPASuites(v[6:]); ok {
+			return res
+		}
+	}
+	return nil
+}
+
+func decodeWPASuites(data []byte) (*WPAElement, bool) {
+	res := &WPAElement{
+		GroupCipher:     WPACipherTKIP,
+		PairwiseCiphers: []int{WPACipherTKIP},
+		AKMs:            []int{WPAAKM8021X},
+	}
+	if len(data) == 0 {
+		return res, true
+	}
+	group, ok := decodeWPASelector(data)
+	if !ok {
+		return nil, false
+	}
+	res.GroupCipher = group
+	data = data[4:]
+
+	for _, list := range []*[]int{&res.PairwiseCiphers, &res.AKMs} {
+		if len(data) == 0 {
+			return res, true
+		}
+		if len(data) < 2 {
+			return nil, false
+		}
+		count := int(binary.LittleEndian.Uint16(data))
+		data = data[2:]
+		if len(data) < count*4 {
+			return nil, false
+		}
+		*list = nil
+		for i := 0; i < count; i++ {
+			suite, ok := decodeWPASelector(data[i*4:])
+			if !ok {
+				return nil, false
+			}
+			*list = append(*list, suite)
+		}
+		data = data[count*4:]
+	}
+	return res, true
+}
+
+func decodeWPASelector(data []byte) (int, bool) {
+	if len(data) < 4 || data[0] != wmmOUI[0] || data[1] != wmmOUI[1] || data[2] != wmmOUI[2] {
+		return 0, false
+	}
+	return int(data[3]), true
+}
+
+// Element encodes the WPA element.
+func (w *WPAElement) Element() Element {
+	value := append([]byte{}, wmmOUI...)
+	value = append(value, wpaOUIType)
+	value = binary.LittleEndian.AppendUint16(value, wpaVersion)
+	value = append(append(value, wmmOUI...), byte(w.GroupCipher))
+	for _, list := range [][]int{w.PairwiseCiphers, w.AKMs} {
+		value = binary.LittleEndian.AppendUint16(value, uint16(len(list)))
+		for _, suite := range list {
+			value = append(append(value, wmmOUI...), byte(suite))
+		}
+	}
+	return Element{ID: ElementIDVendorSpecific, Value: value}
+}
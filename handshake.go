@@ -1,8 +1,10 @@
 package wifistack
 
 import (
+	"context"
 	"errors"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/unixpickle/gofi"
@@ -14,153 +16,421 @@ import (
 // I got this value by analyzing traffic from my phone.
 const HandshakeDurationID = 60
 
-var ErrHandshakeTimeout = errors.New("handshake timed out")
+const (
+	// handshakeAckTimeout is the amount of time to wait for the AP to
+	// acknowledge a request before retransmitting it.
+	handshakeAckTimeout = time.Millisecond * 20
+
+	// handshakeResponseTimeout is the amount of time to wait for the AP to
+	// respond to a request once it has acknowledged it.
+	handshakeResponseTimeout = time.Millisecond * 200
+
+	// handshakeMaxRetries is the number of times an unacknowledged
+	// request is retransmitted.
+	handshakeMaxRetries = 7
+
+	// handshakeMaxAttempts is the number of requests which are sent for
+	// each step of the handshake, and the number of times the AP may
+	// interrupt the handshake with a deauthentication or disassociation.
+	handshakeMaxAttempts = 4
+
+	// defaultListenInterval is the listen interval my phone used.
+	defaultListenInterval = 3
+)
+
+var (
+	ErrHandshakeTimeout     = errors.New("handshake timed out")
+	ErrHandshakeNoResponse  = errors.New("handshake got no response")
+	ErrHandshakeInterrupted = errors.New("handshake interrupted by AP")
+)
+
+// A StationState is a state of the station state machine described in
+// section 10.3.1 of the IEEE 802.11-2012 spec.
+type StationState int
+
+const (
+	StationUnauthenticated StationState = iota
+	StationAuthenticated
+	StationAssociated
+)
+
+// String returns a human-readable name for the state.
+func (s StationState) String() string {
+	switch s {
+	case StationUnauthenticated:
+		return "unauthenticated"
+	case StationAuthenticated:
+		return "authenticated"
+	case StationAssociated:
+		return "associated"
+	default:
+		return "StationState(" + strconv.Itoa(int(s)) + ")"
+	}
+}
 
 type Handshaker struct {
 	Stream Stream
 	Client frames.MAC
 	BSS    frames.BSSDescription
+
+	// UAPSD requests a WMM association with U-APSD enabled for every access
+	// category, which is needed for PowerSaveConfig.UAPSD.
+	UAPSD bool
+
+	// SharedKey enables shared key authentication for WEP networks,
+	// in which the AP's challenge text is encrypted with the cipher's
+	// transmit key.
+	// If this is nil, open system authentication is used.
+	SharedKey *WEPCipher
+
+	// WPA is the WPA element of the association request for a WPA
+	// network, as chosen by SelectWPACiphers.
+	// If this is nil, no WPA element is sent.
+	WPA *frames.WPAElement
+
+	// ListenInterval is the number of beacon intervals between the beacons
+	// which we promise to listen to while in power save mode.
+	// If this is 0, a default value is used.
+	ListenInterval uint16
+
+	// Sequences allocates the sequence numbers of the frames which the
+	// handshake sends. It is passed on in the resulting Link, so that the
+	// data stream continues where the handshake left off.
+	// If this is nil, the handshake creates a new allocator.
+	Sequences *SequenceAllocator
+
+	// OnStateChange, if non-nil, is called on every state transition.
+	// It is called synchronously from the handshake, so it should not block.
+	OnStateChange func(old, new StationState)
+
+	stateLock sync.Mutex
+	state     StationState
+
+	// assocResponse is the response which completed the association.
+	assocResponse *frames.AssocResponse
+
+	// challenge is the challenge text from the second frame of shared
+	// key authentication, which must be returned in the third frame.
+	challenge []byte
 }
 
-// HandshakeOpen performs the handshake for an open network.
-func (h *Handshaker) HandshakeOpen(timeout time.Duration) error {
-	timeoutChan := time.After(timeout)
+// State returns the current state of the station.
+func (h *Handshaker) State() StationState {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	return h.state
+}
 
+// HandshakeOpen performs the handshake for an open network, or for a
+// WEP network if SharedKey is set.
+// On success, it returns the parameters negotiated with the AP.
+//
+// If the handshake does not complete within the timeout,
+// ErrHandshakeTimeout is returned.
+func (h *Handshaker) HandshakeOpen(timeout time.Duration) (*Link, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	link, err := h.Handshake(ctx)
+	if err == context.DeadlineExceeded {
+		return nil, ErrHandshakeTimeout
+	}
+	return link, err
+}
+
+// Handshake performs the handshake for an open network, or for a WEP
+// network if SharedKey is set.
+// On success, it returns the parameters negotiated with the AP.
+//
+// The handshake moves the station from the unauthenticated state to
+// the associated state, retransmitting requests which the AP does not
+// acknowledge or answer.
+// If the AP deauthenticates or disassociates us during the handshake,
+// the station falls back to the appropriate state and continues from there.
+//
+// If the context is done before the handshake completes, the context's
+// error is returned.
+func (h *Handshaker) Handshake(ctx context.Context) (*Link, error) {
 	bssChannel := gofi.Channel{Number: h.BSS.Channel}
 	if err := h.Stream.SetChannel(bssChannel); err != nil {
-		return err
+		return nil, err
+	}
+
+	h.setState(StationUnauthenticated)
+	h.challenge = nil
+	if h.Sequences == nil {
+		h.Sequences = &SequenceAllocator{}
 	}
 
-	if err := h.authenticateOpen(timeoutChan); err != nil {
-		return err
+	interruptions := 0
+	attempts := 0
+	lastState := h.State()
+	for h.State() != StationAssociated {
+		if h.State() != lastState {
+			lastState = h.State()
+			attempts = 0
+		}
+		if attempts == handshakeMaxAttempts {
+			return nil, ErrHandshakeNoResponse
+		}
+		attempts++
+
+		interrupted, err := h.performStep(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if interrupted {
+			interruptions++
+			if interruptions > handshakeMaxAttempts {
+				return nil, ErrHandshakeInterrupted
+			}
+		}
 	}
 
-	return h.associate(timeoutChan)
+	return newLink(h, h.assocResponse, h.listenInterval()), nil
 }
 
-// authenticateOpen performs the authentication handshake for an open (or WPA) network.
-func (h *Handshaker) authenticateOpen(timeout <-chan time.Time) error {
-	authPacket := frames.NewAuthenticationOpen(h.BSS.BSSID, h.Client)
-	authFrame := authPacket.EncodeToFrame()
-	authFrame.DurationID = HandshakeDurationID
+// performStep sends the request for the current state and waits for the
+// AP to respond to it.
+//
+// If the AP does not respond, this returns with a nil error and an unchanged state.
+// If the AP deauthenticates or disassociates us, this returns true.
+func (h *Handshaker) performStep(ctx context.Context) (interrupted bool, err error) {
+	var request *frames.Frame
+	if h.State() == StationUnauthenticated {
+		request = h.authenticationRequest()
+	} else {
+		request = h.associationRequest()
+	}
 
-	h.Stream.Outgoing() <- OutgoingFrame{Frame: authFrame.Encode()}
+	if err := h.send(ctx, request); err != nil {
+		return false, err
+	}
+	retries := 0
+	acked := false
+	stepTimeout := time.After(handshakeAckTimeout)
 
 	for {
 		// NOTE: this guarantees that we will never read more than one packet
-		// after the timeout expires.
+		// after the context is done.
 		select {
-		case <-timeout:
-			return ErrHandshakeTimeout
+		case <-ctx.Done():
+			return false, ctx.Err()
 		default:
 		}
 
 		select {
-		case <-timeout:
-			return ErrHandshakeTimeout
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-stepTimeout:
+			if acked || retries == handshakeMaxRetries {
+				return false, nil
+			}
+			retries++
+			request.Retry = true
+			if err := h.send(ctx, request); err != nil {
+				return false, err
+			}
+			stepTimeout = time.After(handshakeAckTimeout)
 		case packet, ok := <-h.Stream.Incoming():
 			if !ok {
-				return h.Stream.FirstError()
+				return false, h.Stream.FirstError()
 			}
 			frame, err := frames.DecodeFrame(packet.Frame)
-			if err != nil {
+			if err != nil || frame.Version != 0 {
 				continue
 			}
-			if frame.Version != 0 || frame.Type != frames.FrameTypeAuthentication {
+
+			if frame.Type == frames.FrameTypeACK {
+				if frame.Addresses[0] == h.Client && !acked {
+					acked = true
+					stepTimeout = time.After(handshakeResponseTimeout)
+				}
 				continue
 			}
 
-			auth, err := frames.DecodeAuthentication(frame)
-			if err != nil {
+			// NOTE: control frames other than ACKs, such as CTS frames,
+			// only carry a receiver address.
+			if frame.Type.Type() != frames.FrameMajorTypeManagement ||
+				frame.Addresses[0] != h.Client || frame.Addresses[1] != h.BSS.BSSID {
 				continue
 			}
-			if auth.Addresses[0] != h.Client || auth.Addresses[1] != h.BSS.BSSID ||
-				auth.Addresses[2] != h.BSS.BSSID {
-				continue
+
+			done, interrupted, err := h.handleFrame(ctx, frame)
+			if done || err != nil {
+				return interrupted, err
 			}
+		}
+	}
+}
 
-			ack := &frames.Frame{
-				Type:      frames.FrameTypeACK,
-				Addresses: []frames.MAC{auth.Addresses[2]},
+// handleFrame processes a management frame which the AP sent us.
+// It returns true if the current step of the handshake is over.
+func (h *Handshaker) handleFrame(ctx context.Context, frame *frames.Frame) (done, interrupted bool,
+	err error) {
+	switch frame.Type {
+	case frames.FrameTypeAuthentication:
+		if h.State() != StationUnauthenticated {
+			// NOTE: the AP may retransmit its response if it missed our ACK.
+			return false, false, h.sendAck(ctx)
+		}
+		auth, err := frames.DecodeAuthentication(frame)
+		if err != nil || auth.Addresses[2] != h.BSS.BSSID {
+			return false, false, nil
+		}
+		if err := h.sendAck(ctx); err != nil {
+			return false, false, err
+		}
+		if !auth.Success() {
+			h.challenge = nil
+			codeStr := strconv.Itoa(int(auth.StatusCode))
+			return true, false, errors.New("authentication error: " + codeStr)
+		}
+		if h.SharedKey != nil && auth.Algorithm == frames.AuthAlgorithmSharedKey &&
+			auth.SequenceNumber == 2 {
+			challenge := auth.Elements.Get(frames.ElementIDChallengeText)
+			if challenge == nil {
+				return false, false, nil
 			}
-			h.Stream.Outgoing() <- OutgoingFrame{Frame: ack.Encode()}
+			// NOTE: the next step sends the third frame, and the state
+			// only changes once the AP confirms our response.
+			h.challenge = challenge
+			return true, false, nil
+		}
+		h.challenge = nil
+		h.setState(StationAuthenticated)
+		return true, false, nil
+	case frames.FrameTypeAssocResponse:
+		if h.State() != StationAuthenticated {
+			return false, false, h.sendAck(ctx)
+		}
+		resp, err := frames.DecodeAssocResponse(frame)
+		if err != nil {
+			return false, false, nil
+		}
+		if err := h.sendAck(ctx); err != nil {
+			return false, false, err
+		}
+		if !resp.Success() {
+			codeStr := strconv.Itoa(int(resp.StatusCode))
+			return true, false, errors.New("association error " + codeStr)
+		}
+		h.assocResponse = resp
+		h.setState(StationAssociated)
+		return true, false, nil
+	case frames.FrameTypeDeauthentication:
+		if _, err := frames.DecodeDeauthentication(frame); err != nil {
+			return false, false, nil
+		}
+		if err := h.sendAck(ctx); err != nil {
+			return false, false, err
+		}
+		h.challenge = nil
+		h.setState(StationUnauthenticated)
+		return true, true, nil
+	case frames.FrameTypeDisassoc:
+		if _, err := frames.DecodeDisassociation(frame); err != nil {
+			return false, false, nil
+		}
+		if err := h.sendAck(ctx); err != nil {
+			return false, false, err
+		}
+		if h.State() == StationAssociated {
+			h.setState(StationAuthenticated)
+		}
+		return true, true, nil
+	}
+	return false, false, nil
+}
 
-			if auth.Success() {
-				return nil
-			} else {
-				codeStr := strconv.Itoa(int(auth.StatusCode))
-				return errors.New("authentication error: " + codeStr)
+// authenticationRequest generates the first frame of the
+// authentication handshake, or the third frame of shared key
+// authentication if we have received a challenge.
+func (h *Handshaker) authenticationRequest() *frames.Frame {
+	var authPacket *frames.Authentication
+	if h.SharedKey == nil {
+		authPacket = frames.NewAuthenticationOpen(h.BSS.BSSID, h.Client)
+	} else {
+		authPacket = frames.NewAuthenticationSharedKey(h.BSS.BSSID, h.Client)
+		if h.challenge != nil {
+			authPacket.SequenceNumber = 3
+			authPacket.Elements = frames.Elements{
+				{ID: frames.ElementIDChallengeText, Value: h.challenge},
 			}
 		}
 	}
+	authFrame := authPacket.EncodeToFrame()
+	authFrame.DurationID = HandshakeDurationID
+	authFrame.SequenceControl = h.Sequences.NextControl()
+	if h.challenge != nil {
+		// NOTE: this is the only encrypted frame of the handshake, as
+		// described in section 11.2.3.2 of the IEEE 802.11-2012 spec.
+		h.SharedKey.EncryptFrame(authFrame)
+	}
+	return authFrame
 }
 
-// associate performs the association handshake for a network.
-func (h *Handshaker) associate(timeout <-chan time.Time) error {
+// associationRequest generates an association request frame.
+func (h *Handshaker) associationRequest() *frames.Frame {
+	supportedRates, extendedRates := associationRates(h.Stream, h.BSS)
 	assocReq := &frames.AssocRequest{
-		BSSID:  h.BSS.BSSID,
-		Client: h.Client,
-
-		// NOTE: this is the interval my phone used.
-		Interval: 3,
+		BSSID:    h.BSS.BSSID,
+		Client:   h.Client,
+		Interval: h.listenInterval(),
 
 		Elements: frames.Elements{
 			{frames.ElementIDSSID, []byte(h.BSS.SSID)},
-			{frames.ElementIDSupportedRates, h.BSS.BasicRates},
+			{frames.ElementIDSupportedRates, supportedRates},
 		},
 	}
+	if extendedRates != nil {
+		extended := frames.Element{ID: frames.ElementIDExtendedSupportedRates, Value: extendedRates}
+		assocReq.Elements = append(assocReq.Elements, extended)
+	}
+	if h.UAPSD {
+		wmm := frames.NewWMMInformationElement(frames.WMMQoSInfoUAPSDAll)
+		assocReq.Elements = append(assocReq.Elements, wmm)
+	}
+	if h.WPA != nil {
+		assocReq.Elements = append(assocReq.Elements, h.WPA.Element())
+	}
 
 	assocReqFrame := assocReq.EncodeToFrame()
 	assocReqFrame.DurationID = HandshakeDurationID
+	assocReqFrame.SequenceControl = h.Sequences.NextControl()
+	return assocReqFrame
+}
 
-	// The fragment number from the last packet was 0, so this one should be 1.
-	seqControl := uint16(1 << 12)
-	assocReqFrame.SequenceControl = &seqControl
-
-	h.Stream.Outgoing() <- OutgoingFrame{Frame: assocReqFrame.Encode()}
-
-	for {
-		// NOTE: see the comment in authenticateOpen() to see why we need an extra select{}.
-		select {
-		case <-timeout:
-			return ErrHandshakeTimeout
-		default:
-		}
+func (h *Handshaker) listenInterval() uint16 {
+	if h.ListenInterval == 0 {
+		return defaultListenInterval
+	}
+	return h.ListenInterval
+}
 
-		select {
-		case <-timeout:
-			return ErrHandshakeTimeout
-		case packet, ok := <-h.Stream.Incoming():
-			if !ok {
-				return h.Stream.FirstError()
-			}
-			frame, err := frames.DecodeFrame(packet.Frame)
-			if err != nil {
-				continue
-			}
-			if frame.Version != 0 || frame.Type != frames.FrameTypeAssocResponse {
-				continue
-			}
-			resp, err := frames.DecodeAssocResponse(frame)
-			if err != nil {
-				continue
-			}
-			if resp.BSSID != h.BSS.BSSID || resp.Client != h.Client {
-				continue
-			}
+func (h *Handshaker) sendAck(ctx context.Context) error {
+	ack := &frames.Frame{
+		Type:      frames.FrameTypeACK,
+		Addresses: []frames.MAC{h.BSS.BSSID},
+	}
+	return h.send(ctx, ack)
+}
 
-			ack := &frames.Frame{
-				Type:      frames.FrameTypeACK,
-				Addresses: []frames.MAC{resp.BSSID},
-			}
-			h.Stream.Outgoing() <- OutgoingFrame{Frame: ack.Encode()}
+// send sends a frame, giving up if the context is done first.
+func (h *Handshaker) send(ctx context.Context, f *frames.Frame) error {
+	select {
+	case h.Stream.Outgoing() <- OutgoingFrame{Frame: f.Encode()}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-			if resp.Success() {
-				return nil
-			} else {
-				codeStr := strconv.Itoa(int(resp.StatusCode))
-				return errors.New("association error " + codeStr)
-			}
-		}
+func (h *Handshaker) setState(s StationState) {
+	h.stateLock.Lock()
+	old := h.state
+	h.state = s
+	h.stateLock.Unlock()
+	if old != s && h.OnStateChange != nil {
+		h.OnStateChange(old, s)
 	}
 }
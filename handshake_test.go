@@ -0,0 +1,129 @@
+package wifistack_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/unixpickle/gofi"
+	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/frames"
+	"github.com/unixpickle/wifistack/sim"
+)
+
+const (
+	testTimeout = time.Second * 5
+	testChannel = 6
+)
+
+var (
+	testBSSID  = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	testClient = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x03}
+	testWEPKey = []byte("0123456789abc")
+)
+
+func TestHandshakeSharedKey(t *testing.T) {
+	medium := sim.NewMedium()
+	ap, err := sim.NewAccessPoint(medium.NewStream(), sim.AccessPointConfig{
+		SSID:    "wifistack",
+		BSSID:   testBSSID,
+		Channel: testChannel,
+		WEP:     newTestWEPCipher(t, testWEPKey),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ap.Close()
+
+	t.Run("Success", func(t *testing.T) {
+		stream := medium.NewStream()
+		defer close(stream.Outgoing())
+		auths := monitorAuthentication(medium)
+		handshaker := wifistack.Handshaker{
+			Stream:    stream,
+			Client:    testClient,
+			BSS:       findTestBSS(t, stream),
+			SharedKey: newTestWEPCipher(t, testWEPKey),
+		}
+		if _, err := handshaker.HandshakeOpen(testTimeout); err != nil {
+			t.Fatal(err)
+		}
+
+		received := auths()
+		if len(received) != 4 {
+			t.Fatalf("expected 4 authentication frames but got %d", len(received))
+		}
+		for i, f := range received {
+			// NOTE: only the third frame, which returns the challenge
+			// text, is encrypted.
+			if f.Encrypted != (i == 2) {
+				t.Fatalf("frame %d has encrypted flag %v", i+1, f.Encrypted)
+			}
+		}
+	})
+
+	t.Run("WrongKey", func(t *testing.T) {
+		stream := medium.NewStream()
+		defer close(stream.Outgoing())
+		handshaker := wifistack.Handshaker{
+			Stream:    stream,
+			Client:    testClient,
+			BSS:       findTestBSS(t, stream),
+			SharedKey: newTestWEPCipher(t, []byte("cba9876543210")),
+		}
+		_, err := handshaker.HandshakeOpen(testTimeout)
+		if err == nil {
+			t.Fatal("handshake succeeded with the wrong key")
+		} else if err == wifistack.ErrHandshakeTimeout {
+			t.Fatal("AP did not reject the challenge response")
+		}
+		if state := handshaker.State(); state != wifistack.StationUnauthenticated {
+			t.Fatalf("unexpected state %v", state)
+		}
+	})
+}
+
+func newTestWEPCipher(t *testing.T, key []byte) *wifistack.WEPCipher {
+	res, err := wifistack.NewWEPCipher([4][]byte{key}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func findTestBSS(t *testing.T, stream wifistack.Stream) frames.BSSDescription {
+	scanRes, _ := wifistack.ScanNetworks(stream)
+	var bss *frames.BSSDescription
+	for desc := range scanRes {
+		if desc.BSSID == testBSSID {
+			desc := desc
+			bss = &desc
+		}
+	}
+	if bss == nil {
+		t.Fatal("simulated AP not found")
+	}
+	return *bss
+}
+
+// monitorAuthentication listens on the AP's channel and returns a
+// function which stops listening and returns every authentication
+// frame that was sent in the meantime.
+func monitorAuthentication(medium *sim.Medium) func() []*frames.Frame {
+	monitor := medium.NewStream()
+	monitor.SetChannel(gofi.Channel{Number: testChannel})
+	result := make(chan []*frames.Frame, 1)
+	go func() {
+		var res []*frames.Frame
+		for packet := range monitor.Incoming() {
+			f, err := frames.DecodeFrame(packet.Frame)
+			if err == nil && f.Type == frames.FrameTypeAuthentication {
+				res = append(res, f)
+			}
+		}
+		result <- res
+	}()
+	return func() []*frames.Frame {
+		close(monitor.Outgoing())
+		return <-result
+	}
+}
@@ -0,0 +1,170 @@
+package ipv4
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	reassemblyTimeout    = time.Second * 30
+	maxReassemblyBuffers = 64
+	maxPacketSize        = 0xffff
+)
+
+// ErrPacketTooBig is returned when a packet which may not be
+// fragmented does not fit in the MTU.
+var ErrPacketTooBig = errors.New("packet too big")
+
+// fragmentPacket splits a packet into fragments which fit in an MTU,
+// as described in section 3.2 of RFC 791.
+func fragmentPacket(p *Packet, mtu int) ([]*Packet, error) {
+	headerLen := headerSize + (len(p.Options)+3)/4*4
+	if headerLen+len(p.Payload) <= mtu {
+		return []*Packet{p}, nil
+	}
+	if p.DontFragment {
+		return nil, ErrPacketTooBig
+	}
+
+	chunkSize := (mtu - headerLen) / 8 * 8
+	if chunkSize <= 0 {
+		return nil, ErrPacketTooBig
+	}
+
+	var res []*Packet
+	for offset := 0; offset < len(p.Payload); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(p.Payload) {
+			end = len(p.Payload)
+		}
+		fragment := &Packet{Header: p.Header, Payload: p.Payload[offset:end]}
+		fragment.FragmentOffset = p.FragmentOffset + offset
+		fragment.MoreFragments = p.MoreFragments || end < len(p.Payload)
+
+		// NOTE: only options with the copied flag belong in later fragments,
+		// and wifistack never sends any options.
+		if offset > 0 {
+			fragment.Options = nil
+		}
+		res = append(res, fragment)
+	}
+	return res, nil
+}
+
+type fragmentKey struct {
+	source      [4]byte
+	destination [4]byte
+	protocol    int
+	id          int
+}
+
+type fragmentBuffer struct {
+	header    *Header
+	pieces    map[int][]byte
+	totalSize int
+	expiry    time.Time
+}
+
+// A reassembler reconstructs fragmented packets.
+type reassembler struct {
+	buffers map[fragmentKey]*fragmentBuffer
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{buffers: map[fragmentKey]*fragmentBuffer{}}
+}
+
+// add processes an incoming packet.
+// It returns the packet itself if it was not fragmented, the
+// reassembled packet if this was the last missing fragment, or nil.
+func (r *reassembler) add(p *Packet, now time.Time) *Packet {
+	if !p.MoreFragments && p.FragmentOffset == 0 {
+		return p
+	}
+
+	var key fragmentKey
+	copy(key.source[:], p.Source.To4())
+	copy(key.destination[:], p.Destination.To4())
+	key.protocol = p.Protocol
+	key.id = p.ID
+
+	buf, ok := r.buffers[key]
+	if !ok {
+		if len(r.buffers) >= maxReassemblyBuffers {
+			r.expire(now)
+			if len(r.buffers) >= maxReassemblyBuffers {
+				return nil
+			}
+		}
+		buf = &fragmentBuffer{
+			pieces: map[int][]byte{},
+			expiry: now.Add(reassemblyTimeout),
+		}
+		r.buffers[key] = buf
+	}
+
+	if p.FragmentOffset+len(p.Payload) > maxPacketSize {
+		delete(r.buffers, key)
+		return nil
+	}
+	buf.pieces[p.FragmentOffset] = p.Payload
+	if p.FragmentOffset == 0 {
+		header := p.Header
+		buf.header = &header
+	}
+	if !p.MoreFragments {
+		buf.totalSize = p.FragmentOffset + len(p.Payload)
+	}
+
+	if buf.header == nil || buf.totalSize == 0 {
+		return nil
+	}
+	payload := buf.assemble()
+	if payload == nil {
+		return nil
+	}
+	delete(r.buffers, key)
+	res := &Packet{Header: *buf.header, Payload: payload}
+	res.MoreFragments = false
+	return res
+}
+
+// expire drops the buffers which have timed out.
+func (r *reassembler) expire(now time.Time) {
+	for key, buf := range r.buffers {
+		if now.After(buf.expiry) {
+			delete(r.buffers, key)
+		}
+	}
+}
+
+// assemble joins the pieces of a buffer, or returns nil if there
+// are holes in the received data.
+func (f *fragmentBuffer) assemble() []byte {
+	offsets := make([]int, 0, len(f.pieces))
+	for offset := range f.pieces {
+		offsets = append(offsets, offset)
+	}
+	sort.Ints(offsets)
+
+	res := make([]byte, f.totalSize)
+	covered := 0
+	for _, offset := range offsets {
+		if offset > covered {
+			return nil
+		}
+		piece := f.pieces[offset]
+		if offset+len(piece) > f.totalSize {
+			return nil
+		}
+		copy(res[offset:], piece)
+		if offset+len(piece) > covered {
+			covered = offset + len(piece)
+		}
+	}
+	if covered < f.totalSize {
+		return nil
+	}
+	return res
+}
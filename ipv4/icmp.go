@@ -0,0 +1,151 @@
+package ipv4
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// These are the ICMP types and codes from RFC 792 which wifistack uses.
+const (
+	icmpTypeEchoReply              = 0
+	icmpTypeDestinationUnreachable = 3
+	icmpTypeEchoRequest            = 8
+
+	icmpCodePortUnreachable = 3
+)
+
+const (
+	icmpHeaderSize  = 8
+	pingPayloadSize = 56
+)
+
+var errBadICMP = errors.New("invalid ICMP message")
+
+// An icmpMessage is an ICMP message whose header ends with a
+// 16-bit identifier and a 16-bit sequence number, as echo messages do.
+// For other messages, ID and Sequence hold the unused field.
+type icmpMessage struct {
+	Type     int
+	Code     int
+	ID       int
+	Sequence int
+	Data     []byte
+}
+
+func decodeICMP(data []byte) (*icmpMessage, error) {
+	if len(data) < icmpHeaderSize || Checksum(data, 0) != 0 {
+		return nil, errBadICMP
+	}
+	return &icmpMessage{
+		Type:     int(data[0]),
+		Code:     int(data[1]),
+		ID:       int(binary.BigEndian.Uint16(data[4:6])),
+		Sequence: int(binary.BigEndian.Uint16(data[6:8])),
+		Data:     data[icmpHeaderSize:],
+	}, nil
+}
+
+func (i *icmpMessage) encode() []byte {
+	res := make([]byte, icmpHeaderSize+len(i.Data))
+	res[0] = byte(i.Type)
+	res[1] = byte(i.Code)
+	binary.BigEndian.PutUint16(res[4:6], uint16(i.ID))
+	binary.BigEndian.PutUint16(res[6:8], uint16(i.Sequence))
+	copy(res[icmpHeaderSize:], i.Data)
+	binary.BigEndian.PutUint16(res[2:4], Checksum(res, 0))
+	return res
+}
+
+// Ping sends an ICMP echo request and waits for the reply.
+// It returns the round-trip time.
+//
+// To retry a lost ping, call Ping again.
+func (s *Stack) Ping(ctx context.Context, destination net.IP) (time.Duration, error) {
+	s.lock.Lock()
+	s.pingSequence++
+	sequence := s.pingSequence & 0xffff
+	reply := make(chan struct{})
+	s.pings[sequence] = reply
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.pings, sequence)
+		s.lock.Unlock()
+	}()
+
+	request := &icmpMessage{
+		Type:     icmpTypeEchoRequest,
+		ID:       s.pingID,
+		Sequence: sequence,
+		Data:     make([]byte, pingPayloadSize),
+	}
+	for i := range request.Data {
+		request.Data[i] = byte(i)
+	}
+
+	start := time.Now()
+	if err := s.Send(destination, ProtocolICMP, request.encode()); err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-reply:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-s.closeChan:
+		return 0, ErrClosed
+	}
+}
+
+func (s *Stack) handleICMP(p *Packet) {
+	msg, err := decodeICMP(p.Payload)
+	if err != nil {
+		return
+	}
+	switch msg.Type {
+	case icmpTypeEchoRequest:
+		// NOTE: replying to broadcast pings is optional according to
+		// section 3.2.2.6 of RFC 1122, and we choose not to.
+		if !p.Destination.Equal(s.Address()) {
+			return
+		}
+		reply := &icmpMessage{
+			Type:     icmpTypeEchoReply,
+			ID:       msg.ID,
+			Sequence: msg.Sequence,
+			Data:     msg.Data,
+		}
+		s.Send(p.Source, ProtocolICMP, reply.encode())
+	case icmpTypeEchoReply:
+		if msg.ID != s.pingID {
+			return
+		}
+		s.lock.Lock()
+		if ch, ok := s.pings[msg.Sequence]; ok {
+			close(ch)
+			delete(s.pings, msg.Sequence)
+		}
+		s.lock.Unlock()
+	}
+}
+
+// sendPortUnreachable tells the source of a UDP packet that nothing
+// is listening on the destination port.
+func (s *Stack) sendPortUnreachable(p *Packet) {
+	original := (&Packet{Header: p.Header, Payload: p.Payload}).Encode()
+	headerLen := int(original[0]&0xf) * 4
+	if len(original) > headerLen+8 {
+		original = original[:headerLen+8]
+	}
+	msg := &icmpMessage{
+		Type: icmpTypeDestinationUnreachable,
+		Code: icmpCodePortUnreachable,
+		Data: original,
+	}
+	s.Send(p.Source, ProtocolICMP, msg.encode())
+}
@@ -0,0 +1,136 @@
+package ipv4
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// These are the IP protocol numbers used by wifistack.
+const (
+	ProtocolICMP = 1
+	ProtocolTCP  = 6
+	ProtocolUDP  = 17
+)
+
+const (
+	headerSize = 20
+	defaultTTL = 64
+)
+
+var (
+	ErrBadHeader   = errors.New("invalid IPv4 header")
+	ErrBadChecksum = errors.New("bad IPv4 checksum")
+)
+
+// A Header is an IPv4 header, as described in section 3.1 of RFC 791.
+type Header struct {
+	TOS            int
+	ID             int
+	DontFragment   bool
+	MoreFragments  bool
+	FragmentOffset int
+	TTL            int
+	Protocol       int
+	Source         net.IP
+	Destination    net.IP
+	Options        []byte
+}
+
+// A Packet is an IPv4 packet.
+type Packet struct {
+	Header
+	Payload []byte
+}
+
+// DecodePacket decodes an IPv4 packet and verifies its header checksum.
+// Any data after the packet's total length is ignored.
+func DecodePacket(data []byte) (*Packet, error) {
+	if len(data) < headerSize || data[0]>>4 != 4 {
+		return nil, ErrBadHeader
+	}
+	size := int(data[0]&0xf) * 4
+	totalSize := int(binary.BigEndian.Uint16(data[2:4]))
+	if size < headerSize || totalSize < size || totalSize > len(data) {
+		return nil, ErrBadHeader
+	}
+	if Checksum(data[:size], 0) != 0 {
+		return nil, ErrBadChecksum
+	}
+	fragmentInfo := binary.BigEndian.Uint16(data[6:8])
+	return &Packet{
+		Header: Header{
+			TOS:            int(data[1]),
+			ID:             int(binary.BigEndian.Uint16(data[4:6])),
+			DontFragment:   fragmentInfo&0x4000 != 0,
+			MoreFragments:  fragmentInfo&0x2000 != 0,
+			FragmentOffset: int(fragmentInfo&0x1fff) * 8,
+			TTL:            int(data[8]),
+			Protocol:       int(data[9]),
+			Source:         net.IP(append([]byte{}, data[12:16]...)),
+			Destination:    net.IP(append([]byte{}, data[16:20]...)),
+			Options:        append([]byte{}, data[headerSize:size]...),
+		},
+		Payload: data[size:totalSize],
+	}, nil
+}
+
+// Encode generates the binary representation of the packet,
+// including the header checksum.
+//
+// The options are padded to a multiple of four bytes.
+func (p *Packet) Encode() []byte {
+	options := p.Options
+	for len(options)%4 != 0 {
+		options = append(options, 0)
+	}
+	size := headerSize + len(options)
+	res := make([]byte, size+len(p.Payload))
+	res[0] = 0x40 | byte(size/4)
+	res[1] = byte(p.TOS)
+	binary.BigEndian.PutUint16(res[2:4], uint16(len(res)))
+	binary.BigEndian.PutUint16(res[4:6], uint16(p.ID))
+	fragmentInfo := uint16(p.FragmentOffset/8) & 0x1fff
+	if p.DontFragment {
+		fragmentInfo |= 0x4000
+	}
+	if p.MoreFragments {
+		fragmentInfo |= 0x2000
+	}
+	binary.BigEndian.PutUint16(res[6:8], fragmentInfo)
+	res[8] = byte(p.TTL)
+	res[9] = byte(p.Protocol)
+	copy(res[12:16], p.Source.To4())
+	copy(res[16:20], p.Destination.To4())
+	copy(res[headerSize:], options)
+	binary.BigEndian.PutUint16(res[10:12], Checksum(res[:size], 0))
+	copy(res[size:], p.Payload)
+	return res
+}
+
+// Checksum computes the Internet checksum from RFC 1071, starting with
+// an initial sum such as the result of PseudoHeaderSum.
+func Checksum(data []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// PseudoHeaderSum computes the sum of the pseudo-header which is
+// covered by the UDP and TCP checksums.
+func PseudoHeaderSum(source, destination net.IP, protocol, length int) uint32 {
+	var sum uint32
+	s, d := source.To4(), destination.To4()
+	for i := 0; i < 4; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(s[i:]))
+		sum += uint32(binary.BigEndian.Uint16(d[i:]))
+	}
+	return sum + uint32(protocol) + uint32(length)
+}
@@ -0,0 +1,349 @@
+// Package ipv4 implements IPv4, ICMP echo, and UDP on top of a
+// wifistack.EthernetStream.
+package ipv4
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/arp"
+	"github.com/unixpickle/wifistack/frames"
+)
+
+const (
+	defaultMTU             = 1500
+	minMTU                 = 68
+	reassemblyExpiryPeriod = time.Second
+	loopbackBufferSize     = 64
+	incomingBufferSize     = 64
+)
+
+var (
+	ErrNoRoute = errors.New("no route to host")
+	ErrClosed  = errors.New("IPv4 stack closed")
+)
+
+// Config stores the configuration for a Stack.
+type Config struct {
+	// Stream is used to send and receive IPv4 and ARP packets.
+	// The Stack handles the stream's IPv4 and ARP frames, so the stream
+	// may be shared with other protocols, such as a DHCP client.
+	// The Stack never closes the stream.
+	Stream *wifistack.EthernetStream
+
+	// MAC is the hardware address of this station.
+	MAC frames.MAC
+
+	// Address is the local IPv4 address.
+	// It may be nil, in which case the stack can only send and receive
+	// broadcast and multicast packets until SetAddress is called.
+	Address net.IP
+
+	// SubnetMask is the mask of the local network.
+	SubnetMask net.IPMask
+
+	// Gateway is the router for packets which are not on the local
+	// network. If this is nil, only the local network is reachable.
+	Gateway net.IP
+
+	// MTU is the largest packet which may be sent without
+	// fragmentation. If this is 0, a default value is used.
+	MTU int
+}
+
+// A Stack sends and receives IPv4 packets.
+//
+// It answers ICMP echo requests, provides UDP sockets, and dispatches
+// other protocols to handlers registered with HandleProtocol.
+// Addresses on the local network are resolved with ARP.
+type Stack struct {
+	// hasClosed is used to atomically ensure that closeChan is closed only once.
+	hasClosed uint32
+	closeChan chan struct{}
+
+	mtu           int
+	stream        *wifistack.EthernetStream
+	removeHandler func()
+	resolver      *arp.Resolver
+	incoming      chan *frames.EthernetFrame
+	loopback      chan *Packet
+	reassembler   *reassembler
+	nextID        uint32
+	pingID        int
+
+	lock         sync.Mutex
+	address      net.IP
+	mask         net.IPMask
+	gateway      net.IP
+	handlers     map[int]func(p *Packet)
+	pingSequence int
+	pings        map[int]chan struct{}
+	udpConns     map[int]*UDPConn
+	nextUDPPort  int
+
+	wg sync.WaitGroup
+}
+
+// NewStack creates a Stack and starts processing the stream.
+// You must call Close once you are done with the stack.
+func NewStack(c Config) *Stack {
+	if c.MTU == 0 {
+		c.MTU = defaultMTU
+	} else if c.MTU < minMTU {
+		c.MTU = minMTU
+	}
+	res := &Stack{
+		closeChan: make(chan struct{}),
+
+		mtu:    c.MTU,
+		stream: c.Stream,
+		resolver: arp.NewResolver(arp.Config{
+			Stream: c.Stream,
+			MAC:    c.MAC,
+		}),
+		incoming:    make(chan *frames.EthernetFrame, incomingBufferSize),
+		loopback:    make(chan *Packet, loopbackBufferSize),
+		reassembler: newReassembler(),
+		nextID:      rand.Uint32(),
+		pingID:      rand.Intn(0x10000),
+
+		pings:       map[int]chan struct{}{},
+		udpConns:    map[int]*UDPConn{},
+		nextUDPPort: ephemeralPortMin + rand.Intn(ephemeralPortMax-ephemeralPortMin+1),
+	}
+	res.handlers = map[int]func(p *Packet){
+		ProtocolICMP: res.handleICMP,
+		ProtocolUDP:  res.handleUDP,
+	}
+	res.SetAddress(c.Address, c.SubnetMask, c.Gateway)
+
+	res.removeHandler = c.Stream.HandleEtherType(frames.EtherTypeIPv4, func(f *frames.EthernetFrame) {
+		select {
+		case res.incoming <- f:
+		default:
+		}
+	})
+	res.wg.Add(1)
+	go res.incomingLoop()
+	return res
+}
+
+// Address returns the local IPv4 address, or nil if none is set.
+func (s *Stack) Address() net.IP {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.address
+}
+
+// SetAddress changes the local address, the subnet mask, and the gateway.
+// It is typically called after a DHCP lease is acquired or renewed.
+func (s *Stack) SetAddress(address net.IP, mask net.IPMask, gateway net.IP) {
+	if address != nil {
+		address = address.To4()
+	}
+	if gateway != nil {
+		gateway = gateway.To4()
+	}
+	s.lock.Lock()
+	s.address = address
+	s.mask = mask
+	s.gateway = gateway
+	s.lock.Unlock()
+	s.resolver.SetAddress(address)
+}
+
+// MTU returns the MTU of the stack.
+func (s *Stack) MTU() int {
+	return s.mtu
+}
+
+// HandleProtocol registers a handler for incoming packets of an IP
+// protocol, replacing any previous handler.
+// Registering a handler for ICMP or UDP replaces the built-in
+// implementation, and a nil handler drops the protocol's packets.
+//
+// The handler is called with reassembled packets from the stack's
+// incoming goroutine, so it should not block.
+func (s *Stack) HandleProtocol(protocol int, handler func(p *Packet)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if handler == nil {
+		delete(s.handlers, protocol)
+	} else {
+		s.handlers[protocol] = handler
+	}
+}
+
+// Send sends a payload to a destination, fragmenting it if it does not
+// fit in the MTU.
+//
+// The packet is dropped silently if the next hop cannot be resolved.
+func (s *Stack) Send(destination net.IP, protocol int, payload []byte) error {
+	select {
+	case <-s.closeChan:
+		return ErrClosed
+	default:
+	}
+
+	destination = destination.To4()
+	if destination == nil {
+		return ErrNoRoute
+	}
+
+	s.lock.Lock()
+	source := s.address
+	s.lock.Unlock()
+	if source == nil {
+		source = net.IPv4zero
+	}
+
+	packet := &Packet{
+		Header: Header{
+			ID:          int(atomic.AddUint32(&s.nextID, 1) & 0xffff),
+			TTL:         defaultTTL,
+			Protocol:    protocol,
+			Source:      source,
+			Destination: destination,
+		},
+		Payload: payload,
+	}
+
+	// NOTE: packets to the local address never reach the link layer.
+	// They are delivered from the incoming goroutine, like any other
+	// packet, so that handlers may safely send replies.
+	if destination.Equal(source) {
+		select {
+		case s.loopback <- packet:
+		default:
+		}
+		return nil
+	}
+
+	nextHop, err := s.nextHop(destination)
+	if err != nil {
+		return err
+	}
+	fragments, err := fragmentPacket(packet, s.mtu)
+	if err != nil {
+		return err
+	}
+	for _, fragment := range fragments {
+		s.resolver.Send(nextHop, frames.EtherTypeIPv4, fragment.Encode())
+	}
+	return nil
+}
+
+// Close stops the stack and removes its handlers from the stream.
+// Open UDP sockets stop receiving, and pending pings fail.
+func (s *Stack) Close() {
+	if atomic.SwapUint32(&s.hasClosed, 1) == 0 {
+		close(s.closeChan)
+		s.removeHandler()
+		s.wg.Wait()
+		s.resolver.Close()
+	}
+}
+
+// nextHop decides where to send a packet, as described in section
+// 3.3.1 of RFC 1122.
+func (s *Stack) nextHop(destination net.IP) (net.IP, error) {
+	if destination.Equal(net.IPv4bcast) || destination.IsMulticast() {
+		return destination, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.address != nil && s.mask != nil && destination.Mask(s.mask).Equal(s.address.Mask(s.mask)) {
+		if s.isSubnetBroadcast(destination) {
+			return net.IPv4bcast, nil
+		}
+		return destination, nil
+	}
+	if s.gateway != nil {
+		return s.gateway, nil
+	}
+	return nil, ErrNoRoute
+}
+
+// accepts checks if an incoming packet is addressed to this host.
+func (s *Stack) accepts(destination net.IP) bool {
+	if destination.Equal(net.IPv4bcast) || destination.IsMulticast() {
+		return true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.address != nil && (destination.Equal(s.address) || s.isSubnetBroadcast(destination))
+}
+
+// isSubnetBroadcast checks if an address is the directed broadcast
+// address of the local network.
+//
+// The caller must hold the lock.
+func (s *Stack) isSubnetBroadcast(ip net.IP) bool {
+	if s.address == nil || s.mask == nil {
+		return false
+	}
+	ip = ip.To4()
+	network := s.address.Mask(s.mask)
+	if network == nil || len(network) != len(ip) {
+		return false
+	}
+	for i, b := range ip {
+		if b != network[i]|^s.mask[len(s.mask)-len(ip)+i] {
+			return false
+		}
+	}
+	return true
+}
+
+// deliver dispatches a complete packet to its protocol handler.
+func (s *Stack) deliver(p *Packet) {
+	s.lock.Lock()
+	handler := s.handlers[p.Protocol]
+	s.lock.Unlock()
+	if handler != nil {
+		handler(p)
+	}
+}
+
+func (s *Stack) incomingLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(reassemblyExpiryPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case frame := <-s.incoming:
+			s.handleFrame(frame)
+		case packet := <-s.loopback:
+			s.deliver(packet)
+		case now := <-ticker.C:
+			s.reassembler.expire(now)
+		case <-s.stream.Done():
+			return
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+func (s *Stack) handleFrame(frame *frames.EthernetFrame) {
+	packet, err := DecodePacket(frame.Payload)
+	if err != nil || !s.accepts(packet.Destination) {
+		return
+	}
+	if packet.MoreFragments || packet.FragmentOffset != 0 {
+		packet = s.reassembler.add(packet, time.Now())
+		if packet == nil {
+			return
+		}
+	}
+	s.deliver(packet)
+}
@@ -0,0 +1,220 @@
+package ipv4_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/dhcp"
+	"github.com/unixpickle/wifistack/frames"
+	"github.com/unixpickle/wifistack/ipv4"
+	"github.com/unixpickle/wifistack/sim"
+)
+
+const (
+	testTimeout = time.Second * 5
+	echoPort    = 7
+	pingCount   = 4
+)
+
+var (
+	testBSSID     = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	testRouterMAC = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	testClient    = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x03}
+
+	testRouterIP = net.IPv4(10, 0, 0, 1).To4()
+	testClientIP = net.IPv4(10, 0, 0, 2).To4()
+	testMask     = net.CIDRMask(24, 32)
+)
+
+func TestSimulatedNetwork(t *testing.T) {
+	medium := sim.NewMedium()
+	ap, err := sim.NewAccessPoint(medium.NewStream(), sim.AccessPointConfig{
+		SSID:    "wifistack",
+		BSSID:   testBSSID,
+		Channel: 6,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ap.Close()
+
+	routerEthernet := wifistack.NewEthernetStream(ap.DS(), testRouterMAC)
+	defer close(routerEthernet.Outgoing())
+	router := ipv4.NewStack(ipv4.Config{
+		Stream:     routerEthernet,
+		MAC:        testRouterMAC,
+		Address:    testRouterIP,
+		SubnetMask: testMask,
+	})
+	defer router.Close()
+	runDHCPServer(t, router)
+	runEchoServer(t, router)
+
+	client := joinTestNetwork(t, medium)
+	defer client.Close()
+	if !client.Address().Equal(testClientIP) {
+		t.Fatalf("expected address %v but got %v", testClientIP, client.Address())
+	}
+
+	t.Run("Ping", func(t *testing.T) {
+		for i := 0; i < pingCount; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			_, err := client.Ping(ctx, testRouterIP)
+			cancel()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("UDPEcho", func(t *testing.T) {
+		// NOTE: the larger messages do not fit in the MTU, so both stacks
+		// fragment them and reassemble them.
+		for _, size := range []int{16, 1472, 1473, 3000, 8000} {
+			message := make([]byte, size)
+			for i := range message {
+				message[i] = byte(i * 7)
+			}
+			if reply := udpEcho(t, client, message); !bytes.Equal(reply, message) {
+				t.Fatalf("bad echo of %d bytes: got %d bytes", size, len(reply))
+			}
+		}
+	})
+}
+
+// joinTestNetwork connects a station to the simulated AP and configures
+// its IPv4 stack with DHCP.
+func joinTestNetwork(t *testing.T, medium *sim.Medium) *ipv4.Stack {
+	stream := medium.NewStream()
+	scanRes, _ := wifistack.ScanNetworks(stream)
+	var bss *frames.BSSDescription
+	for desc := range scanRes {
+		if desc.BSSID == testBSSID {
+			desc := desc
+			bss = &desc
+		}
+	}
+	if bss == nil {
+		t.Fatal("simulated AP not found")
+	}
+	handshaker := wifistack.Handshaker{Stream: stream, Client: testClient, BSS: *bss}
+	link, err := handshaker.HandshakeOpen(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ethernet := wifistack.NewEthernetStream(wifistack.NewOpenMSDUStream(
+		wifistack.NewOpenMSDUStreamConfig(stream, link)), testClient)
+	t.Cleanup(func() {
+		close(ethernet.Outgoing())
+	})
+	res := ipv4.NewStack(ipv4.Config{
+		Stream: ethernet,
+		MAC:    testClient,
+	})
+
+	dhcpClient := &dhcp.Client{Stream: ethernet, MAC: testClient}
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	lease, err := dhcpClient.Acquire(ctx)
+	if err != nil {
+		res.Close()
+		t.Fatal(err)
+	}
+	var gateway net.IP
+	if len(lease.Routers) > 0 {
+		gateway = lease.Routers[0]
+	}
+	res.SetAddress(lease.Address, lease.SubnetMask, gateway)
+	return res
+}
+
+// runDHCPServer answers every DHCP request with testClientIP.
+func runDHCPServer(t *testing.T, s *ipv4.Stack) {
+	conn, err := s.ListenUDP(67)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, 2048)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg, err := dhcp.DecodeMessage(buf[:n])
+			if err != nil || msg.Op != dhcp.OpRequest {
+				continue
+			}
+			var replyType dhcp.MessageType
+			switch msg.Type() {
+			case dhcp.MessageTypeDiscover:
+				replyType = dhcp.MessageTypeOffer
+			case dhcp.MessageTypeRequest:
+				replyType = dhcp.MessageTypeAck
+			default:
+				continue
+			}
+			reply := &dhcp.Message{
+				Op:        dhcp.OpReply,
+				XID:       msg.XID,
+				Flags:     msg.Flags,
+				ClientIP:  net.IPv4zero,
+				YourIP:    testClientIP,
+				ServerIP:  testRouterIP,
+				RelayIP:   net.IPv4zero,
+				ClientMAC: msg.ClientMAC,
+				Options: dhcp.Options{
+					{Code: dhcp.OptionMessageType, Data: []byte{byte(replyType)}},
+					{Code: dhcp.OptionServerIdentifier, Data: testRouterIP},
+					{Code: dhcp.OptionSubnetMask, Data: testMask},
+					{Code: dhcp.OptionRouter, Data: testRouterIP},
+					{Code: dhcp.OptionLeaseTime, Data: []byte{0, 0, 0x0e, 0x10}},
+				},
+			}
+			dest := &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+			conn.WriteTo(reply.Encode(), dest)
+		}
+	}()
+}
+
+func runEchoServer(t *testing.T, s *ipv4.Stack) {
+	conn, err := s.ListenUDP(echoPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, 0x10000)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+}
+
+func udpEcho(t *testing.T, s *ipv4.Stack, message []byte) []byte {
+	conn, err := s.ListenUDP(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.WriteTo(message, &net.UDPAddr{IP: testRouterIP, Port: echoPort}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	buf := make([]byte, 0x10000)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
@@ -0,0 +1,274 @@
+package ipv4
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	udpHeaderSize     = 8
+	udpBufferSize     = 64
+	maxUDPPayloadSize = maxPacketSize - headerSize - udpHeaderSize
+	ephemeralPortMin  = 49152
+	ephemeralPortMax  = 65535
+)
+
+var (
+	ErrPortInUse       = errors.New("UDP port in use")
+	ErrNoFreePorts     = errors.New("no free UDP ports")
+	ErrMessageTooLarge = errors.New("UDP message too large")
+)
+
+type udpDatagram struct {
+	source  *net.UDPAddr
+	payload []byte
+}
+
+func encodeUDP(source, destination net.IP, sourcePort, destinationPort int,
+	payload []byte) []byte {
+	sum := PseudoHeaderSum(source, destination, ProtocolUDP, udpHeaderSize+len(payload))
+	return EncodeUDP(sum, sourcePort, destinationPort, payload)
+}
+
+// EncodeUDP generates a UDP datagram, as described in RFC 768.
+//
+// The checksum covers the sum of a pseudo-header, which comes from
+// PseudoHeaderSum for IPv4 or from its IPv6 counterpart.
+func EncodeUDP(pseudoHeaderSum uint32, sourcePort, destinationPort int, payload []byte) []byte {
+	res := make([]byte, udpHeaderSize+len(payload))
+	binary.BigEndian.PutUint16(res[0:2], uint16(sourcePort))
+	binary.BigEndian.PutUint16(res[2:4], uint16(destinationPort))
+	binary.BigEndian.PutUint16(res[4:6], uint16(len(res)))
+	copy(res[udpHeaderSize:], payload)
+
+	// NOTE: a computed checksum of zero is sent as all ones, since zero
+	// means that there is no checksum.
+	checksum := Checksum(res, pseudoHeaderSum)
+	if checksum == 0 {
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(res[6:8], checksum)
+	return res
+}
+
+// A UDPConn is a UDP socket bound to a local port.
+// It implements net.PacketConn.
+type UDPConn struct {
+	stack    *Stack
+	port     int
+	incoming chan udpDatagram
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	deadlineLock    sync.Mutex
+	readDeadline    time.Time
+	deadlineChanged chan struct{}
+}
+
+// ListenUDP binds a UDP socket to a local port.
+// If port is 0, an ephemeral port is chosen.
+func (s *Stack) ListenUDP(port int) (*UDPConn, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	select {
+	case <-s.closeChan:
+		return nil, ErrClosed
+	default:
+	}
+
+	if port == 0 {
+		for i := ephemeralPortMin; i <= ephemeralPortMax; i++ {
+			candidate := s.nextUDPPort
+			s.nextUDPPort++
+			if s.nextUDPPort > ephemeralPortMax {
+				s.nextUDPPort = ephemeralPortMin
+			}
+			if _, ok := s.udpConns[candidate]; !ok {
+				port = candidate
+				break
+			}
+		}
+		if port == 0 {
+			return nil, ErrNoFreePorts
+		}
+	} else if _, ok := s.udpConns[port]; ok {
+		return nil, ErrPortInUse
+	}
+
+	res := &UDPConn{
+		stack:           s,
+		port:            port,
+		incoming:        make(chan udpDatagram, udpBufferSize),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+	s.udpConns[port] = res
+	return res, nil
+}
+
+// ReadFrom reads the next datagram, like recvfrom(2).
+// If b is too small, the rest of the datagram is discarded.
+func (u *UDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		u.deadlineLock.Lock()
+		deadline := u.readDeadline
+		changed := u.deadlineChanged
+		u.deadlineLock.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return 0, nil, timeoutError{}
+			}
+			timer = time.NewTimer(remaining)
+			timeout = timer.C
+		}
+
+		var n int
+		var source net.Addr
+		var err error
+		done := true
+		select {
+		case datagram := <-u.incoming:
+			n, source = copy(b, datagram.payload), datagram.source
+		case <-timeout:
+			err = timeoutError{}
+		case <-u.closed:
+			err = ErrClosed
+		case <-u.stack.closeChan:
+			err = ErrClosed
+		case <-changed:
+			done = false
+		}
+
+		// NOTE: the timer is stopped here rather than deferred, since a
+		// deferred call would pile up every time the deadline changes.
+		if timer != nil {
+			timer.Stop()
+		}
+		if done {
+			return n, source, err
+		}
+	}
+}
+
+// WriteTo sends a datagram, like sendto(2).
+// The address must be a *net.UDPAddr.
+func (u *UDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-u.closed:
+		return 0, ErrClosed
+	default:
+	}
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || udpAddr.IP.To4() == nil {
+		return 0, &net.AddrError{Err: "not an IPv4 UDP address", Addr: addr.String()}
+	}
+	if len(b) > maxUDPPayloadSize {
+		return 0, ErrMessageTooLarge
+	}
+	source := u.stack.Address()
+	if source == nil {
+		source = net.IPv4zero
+	}
+	data := encodeUDP(source, udpAddr.IP, u.port, udpAddr.Port, b)
+	if err := u.stack.Send(udpAddr.IP, ProtocolUDP, data); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close unbinds the socket.
+func (u *UDPConn) Close() error {
+	u.closeOnce.Do(func() {
+		close(u.closed)
+		u.stack.lock.Lock()
+		if u.stack.udpConns[u.port] == u {
+			delete(u.stack.udpConns, u.port)
+		}
+		u.stack.lock.Unlock()
+	})
+	return nil
+}
+
+// LocalAddr returns the local address of the socket.
+func (u *UDPConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: u.stack.Address(), Port: u.port}
+}
+
+// SetDeadline sets the read deadline.
+// Writes never block, so they have no deadline.
+func (u *UDPConn) SetDeadline(t time.Time) error {
+	return u.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for ReadFrom calls, including
+// calls which are already blocked.
+// A zero value means ReadFrom will not time out.
+func (u *UDPConn) SetReadDeadline(t time.Time) error {
+	u.deadlineLock.Lock()
+	defer u.deadlineLock.Unlock()
+	u.readDeadline = t
+	close(u.deadlineChanged)
+	u.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing, since writes never block.
+func (u *UDPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (s *Stack) handleUDP(p *Packet) {
+	data := p.Payload
+	if len(data) < udpHeaderSize {
+		return
+	}
+	size := int(binary.BigEndian.Uint16(data[4:6]))
+	if size < udpHeaderSize || size > len(data) {
+		return
+	}
+	data = data[:size]
+	if binary.BigEndian.Uint16(data[6:8]) != 0 {
+		sum := PseudoHeaderSum(p.Source, p.Destination, ProtocolUDP, size)
+		if Checksum(data, sum) != 0 {
+			return
+		}
+	}
+
+	sourcePort := int(binary.BigEndian.Uint16(data[0:2]))
+	destinationPort := int(binary.BigEndian.Uint16(data[2:4]))
+
+	s.lock.Lock()
+	conn := s.udpConns[destinationPort]
+	s.lock.Unlock()
+
+	if conn == nil {
+		if p.Destination.Equal(s.Address()) {
+			s.sendPortUnreachable(p)
+		}
+		return
+	}
+
+	datagram := udpDatagram{
+		source:  &net.UDPAddr{IP: p.Source, Port: sourcePort},
+		payload: data[udpHeaderSize:],
+	}
+	select {
+	case conn.incoming <- datagram:
+	default:
+	}
+}
+
+type timeoutError struct{}
+
+func (t timeoutError) Error() string   { return "i/o timeout" }
+func (t timeoutError) Timeout() bool   { return true }
+func (t timeoutError) Temporary() bool { return true }
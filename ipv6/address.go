@@ -0,0 +1,81 @@
+package ipv6
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+
+	"github.com/unixpickle/wifistack/frames"
+)
+
+var (
+	allNodes   = net.ParseIP("ff02::1")
+	allRouters = net.ParseIP("ff02::2")
+
+	linkLocalPrefix = &net.IPNet{IP: net.ParseIP("fe80::"), Mask: net.CIDRMask(64, 128)}
+)
+
+// MulticastMAC maps an IPv6 multicast address to a group MAC address,
+// as described in section 7 of RFC 2464.
+func MulticastMAC(ip net.IP) frames.MAC {
+	ip = ip.To16()
+	return frames.MAC{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+}
+
+// SolicitedNodeAddress returns the solicited-node multicast address
+// for a unicast address, as described in section 2.7.1 of RFC 4291.
+func SolicitedNodeAddress(ip net.IP) net.IP {
+	ip = ip.To16()
+	res := net.ParseIP("ff02::1:ff00:0")
+	copy(res[13:], ip[13:])
+	return res
+}
+
+// StableAddress generates a stable, semantically opaque address in a /64
+// prefix, as described in section 5 of RFC 7217.
+//
+// The networkID identifies the network (for example, by its SSID), and
+// the dadCounter is incremented each time the address turns out to be
+// a duplicate.
+func StableAddress(prefix net.IP, mac frames.MAC, networkID []byte, dadCounter int,
+	secretKey []byte) net.IP {
+	for {
+		hash := sha256.New()
+		hash.Write(prefix.To16()[:8])
+		hash.Write(mac[:])
+		hash.Write(networkID)
+		var counter [4]byte
+		binary.BigEndian.PutUint32(counter[:], uint32(dadCounter))
+		hash.Write(counter[:])
+		hash.Write(secretKey)
+		digest := hash.Sum(nil)
+
+		res := make(net.IP, net.IPv6len)
+		copy(res, prefix.To16()[:8])
+
+		// NOTE: the interface identifier is taken from the least
+		// significant bits of the hash.
+		copy(res[8:], digest[len(digest)-8:])
+		if !reservedInterfaceID(res[8:]) {
+			return res
+		}
+		dadCounter++
+	}
+}
+
+// reservedInterfaceID checks if an interface identifier is reserved,
+// as listed in RFC 5453.
+func reservedInterfaceID(id []byte) bool {
+	if bytes.Equal(id, make([]byte, 8)) {
+		return true
+	}
+	anycast := []byte{0xfd, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	return bytes.Equal(id[:7], anycast) && id[7] >= 0x80
+}
+
+func ipKey(ip net.IP) [16]byte {
+	var res [16]byte
+	copy(res[:], ip.To16())
+	return res
+}
@@ -0,0 +1,151 @@
+package ipv6
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/unixpickle/wifistack/ipv4"
+)
+
+// These are the ICMPv6 types from RFC 4443 and RFC 4861 which wifistack
+// uses.
+const (
+	icmpTypeEchoRequest           = 128
+	icmpTypeEchoReply             = 129
+	icmpTypeRouterSolicitation    = 133
+	icmpTypeRouterAdvertisement   = 134
+	icmpTypeNeighborSolicitation  = 135
+	icmpTypeNeighborAdvertisement = 136
+)
+
+const (
+	icmpHeaderSize  = 4
+	pingPayloadSize = 56
+)
+
+var errBadICMP = errors.New("invalid ICMPv6 message")
+
+// An icmpMessage is an ICMPv6 message, where Body is everything after
+// the checksum.
+type icmpMessage struct {
+	Type int
+	Code int
+	Body []byte
+}
+
+func decodeICMP(source, destination net.IP, data []byte) (*icmpMessage, error) {
+	if len(data) < icmpHeaderSize {
+		return nil, errBadICMP
+	}
+	sum := PseudoHeaderSum(source, destination, NextHeaderICMPv6, len(data))
+	if ipv4.Checksum(data, sum) != 0 {
+		return nil, errBadICMP
+	}
+	return &icmpMessage{
+		Type: int(data[0]),
+		Code: int(data[1]),
+		Body: data[icmpHeaderSize:],
+	}, nil
+}
+
+func (i *icmpMessage) encode(source, destination net.IP) []byte {
+	res := make([]byte, icmpHeaderSize+len(i.Body))
+	res[0] = byte(i.Type)
+	res[1] = byte(i.Code)
+	copy(res[icmpHeaderSize:], i.Body)
+	sum := PseudoHeaderSum(source, destination, NextHeaderICMPv6, len(res))
+	binary.BigEndian.PutUint16(res[2:4], ipv4.Checksum(res, sum))
+	return res
+}
+
+// Ping sends an ICMPv6 echo request and waits for the reply.
+// It returns the round-trip time.
+//
+// To retry a lost ping, call Ping again.
+func (s *Stack) Ping(ctx context.Context, destination net.IP) (time.Duration, error) {
+	s.lock.Lock()
+	s.pingSequence++
+	sequence := s.pingSequence & 0xffff
+	reply := make(chan struct{})
+	s.pings[sequence] = reply
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.pings, sequence)
+		s.lock.Unlock()
+	}()
+
+	body := make([]byte, 4+pingPayloadSize)
+	binary.BigEndian.PutUint16(body[0:2], uint16(s.pingID))
+	binary.BigEndian.PutUint16(body[2:4], uint16(sequence))
+	for i := range body[4:] {
+		body[4+i] = byte(i)
+	}
+
+	start := time.Now()
+	if err := s.sendICMP(destination, &icmpMessage{Type: icmpTypeEchoRequest, Body: body}); err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-reply:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-s.closeChan:
+		return 0, ErrClosed
+	}
+}
+
+// sendICMP sends an ICMPv6 message from the best source address for
+// the destination.
+func (s *Stack) sendICMP(destination net.IP, msg *icmpMessage) error {
+	source := s.sourceAddress(destination)
+	if source == nil {
+		return ErrNoAddress
+	}
+	return s.send(&Packet{
+		Header: Header{
+			NextHeader:  NextHeaderICMPv6,
+			HopLimit:    s.currentHopLimit(),
+			Source:      source,
+			Destination: destination,
+		},
+		Payload: msg.encode(source, destination),
+	})
+}
+
+func (s *Stack) handleICMP(p *Packet) {
+	msg, err := decodeICMP(p.Source, p.Destination, p.Payload)
+	if err != nil {
+		return
+	}
+	switch msg.Type {
+	case icmpTypeEchoRequest:
+		reply := &icmpMessage{Type: icmpTypeEchoReply, Body: msg.Body}
+		s.sendICMP(p.Source, reply)
+	case icmpTypeEchoReply:
+		if len(msg.Body) < 4 || int(binary.BigEndian.Uint16(msg.Body[0:2])) != s.pingID {
+			return
+		}
+		sequence := int(binary.BigEndian.Uint16(msg.Body[2:4]))
+		s.lock.Lock()
+		if ch, ok := s.pings[sequence]; ok {
+			close(ch)
+			delete(s.pings, sequence)
+		}
+		s.lock.Unlock()
+	case icmpTypeRouterSolicitation, icmpTypeRouterAdvertisement,
+		icmpTypeNeighborSolicitation, icmpTypeNeighborAdvertisement:
+		// NOTE: section 6.1 and 7.1 of RFC 4861 require NDP messages to
+		// have a hop limit of 255, which proves they are from the link.
+		if p.HopLimit != ndpHopLimit || msg.Code != 0 {
+			return
+		}
+		s.handleNDP(p, msg)
+	}
+}
@@ -0,0 +1,434 @@
+package ipv6
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/unixpickle/wifistack/frames"
+)
+
+// These are the protocol constants from section 10 of RFC 4861.
+const (
+	ndpHopLimit = 255
+
+	maxMulticastSolicit = 3
+	maxUnicastSolicit   = 3
+	retransTimer        = time.Second
+	reachableTime       = time.Second * 30
+
+	maxPendingPackets = 16
+
+	// neighborGCTime is how long a stale entry which is not used is
+	// kept in the neighbor cache.
+	neighborGCTime = time.Minute * 10
+)
+
+// These are the NDP option types from section 4.6 of RFC 4861, as well
+// as the nonce option from section 5.3.2 of RFC 3971.
+const (
+	optionSourceLinkLayerAddress = 1
+	optionTargetLinkLayerAddress = 2
+	optionPrefixInformation      = 3
+	optionMTU                    = 5
+	optionNonce                  = 14
+)
+
+const (
+	advertisementFlagRouter    = 0x80
+	advertisementFlagSolicited = 0x40
+	advertisementFlagOverride  = 0x20
+
+	prefixFlagOnLink     = 0x80
+	prefixFlagAutonomous = 0x40
+)
+
+var errBadOption = errors.New("invalid NDP option")
+
+// An ndpOption is an NDP option, where Data excludes the type and
+// length fields.
+type ndpOption struct {
+	Type int
+	Data []byte
+}
+
+func decodeOptions(data []byte) ([]ndpOption, error) {
+	var res []ndpOption
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, errBadOption
+		}
+		size := int(data[1]) * 8
+		if size == 0 || size > len(data) {
+			return nil, errBadOption
+		}
+		res = append(res, ndpOption{Type: int(data[0]), Data: data[2:size]})
+		data = data[size:]
+	}
+	return res, nil
+}
+
+// encodeOptions encodes options, padding each one to a multiple of
+// eight bytes.
+func encodeOptions(options ...ndpOption) []byte {
+	var res []byte
+	for _, o := range options {
+		size := (len(o.Data) + 2 + 7) / 8 * 8
+		encoded := make([]byte, size)
+		encoded[0] = byte(o.Type)
+		encoded[1] = byte(size / 8)
+		copy(encoded[2:], o.Data)
+		res = append(res, encoded...)
+	}
+	return res
+}
+
+func findOption(options []ndpOption, optionType int) []byte {
+	for _, o := range options {
+		if o.Type == optionType {
+			return o.Data
+		}
+	}
+	return nil
+}
+
+func linkLayerOption(options []ndpOption, optionType int) (frames.MAC, bool) {
+	var res frames.MAC
+	data := findOption(options, optionType)
+	if len(data) < len(res) {
+		return res, false
+	}
+	copy(res[:], data)
+	return res, true
+}
+
+// A neighbor is an entry in the neighbor cache.
+//
+// NOTE: this is a simplification of the states in section 7.3.2 of
+// RFC 4861. An unresolved entry is INCOMPLETE, and a resolved entry is
+// REACHABLE until its expiry, after which it is STALE. Packets are
+// still sent to a stale entry, but the first such packet starts a
+// unicast solicitation, like the PROBE state.
+type neighbor struct {
+	ip       net.IP
+	mac      frames.MAC
+	resolved bool
+	expiry   time.Time
+
+	solicitations int
+	timer         *time.Timer
+	pending       [][]byte
+}
+
+// sendToNeighbor sends an encoded packet to an address on the link,
+// resolving its MAC address if necessary.
+//
+// If the address is not resolved, the packet is queued until it is,
+// and it is dropped if the address cannot be resolved.
+func (s *Stack) sendToNeighbor(ip net.IP, packet []byte) {
+	var toSend []*frames.EthernetFrame
+
+	s.lock.Lock()
+	key := ipKey(ip)
+	n := s.neighbors[key]
+	if n == nil {
+		n = &neighbor{ip: ip.To16()}
+		s.neighbors[key] = n
+	}
+	if n.resolved {
+		toSend = append(toSend, s.frame(n.mac, packet))
+		if time.Now().After(n.expiry) {
+			toSend = append(toSend, s.startSoliciting(n)...)
+		}
+	} else {
+		n.pending = append(n.pending, packet)
+		if len(n.pending) > maxPendingPackets {
+			n.pending = n.pending[1:]
+		}
+		toSend = s.startSoliciting(n)
+	}
+	s.lock.Unlock()
+
+	s.sendAll(toSend)
+}
+
+// startSoliciting sends the first neighbor solicitation for an entry
+// if no solicitation is in progress.
+// It returns the frames to send once the lock is released.
+//
+// The caller must hold the lock.
+func (s *Stack) startSoliciting(n *neighbor) []*frames.EthernetFrame {
+	if n.timer != nil {
+		return nil
+	}
+	n.solicitations = 1
+	n.timer = time.AfterFunc(retransTimer, func() {
+		s.retrySoliciting(n)
+	})
+	return s.solicitationFrames(n)
+}
+
+// retrySoliciting resends a neighbor solicitation, or removes the
+// entry after too many solicitations.
+func (s *Stack) retrySoliciting(n *neighbor) {
+	s.lock.Lock()
+	if s.neighbors[ipKey(n.ip)] != n || n.timer == nil {
+		s.lock.Unlock()
+		return
+	}
+	limit := maxMulticastSolicit
+	if n.resolved {
+		limit = maxUnicastSolicit
+	}
+	if n.solicitations >= limit {
+		n.timer = nil
+		delete(s.neighbors, ipKey(n.ip))
+		s.lock.Unlock()
+		return
+	}
+	n.solicitations++
+	n.timer.Reset(retransTimer)
+	toSend := s.solicitationFrames(n)
+	s.lock.Unlock()
+	s.sendAll(toSend)
+}
+
+// solicitationFrames creates a neighbor solicitation for an entry.
+// Unresolved entries are solicited with the solicited-node multicast
+// address, and stale entries are probed with unicast.
+//
+// The caller must hold the lock.
+func (s *Stack) solicitationFrames(n *neighbor) []*frames.EthernetFrame {
+	source := s.sourceAddressLocked(n.ip)
+	if source == nil {
+		return nil
+	}
+	body := make([]byte, 20)
+	copy(body[4:], n.ip)
+	body = append(body, encodeOptions(ndpOption{
+		Type: optionSourceLinkLayerAddress,
+		Data: s.config.MAC[:],
+	})...)
+	msg := &icmpMessage{Type: icmpTypeNeighborSolicitation, Body: body}
+	if n.resolved {
+		return []*frames.EthernetFrame{s.frame(n.mac, ndpPacket(source, n.ip, msg))}
+	}
+	destination := SolicitedNodeAddress(n.ip)
+	return []*frames.EthernetFrame{s.frame(MulticastMAC(destination), ndpPacket(source, destination, msg))}
+}
+
+// updateNeighbor records the MAC address of an entry, flushing queued
+// packets if it was unresolved.
+// It returns the frames to send once the lock is released.
+//
+// A confirmed entry is reachable, while an unconfirmed entry (e.g. from
+// the source address of a solicitation) is stale.
+//
+// The caller must hold the lock.
+func (s *Stack) updateNeighbor(n *neighbor, mac frames.MAC, confirmed bool) []*frames.EthernetFrame {
+	if !confirmed && n.resolved && n.mac == mac {
+		return nil
+	}
+	n.mac = mac
+	n.resolved = true
+	if confirmed {
+		n.expiry = time.Now().Add(reachableTime)
+		if n.timer != nil {
+			n.timer.Stop()
+			n.timer = nil
+		}
+	} else {
+		n.expiry = time.Now()
+	}
+
+	var res []*frames.EthernetFrame
+	for _, packet := range n.pending {
+		res = append(res, s.frame(mac, packet))
+	}
+	n.pending = nil
+	return res
+}
+
+// learnNeighbor records the MAC address of a neighbor which was
+// advertised by a solicitation or a router advertisement.
+// It returns the frames to send once the lock is released.
+//
+// The caller must hold the lock.
+func (s *Stack) learnNeighbor(ip net.IP, mac frames.MAC) []*frames.EthernetFrame {
+	key := ipKey(ip)
+	n := s.neighbors[key]
+	if n == nil {
+		n = &neighbor{ip: ip.To16()}
+		s.neighbors[key] = n
+	}
+	return s.updateNeighbor(n, mac, false)
+}
+
+func (s *Stack) handleNDP(p *Packet, msg *icmpMessage) {
+	switch msg.Type {
+	case icmpTypeRouterSolicitation:
+		s.handleRouterSolicitation(p, msg)
+	case icmpTypeRouterAdvertisement:
+		s.handleRouterAdvertisement(p, msg)
+	case icmpTypeNeighborSolicitation:
+		s.handleNeighborSolicitation(p, msg)
+	case icmpTypeNeighborAdvertisement:
+		s.handleNeighborAdvertisement(p, msg)
+	}
+}
+
+// handleNeighborSolicitation validates and answers a neighbor
+// solicitation, as described in sections 7.1.1 and 7.2.3 of RFC 4861.
+func (s *Stack) handleNeighborSolicitation(p *Packet, msg *icmpMessage) {
+	if len(msg.Body) < 20 {
+		return
+	}
+	target := net.IP(append([]byte{}, msg.Body[4:20]...))
+	options, err := decodeOptions(msg.Body[20:])
+	if err != nil || target.IsMulticast() {
+		return
+	}
+	sourceMAC, hasSourceMAC := linkLayerOption(options, optionSourceLinkLayerAddress)
+	unspecified := p.Source.IsUnspecified()
+	if unspecified && (hasSourceMAC || !p.Destination.Equal(SolicitedNodeAddress(target))) {
+		return
+	}
+
+	var toSend []*frames.EthernetFrame
+
+	s.lock.Lock()
+	a := s.findAddress(target)
+	if a == nil {
+		s.lock.Unlock()
+		return
+	}
+	if a.tentative {
+		// NOTE: a solicitation from another node performing DAD means the
+		// address is a duplicate, as described in section 5.4.3 of
+		// RFC 4862. Our own solicitation may be looped back to us, which
+		// we detect with the nonce from RFC 7527.
+		if unspecified && !bytes.Equal(findOption(options, optionNonce), a.nonce) {
+			toSend = s.duplicateDetected(a)
+		}
+		s.lock.Unlock()
+		s.sendAll(toSend)
+		return
+	}
+
+	flags := advertisementFlagSolicited | advertisementFlagOverride
+	destination := p.Source
+	if unspecified {
+		flags = advertisementFlagOverride
+		destination = allNodes
+	} else if hasSourceMAC {
+		toSend = s.learnNeighbor(p.Source, sourceMAC)
+	}
+	if s.isRouter() {
+		flags |= advertisementFlagRouter
+	}
+	packet := s.advertisementPacket(target, destination, flags)
+	s.lock.Unlock()
+
+	s.sendAll(toSend)
+	if unspecified {
+		s.sendAll([]*frames.EthernetFrame{s.frame(MulticastMAC(destination), packet)})
+	} else {
+		s.sendToNeighbor(destination, packet)
+	}
+}
+
+// handleNeighborAdvertisement validates a neighbor advertisement and
+// updates the neighbor cache, as described in sections 7.1.2 and 7.2.5
+// of RFC 4861.
+func (s *Stack) handleNeighborAdvertisement(p *Packet, msg *icmpMessage) {
+	if len(msg.Body) < 20 {
+		return
+	}
+	flags := int(msg.Body[0])
+	target := net.IP(append([]byte{}, msg.Body[4:20]...))
+	options, err := decodeOptions(msg.Body[20:])
+	if err != nil || target.IsMulticast() ||
+		(flags&advertisementFlagSolicited != 0 && p.Destination.IsMulticast()) {
+		return
+	}
+	mac, hasMAC := linkLayerOption(options, optionTargetLinkLayerAddress)
+
+	var toSend []*frames.EthernetFrame
+
+	s.lock.Lock()
+	if a := s.findAddress(target); a != nil {
+		// NOTE: if the address has already passed DAD, the conflict
+		// cannot be resolved automatically (section 5.4.4 of RFC 4862),
+		// so the advertisement is ignored.
+		if a.tentative {
+			toSend = s.duplicateDetected(a)
+		}
+	} else if n := s.neighbors[ipKey(target)]; n != nil {
+		if flags&advertisementFlagRouter == 0 {
+			s.removeRouter(target)
+		}
+		solicited := flags&advertisementFlagSolicited != 0
+		override := flags&advertisementFlagOverride != 0
+		if !n.resolved {
+			if hasMAC {
+				toSend = s.updateNeighbor(n, mac, solicited)
+			}
+		} else if !hasMAC || mac == n.mac || override {
+			if !hasMAC {
+				mac = n.mac
+			}
+			if solicited {
+				toSend = s.updateNeighbor(n, mac, true)
+			} else if mac != n.mac {
+				toSend = s.updateNeighbor(n, mac, false)
+			}
+		} else {
+			// NOTE: an advertisement for a different MAC without the
+			// override flag only makes a reachable entry stale.
+			n.expiry = time.Now()
+		}
+	}
+	s.lock.Unlock()
+
+	s.sendAll(toSend)
+}
+
+// advertisementPacket creates a neighbor advertisement for one of our
+// addresses.
+//
+// The caller must hold the lock.
+func (s *Stack) advertisementPacket(target, destination net.IP, flags int) []byte {
+	body := make([]byte, 20)
+	body[0] = byte(flags)
+	copy(body[4:], target.To16())
+	body = append(body, encodeOptions(ndpOption{
+		Type: optionTargetLinkLayerAddress,
+		Data: s.config.MAC[:],
+	})...)
+	msg := &icmpMessage{Type: icmpTypeNeighborAdvertisement, Body: body}
+	return ndpPacket(target, destination, msg)
+}
+
+// ndpPacket encodes an NDP message in a packet with a hop limit of 255.
+func ndpPacket(source, destination net.IP, msg *icmpMessage) []byte {
+	packet := &Packet{
+		Header: Header{
+			NextHeader:  NextHeaderICMPv6,
+			HopLimit:    ndpHopLimit,
+			Source:      source,
+			Destination: destination,
+		},
+		Payload: msg.encode(source, destination),
+	}
+	return packet.Encode()
+}
+
+// lifetimeDeadline converts a lifetime in seconds into a deadline,
+// where the zero time means the lifetime is infinite.
+func lifetimeDeadline(seconds uint32, now time.Time) time.Time {
+	if seconds == infiniteLifetime {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(seconds) * time.Second)
+}
@@ -0,0 +1,127 @@
+package ipv6
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// These are the next header values used by wifistack.
+const (
+	NextHeaderHopByHop           = 0
+	NextHeaderTCP                = 6
+	NextHeaderUDP                = 17
+	NextHeaderRouting            = 43
+	NextHeaderFragment           = 44
+	NextHeaderICMPv6             = 58
+	NextHeaderNone               = 59
+	NextHeaderDestinationOptions = 60
+)
+
+const (
+	headerSize       = 40
+	defaultHopLimit  = 64
+	minimumLinkMTU   = 1280
+	extensionUnitLen = 8
+)
+
+var (
+	ErrBadHeader          = errors.New("invalid IPv6 header")
+	ErrBadExtensionHeader = errors.New("invalid IPv6 extension header")
+)
+
+// A Header is an IPv6 header, as described in section 3 of RFC 8200.
+type Header struct {
+	TrafficClass int
+	FlowLabel    int
+	NextHeader   int
+	HopLimit     int
+	Source       net.IP
+	Destination  net.IP
+}
+
+// A Packet is an IPv6 packet.
+type Packet struct {
+	Header
+	Payload []byte
+}
+
+// DecodePacket decodes an IPv6 packet.
+// Any data after the packet's payload length is ignored.
+//
+// Extension headers are left in the payload; see UpperLayer.
+func DecodePacket(data []byte) (*Packet, error) {
+	if len(data) < headerSize || data[0]>>4 != 6 {
+		return nil, ErrBadHeader
+	}
+	payloadSize := int(binary.BigEndian.Uint16(data[4:6]))
+	if headerSize+payloadSize > len(data) {
+		return nil, ErrBadHeader
+	}
+	info := binary.BigEndian.Uint32(data[0:4])
+	return &Packet{
+		Header: Header{
+			TrafficClass: int(info>>20) & 0xff,
+			FlowLabel:    int(info & 0xfffff),
+			NextHeader:   int(data[6]),
+			HopLimit:     int(data[7]),
+			Source:       net.IP(append([]byte{}, data[8:24]...)),
+			Destination:  net.IP(append([]byte{}, data[24:40]...)),
+		},
+		Payload: data[headerSize : headerSize+payloadSize],
+	}, nil
+}
+
+// Encode generates the binary representation of the packet.
+func (p *Packet) Encode() []byte {
+	res := make([]byte, headerSize+len(p.Payload))
+	info := uint32(6)<<28 | uint32(p.TrafficClass&0xff)<<20 | uint32(p.FlowLabel&0xfffff)
+	binary.BigEndian.PutUint32(res[0:4], info)
+	binary.BigEndian.PutUint16(res[4:6], uint16(len(p.Payload)))
+	res[6] = byte(p.NextHeader)
+	res[7] = byte(p.HopLimit)
+	copy(res[8:24], p.Source.To16())
+	copy(res[24:40], p.Destination.To16())
+	copy(res[headerSize:], p.Payload)
+	return res
+}
+
+// UpperLayer skips the hop-by-hop options, routing, and destination
+// options extension headers, and returns the upper-layer protocol and
+// its data.
+//
+// Fragmented packets are not supported, so a fragment header is
+// returned as the upper-layer protocol.
+func (p *Packet) UpperLayer() (nextHeader int, payload []byte, err error) {
+	nextHeader = p.NextHeader
+	payload = p.Payload
+	for {
+		switch nextHeader {
+		case NextHeaderHopByHop, NextHeaderRouting, NextHeaderDestinationOptions:
+		default:
+			return nextHeader, payload, nil
+		}
+		if len(payload) < 2 {
+			return 0, nil, ErrBadExtensionHeader
+		}
+		size := (int(payload[1]) + 1) * extensionUnitLen
+		if size > len(payload) {
+			return 0, nil, ErrBadExtensionHeader
+		}
+		nextHeader = int(payload[0])
+		payload = payload[size:]
+	}
+}
+
+// PseudoHeaderSum computes the sum of the pseudo-header which is
+// covered by upper-layer checksums, as described in section 8.1 of
+// RFC 8200.
+func PseudoHeaderSum(source, destination net.IP, nextHeader, length int) uint32 {
+	var sum uint32
+	s, d := source.To16(), destination.To16()
+	for i := 0; i < 16; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(s[i:]))
+		sum += uint32(binary.BigEndian.Uint16(d[i:]))
+	}
+	return sum + uint32(length>>16) + uint32(length&0xffff) + uint32(nextHeader)
+}
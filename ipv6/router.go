@@ -0,0 +1,107 @@
+package ipv6
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/unixpickle/wifistack/frames"
+)
+
+// These are the router constants from section 6.2.1 of RFC 4861,
+// along with the lifetimes which a router advertises.
+const (
+	routerAdvertisementInterval = time.Second * 200
+	advertisedRouterLifetime    = time.Second * 1800
+	advertisedValidLifetime     = 30 * 24 * 60 * 60
+	advertisedPreferredLifetime = 7 * 24 * 60 * 60
+)
+
+// isRouter checks if the stack advertises itself as a router.
+func (s *Stack) isRouter() bool {
+	return len(s.config.Prefixes) > 0
+}
+
+// handleRouterSolicitation answers a router solicitation with a
+// multicast advertisement, as described in section 6.2.6 of RFC 4861.
+func (s *Stack) handleRouterSolicitation(p *Packet, msg *icmpMessage) {
+	if !s.isRouter() || len(msg.Body) < 4 {
+		return
+	}
+	options, err := decodeOptions(msg.Body[4:])
+	if err != nil {
+		return
+	}
+	mac, hasMAC := linkLayerOption(options, optionSourceLinkLayerAddress)
+	if p.Source.IsUnspecified() && hasMAC {
+		return
+	}
+
+	var toSend []*frames.EthernetFrame
+	s.lock.Lock()
+	if hasMAC {
+		toSend = s.learnNeighbor(p.Source, mac)
+	}
+	toSend = append(toSend, s.routerAdvertisementFrames()...)
+	s.lock.Unlock()
+
+	s.sendAll(toSend)
+}
+
+// routerAdvertisementFrames creates a router advertisement for the
+// configured prefixes, which is sent to all nodes.
+//
+// The caller must hold the lock.
+func (s *Stack) routerAdvertisementFrames() []*frames.EthernetFrame {
+	source := s.sourceAddressLocked(allNodes)
+	if source == nil {
+		return nil
+	}
+
+	body := make([]byte, 12)
+	body[0] = defaultHopLimit
+	binary.BigEndian.PutUint16(body[2:4], uint16(advertisedRouterLifetime/time.Second))
+
+	mtu := make([]byte, 6)
+	binary.BigEndian.PutUint32(mtu[2:], uint32(s.mtu))
+	options := []ndpOption{
+		{Type: optionSourceLinkLayerAddress, Data: s.config.MAC[:]},
+		{Type: optionMTU, Data: mtu},
+	}
+	for _, prefix := range s.config.Prefixes {
+		ones, _ := prefix.Mask.Size()
+		data := make([]byte, 30)
+		data[0] = byte(ones)
+		data[1] = prefixFlagOnLink
+		if ones == interfaceIDBits {
+			data[1] |= prefixFlagAutonomous
+		}
+		binary.BigEndian.PutUint32(data[2:6], advertisedValidLifetime)
+		binary.BigEndian.PutUint32(data[6:10], advertisedPreferredLifetime)
+		copy(data[14:], prefix.IP.To16())
+		options = append(options, ndpOption{Type: optionPrefixInformation, Data: data})
+	}
+	body = append(body, encodeOptions(options...)...)
+
+	msg := &icmpMessage{Type: icmpTypeRouterAdvertisement, Body: body}
+	packet := ndpPacket(source, allNodes, msg)
+	return []*frames.EthernetFrame{s.frame(MulticastMAC(allNodes), packet)}
+}
+
+func (s *Stack) routerLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(routerAdvertisementInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.lock.Lock()
+			toSend := s.routerAdvertisementFrames()
+			s.lock.Unlock()
+			s.sendAll(toSend)
+		case <-s.closeChan:
+			return
+		}
+	}
+}
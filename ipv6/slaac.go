@@ -0,0 +1,374 @@
+package ipv6
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/unixpickle/wifistack/frames"
+)
+
+const (
+	// idgenRetries is the number of times a new address is generated
+	// after DAD fails, as described in section 7 of RFC 7217.
+	idgenRetries = 3
+
+	// These are the host constants from section 10 of RFC 4861.
+	maxRtrSolicitations     = 3
+	rtrSolicitationInterval = time.Second * 4
+
+	// twoHours is used by the lifetime rule in section 5.5.3 (e) of
+	// RFC 4862.
+	twoHours = time.Hour * 2
+
+	infiniteLifetime = 0xffffffff
+	nonceSize        = 6
+	interfaceIDBits  = 64
+)
+
+// An address is a unicast address assigned to the stack, as described
+// in section 5.5 of RFC 4862.
+type address struct {
+	ip         net.IP
+	prefix     net.IP
+	dadCounter int
+
+	// tentative is set until DAD completes.
+	tentative bool
+	nonce     []byte
+	timer     *time.Timer
+
+	// preferredUntil and validUntil are zero for infinite lifetimes.
+	preferredUntil time.Time
+	validUntil     time.Time
+}
+
+func (a *address) preferred(now time.Time) bool {
+	return !a.tentative && (a.preferredUntil.IsZero() || now.Before(a.preferredUntil))
+}
+
+// A defaultRouter is an entry in the default router list.
+type defaultRouter struct {
+	ip     net.IP
+	expiry time.Time
+}
+
+// An onLinkPrefix is an entry in the prefix list.
+// Its validUntil is zero for an infinite lifetime.
+type onLinkPrefix struct {
+	network    *net.IPNet
+	validUntil time.Time
+}
+
+// addAddress generates a stable address in a /64 prefix and starts
+// duplicate address detection for it.
+// It returns the frames to send once the lock is released.
+//
+// The caller must hold the lock.
+func (s *Stack) addAddress(prefix net.IP, dadCounter int,
+	preferredUntil, validUntil time.Time) []*frames.EthernetFrame {
+	ip := StableAddress(prefix, s.config.MAC, s.config.NetworkID, dadCounter, s.secretKey)
+	a := &address{
+		ip:             ip,
+		prefix:         prefix.To16().Mask(net.CIDRMask(interfaceIDBits, 128)),
+		dadCounter:     dadCounter,
+		tentative:      true,
+		nonce:          make([]byte, nonceSize),
+		preferredUntil: preferredUntil,
+		validUntil:     validUntil,
+	}
+	rand.Read(a.nonce)
+	s.addresses = append(s.addresses, a)
+	s.joinGroup(SolicitedNodeAddress(ip))
+
+	// NOTE: DupAddrDetectTransmits defaults to 1, so a single
+	// solicitation is sent, as described in section 5.4 of RFC 4862.
+	a.timer = time.AfterFunc(retransTimer, func() {
+		s.finishDAD(a)
+	})
+	body := make([]byte, 20)
+	copy(body[4:], ip)
+	body = append(body, encodeOptions(ndpOption{Type: optionNonce, Data: a.nonce})...)
+	msg := &icmpMessage{Type: icmpTypeNeighborSolicitation, Body: body}
+	destination := SolicitedNodeAddress(ip)
+	packet := ndpPacket(net.IPv6unspecified, destination, msg)
+	return []*frames.EthernetFrame{s.frame(MulticastMAC(destination), packet)}
+}
+
+// finishDAD assigns an address once DAD has completed without
+// detecting a duplicate.
+func (s *Stack) finishDAD(a *address) {
+	var toSend []*frames.EthernetFrame
+
+	s.lock.Lock()
+	if !a.tentative || s.findAddress(a.ip) != a {
+		s.lock.Unlock()
+		return
+	}
+	a.tentative = false
+	a.timer = nil
+	s.notify()
+
+	if a.ip.IsLinkLocalUnicast() {
+		if s.isRouter() {
+			toSend = s.routerAdvertisementFrames()
+		} else {
+			toSend = s.startRouterSolicitation()
+		}
+	}
+	s.lock.Unlock()
+
+	s.sendAll(toSend)
+}
+
+// duplicateDetected removes a tentative address after DAD fails, and
+// generates a new address, as described in section 6 of RFC 7217.
+// It returns the frames to send once the lock is released.
+//
+// The caller must hold the lock.
+func (s *Stack) duplicateDetected(a *address) []*frames.EthernetFrame {
+	s.removeAddress(a)
+	if a.dadCounter >= idgenRetries {
+		return nil
+	}
+	return s.addAddress(a.prefix, a.dadCounter+1, a.preferredUntil, a.validUntil)
+}
+
+// removeAddress removes an address from the stack.
+//
+// The caller must hold the lock.
+func (s *Stack) removeAddress(a *address) {
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	for i, x := range s.addresses {
+		if x == a {
+			s.addresses = append(s.addresses[:i], s.addresses[i+1:]...)
+			break
+		}
+	}
+	s.leaveGroup(SolicitedNodeAddress(a.ip))
+	s.notify()
+}
+
+// findAddress finds one of our addresses, including tentative ones.
+//
+// The caller must hold the lock.
+func (s *Stack) findAddress(ip net.IP) *address {
+	for _, a := range s.addresses {
+		if a.ip.Equal(ip) {
+			return a
+		}
+	}
+	return nil
+}
+
+// startRouterSolicitation starts soliciting routers, as described in
+// section 6.3.7 of RFC 4861.
+// It returns the frames to send once the lock is released.
+//
+// The caller must hold the lock.
+func (s *Stack) startRouterSolicitation() []*frames.EthernetFrame {
+	if s.advertised || s.solicitTimer != nil {
+		return nil
+	}
+	s.routerSolicitations = 1
+	s.solicitTimer = time.AfterFunc(rtrSolicitationInterval, s.retryRouterSolicitation)
+	return s.routerSolicitationFrames()
+}
+
+func (s *Stack) retryRouterSolicitation() {
+	s.lock.Lock()
+	if s.advertised || s.routerSolicitations >= maxRtrSolicitations {
+		s.lock.Unlock()
+		return
+	}
+	s.routerSolicitations++
+	s.solicitTimer.Reset(rtrSolicitationInterval)
+	toSend := s.routerSolicitationFrames()
+	s.lock.Unlock()
+	s.sendAll(toSend)
+}
+
+// routerSolicitationFrames creates a router solicitation from the
+// link-local address.
+//
+// The caller must hold the lock.
+func (s *Stack) routerSolicitationFrames() []*frames.EthernetFrame {
+	source := s.sourceAddressLocked(allRouters)
+	if source == nil {
+		return nil
+	}
+	body := make([]byte, 4)
+	body = append(body, encodeOptions(ndpOption{
+		Type: optionSourceLinkLayerAddress,
+		Data: s.config.MAC[:],
+	})...)
+	msg := &icmpMessage{Type: icmpTypeRouterSolicitation, Body: body}
+	packet := ndpPacket(source, allRouters, msg)
+	return []*frames.EthernetFrame{s.frame(MulticastMAC(allRouters), packet)}
+}
+
+// handleRouterAdvertisement validates a router advertisement and
+// processes it as described in section 6.3.4 of RFC 4861.
+func (s *Stack) handleRouterAdvertisement(p *Packet, msg *icmpMessage) {
+	if len(msg.Body) < 12 || !p.Source.IsLinkLocalUnicast() {
+		return
+	}
+	options, err := decodeOptions(msg.Body[12:])
+	if err != nil {
+		return
+	}
+	hopLimit := int(msg.Body[0])
+	lifetime := time.Duration(binary.BigEndian.Uint16(msg.Body[2:4])) * time.Second
+
+	var toSend []*frames.EthernetFrame
+
+	s.lock.Lock()
+	defer func() {
+		s.lock.Unlock()
+		s.sendAll(toSend)
+	}()
+
+	if s.isRouter() {
+		return
+	}
+	s.advertised = true
+	if s.solicitTimer != nil {
+		s.solicitTimer.Stop()
+	}
+
+	if hopLimit != 0 {
+		s.hopLimit = hopLimit
+	}
+	s.removeRouter(p.Source)
+	if lifetime != 0 {
+		s.routers = append(s.routers, &defaultRouter{
+			ip:     p.Source,
+			expiry: time.Now().Add(lifetime),
+		})
+	}
+	if mac, ok := linkLayerOption(options, optionSourceLinkLayerAddress); ok {
+		toSend = append(toSend, s.learnNeighbor(p.Source, mac)...)
+	}
+	if data := findOption(options, optionMTU); len(data) >= 6 {
+		mtu := int(binary.BigEndian.Uint32(data[2:6]))
+		if mtu >= minimumLinkMTU && mtu <= s.config.MTU {
+			s.mtu = mtu
+		}
+	}
+	for _, o := range options {
+		if o.Type == optionPrefixInformation {
+			toSend = append(toSend, s.handlePrefix(o.Data)...)
+		}
+	}
+}
+
+// handlePrefix processes a prefix information option, as described in
+// section 6.3.4 of RFC 4861 and section 5.5.3 of RFC 4862.
+// It returns the frames to send once the lock is released.
+//
+// The caller must hold the lock.
+func (s *Stack) handlePrefix(data []byte) []*frames.EthernetFrame {
+	if len(data) < 30 {
+		return nil
+	}
+	prefixLength := int(data[0])
+	flags := int(data[1])
+	validLifetime := binary.BigEndian.Uint32(data[2:6])
+	preferredLifetime := binary.BigEndian.Uint32(data[6:10])
+	if prefixLength > 128 || preferredLifetime > validLifetime {
+		return nil
+	}
+	mask := net.CIDRMask(prefixLength, 128)
+	prefix := net.IP(data[14:30]).Mask(mask)
+	if prefix.IsLinkLocalUnicast() {
+		return nil
+	}
+
+	now := time.Now()
+	validUntil := lifetimeDeadline(validLifetime, now)
+	preferredUntil := lifetimeDeadline(preferredLifetime, now)
+
+	if flags&prefixFlagOnLink != 0 {
+		network := &net.IPNet{IP: prefix, Mask: mask}
+		key := network.String()
+		if validLifetime == 0 {
+			delete(s.prefixes, key)
+		} else {
+			s.prefixes[key] = &onLinkPrefix{network: network, validUntil: validUntil}
+		}
+	}
+
+	// NOTE: interface identifiers are 64 bits, so only /64 prefixes can
+	// be used for autoconfiguration.
+	if flags&prefixFlagAutonomous == 0 || prefixLength != interfaceIDBits {
+		return nil
+	}
+	found := false
+	for _, a := range s.addresses {
+		if !a.prefix.Equal(prefix) {
+			continue
+		}
+		found = true
+		a.preferredUntil = preferredUntil
+
+		// NOTE: this is the rule from section 5.5.3 (e) of RFC 4862, which
+		// prevents a spoofed advertisement from expiring an address.
+		if validUntil.IsZero() || validUntil.Sub(now) > twoHours ||
+			(!a.validUntil.IsZero() && validUntil.After(a.validUntil)) {
+			a.validUntil = validUntil
+		} else if a.validUntil.IsZero() || a.validUntil.Sub(now) > twoHours {
+			a.validUntil = now.Add(twoHours)
+		}
+	}
+	if found || validLifetime == 0 {
+		return nil
+	}
+	return s.addAddress(prefix, 0, preferredUntil, validUntil)
+}
+
+// removeRouter removes an address from the default router list.
+//
+// The caller must hold the lock.
+func (s *Stack) removeRouter(ip net.IP) {
+	for i, r := range s.routers {
+		if r.ip.Equal(ip) {
+			s.routers = append(s.routers[:i], s.routers[i+1:]...)
+			return
+		}
+	}
+}
+
+// expire removes addresses, routers, prefixes, and neighbor cache
+// entries which have timed out.
+func (s *Stack) expire(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := 0; i < len(s.addresses); i++ {
+		a := s.addresses[i]
+		if !a.validUntil.IsZero() && now.After(a.validUntil) {
+			s.removeAddress(a)
+			i--
+		}
+	}
+	for i := 0; i < len(s.routers); i++ {
+		if now.After(s.routers[i].expiry) {
+			s.routers = append(s.routers[:i], s.routers[i+1:]...)
+			i--
+		}
+	}
+	for key, prefix := range s.prefixes {
+		if !prefix.validUntil.IsZero() && now.After(prefix.validUntil) {
+			delete(s.prefixes, key)
+		}
+	}
+	for key, n := range s.neighbors {
+		if n.resolved && n.timer == nil && now.Sub(n.expiry) > neighborGCTime {
+			delete(s.neighbors, key)
+		}
+	}
+}
@@ -0,0 +1,589 @@
+// Package ipv6 implements IPv6, Neighbor Discovery, stateless address
+// autoconfiguration, ICMPv6 echo, and UDP on top of a
+// wifistack.EthernetStream.
+package ipv6
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	mathrand "math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/frames"
+)
+
+const (
+	defaultMTU         = 1500
+	secretKeySize      = 32
+	incomingBufferSize = 64
+	outgoingBufferSize = 16
+	loopbackBufferSize = 64
+	expiryPeriod       = time.Second
+)
+
+var (
+	ErrNoRoute      = errors.New("no route to host")
+	ErrNoAddress    = errors.New("no suitable source address")
+	ErrPacketTooBig = errors.New("packet too big")
+	ErrNotMulticast = errors.New("not a multicast address")
+	ErrClosed       = errors.New("IPv6 stack closed")
+)
+
+// Config stores the configuration for a Stack.
+type Config struct {
+	// Stream is used to send and receive IPv6 packets.
+	// The Stack handles the stream's IPv6 frames, so the stream may be
+	// shared with an ipv4.Stack. The Stack never closes the stream.
+	Stream *wifistack.EthernetStream
+
+	// MAC is the hardware address of this station.
+	MAC frames.MAC
+
+	// NetworkID identifies the network (e.g. by its SSID), so that the
+	// stable addresses from RFC 7217 differ between networks.
+	NetworkID []byte
+
+	// SecretKey is mixed into stable addresses, so that they cannot be
+	// predicted from the MAC address.
+	// If this is nil, a random key is generated, in which case addresses
+	// are only stable for the lifetime of the Stack.
+	SecretKey []byte
+
+	// MTU is the largest packet which may be sent.
+	// If this is 0, a default value is used.
+	MTU int
+
+	// Prefixes is a list of on-link prefixes to advertise.
+	// If it is non-empty, the stack acts as the router of the link: it
+	// sends router advertisements (section 6.2 of RFC 4861) rather than
+	// processing them, and it assigns itself an address in each /64
+	// prefix. The stack never forwards packets.
+	Prefixes []*net.IPNet
+}
+
+// A Stack sends and receives IPv6 packets.
+//
+// It configures a link-local address and, once a router advertises
+// prefixes, global addresses, as described in RFC 4862. Addresses are
+// generated with RFC 7217 and checked with duplicate address detection.
+// Neighbors are resolved with Neighbor Discovery from RFC 4861.
+//
+// The stack answers ICMPv6 echo requests, provides UDP sockets, and
+// dispatches other protocols to handlers registered with
+// HandleProtocol.
+//
+// Multicast packets are sent to the group MAC addresses from RFC 2464,
+// and only the group MAC addresses of joined groups are received.
+type Stack struct {
+	// hasClosed is used to atomically ensure that closeChan is closed only once.
+	hasClosed uint32
+	closeChan chan struct{}
+
+	config        Config
+	secretKey     []byte
+	removeHandler func()
+	incoming      chan *frames.EthernetFrame
+	outgoing      chan *frames.EthernetFrame
+	loopback      chan *Packet
+	pingID        int
+
+	lock         sync.Mutex
+	mtu          int
+	hopLimit     int
+	addresses    []*address
+	groups       map[[16]byte]int
+	neighbors    map[[16]byte]*neighbor
+	routers      []*defaultRouter
+	prefixes     map[string]*onLinkPrefix
+	handlers     map[int]func(p *Packet)
+	pingSequence int
+	pings        map[int]chan struct{}
+	udpConns     map[int]*UDPConn
+	nextUDPPort  int
+
+	// changed is closed and replaced whenever an address is added or
+	// removed.
+	changed chan struct{}
+
+	advertised          bool
+	routerSolicitations int
+	solicitTimer        *time.Timer
+
+	wg sync.WaitGroup
+}
+
+// NewStack creates a Stack and starts processing the stream.
+// You must call Close once you are done with the stack.
+func NewStack(c Config) *Stack {
+	if c.MTU == 0 {
+		c.MTU = defaultMTU
+	} else if c.MTU < minimumLinkMTU {
+		c.MTU = minimumLinkMTU
+	}
+	secretKey := c.SecretKey
+	if secretKey == nil {
+		secretKey = make([]byte, secretKeySize)
+		rand.Read(secretKey)
+	}
+	res := &Stack{
+		closeChan: make(chan struct{}),
+		config:    c,
+		secretKey: secretKey,
+		incoming:  make(chan *frames.EthernetFrame, incomingBufferSize),
+		outgoing:  make(chan *frames.EthernetFrame, outgoingBufferSize),
+		loopback:  make(chan *Packet, loopbackBufferSize),
+		pingID:    mathrand.Intn(0x10000),
+
+		mtu:       c.MTU,
+		hopLimit:  defaultHopLimit,
+		groups:    map[[16]byte]int{},
+		neighbors: map[[16]byte]*neighbor{},
+		prefixes:  map[string]*onLinkPrefix{},
+		pings:     map[int]chan struct{}{},
+		changed:   make(chan struct{}),
+
+		udpConns:    map[int]*UDPConn{},
+		nextUDPPort: ephemeralPortMin + mathrand.Intn(ephemeralPortMax-ephemeralPortMin+1),
+	}
+	res.handlers = map[int]func(p *Packet){
+		NextHeaderICMPv6: res.handleICMP,
+		NextHeaderUDP:    res.handleUDP,
+	}
+
+	res.removeHandler = c.Stream.HandleEtherType(frames.EtherTypeIPv6, func(f *frames.EthernetFrame) {
+		select {
+		case res.incoming <- f:
+		default:
+		}
+	})
+	res.wg.Add(2)
+	go res.incomingLoop()
+	go res.outgoingLoop()
+	if res.isRouter() {
+		res.wg.Add(1)
+		go res.routerLoop()
+	}
+
+	res.lock.Lock()
+	res.joinGroup(allNodes)
+	if res.isRouter() {
+		res.joinGroup(allRouters)
+	}
+	toSend := res.addAddress(linkLocalPrefix.IP, 0, time.Time{}, time.Time{})
+	for _, prefix := range c.Prefixes {
+		network := &net.IPNet{IP: prefix.IP.To16().Mask(prefix.Mask), Mask: prefix.Mask}
+		res.prefixes[network.String()] = &onLinkPrefix{network: network}
+		if ones, _ := prefix.Mask.Size(); ones == interfaceIDBits {
+			toSend = append(toSend, res.addAddress(network.IP, 0, time.Time{}, time.Time{})...)
+		}
+	}
+	res.lock.Unlock()
+	res.sendAll(toSend)
+
+	return res
+}
+
+// Addresses returns the addresses which have passed duplicate address
+// detection, including deprecated addresses.
+func (s *Stack) Addresses() []net.IP {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var res []net.IP
+	for _, a := range s.addresses {
+		if !a.tentative {
+			res = append(res, a.ip)
+		}
+	}
+	return res
+}
+
+// WaitAddress waits until the stack has a preferred address.
+// If global is true, it waits for an address which is not link-local,
+// which requires a router advertisement.
+func (s *Stack) WaitAddress(ctx context.Context, global bool) (net.IP, error) {
+	for {
+		s.lock.Lock()
+		now := time.Now()
+		for _, a := range s.addresses {
+			if a.preferred(now) && a.ip.IsLinkLocalUnicast() != global {
+				s.lock.Unlock()
+				return a.ip, nil
+			}
+		}
+		changed := s.changed
+		s.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.closeChan:
+			return nil, ErrClosed
+		}
+	}
+}
+
+// MTU returns the current MTU of the link, which may be lowered by
+// router advertisements.
+func (s *Stack) MTU() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.mtu
+}
+
+// HandleProtocol registers a handler for incoming packets of an
+// upper-layer protocol, replacing any previous handler.
+// Registering a handler for ICMPv6 or UDP replaces the built-in
+// implementation (for ICMPv6, including Neighbor Discovery), and a nil
+// handler drops the protocol's packets.
+//
+// The handler is called with packets whose extension headers have been
+// removed, so that NextHeader is the upper-layer protocol and Payload is
+// its data. It is called from the stack's incoming goroutine, so it
+// should not block.
+func (s *Stack) HandleProtocol(nextHeader int, handler func(p *Packet)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if handler == nil {
+		delete(s.handlers, nextHeader)
+	} else {
+		s.handlers[nextHeader] = handler
+	}
+}
+
+// JoinGroup starts receiving packets for a multicast address.
+// Groups are reference counted, so each call must be balanced by a
+// call to LeaveGroup.
+func (s *Stack) JoinGroup(group net.IP) error {
+	if group.To16() == nil || !group.IsMulticast() {
+		return ErrNotMulticast
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.joinGroup(group)
+	return nil
+}
+
+// LeaveGroup undoes a call to JoinGroup.
+func (s *Stack) LeaveGroup(group net.IP) error {
+	if group.To16() == nil || !group.IsMulticast() {
+		return ErrNotMulticast
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.leaveGroup(group)
+	return nil
+}
+
+// Send sends a payload to a destination from the most appropriate
+// local address.
+//
+// Packets are never fragmented, so ErrPacketTooBig is returned if the
+// packet does not fit in the MTU.
+// The packet is dropped silently if the next hop cannot be resolved.
+func (s *Stack) Send(destination net.IP, nextHeader int, payload []byte) error {
+	destination = destination.To16()
+	if destination == nil || destination.To4() != nil {
+		return ErrNoRoute
+	}
+	source := s.sourceAddress(destination)
+	if source == nil {
+		return ErrNoAddress
+	}
+	return s.send(&Packet{
+		Header: Header{
+			NextHeader:  nextHeader,
+			HopLimit:    s.currentHopLimit(),
+			Source:      source,
+			Destination: destination,
+		},
+		Payload: payload,
+	})
+}
+
+// SourceAddress returns the local address which Send uses for a
+// destination, or nil if there is none.
+func (s *Stack) SourceAddress(destination net.IP) net.IP {
+	return s.sourceAddress(destination)
+}
+
+// Close stops the stack and removes its handler from the stream.
+// Pending pings fail, and queued packets are dropped.
+func (s *Stack) Close() {
+	if atomic.SwapUint32(&s.hasClosed, 1) == 0 {
+		close(s.closeChan)
+	}
+	s.removeHandler()
+	s.lock.Lock()
+	for _, a := range s.addresses {
+		if a.timer != nil {
+			a.timer.Stop()
+		}
+	}
+	for _, n := range s.neighbors {
+		if n.timer != nil {
+			n.timer.Stop()
+		}
+	}
+	if s.solicitTimer != nil {
+		s.solicitTimer.Stop()
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+}
+
+// send sends a complete packet.
+func (s *Stack) send(p *Packet) error {
+	select {
+	case <-s.closeChan:
+		return ErrClosed
+	default:
+	}
+
+	data := p.Encode()
+
+	s.lock.Lock()
+	mtu := s.mtu
+	local := s.findAddress(p.Destination)
+	s.lock.Unlock()
+
+	if len(data) > mtu {
+		return ErrPacketTooBig
+	}
+
+	// NOTE: packets to a local address never reach the link layer.
+	// They are delivered from the incoming goroutine, like any other
+	// packet, so that handlers may safely send replies.
+	if local != nil && !local.tentative {
+		select {
+		case s.loopback <- p:
+		default:
+		}
+		return nil
+	}
+
+	if p.Destination.IsMulticast() {
+		s.sendAll([]*frames.EthernetFrame{s.frame(MulticastMAC(p.Destination), data)})
+		return nil
+	}
+	nextHop, err := s.nextHop(p.Destination)
+	if err != nil {
+		return err
+	}
+	s.sendToNeighbor(nextHop, data)
+	return nil
+}
+
+// nextHop decides where to send a unicast packet, as described in
+// section 5.2 of RFC 4861.
+//
+// NOTE: following RFC 4943, destinations are not assumed to be on-link
+// when there is no default router.
+func (s *Stack) nextHop(destination net.IP) (net.IP, error) {
+	if destination.IsLinkLocalUnicast() {
+		return destination, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, prefix := range s.prefixes {
+		if prefix.network.Contains(destination) {
+			return destination, nil
+		}
+	}
+	if len(s.routers) > 0 {
+		return s.routers[0].ip, nil
+	}
+	return nil, ErrNoRoute
+}
+
+func (s *Stack) sourceAddress(destination net.IP) net.IP {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sourceAddressLocked(destination)
+}
+
+// sourceAddressLocked selects a source address for a destination.
+//
+// NOTE: this is a simplification of section 5 of RFC 6724, which
+// prefers an address of the same scope and avoids deprecated addresses.
+//
+// The caller must hold the lock.
+func (s *Stack) sourceAddressLocked(destination net.IP) net.IP {
+	if a := s.findAddress(destination); a != nil && !a.tentative {
+		return a.ip
+	}
+	linkScope := destination.IsLinkLocalUnicast() || destination.IsLinkLocalMulticast() ||
+		destination.IsInterfaceLocalMulticast()
+	now := time.Now()
+	var deprecated net.IP
+	for _, a := range s.addresses {
+		if a.tentative || a.ip.IsLinkLocalUnicast() != linkScope {
+			continue
+		}
+		if a.preferred(now) {
+			return a.ip
+		}
+		if deprecated == nil {
+			deprecated = a.ip
+		}
+	}
+	return deprecated
+}
+
+func (s *Stack) currentHopLimit() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.hopLimit
+}
+
+// joinGroup increments the reference count of a multicast group.
+//
+// The caller must hold the lock.
+func (s *Stack) joinGroup(group net.IP) {
+	s.groups[ipKey(group)]++
+}
+
+// leaveGroup decrements the reference count of a multicast group.
+//
+// The caller must hold the lock.
+func (s *Stack) leaveGroup(group net.IP) {
+	key := ipKey(group)
+	if s.groups[key] <= 1 {
+		delete(s.groups, key)
+	} else {
+		s.groups[key]--
+	}
+}
+
+// notify wakes up calls which are waiting for an address.
+//
+// The caller must hold the lock.
+func (s *Stack) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// acceptsMAC checks if a frame's destination is this station or the
+// group MAC address of a joined group.
+func (s *Stack) acceptsMAC(mac frames.MAC) bool {
+	if mac == s.config.MAC {
+		return true
+	}
+	if mac[0] != 0x33 || mac[1] != 0x33 {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key := range s.groups {
+		if MulticastMAC(key[:]) == mac {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts checks if an incoming packet is addressed to this host.
+//
+// NOTE: packets for tentative addresses are dropped, as described in
+// section 5.4 of RFC 4862. DAD messages are still received, since they
+// are sent to multicast groups.
+func (s *Stack) accepts(destination net.IP) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if destination.IsMulticast() {
+		return s.groups[ipKey(destination)] > 0
+	}
+	a := s.findAddress(destination)
+	return a != nil && !a.tentative
+}
+
+// deliver dispatches a packet to the handler of its upper-layer
+// protocol.
+func (s *Stack) deliver(p *Packet) {
+	nextHeader, payload, err := p.UpperLayer()
+	if err != nil {
+		return
+	}
+	upper := &Packet{Header: p.Header, Payload: payload}
+	upper.NextHeader = nextHeader
+
+	s.lock.Lock()
+	handler := s.handlers[nextHeader]
+	s.lock.Unlock()
+	if handler != nil {
+		handler(upper)
+	}
+}
+
+func (s *Stack) frame(destination frames.MAC, packet []byte) *frames.EthernetFrame {
+	return &frames.EthernetFrame{
+		Destination: destination,
+		Source:      s.config.MAC,
+		EtherType:   frames.EtherTypeIPv6,
+		Payload:     packet,
+	}
+}
+
+func (s *Stack) sendAll(toSend []*frames.EthernetFrame) {
+	for _, f := range toSend {
+		select {
+		case s.outgoing <- f:
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+func (s *Stack) incomingLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(expiryPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case frame := <-s.incoming:
+			s.handleFrame(frame)
+		case packet := <-s.loopback:
+			s.deliver(packet)
+		case now := <-ticker.C:
+			s.expire(now)
+		case <-s.config.Stream.Done():
+			return
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+func (s *Stack) outgoingLoop() {
+	defer s.wg.Done()
+	for {
+		select {
+		case frame := <-s.outgoing:
+			select {
+			case s.config.Stream.Outgoing() <- frame:
+			case <-s.closeChan:
+				return
+			}
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+func (s *Stack) handleFrame(frame *frames.EthernetFrame) {
+	if !s.acceptsMAC(frame.Destination) {
+		return
+	}
+	packet, err := DecodePacket(frame.Payload)
+	if err != nil || packet.Source.IsMulticast() || !s.accepts(packet.Destination) {
+		return
+	}
+	s.deliver(packet)
+}
@@ -0,0 +1,154 @@
+package ipv6
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/frames"
+	"github.com/unixpickle/wifistack/sim"
+)
+
+const (
+	testTimeout = time.Second * 5
+	testSSID    = "wifistack"
+	pingCount   = 4
+)
+
+var (
+	testBSSID     = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	testRouterMAC = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	testClient    = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x03}
+
+	testPrefix    = &net.IPNet{IP: net.ParseIP("2001:db8:1::"), Mask: net.CIDRMask(64, 128)}
+	testSecretKey = []byte("secret")
+)
+
+func TestSimulatedNetwork(t *testing.T) {
+	medium := sim.NewMedium()
+	ap, err := sim.NewAccessPoint(medium.NewStream(), sim.AccessPointConfig{
+		SSID:    testSSID,
+		BSSID:   testBSSID,
+		Channel: 6,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ap.Close()
+
+	// NOTE: the router sits on the distribution system and advertises
+	// a prefix, from which the client configures a global address.
+	routerEthernet := wifistack.NewEthernetStream(ap.DS(), testRouterMAC)
+	defer close(routerEthernet.Outgoing())
+	router := NewStack(Config{
+		Stream:   routerEthernet,
+		MAC:      testRouterMAC,
+		Prefixes: []*net.IPNet{testPrefix},
+	})
+	defer router.Close()
+
+	clientEthernet := wifistack.NewEthernetStream(joinTestNetwork(t, medium), testClient)
+	defer close(clientEthernet.Outgoing())
+	client := NewStack(Config{
+		Stream:    clientEthernet,
+		MAC:       testClient,
+		NetworkID: []byte(testSSID),
+		SecretKey: testSecretKey,
+	})
+	defer client.Close()
+
+	t.Run("DAD", func(t *testing.T) {
+		if addrs := client.Addresses(); len(addrs) != 0 {
+			t.Fatalf("tentative addresses were listed: %v", addrs)
+		}
+
+		// NOTE: the router claims the client's first link-local
+		// candidate while it is still tentative, so the client must
+		// pick the next one.
+		conflict := StableAddress(linkLocalPrefix.IP, testClient, []byte(testSSID), 0,
+			testSecretKey)
+		router.lock.Lock()
+		packet := router.advertisementPacket(conflict, allNodes, advertisementFlagOverride)
+		router.lock.Unlock()
+		router.sendAll([]*frames.EthernetFrame{router.frame(MulticastMAC(allNodes), packet)})
+
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		linkLocal, err := client.WaitAddress(ctx, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := StableAddress(linkLocalPrefix.IP, testClient, []byte(testSSID), 1,
+			testSecretKey)
+		if !linkLocal.Equal(expected) {
+			t.Fatalf("expected link-local address %v but got %v", expected, linkLocal)
+		}
+	})
+
+	t.Run("SLAAC", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout*2)
+		defer cancel()
+		global, err := client.WaitAddress(ctx, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testPrefix.Contains(global) {
+			t.Fatalf("address %v is not in prefix %v", global, testPrefix)
+		}
+		expected := StableAddress(testPrefix.IP, testClient, []byte(testSSID), 0,
+			testSecretKey)
+		if !global.Equal(expected) {
+			t.Fatalf("expected global address %v but got %v", expected, global)
+		}
+	})
+
+	t.Run("Ping", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		routerAddress, err := router.WaitAddress(ctx, true)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), testTimeout)
+		clientAddress, err := client.WaitAddress(ctx, true)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < pingCount; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			_, err := client.Ping(ctx, routerAddress)
+			if err == nil {
+				_, err = router.Ping(ctx, clientAddress)
+			}
+			cancel()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+// joinTestNetwork connects a station to the simulated AP.
+func joinTestNetwork(t *testing.T, medium *sim.Medium) wifistack.MSDUStream {
+	stream := medium.NewStream()
+	scanRes, _ := wifistack.ScanNetworks(stream)
+	var bss *frames.BSSDescription
+	for desc := range scanRes {
+		if desc.BSSID == testBSSID {
+			desc := desc
+			bss = &desc
+		}
+	}
+	if bss == nil {
+		t.Fatal("simulated AP not found")
+	}
+	handshaker := wifistack.Handshaker{Stream: stream, Client: testClient, BSS: *bss}
+	link, err := handshaker.HandshakeOpen(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wifistack.NewOpenMSDUStream(wifistack.NewOpenMSDUStreamConfig(stream, link))
+}
@@ -0,0 +1,166 @@
+package wifistack
+
+import (
+	"sort"
+
+	"github.com/unixpickle/gofi"
+	"github.com/unixpickle/wifistack/frames"
+)
+
+// defaultFragmentThreshold is the largest MPDU payload which does
+// not have to be fragmented.
+const defaultFragmentThreshold = 2346
+
+// A Link describes the parameters which were negotiated with an AP
+// during association.
+type Link struct {
+	BSS    frames.BSSDescription
+	Client frames.MAC
+
+	// AssociationID is the AID which the AP assigned to us.
+	AssociationID uint16
+
+	// Capabilities is the capability information field from the
+	// association response.
+	Capabilities uint16
+
+	// ListenInterval is the listen interval which we requested,
+	// measured in beacon intervals.
+	ListenInterval uint16
+
+	// BasicRates lists the rates which every station in the BSS must
+	// support, in ascending order.
+	BasicRates []gofi.DataRate
+
+	// Rates lists the rates which both we and the AP support,
+	// in ascending order.
+	Rates []gofi.DataRate
+
+	// WMM stores the QoS parameters from the association response.
+	// It is nil if the association does not use QoS.
+	WMM *frames.WMMParameters
+
+	// UAPSD is true if we requested U-APSD and the AP supports it.
+	UAPSD bool
+
+	// HTOperation and VHTOperation are nil unless the AP included
+	// the corresponding elements in its association response.
+	HTOperation  *frames.HTOperation
+	VHTOperation *frames.VHTOperation
+
+	// Elements contains every element from the association response.
+	Elements frames.Elements
+
+	// Sequences is the allocator which the handshake used for its
+	// frames, which should be used for every later frame we send.
+	Sequences *SequenceAllocator
+}
+
+// newLink generates a Link from an association response.
+func newLink(h *Handshaker, resp *frames.AssocResponse, listenInterval uint16) *Link {
+	res := &Link{
+		BSS:            h.BSS,
+		Client:         h.Client,
+		AssociationID:  resp.AssociationID & 0x3fff,
+		Capabilities:   resp.Capabilities,
+		ListenInterval: listenInterval,
+		WMM:            frames.DecodeWMMParameters(resp.Elements),
+		Elements:       resp.Elements,
+		Sequences:      h.Sequences,
+	}
+
+	supported := map[gofi.DataRate]bool{}
+	for _, r := range h.Stream.SupportedRates() {
+		supported[r] = true
+	}
+	for _, id := range []frames.ElementID{frames.ElementIDSupportedRates,
+		frames.ElementIDExtendedSupportedRates} {
+		for _, r := range resp.Elements.Get(id) {
+			rate := gofi.DataRate(r & 0x7f)
+			if (r & 0x80) != 0 {
+				res.BasicRates = append(res.BasicRates, rate)
+			}
+			if supported[rate] {
+				res.Rates = append(res.Rates, rate)
+			}
+		}
+	}
+	if len(res.Rates) == 0 {
+		// NOTE: some APs do not repeat their rates in the association response.
+		res.Rates = NegotiatedRates(h.Stream, h.BSS)
+	}
+	sortRates(res.BasicRates)
+	sortRates(res.Rates)
+
+	res.UAPSD = h.UAPSD && res.WMM != nil && res.WMM.UAPSD()
+
+	if ht := resp.Elements.Get(frames.ElementIDHTOperation); ht != nil {
+		res.HTOperation, _ = frames.DecodeHTOperation(ht)
+	}
+	if vht := resp.Elements.Get(frames.ElementIDVHTOperation); vht != nil {
+		res.VHTOperation, _ = frames.DecodeVHTOperation(vht)
+	}
+
+	return res
+}
+
+// NewOpenMSDUStreamConfig creates a configuration for an OpenMSDUStream
+// which uses the parameters negotiated for a Link.
+//
+// The data rate is chosen by a MinstrelController over the negotiated
+// rates, QoS data frames are used if the association uses QoS, and our
+// own broadcasts are dropped when the AP echoes them back.
+// Power save is not enabled, but PowerSave can be set afterwards using
+// the link's AssociationID and ListenInterval.
+func NewOpenMSDUStreamConfig(s Stream, l *Link) OpenMSDUStreamConfig {
+	res := OpenMSDUStreamConfig{
+		FragmentThreshold: defaultFragmentThreshold,
+		BSSID:             l.BSS.BSSID,
+		Client:            l.Client,
+		Stream:            s,
+		QoS:               l.WMM != nil,
+		DropEchoes:        true,
+		BasicRates:        l.BasicRates,
+		Sequences:         l.Sequences,
+	}
+	if len(l.BasicRates) > 0 {
+		res.DataRate = l.BasicRates[0]
+	} else if len(l.Rates) > 0 {
+		res.DataRate = l.Rates[0]
+	}
+	if len(l.Rates) > 1 {
+		res.RateController = NewMinstrelController(l.Rates)
+	}
+	return res
+}
+
+// associationRates generates the values of the Supported Rates and Extended
+// Supported Rates elements for an association request.
+func associationRates(s Stream, bss frames.BSSDescription) (supported, extended []byte) {
+	basic := map[byte]bool{}
+	for _, r := range bss.BasicRates {
+		basic[r] = true
+	}
+
+	var rates []byte
+	for _, r := range bss.BasicRates {
+		rates = append(rates, r|0x80)
+	}
+	for _, r := range NegotiatedRates(s, bss) {
+		if !basic[byte(r)] {
+			rates = append(rates, byte(r))
+		}
+	}
+
+	// NOTE: the Supported Rates element holds at most 8 rates.
+	if len(rates) > 8 {
+		return rates[:8], rates[8:]
+	}
+	return rates, nil
+}
+
+func sortRates(rates []gofi.DataRate) {
+	sort.Slice(rates, func(i, j int) bool {
+		return rates[i] < rates[j]
+	})
+}
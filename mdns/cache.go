@@ -0,0 +1,130 @@
+package mdns
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/unixpickle/wifistack/dns"
+)
+
+const (
+	// cacheFlushBit is the top bit of the class of a record, which marks
+	// it as the complete set of records for its name and type, as
+	// described in section 10.2 of RFC 6762.
+	cacheFlushBit = 0x8000
+	classMask     = 0x7fff
+
+	// flushDelay is how long flushed and goodbye records are kept, from
+	// sections 10.1 and 10.2 of RFC 6762.
+	flushDelay = time.Second
+
+	maxCacheKeys = 1024
+)
+
+type cacheKey struct {
+	name  string
+	rtype int
+}
+
+type cachedRecord struct {
+	dns.Resource
+	received time.Time
+	expiry   time.Time
+}
+
+// addRecord caches a record from a response.
+//
+// The caller must hold the lock.
+func (c *Client) addRecord(r dns.Resource, now time.Time) {
+	flush := r.Class&cacheFlushBit != 0
+	r.Class &= classMask
+	if r.Class != dns.ClassINET || r.Type == dns.TypeOPT {
+		return
+	}
+	key := cacheKey{name: dns.CanonicalName(r.Name), rtype: r.Type}
+
+	records, ok := c.cache[key]
+	if !ok && len(c.cache) >= maxCacheKeys {
+		c.removeExpired(now)
+		if len(c.cache) >= maxCacheKeys {
+			return
+		}
+	}
+
+	expiry := now.Add(time.Duration(r.TTL) * time.Second)
+	if r.TTL == 0 {
+		// NOTE: this is a goodbye record, so the record expires soon.
+		expiry = now.Add(flushDelay)
+	}
+
+	found := false
+	for _, existing := range records {
+		if bytes.Equal(existing.Data, r.Data) {
+			existing.Resource = r
+			existing.received = now
+			existing.expiry = expiry
+			found = true
+		} else if flush && now.Sub(existing.received) > flushDelay &&
+			existing.expiry.After(now.Add(flushDelay)) {
+			existing.expiry = now.Add(flushDelay)
+		}
+	}
+	if !found && r.TTL != 0 {
+		records = append(records, &cachedRecord{Resource: r, received: now, expiry: expiry})
+	}
+	c.cache[key] = records
+}
+
+// lookup returns the unexpired records for a name and type, with TTLs
+// reduced by the time which has passed since they were received.
+func (c *Client) lookup(name string, rtype int) []dns.Resource {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	var res []dns.Resource
+	for _, record := range c.cache[cacheKey{name: dns.CanonicalName(name), rtype: rtype}] {
+		if now.Before(record.expiry) {
+			r := record.Resource
+			r.TTL = uint32(record.expiry.Sub(now) / time.Second)
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// knownAnswers returns the cached records for a name and type which
+// have more than half of their TTL remaining.
+func (c *Client) knownAnswers(name string, rtype int) []dns.Resource {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	var res []dns.Resource
+	for _, record := range c.cache[cacheKey{name: dns.CanonicalName(name), rtype: rtype}] {
+		remaining := record.expiry.Sub(now)
+		if remaining > time.Duration(record.TTL)*time.Second/2 {
+			r := record.Resource
+			r.TTL = uint32(remaining / time.Second)
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// removeExpired removes the expired records from the cache.
+//
+// The caller must hold the lock.
+func (c *Client) removeExpired(now time.Time) {
+	for key, records := range c.cache {
+		var kept []*cachedRecord
+		for _, record := range records {
+			if now.Before(record.expiry) {
+				kept = append(kept, record)
+			}
+		}
+		if len(kept) == 0 {
+			delete(c.cache, key)
+		} else {
+			c.cache[key] = kept
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// Package mdns implements a Multicast DNS (RFC 6762) querier and DNS
+// Service Discovery (RFC 6763) over wifistack's IP layers, so that
+// services on a joined network can be found without a host network
+// stack.
+package mdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unixpickle/wifistack/dns"
+	"github.com/unixpickle/wifistack/ipv4"
+	"github.com/unixpickle/wifistack/ipv6"
+)
+
+// Port is the UDP port of Multicast DNS.
+const Port = 5353
+
+const (
+	initialQueryInterval = time.Second
+	maxQueryInterval     = time.Hour
+
+	// maxQuerySize keeps queries, including their known answers, below
+	// the IPv6 minimum MTU.
+	maxQuerySize   = 1200
+	maxMessageSize = 9000
+)
+
+// These are the multicast addresses of Multicast DNS, which are sent to
+// the group MAC addresses 01:00:5e:00:00:fb and 33:33:00:00:00:fb.
+var (
+	IPv4Group = net.IPv4(224, 0, 0, 251)
+	IPv6Group = net.ParseIP("ff02::fb")
+)
+
+var (
+	ErrNoStacks = errors.New("no IP stacks for Multicast DNS")
+	ErrClosed   = errors.New("Multicast DNS client closed")
+)
+
+// Config stores the configuration for a Client.
+// At least one of the stacks must be set.
+type Config struct {
+	// IPv4 is used to send and receive messages with 224.0.0.251.
+	IPv4 *ipv4.Stack
+
+	// IPv6 is used to send and receive messages with ff02::fb.
+	IPv6 *ipv6.Stack
+}
+
+// A Client sends Multicast DNS queries and caches the records in the
+// responses which it receives, including unsolicited responses.
+//
+// The client binds port 5353 on each stack, and it does not answer
+// queries or publish records of its own.
+type Client struct {
+	// hasClosed is used to atomically ensure that closeChan is closed only once.
+	hasClosed uint32
+	closeChan chan struct{}
+
+	config Config
+	conns  []net.PacketConn
+	groups []*net.UDPAddr
+
+	lock  sync.Mutex
+	cache map[cacheKey][]*cachedRecord
+
+	// changed is closed and replaced whenever a record is cached.
+	changed chan struct{}
+
+	wg sync.WaitGroup
+}
+
+// NewClient creates a Client and starts receiving responses.
+// You must call Close once you are done with the client.
+func NewClient(c Config) (*Client, error) {
+	if c.IPv4 == nil && c.IPv6 == nil {
+		return nil, ErrNoStacks
+	}
+	res := &Client{
+		closeChan: make(chan struct{}),
+		config:    c,
+		cache:     map[cacheKey][]*cachedRecord{},
+		changed:   make(chan struct{}),
+	}
+	if c.IPv4 != nil {
+		conn, err := c.IPv4.ListenUDP(Port)
+		if err != nil {
+			return nil, err
+		}
+		res.conns = append(res.conns, conn)
+		res.groups = append(res.groups, &net.UDPAddr{IP: IPv4Group, Port: Port})
+	}
+	if c.IPv6 != nil {
+		conn, err := c.IPv6.ListenUDP(Port)
+		if err != nil {
+			for _, conn := range res.conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		c.IPv6.JoinGroup(IPv6Group)
+		res.conns = append(res.conns, conn)
+		res.groups = append(res.groups, &net.UDPAddr{IP: IPv6Group, Port: Port})
+	}
+	for _, conn := range res.conns {
+		res.wg.Add(1)
+		go res.receiveLoop(conn)
+	}
+	return res, nil
+}
+
+// Query finds the records of a type for a name, sending queries with
+// exponential backoff until a record is found.
+//
+// Query returns as soon as any record is found, so Browse should be
+// used for names with many records, such as DNS-SD service types.
+func (c *Client) Query(ctx context.Context, name string, qtype int) ([]dns.Resource, error) {
+	if !dns.IsAbsolute(name) {
+		name += "."
+	}
+	var res []dns.Resource
+	err := c.await(ctx, []dns.Question{{Name: name, Type: qtype, Class: dns.ClassINET}},
+		func() bool {
+			res = c.lookup(name, qtype)
+			return len(res) > 0
+		})
+	return res, err
+}
+
+// Close stops the client and unbinds its sockets.
+func (c *Client) Close() {
+	if atomic.SwapUint32(&c.hasClosed, 1) == 0 {
+		close(c.closeChan)
+		for _, conn := range c.conns {
+			conn.Close()
+		}
+		if c.config.IPv6 != nil {
+			c.config.IPv6.LeaveGroup(IPv6Group)
+		}
+		c.wg.Wait()
+	}
+}
+
+// await sends queries until done returns true, following section 5.2
+// of RFC 6762: the interval between queries starts at one second and
+// doubles after each query, up to one hour.
+//
+// The done function is called whenever a record is cached.
+func (c *Client) await(ctx context.Context, questions []dns.Question, done func() bool) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	interval := initialQueryInterval
+	for {
+		c.lock.Lock()
+		changed := c.changed
+		c.lock.Unlock()
+		if done() {
+			return nil
+		}
+		select {
+		case <-timer.C:
+			// NOTE: a failed query (e.g. because a stack has no address
+			// yet) is simply retried after the next interval.
+			c.sendQuery(questions)
+			timer.Reset(interval)
+			interval *= 2
+			if interval > maxQueryInterval {
+				interval = maxQueryInterval
+			}
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.closeChan:
+			return ErrClosed
+		}
+	}
+}
+
+// sendQuery multicasts a query on each stack.
+//
+// The cached records which answer the questions and have more than half
+// of their TTL remaining are included for Known-Answer Suppression, as
+// described in section 7.1 of RFC 6762.
+func (c *Client) sendQuery(questions []dns.Question) error {
+	msg := &dns.Message{Questions: questions}
+	for _, q := range questions {
+		msg.Answers = append(msg.Answers, c.knownAnswers(q.Name, q.Type)...)
+	}
+	data, err := msg.Encode()
+	for err == nil && len(data) > maxQuerySize && len(msg.Answers) > 0 {
+		msg.Answers = msg.Answers[:len(msg.Answers)/2]
+		data, err = msg.Encode()
+	}
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	sent := false
+	for i, conn := range c.conns {
+		if _, err := conn.WriteTo(data, c.groups[i]); err != nil {
+			lastErr = err
+		} else {
+			sent = true
+		}
+	}
+	if !sent {
+		return lastErr
+	}
+	return nil
+}
+
+func (c *Client) receiveLoop(conn net.PacketConn) {
+	defer c.wg.Done()
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		// NOTE: section 6 of RFC 6762 requires responses to be sent from
+		// port 5353, and other responses must be ignored.
+		if udpAddr, ok := addr.(*net.UDPAddr); !ok || udpAddr.Port != Port {
+			continue
+		}
+		msg, err := dns.DecodeMessage(buf[:n])
+		if err != nil || !msg.Response || msg.Opcode != 0 || msg.RCode != dns.RCodeSuccess {
+			continue
+		}
+		now := time.Now()
+		c.lock.Lock()
+		for _, records := range [][]dns.Resource{msg.Answers, msg.Additionals} {
+			for _, record := range records {
+				c.addRecord(record, now)
+			}
+		}
+		close(c.changed)
+		c.changed = make(chan struct{})
+		c.lock.Unlock()
+	}
+}
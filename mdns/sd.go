@@ -0,0 +1,181 @@
+package mdns
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/unixpickle/wifistack/dns"
+)
+
+// Domain is the domain of Multicast DNS names.
+const Domain = "local."
+
+// A Service is a resolved DNS-SD service instance.
+type Service struct {
+	// Name is the full name of the instance, such as
+	// "My Printer._ipp._tcp.local.".
+	Name string
+
+	// Instance is the unescaped instance label, such as "My Printer".
+	Instance string
+
+	Host string
+	Port int
+
+	// Text contains the key/value strings of the TXT record, as
+	// described in section 6 of RFC 6763.
+	Text []string
+
+	Addresses []net.IP
+}
+
+// Browse finds the instances of a service type, such as "_http._tcp",
+// in the "local." domain.
+//
+// Each instance name is sent once on the returned channel, which is
+// closed once the context is done or the client is closed.
+func (c *Client) Browse(ctx context.Context, service string) (<-chan string, error) {
+	name, err := serviceName(service)
+	if err != nil {
+		return nil, err
+	}
+	res := make(chan string)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(res)
+		seen := map[string]bool{}
+		var pending []string
+		c.await(ctx, []dns.Question{{Name: name, Type: dns.TypePTR, Class: dns.ClassINET}},
+			func() bool {
+				for _, record := range c.lookup(name, dns.TypePTR) {
+					instance, err := record.Target()
+					if err == nil && !seen[dns.CanonicalName(instance)] {
+						seen[dns.CanonicalName(instance)] = true
+						pending = append(pending, instance)
+					}
+				}
+				for len(pending) > 0 {
+					select {
+					case res <- pending[0]:
+						pending = pending[1:]
+					case <-ctx.Done():
+						return true
+					case <-c.closeChan:
+						return true
+					}
+				}
+				return false
+			})
+	}()
+	return res, nil
+}
+
+// Resolve finds the host, port, text and addresses of a service
+// instance, such as one returned by Browse.
+//
+// Names of known instances can be built with dns.JoinName, which
+// escapes any dots in instance labels.
+func (c *Client) Resolve(ctx context.Context, instance string) (*Service, error) {
+	if !dns.IsAbsolute(instance) {
+		instance += "."
+	}
+	labels, err := dns.SplitName(instance)
+	if err != nil {
+		return nil, err
+	}
+	if len(labels) < 3 {
+		return nil, dns.ErrBadName
+	}
+
+	res := &Service{Name: instance, Instance: labels[0]}
+	var srv, txt []dns.Resource
+	err = c.await(ctx, []dns.Question{
+		{Name: instance, Type: dns.TypeSRV, Class: dns.ClassINET},
+		{Name: instance, Type: dns.TypeTXT, Class: dns.ClassINET},
+	}, func() bool {
+		srv = c.lookup(instance, dns.TypeSRV)
+		txt = c.lookup(instance, dns.TypeTXT)
+		return len(srv) > 0 && len(txt) > 0
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := srv[0].SRV()
+	if err != nil {
+		return nil, err
+	}
+	res.Host = target.Target
+	res.Port = int(target.Port)
+	for _, record := range txt {
+		texts, err := record.Texts()
+		if err != nil {
+			return nil, err
+		}
+		for _, text := range texts {
+			// NOTE: section 6.1 of RFC 6763 says that a TXT record with no
+			// data contains a single empty string.
+			if text != "" {
+				res.Text = append(res.Text, text)
+			}
+		}
+	}
+	res.Addresses, err = c.LookupIP(ctx, res.Host)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// LookupIP finds the IPv4 and IPv6 addresses of a host, such as
+// "printer.local.".
+//
+// Addresses are only queried for the address families of the client's
+// stacks.
+func (c *Client) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if !dns.IsAbsolute(host) {
+		host += "."
+	}
+	var types []int
+	if c.config.IPv4 != nil {
+		types = append(types, dns.TypeA)
+	}
+	if c.config.IPv6 != nil {
+		types = append(types, dns.TypeAAAA)
+	}
+	var questions []dns.Question
+	for _, t := range types {
+		questions = append(questions, dns.Question{Name: host, Type: t, Class: dns.ClassINET})
+	}
+	var res []net.IP
+	err := c.await(ctx, questions, func() bool {
+		res = nil
+		for _, t := range types {
+			for _, record := range c.lookup(host, t) {
+				if ip := record.IP(); ip != nil {
+					res = append(res, ip)
+				}
+			}
+		}
+		return len(res) > 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// serviceName turns a service type into the name which is browsed for
+// its instances, such as "_http._tcp.local.".
+func serviceName(service string) (string, error) {
+	name := strings.TrimSuffix(service, ".") + "."
+	if !strings.HasSuffix(strings.ToLower(name), "."+Domain) {
+		name += Domain
+	}
+	if _, err := dns.SplitName(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
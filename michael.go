@@ -0,0 +1,55 @@
+package wifistack
+
+import (
+	"encoding/binary"
+	"math/bits"
+
+	"github.com/unixpickle/wifistack/frames"
+)
+
+const (
+	michaelKeySize = 8
+	michaelMICSize = 8
+)
+
+// michaelMIC computes the Michael MIC of an MSDU, as described in
+// section 11.4.2.3 of the IEEE 802.11-2012 spec.
+//
+// The MIC covers DA, SA, and the priority, followed by three zero
+// octets and the MSDU's payload.
+func michaelMIC(key []byte, da, sa frames.MAC, priority int, payload []byte) []byte {
+	header := make([]byte, 0, 16)
+	header = append(append(header, da[:]...), sa[:]...)
+	header = append(header, byte(priority), 0, 0, 0)
+	return michael(key, append(header, payload...))
+}
+
+// michael computes the Michael function of a message.
+func michael(key, data []byte) []byte {
+	l := binary.LittleEndian.Uint32(key)
+	r := binary.LittleEndian.Uint32(key[4:])
+
+	// NOTE: the message is padded with 0x5a and then four to seven
+	// zeros, so that its length is a multiple of four.
+	padded := make([]byte, len(data), len(data)+8)
+	copy(padded, data)
+	padded = append(padded, 0x5a, 0, 0, 0, 0)
+	for len(padded)%4 != 0 {
+		padded = append(padded, 0)
+	}
+
+	for i := 0; i < len(padded); i += 4 {
+		l ^= binary.LittleEndian.Uint32(padded[i:])
+		r ^= bits.RotateLeft32(l, 17)
+		l += r
+		r ^= ((l & 0xff00ff00) >> 8) | ((l & 0x00ff00ff) << 8)
+		l += r
+		r ^= bits.RotateLeft32(l, 3)
+		l += r
+		r ^= bits.RotateLeft32(l, -2)
+		l += r
+	}
+
+	res := binary.LittleEndian.AppendUint32(make([]byte, 0, michaelMICSize), l)
+	return binary.LittleEndian.AppendUint32(res, r)
+}
@@ -0,0 +1,32 @@
+package wifistack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestMichael(t *testing.T) {
+	// NOTE: these are the test vectors of the Michael reference
+	// implementation, in which each key is the MIC of the previous
+	// vector.
+	vectors := []struct {
+		key     string
+		message string
+		mic     string
+	}{
+		{"0000000000000000", "", "82925c1ca1d130b8"},
+		{"82925c1ca1d130b8", "M", "434721ca40639b3f"},
+		{"434721ca40639b3f", "Mi", "e8f9becae97e5d29"},
+		{"e8f9becae97e5d29", "Mic", "90038fc6cf13c1db"},
+		{"90038fc6cf13c1db", "Mich", "d55e100510128986"},
+		{"d55e100510128986", "Michael", "0a942b124ecaa546"},
+	}
+	for _, v := range vectors {
+		key, _ := hex.DecodeString(v.key)
+		expected, _ := hex.DecodeString(v.mic)
+		if mic := michael(key, []byte(v.message)); !bytes.Equal(mic, expected) {
+			t.Errorf("message %q: expected MIC %x but got %x", v.message, expected, mic)
+		}
+	}
+}
@@ -1,12 +1,73 @@
 package wifistack
 
-import "github.com/unixpickle/wifistack/frames"
+import (
+	"github.com/unixpickle/gofi"
+	"github.com/unixpickle/wifistack/frames"
+)
 
+// An MSDU is a MAC service data unit, along with the addresses
+// and other information which accompany it.
 type MSDU struct {
-	Remote  frames.MAC
+	// Remote is the station on the other end of the distribution system.
+	// For incoming MSDUs, it is the same as SA.
+	// For outgoing MSDUs, it is used as the destination if DA is zero.
+	Remote frames.MAC
+
+	// DA is the final destination of the MSDU, which may be a group address.
+	DA frames.MAC
+
+	// SA is the original source of the MSDU.
+	// For outgoing MSDUs, a zero SA means the local station.
+	SA frames.MAC
+
+	// Transmitter and Receiver are the addresses of the stations which
+	// transmitted and received the MSDU over the air.
+	// They are only set on incoming MSDUs.
+	Transmitter frames.MAC
+	Receiver    frames.MAC
+
+	// Priority is the 802.1D user priority, from 0 to 7.
+	// It is 0 for MSDUs which were not sent in QoS data frames.
+	Priority int
+
+	// Radio is the radio information of the last fragment of an
+	// incoming MSDU.
+	// It is nil for outgoing MSDUs, or if the Stream provided no radio
+	// information.
+	Radio *gofi.RadioInfo
+
 	Payload []byte
 }
 
+// Group returns true if the MSDU's destination is a group address,
+// i.e. if it was broadcast or multicast.
+func (m *MSDU) Group() bool {
+	return m.DA[0]&1 != 0
+}
+
+// setAddresses fills in the address fields of an incoming MSDU using
+// the addresses of one of its data frames, as described in table 8-19
+// of the IEEE 802.11-2012 spec.
+func (m *MSDU) setAddresses(f *frames.Frame) {
+	m.Receiver = f.Addresses[0]
+	m.Transmitter = f.Addresses[1]
+	switch {
+	case !f.ToDS && !f.FromDS:
+		m.DA = f.Addresses[0]
+		m.SA = f.Addresses[1]
+	case !f.ToDS && f.FromDS:
+		m.DA = f.Addresses[0]
+		m.SA = f.Addresses[2]
+	case f.ToDS && !f.FromDS:
+		m.DA = f.Addresses[2]
+		m.SA = f.Addresses[1]
+	default:
+		m.DA = f.Addresses[2]
+		m.SA = f.Addresses[3]
+	}
+	m.Remote = m.SA
+}
+
 // An MSDUStream sends and receives MAC service data units.
 type MSDUStream interface {
 	// Incoming returns the channel to which incoming MSDUs are delivered.
@@ -0,0 +1,294 @@
+// Package netstack attaches a wifistack.EthernetStream to gVisor's netstack,
+// so that netstack provides IPv4, IPv6, TCP, and UDP while wifistack
+// handles the 802.11 layer.
+package netstack
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/frames"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const defaultMTU = 1500
+
+var _ stack.LinkEndpoint = (*Endpoint)(nil)
+
+// An Endpoint is a stack.LinkEndpoint which sends and receives packets
+// on a wifistack.EthernetStream.
+//
+// To netstack, the Endpoint looks like an Ethernet device: outgoing
+// packets get Ethernet headers, which the EthernetStream turns into the
+// DA, SA, and LLC/SNAP header of an MSDU, and incoming MSDUs are turned
+// back into Ethernet frames. As a result, netstack's ARP and NDP work as
+// usual.
+type Endpoint struct {
+	// hasClosed is used to atomically ensure that closeChan is closed only once.
+	hasClosed uint32
+	closeChan chan struct{}
+
+	// sendLock is held for reading while sending on the stream's
+	// outgoing channel, so that Close does not close the channel
+	// while a send is in progress.
+	sendLock sync.RWMutex
+
+	stream *wifistack.EthernetStream
+	mtu    uint32
+
+	lock       sync.RWMutex
+	dispatcher stack.NetworkDispatcher
+	linkAddr   tcpip.LinkAddress
+	onClose    func()
+
+	wg sync.WaitGroup
+}
+
+// NewEndpoint creates an Endpoint which uses an EthernetStream and starts
+// reading incoming frames.
+// It receives every frame whose EtherType has no handler on the stream.
+//
+// The Endpoint takes ownership of the stream, and closes its outgoing
+// channel when the Endpoint is closed.
+func NewEndpoint(s *wifistack.EthernetStream, mac frames.MAC) *Endpoint {
+	res := &Endpoint{
+		closeChan: make(chan struct{}),
+		stream:    s,
+		mtu:       defaultMTU,
+		linkAddr:  tcpip.LinkAddress(mac[:]),
+	}
+	res.wg.Add(1)
+	go res.incomingLoop()
+	return res
+}
+
+// MTU returns the largest network-layer packet which may be sent.
+func (e *Endpoint) MTU() uint32 {
+	return atomic.LoadUint32(&e.mtu)
+}
+
+// SetMTU changes the MTU.
+func (e *Endpoint) SetMTU(mtu uint32) {
+	atomic.StoreUint32(&e.mtu, mtu)
+}
+
+// MaxHeaderLength returns the size of an Ethernet header.
+func (e *Endpoint) MaxHeaderLength() uint16 {
+	return header.EthernetMinimumSize
+}
+
+// LinkAddress returns the MAC address of the endpoint.
+func (e *Endpoint) LinkAddress() tcpip.LinkAddress {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.linkAddr
+}
+
+// SetLinkAddress changes the MAC address of the endpoint.
+//
+// This only changes the source address of outgoing frames; the station
+// is still associated with the address it used for its handshake.
+func (e *Endpoint) SetLinkAddress(addr tcpip.LinkAddress) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.linkAddr = addr
+}
+
+// Capabilities indicates that link addresses must be resolved.
+func (e *Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return stack.CapabilityResolutionRequired
+}
+
+// Attach sets the dispatcher for incoming packets.
+// A nil dispatcher causes incoming packets to be dropped.
+func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.dispatcher = dispatcher
+}
+
+// IsAttached checks if a dispatcher is attached.
+func (e *Endpoint) IsAttached() bool {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.dispatcher != nil
+}
+
+// Wait waits for the endpoint to stop reading incoming frames, which
+// happens when the endpoint is closed or the stream's incoming channel
+// is closed.
+func (e *Endpoint) Wait() {
+	e.wg.Wait()
+}
+
+// ARPHardwareType returns the Ethernet hardware type.
+func (e *Endpoint) ARPHardwareType() header.ARPHardwareType {
+	return header.ARPHardwareEther
+}
+
+// AddHeader adds an Ethernet header to an outgoing packet.
+func (e *Endpoint) AddHeader(pkt *stack.PacketBuffer) {
+	eth := header.Ethernet(pkt.LinkHeader().Push(header.EthernetMinimumSize))
+	eth.Encode(&header.EthernetFields{
+		SrcAddr: pkt.EgressRoute.LocalLinkAddress,
+		DstAddr: pkt.EgressRoute.RemoteLinkAddress,
+		Type:    pkt.NetworkProtocolNumber,
+	})
+}
+
+// ParseHeader consumes the Ethernet header of an incoming packet.
+func (e *Endpoint) ParseHeader(pkt *stack.PacketBuffer) bool {
+	_, ok := pkt.LinkHeader().Consume(header.EthernetMinimumSize)
+	return ok
+}
+
+// WritePackets sends packets as Ethernet frames.
+// It blocks while the stream is not ready for more frames.
+func (e *Endpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	localAddr := e.LinkAddress()
+	n := 0
+	for _, pkt := range pkts.AsSlice() {
+		view := pkt.ToView()
+		data := view.AsSlice()
+		if len(data) < header.EthernetMinimumSize {
+			view.Release()
+			continue
+		}
+		eth := header.Ethernet(data)
+		source := eth.SourceAddress()
+		if source == "" || source == header.UnspecifiedEthernetAddress {
+			source = localAddr
+		}
+		frame := &frames.EthernetFrame{
+			Destination: macFromLinkAddress(eth.DestinationAddress()),
+			Source:      macFromLinkAddress(source),
+			EtherType:   int(eth.Type()),
+			Payload:     append([]byte{}, data[header.EthernetMinimumSize:]...),
+		}
+		view.Release()
+
+		if !e.send(frame) {
+			if n == 0 {
+				return 0, &tcpip.ErrClosedForSend{}
+			}
+			return n, nil
+		}
+		n++
+	}
+	return n, nil
+}
+
+// send sends a frame on the stream.
+// It returns false if the endpoint has been closed.
+func (e *Endpoint) send(frame *frames.EthernetFrame) bool {
+	e.sendLock.RLock()
+	defer e.sendLock.RUnlock()
+
+	// NOTE: select picks randomly among ready cases, so closeChan must
+	// be checked first to avoid sending after Close has begun.
+	select {
+	case <-e.closeChan:
+		return false
+	default:
+	}
+
+	select {
+	case e.stream.Outgoing() <- frame:
+		return true
+	case <-e.closeChan:
+		return false
+	}
+}
+
+// Close stops the endpoint and closes the stream's outgoing channel.
+func (e *Endpoint) Close() {
+	if atomic.SwapUint32(&e.hasClosed, 1) != 0 {
+		return
+	}
+	e.lock.RLock()
+	onClose := e.onClose
+	e.lock.RUnlock()
+	if onClose != nil {
+		onClose()
+	}
+	close(e.closeChan)
+	e.wg.Wait()
+
+	// NOTE: once closeChan is closed, writers give up on pending sends,
+	// and new writers will not reach the outgoing channel.
+	e.sendLock.Lock()
+	close(e.stream.Outgoing())
+	e.sendLock.Unlock()
+}
+
+// SetOnCloseAction sets a function to be called when the endpoint is
+// closed.
+func (e *Endpoint) SetOnCloseAction(action func()) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.onClose = action
+}
+
+func (e *Endpoint) incomingLoop() {
+	defer e.wg.Done()
+	for {
+		select {
+		case frame, ok := <-e.stream.Incoming():
+			if !ok {
+				return
+			}
+			e.deliver(frame)
+		case <-e.closeChan:
+			return
+		}
+	}
+}
+
+// deliver encodes an incoming frame and passes it to the dispatcher.
+func (e *Endpoint) deliver(frame *frames.EthernetFrame) {
+	e.lock.RLock()
+	dispatcher := e.dispatcher
+	linkAddr := e.linkAddr
+	e.lock.RUnlock()
+	if dispatcher == nil {
+		return
+	}
+
+	data := make([]byte, header.EthernetMinimumSize+len(frame.Payload))
+	header.Ethernet(data).Encode(&header.EthernetFields{
+		SrcAddr: tcpip.LinkAddress(frame.Source[:]),
+		DstAddr: tcpip.LinkAddress(frame.Destination[:]),
+		Type:    tcpip.NetworkProtocolNumber(frame.EtherType),
+	})
+	copy(data[header.EthernetMinimumSize:], frame.Payload)
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(data),
+	})
+	defer pkt.DecRef()
+	if !e.ParseHeader(pkt) {
+		return
+	}
+
+	destination := tcpip.LinkAddress(frame.Destination[:])
+	if destination == header.EthernetBroadcastAddress {
+		pkt.PktType = tcpip.PacketBroadcast
+	} else if header.IsMulticastEthernetAddress(destination) {
+		pkt.PktType = tcpip.PacketMulticast
+	} else if destination == linkAddr {
+		pkt.PktType = tcpip.PacketHost
+	} else {
+		pkt.PktType = tcpip.PacketOtherHost
+	}
+	dispatcher.DeliverNetworkPacket(tcpip.NetworkProtocolNumber(frame.EtherType), pkt)
+}
+
+func macFromLinkAddress(addr tcpip.LinkAddress) frames.MAC {
+	var res frames.MAC
+	copy(res[:], addr)
+	return res
+}
@@ -1,6 +1,7 @@
 package wifistack
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,7 +12,11 @@ import (
 
 const dataResendTimeout = time.Millisecond * 10
 
-var broadcastMAC = frames.MAC{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+// receivedFrame is an incoming frame along with its radio information.
+type receivedFrame struct {
+	frame *frames.Frame
+	radio *gofi.RadioInfo
+}
 
 // OpenMSDUStreamConfig stores the configuration for an OpenMSDUStream.
 type OpenMSDUStreamConfig struct {
@@ -19,9 +24,21 @@ type OpenMSDUStreamConfig struct {
 	// fragmented into multiple MPDUs.
 	FragmentThreshold int
 
-	// DataRate is the rate at which data frames will be sent.
+	// DataRate is the rate at which data frames will be sent
+	// if RateController is nil.
 	DataRate gofi.DataRate
 
+	// RateController chooses the rate for each data frame.
+	// If this is nil, a FixedRateController with DataRate is used.
+	RateController RateController
+
+	// BasicRates lists the basic rates of the BSS, in ascending order.
+	// RTS and CTS frames are sent at the highest basic rate which does
+	// not exceed the rate of the frame they protect, so that every station
+	// can decode them.
+	// If this is empty, they are sent at 1Mb/s.
+	BasicRates []gofi.DataRate
+
 	// BSSID is the BSS identifier for the access point.
 	BSSID frames.MAC
 
@@ -30,10 +47,43 @@ type OpenMSDUStreamConfig struct {
 
 	// Stream is used to transfer raw 802.11 frames.
 	Stream Stream
+
+	// Sequences allocates the sequence numbers of the frames we send.
+	// It should be shared with anything else which transmits as Client,
+	// such as the Handshaker which associated us.
+	// If this is nil, a new allocator is used.
+	Sequences *SequenceAllocator
+
+	// PowerSave enables station power save mode if it is non-nil.
+	PowerSave *PowerSaveConfig
+
+	// QoS indicates that outgoing MSDUs should be sent in QoS data frames.
+	// This should be set if the association negotiated QoS.
+	QoS bool
+
+	// RTSThreshold is the size, in bytes, above which outgoing frames are
+	// protected by an RTS/CTS exchange.
+	// If this is 0, RTS/CTS is never used.
+	RTSThreshold int
+
+	// DropEchoes causes incoming MSDUs whose SA is Client to be dropped.
+	// The AP relays the group addressed MSDUs that we send back to the
+	// whole BSS, so without this we receive our own broadcasts.
+	DropEchoes bool
+
+	// Cipher protects data frames, like a WEPCipher does.
+	// If it is also an MSDUCipher, like a TKIPCipher, it protects whole
+	// MSDUs as well.
+	// If this is nil, data frames are sent and received in the clear,
+	// and protected data frames are dropped.
+	Cipher FrameCipher
 }
 
-// OpenMSDUStream is an MSDUStream which sends and receives MSDUs from an open network.
-// Currently, this does not support QoS, HCF, or PCF.
+// OpenMSDUStream is an MSDUStream which sends and receives MSDUs from an open network,
+// or from a network whose data frames are protected by the configured Cipher.
+// Currently, this does not support HCF or PCF.
+// QoS data frames are received, and block ack agreements initiated by the AP
+// are accepted so that aggregated traffic can be reordered.
 type OpenMSDUStream struct {
 	// hasClosed is used to atomically ensure that closeChan is closed only once.
 	hasClosed uint32
@@ -48,35 +98,73 @@ type OpenMSDUStream struct {
 	// acks is used by the incoming loop to pass ack frames to the outgoing loop.
 	acks chan *frames.Frame
 
-	// data is used by the incoming loop to filter out and process the data frames.
-	data chan *frames.Frame
+	// ctss is used by the incoming loop to pass CTS frames to the outgoing loop.
+	ctss chan *frames.Frame
+
+	// needsAck is used by the incoming data loop to pass frames which must be
+	// acknowledged, such as ADDBA responses, to the outgoing loop, which
+	// retransmits them until they are.
+	needsAck chan *frames.Frame
+
+	// data is used by the incoming loop to filter out and process the data frames,
+	// as well as action frames and block ack requests from the AP.
+	data chan receivedFrame
 
 	// wg waits for the background loops to return.
 	wg sync.WaitGroup
 
-	// outgoingSequenceNum is the outgoing sequence number.
-	// It is used by the outgoing loop.
-	outgoingSequenceNum int
+	// sequences allocates sequence numbers for every frame we send.
+	sequences *SequenceAllocator
+
+	// incomingMSDUs maps TIDs to the reconstructions of the current incoming packets.
+	// Non-QoS data frames use the TID -1.
+	// It is used by the incoming data loop.
+	incomingMSDUs map[int]*partialMSDU
+
+	// blockAckSessions maps TIDs to block ack agreements.
+	// It is used by the incoming data loop.
+	blockAckSessions map[int]*blockAckSession
+
+	// dozing is set to 1 when the AP believes we are in power save mode.
+	// It is written by the outgoing loop and read by the incoming data loop.
+	dozing uint32
 
-	// incomingSequenceNum is the sequence number of the last incoming data frame.
+	// beaconCount counts the beacons received while dozing.
 	// It is used by the incoming data loop.
-	incomingSequenceNum int
+	beaconCount int
+
+	// navExpiry is the UnixNano time at which the virtual carrier sense
+	// reservation ends.
+	// It is written by the incoming loop and read by the outgoing loop.
+	navExpiry int64
 
-	// incomingMSDU is the reconstruction of the current incoming packet.
-	// This is nil if no packet is currently being received.
-	incomingMSDU *partialMSDU
+	// erpProtection is set to 1 when the AP requires protection for OFDM frames.
+	// It is written by the incoming loop and read by the outgoing loop.
+	erpProtection uint32
 }
 
 // NewOpenMSDUStream creates an OpenMSDUStream using a configuration.
 // You must close the stream's outgoing channel once you are done with it.
 func NewOpenMSDUStream(c OpenMSDUStreamConfig) *OpenMSDUStream {
+	if c.RateController == nil {
+		c.RateController = FixedRateController{Rate: c.DataRate}
+	}
+	if c.Sequences == nil {
+		c.Sequences = &SequenceAllocator{}
+	}
 	res := &OpenMSDUStream{
 		closeChan: make(chan struct{}),
 		config:    c,
 		incoming:  make(chan MSDU, 16),
 		outgoing:  make(chan MSDU, 16),
 		acks:      make(chan *frames.Frame, 16),
-		data:      make(chan *frames.Frame, 16),
+		ctss:      make(chan *frames.Frame, 16),
+		needsAck:  make(chan *frames.Frame, 16),
+		data:      make(chan receivedFrame, 16),
+
+		sequences:        c.Sequences,
+		incomingMSDUs:    map[int]*partialMSDU{},
+		blockAckSessions: map[int]*blockAckSession{},
 	}
 	res.wg.Add(3)
 	go res.incomingLoop()
@@ -89,6 +177,23 @@ func NewOpenMSDUStream(c OpenMSDUStreamConfig) *OpenMSDUStream {
 	return res
 }
 
+// NewOpenMSDUStreamContext creates an OpenMSDUStream which is forcefully
+// closed (see ForceClose) once the context is done.
+//
+// Once the context is done, the incoming channel will be closed, but you
+// must still close the outgoing channel.
+func NewOpenMSDUStreamContext(ctx context.Context, c OpenMSDUStreamConfig) *OpenMSDUStream {
+	res := NewOpenMSDUStream(c)
+	go func() {
+		select {
+		case <-ctx.Done():
+			res.ForceClose()
+		case <-res.closeChan:
+		}
+	}()
+	return res
+}
+
 // Incoming returns the incoming channel, which will be closed
 // if the underlying stream is closed or encounters an error.
 func (o *OpenMSDUStream) Incoming() <-chan MSDU {
@@ -134,10 +239,28 @@ func (o *OpenMSDUStream) incomingLoop() {
 				continue
 			}
 
-			if frame.Type == frames.FrameTypeData {
+			o.updateNAV(frame)
+
+			received := receivedFrame{frame: frame, radio: packet.RadioInfo}
+			if frame.Type == frames.FrameTypeData || frame.Type == frames.FrameTypeQoSData {
+				// NOTE: this accepts both three-address frames and four-address
+				// frames from the AP, and the group bit of address 1 indicates
+				// a broadcast or multicast frame.
 				if frame.FromDS && frame.Addresses[1] == o.config.BSSID &&
-					(frame.Addresses[0] == o.config.Client || frame.Addresses[0] == broadcastMAC) {
-					o.data <- frame
+					(frame.Addresses[0] == o.config.Client || frame.Addresses[0][0]&1 != 0) {
+					o.data <- received
+				}
+			} else if frame.Type == frames.FrameTypeBeacon {
+				if frame.Addresses[1] == o.config.BSSID {
+					o.updateERP(frame)
+					if o.config.PowerSave != nil {
+						o.data <- received
+					}
+				}
+			} else if frame.Type == frames.FrameTypeAction ||
+				frame.Type == frames.FrameTypeBlockAckRequest {
+				if frame.Addresses[0] == o.config.Client && frame.Addresses[1] == o.config.BSSID {
+					o.data <- received
 				}
 			} else if frame.Type == frames.FrameTypeACK {
 				if frame.Addresses[0] == o.config.Client {
@@ -148,6 +271,13 @@ func (o *OpenMSDUStream) incomingLoop() {
 					default:
 					}
 				}
+			} else if frame.Type == frames.FrameTypeCTS {
+				if frame.Addresses[0] == o.config.Client {
+					select {
+					case o.ctss <- frame:
+					default:
+					}
+				}
 			}
 		}
 	}
@@ -163,6 +293,12 @@ func (o *OpenMSDUStream) outgoingLoop() {
 		o.ForceClose()
 		o.wg.Done()
 	}()
+
+	var idleTimeout <-chan time.Time
+	if o.config.PowerSave != nil {
+		idleTimeout = time.After(o.config.PowerSave.idleTimeout())
+	}
+
 	for {
 		select {
 		case <-o.closeChan:
@@ -175,9 +311,22 @@ func (o *OpenMSDUStream) outgoingLoop() {
 			if !ok {
 				return
 			}
+			if o.config.PowerSave != nil {
+				o.wakeUp()
+				idleTimeout = time.After(o.config.PowerSave.idleTimeout())
+			}
 			if !o.sendOutgoingData(msdu) {
 				return
 			}
+		case frame := <-o.needsAck:
+			if !o.sendWithAck(frame) {
+				return
+			}
+		case <-idleTimeout:
+			idleTimeout = nil
+			if !o.enterDoze() {
+				return
+			}
 		case <-o.closeChan:
 			return
 		}
@@ -185,7 +334,9 @@ func (o *OpenMSDUStream) outgoingLoop() {
 }
 
 func (o *OpenMSDUStream) incomingDataLoop() {
+	flushTicker := time.NewTicker(reorderFlushTimeout / 4)
 	defer func() {
+		flushTicker.Stop()
 		o.ForceClose()
 		o.wg.Done()
 		close(o.incoming)
@@ -198,8 +349,23 @@ func (o *OpenMSDUStream) incomingDataLoop() {
 		}
 
 		select {
-		case f := <-o.data:
-			if !o.handleIncomingData(f) {
+		case r := <-o.data:
+			var ok bool
+			switch r.frame.Type {
+			case frames.FrameTypeAction:
+				ok = o.handleIncomingAction(r.frame)
+			case frames.FrameTypeBlockAckRequest:
+				ok = o.handleBlockAckRequest(r.frame)
+			case frames.FrameTypeBeacon:
+				ok = o.handleBeacon(r.frame)
+			default:
+				ok = o.handleIncomingData(r.frame, r.radio)
+			}
+			if !ok {
+				return
+			}
+		case <-flushTicker.C:
+			if !o.flushReorderBuffers() || !o.expireBlockAckSessions() {
 				return
 			}
 		case <-o.closeChan:
@@ -208,54 +374,177 @@ func (o *OpenMSDUStream) incomingDataLoop() {
 	}
 }
 
-func (o *OpenMSDUStream) handleIncomingData(f *frames.Frame) bool {
+func (o *OpenMSDUStream) handleIncomingData(f *frames.Frame, radio *gofi.RadioInfo) bool {
 	seqNum := int(*f.SequenceControl) >> 4
-	if o.incomingMSDU == nil || o.incomingSequenceNum != seqNum {
-		o.incomingMSDU = &partialMSDU{}
-		o.incomingSequenceNum = seqNum
+	tid := -1
+	normalAck := true
+	if f.QoSControl != nil {
+		tid = int(*f.QoSControl & 0xf)
+
+		// NOTE: see section 8.2.4.5.4 of the IEEE 802.11-2012 spec.
+		normalAck = ((*f.QoSControl >> 5) & 3) == 0
+	}
+	if f.Addresses[0][0]&1 != 0 {
+		// NOTE: group addressed frames are never acknowledged, as described
+		// in section 9.3.6 of the IEEE 802.11-2012 spec.
+		normalAck = false
 	}
-	o.incomingMSDU.handleFrame(f)
 
-	ackFrame := &frames.Frame{
-		Type:      frames.FrameTypeACK,
-		Addresses: []frames.MAC{f.Addresses[1]},
+	// NOTE: frames which fail decryption are still acknowledged, since
+	// they were received intact, but their data is dropped.
+	valid := o.unprotect(f)
+	partial := o.incomingMSDUs[tid]
+	if valid {
+		if partial == nil || partial.sequenceNum != seqNum {
+			partial = &partialMSDU{sequenceNum: seqNum}
+			o.incomingMSDUs[tid] = partial
+		}
+		partial.handleFrame(f, radio)
 	}
 
-	if f.MoreFrag {
-		// TODO: compute this here, as specified in section 8.3.1.4 of the 2012 802.11 spec.
-		ackFrame.DurationID = 2000
+	session := o.blockAckSessions[tid]
+	if session != nil {
+		session.lastActivity = time.Now()
+		if valid {
+			session.reorder.markReceived(seqNum)
+		}
 	}
 
-	select {
-	case o.config.Stream.Outgoing() <- OutgoingFrame{Frame: ackFrame.Encode()}:
-	case <-o.closeChan:
+	// NOTE: under a block ack agreement, a frame with the normal ack policy
+	// is only an implicit block ack request if it arrived in an A-MPDU
+	// (section 9.21.7.5 of the IEEE 802.11-2012 spec). The Stream does not
+	// report aggregation, and a lone MPDU expects an ACK, so we send an ACK
+	// and answer explicit block ack requests with block acks.
+	if normalAck {
+		ackFrame := &frames.Frame{
+			Type:      frames.FrameTypeACK,
+			Addresses: []frames.MAC{f.Addresses[1]},
+		}
+
+		if f.MoreFrag {
+			// TODO: compute this here, as specified in section 8.3.1.4 of the 2012 802.11 spec.
+			ackFrame.DurationID = 2000
+		}
+
+		if !o.sendControlFrame(ackFrame) {
+			return false
+		}
+	}
+
+	if !o.handleBufferedDelivery(f) {
 		return false
 	}
 
-	if o.incomingMSDU.complete() {
+	if valid && partial.complete() {
 		msdu := MSDU{
-			Payload: o.incomingMSDU.msdu(),
-			Remote:  f.Addresses[2],
+			Payload: partial.msdu(),
+			Radio:   partial.radio,
+		}
+		msdu.setAddresses(f)
+		if tid >= 0 {
+			msdu.Priority = tid & 7
+		}
+		delete(o.incomingMSDUs, tid)
+		if cipher, ok := o.config.Cipher.(MSDUCipher); ok {
+			if cipher.VerifyMSDU(&msdu) != nil {
+				return true
+			}
+		}
+		if o.config.DropEchoes && msdu.SA == o.config.Client {
+			return true
+		}
+		if session != nil {
+			return o.deliverMSDUs(session.reorder.add(seqNum, msdu, time.Now()))
 		}
-		o.incomingMSDU = nil
+		return o.deliverMSDUs([]MSDU{msdu})
+	}
+
+	return true
+}
+
+// unprotect decrypts an incoming data frame if the stream has a cipher.
+// It returns false if the frame should be dropped, either because it
+// could not be decrypted or because its protection does not match the
+// stream's.
+func (o *OpenMSDUStream) unprotect(f *frames.Frame) bool {
+	if o.config.Cipher == nil {
+		return !f.Encrypted
+	}
+	return f.Encrypted && o.config.Cipher.DecryptFrame(f) == nil
+}
+
+// deliverMSDUs passes MSDUs to the incoming channel.
+// It is used by the incoming data loop.
+func (o *OpenMSDUStream) deliverMSDUs(msdus []MSDU) bool {
+	for _, msdu := range msdus {
 		select {
 		case o.incoming <- msdu:
 		case <-o.closeChan:
 			return false
 		}
 	}
-
 	return true
 }
 
+// queueWithAck passes a frame from the incoming data loop to the outgoing
+// loop, which sends it until it is acknowledged.
+func (o *OpenMSDUStream) queueWithAck(f *frames.Frame) bool {
+	select {
+	case o.needsAck <- f:
+		return true
+	case <-o.closeChan:
+		return false
+	}
+}
+
+// sendControlFrame sends a frame which does not expect an acknowledgment
+// from the outgoing loop, such as an ACK or a block ack.
+func (o *OpenMSDUStream) sendControlFrame(f *frames.Frame) bool {
+	select {
+	case o.config.Stream.Outgoing() <- OutgoingFrame{Frame: f.Encode()}:
+		return true
+	case <-o.closeChan:
+		return false
+	}
+}
+
 func (o *OpenMSDUStream) sendOutgoingData(msdu MSDU) bool {
+	if cipher, ok := o.config.Cipher.(MSDUCipher); ok {
+		if !o.protectMSDU(cipher, &msdu) {
+			return true
+		}
+	}
+
 	numFragments := len(msdu.Payload) / o.config.FragmentThreshold
 	if len(msdu.Payload)%o.config.FragmentThreshold > 0 {
 		numFragments++
 	}
 
-	sequenceNum := o.outgoingSequenceNum
-	o.outgoingSequenceNum = (o.outgoingSequenceNum + 1) & 0xfff
+	frameType := frames.FrameType(frames.FrameTypeData)
+	var qosControl *uint16
+	var sequenceNum int
+	if o.config.QoS {
+		// NOTE: the user priority is used as the TID, as described in
+		// section 9.2.4.2 of the IEEE 802.11-2012 spec.
+		tid := msdu.Priority & 7
+		frameType = frames.FrameTypeQoSData
+		qosControl = new(uint16)
+		*qosControl = uint16(tid)
+		sequenceNum = o.sequences.NextTID(tid)
+	} else {
+		sequenceNum = o.sequences.Next()
+	}
+
+	destination := msdu.DA
+	if destination == (frames.MAC{}) {
+		destination = msdu.Remote
+	}
+	addresses := []frames.MAC{o.config.BSSID, o.config.Client, destination}
+	if msdu.SA != (frames.MAC{}) && msdu.SA != o.config.Client {
+		// NOTE: the AP must be willing to accept four-address frames
+		// for this to work, which is usually not the case.
+		addresses = append(addresses, msdu.SA)
+	}
 
 	for i := 0; i < numFragments; i++ {
 		startIndex := i * o.config.FragmentThreshold
@@ -265,42 +554,94 @@ func (o *OpenMSDUStream) sendOutgoingData(msdu MSDU) bool {
 		}
 		piece := msdu.Payload[startIndex:endIndex]
 
-		seqControl := uint16(i | (sequenceNum << 4))
 		frame := &frames.Frame{
-			Type:     frames.FrameTypeData,
-			ToDS:     true,
-			MoreData: i+1 < numFragments,
-			Addresses: []frames.MAC{
-				o.config.BSSID,
-				o.config.Client,
-				msdu.Remote,
-			},
+			Type:            frameType,
+			ToDS:            true,
+			FromDS:          len(addresses) == 4,
+			MoreFrag:        i+1 < numFragments,
+			Addresses:       addresses,
 			Payload:         piece,
-			SequenceControl: &seqControl,
+			SequenceControl: sequenceControl(sequenceNum, i),
+			QoSControl:      qosControl,
 		}
 		// TODO: compute the DurationID here; for now we just use 2ms.
 		frame.DurationID = 2000
 
-	SendLoop:
+		// NOTE: the frame is encrypted once, so that retransmissions
+		// reuse its IV.
+		if o.config.Cipher != nil {
+			if err := o.config.Cipher.EncryptFrame(frame); err != nil {
+				return true
+			}
+		}
+
+		if !o.sendWithAck(frame) {
+			return false
+		}
+	}
+	return true
+}
+
+// protectMSDU applies an MSDUCipher to an outgoing MSDU, whose
+// addresses and priority are first filled in the way that the receiver
+// will see them.
+// It returns false if the MSDU should be dropped.
+func (o *OpenMSDUStream) protectMSDU(cipher MSDUCipher, msdu *MSDU) bool {
+	if msdu.DA == (frames.MAC{}) {
+		msdu.DA = msdu.Remote
+	}
+	if msdu.SA == (frames.MAC{}) {
+		msdu.SA = o.config.Client
+	}
+	if !o.config.QoS {
+		msdu.Priority = 0
+	}
+	return cipher.ProtectMSDU(msdu) == nil
+}
+
+// sendWithAck sends a frame and retransmits it until the AP acknowledges it.
+// It is used by the outgoing loop.
+func (o *OpenMSDUStream) sendWithAck(frame *frames.Frame) bool {
+	// NOTE: ACKs which arrived late for earlier frames may still be queued,
+	// and they should not count towards this frame.
+DrainLoop:
+	for {
+		select {
+		case <-o.acks:
+		default:
+			break DrainLoop
+		}
+	}
+
+	attempt := 0
+
+SendLoop:
+	for {
+		rate := o.config.RateController.NextRate(attempt)
+		attempt++
+
+		outgoing := OutgoingFrame{Frame: frame.Encode(), Rate: rate}
+		if !o.waitForNAV() || !o.protectFrame(len(outgoing.Frame), outgoing.Rate) {
+			return false
+		}
+		select {
+		case o.config.Stream.Outgoing() <- outgoing:
+		case <-o.closeChan:
+			return false
+		}
+
+		ackTimeout := time.After(dataResendTimeout)
 		for {
-			outgoing := OutgoingFrame{Frame: frame.Encode(), Rate: o.config.DataRate}
 			select {
-			case o.config.Stream.Outgoing() <- outgoing:
 			case <-o.closeChan:
 				return false
-			}
-
-			ackTimeout := time.After(dataResendTimeout)
-			for {
-				select {
-				case <-o.closeChan:
-					return false
-				case <-ackTimeout:
-					frame.Retry = true
-					continue SendLoop
-				case <-o.acks:
-					break SendLoop
-				}
+			case <-ackTimeout:
+				o.config.RateController.ReportAttempt(rate, false)
+				frame.Retry = true
+				continue SendLoop
+			case <-o.acks:
+				o.config.RateController.ReportAttempt(rate, true)
+				break SendLoop
 			}
 		}
 	}
@@ -3,20 +3,26 @@ package wifistack
 import (
 	"bytes"
 
+	"github.com/unixpickle/gofi"
 	"github.com/unixpickle/wifistack/frames"
 )
 
 // partialMSDU represents an MSDU which has arrived in pieces.
 type partialMSDU struct {
+	sequenceNum     int
 	hasLastFragment bool
 	fragments       [][]byte
+
+	// radio is the radio information of the last fragment.
+	radio *gofi.RadioInfo
 }
 
 // handleFrame takes the data from a data frame and adds it to this MSDU.
-func (p *partialMSDU) handleFrame(f *frames.Frame) {
+func (p *partialMSDU) handleFrame(f *frames.Frame, radio *gofi.RadioInfo) {
 	idx := int((*f.SequenceControl) & 0xf)
 	if !f.MoreFrag {
 		p.hasLastFragment = true
+		p.radio = radio
 	}
 	for idx >= len(p.fragments) {
 		p.fragments = append(p.fragments, nil)
@@ -0,0 +1,150 @@
+package wifistack
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/unixpickle/wifistack/frames"
+)
+
+const defaultPowerSaveIdleTimeout = time.Millisecond * 200
+
+// PowerSaveConfig configures the station power save mode of an OpenMSDUStream.
+//
+// While the stream is dozing, the AP buffers frames destined for us and
+// announces them in the TIM of its beacons.
+type PowerSaveConfig struct {
+	// AssociationID is the AID which the AP assigned to us during association.
+	AssociationID uint16
+
+	// ListenInterval is the number of beacon intervals between the beacons
+	// which the stream wakes up for.
+	// DTIM beacons are always processed.
+	// If this is 0, every beacon is processed.
+	ListenInterval int
+
+	// IdleTimeout is the amount of time the stream stays awake after sending
+	// an MSDU before it goes back to sleep.
+	// If this is 0, a default value is used.
+	IdleTimeout time.Duration
+
+	// UAPSD indicates that buffered frames should be retrieved with U-APSD
+	// trigger frames instead of PS-Polls.
+	// This requires a WMM association which enabled U-APSD for every access
+	// category (see Handshaker.UAPSD).
+	UAPSD bool
+}
+
+func (p *PowerSaveConfig) idleTimeout() time.Duration {
+	if p.IdleTimeout == 0 {
+		return defaultPowerSaveIdleTimeout
+	}
+	return p.IdleTimeout
+}
+
+// enterDoze tells the AP that we are going to sleep by sending a null data
+// frame with the power management bit set.
+// It is used by the outgoing loop.
+func (o *OpenMSDUStream) enterDoze() bool {
+	nullFrame := &frames.Frame{
+		Type:            frames.FrameTypeNull,
+		ToDS:            true,
+		PowerManagement: true,
+		Addresses: []frames.MAC{
+			o.config.BSSID,
+			o.config.Client,
+			o.config.BSSID,
+		},
+		SequenceControl: o.sequences.NextControl(),
+	}
+	nullFrame.DurationID = 2000
+	if !o.sendWithAck(nullFrame) {
+		return false
+	}
+	atomic.StoreUint32(&o.dozing, 1)
+	return true
+}
+
+// wakeUp marks the stream as awake.
+// Outgoing data frames do not set the power management bit,
+// so the AP will consider us awake once it receives one.
+func (o *OpenMSDUStream) wakeUp() {
+	atomic.StoreUint32(&o.dozing, 0)
+}
+
+// handleBeacon checks the TIM of a beacon from our AP to see if any frames
+// are buffered for us.
+// It is used by the incoming data loop.
+func (o *OpenMSDUStream) handleBeacon(f *frames.Frame) bool {
+	if atomic.LoadUint32(&o.dozing) == 0 {
+		return true
+	}
+	beacon, err := frames.DecodeBeacon(f)
+	if err != nil {
+		return true
+	}
+	tim, err := frames.DecodeTIM(beacon.Elements.Get(frames.ElementIDTIM))
+	if err != nil {
+		return true
+	}
+
+	o.beaconCount++
+	interval := o.config.PowerSave.ListenInterval
+	if !tim.DTIM() && interval > 1 && o.beaconCount%interval != 0 {
+		return true
+	}
+
+	// NOTE: group addressed frames are sent right after a DTIM beacon, and we
+	// never actually turn off the receiver, so we only handle unicast traffic here.
+	if !tim.HasTraffic(o.config.PowerSave.AssociationID) {
+		return true
+	}
+	return o.retrieveBuffered()
+}
+
+// retrieveBuffered asks the AP to deliver buffered frames, either with
+// a PS-Poll or with a U-APSD trigger frame.
+// It is used by the incoming data loop.
+func (o *OpenMSDUStream) retrieveBuffered() bool {
+	if !o.config.PowerSave.UAPSD {
+		poll := frames.NewPSPoll(o.config.BSSID, o.config.Client,
+			o.config.PowerSave.AssociationID)
+		return o.sendControlFrame(poll)
+	}
+
+	var qosControl uint16
+	trigger := &frames.Frame{
+		Type:            frames.FrameTypeQoSNull,
+		ToDS:            true,
+		PowerManagement: true,
+		Addresses: []frames.MAC{
+			o.config.BSSID,
+			o.config.Client,
+			o.config.BSSID,
+		},
+		SequenceControl: o.sequences.NextControl(),
+		QoSControl:      &qosControl,
+	}
+	trigger.DurationID = 2000
+
+	// NOTE: the AP acknowledges the trigger frame before it starts the
+	// service period, so a lost trigger is retransmitted.
+	return o.queueWithAck(trigger)
+}
+
+// handleBufferedDelivery continues retrieving buffered frames after one
+// has been delivered while we are dozing.
+// It is used by the incoming data loop.
+func (o *OpenMSDUStream) handleBufferedDelivery(f *frames.Frame) bool {
+	if o.config.PowerSave == nil || atomic.LoadUint32(&o.dozing) == 0 || !f.MoreData {
+		return true
+	}
+	if o.config.PowerSave.UAPSD && f.QoSControl != nil {
+		// NOTE: the AP keeps sending frames until the end of the service period,
+		// which is indicated by the EOSP bit of the QoS Control field.
+		if (*f.QoSControl & 0x10) == 0 {
+			return true
+		}
+	}
+	return o.retrieveBuffered()
+}
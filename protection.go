@@ -0,0 +1,202 @@
+package wifistack
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/unixpickle/gofi"
+	"github.com/unixpickle/wifistack/frames"
+)
+
+const (
+	// sifsTime is the short interframe space for 2.4GHz PHYs.
+	sifsTime = time.Microsecond * 10
+
+	// controlResponseSize is the encoded size of an ACK or CTS frame.
+	controlResponseSize = 14
+
+	// ctsTimeout is the amount of time to wait for a CTS after sending an RTS.
+	ctsTimeout = time.Millisecond * 2
+
+	// maxRTSAttempts is the number of times an RTS is sent before
+	// we give up and send the frame without protection.
+	maxRTSAttempts = 4
+
+	// maxNAVDuration is the largest duration a frame may reserve,
+	// as per section 8.2.4.2 of the IEEE 802.11-2012 spec.
+	maxNAVDuration = time.Microsecond * 32767
+
+	// highestDSSSRate is the highest rate which does not use OFDM.
+	highestDSSSRate gofi.DataRate = 22
+
+	// lowestRate is the 1Mb/s rate, which every 2.4GHz station supports.
+	lowestRate gofi.DataRate = 2
+)
+
+// frameAirtime estimates how long it takes to transmit a frame.
+// The rate is measured in units of 500Kb/s, and a rate of 0 is
+// treated as 1Mb/s.
+func frameAirtime(size int, rate gofi.DataRate) time.Duration {
+	if rate <= 0 {
+		rate = 2
+	}
+	preamble := time.Microsecond * 20
+	if rate <= highestDSSSRate {
+		// NOTE: this is the long PLCP preamble and header.
+		preamble = time.Microsecond * 192
+	}
+	return preamble + time.Duration(size*8*2)*time.Microsecond/time.Duration(rate)
+}
+
+// durationField converts a duration into a DurationID value.
+func durationField(d time.Duration) uint16 {
+	if d > maxNAVDuration {
+		d = maxNAVDuration
+	}
+	micros := (d + time.Microsecond - 1) / time.Microsecond
+	return uint16(micros)
+}
+
+// controlRate finds the rate for a control frame which protects or
+// responds to a frame sent at the given rate, as described in section
+// 9.7.6.5 of the IEEE 802.11-2012 spec.
+// This is the highest basic rate which does not exceed the rate.
+func (o *OpenMSDUStream) controlRate(rate gofi.DataRate) gofi.DataRate {
+	res := lowestRate
+	for _, basic := range o.config.BasicRates {
+		if basic <= rate && basic > res {
+			res = basic
+		}
+	}
+	return res
+}
+
+// updateNAV processes the Duration field of an overheard frame.
+// It is used by the incoming loop.
+func (o *OpenMSDUStream) updateNAV(f *frames.Frame) {
+	if f.Type == frames.FrameTypeCFEnd || f.Type == frames.FrameTypeCFEndCFAck {
+		if f.Addresses[1] == o.config.BSSID {
+			atomic.StoreInt64(&o.navExpiry, 0)
+		}
+		return
+	}
+
+	// NOTE: the DurationID of a PS-Poll is an AID, and a set high bit
+	// indicates that the field is not a duration.
+	if f.Type == frames.FrameTypePSPoll || (f.DurationID&0x8000) != 0 {
+		return
+	}
+	if len(f.Addresses) == 0 || f.Addresses[0] == o.config.Client {
+		return
+	}
+	if len(f.Addresses) > 1 && f.Addresses[1] == o.config.Client {
+		return
+	}
+
+	expiry := time.Now().Add(time.Duration(f.DurationID) * time.Microsecond).UnixNano()
+	for {
+		old := atomic.LoadInt64(&o.navExpiry)
+		if old >= expiry || atomic.CompareAndSwapInt64(&o.navExpiry, old, expiry) {
+			return
+		}
+	}
+}
+
+// updateERP records whether the AP requires protection for OFDM frames,
+// based on the ERP element of one of its beacons.
+// It is used by the incoming loop.
+func (o *OpenMSDUStream) updateERP(f *frames.Frame) {
+	beacon, err := frames.DecodeBeacon(f)
+	if err != nil {
+		return
+	}
+	erp := beacon.Elements.Get(frames.ElementIDERP)
+	if len(erp) == 0 {
+		return
+	}
+
+	// NOTE: see section 8.4.2.14 of the IEEE 802.11-2012 spec.
+	if (erp[0] & 2) != 0 {
+		atomic.StoreUint32(&o.erpProtection, 1)
+	} else {
+		atomic.StoreUint32(&o.erpProtection, 0)
+	}
+}
+
+// waitForNAV blocks until the medium is no longer reserved by another station.
+func (o *OpenMSDUStream) waitForNAV() bool {
+	for {
+		expiry := atomic.LoadInt64(&o.navExpiry)
+		remaining := time.Duration(expiry - time.Now().UnixNano())
+		if remaining <= 0 {
+			return true
+		}
+		select {
+		case <-time.After(remaining):
+		case <-o.closeChan:
+			return false
+		}
+	}
+}
+
+// protectFrame reserves the medium for an outgoing frame and its ACK using
+// RTS/CTS or CTS-to-self, if either one is needed.
+// It is used by the outgoing loop.
+func (o *OpenMSDUStream) protectFrame(encodedSize int, rate gofi.DataRate) bool {
+	controlRate := o.controlRate(rate)
+	ackTime := frameAirtime(controlResponseSize, controlRate)
+	dataTime := frameAirtime(encodedSize, rate)
+
+	if o.config.RTSThreshold > 0 && encodedSize > o.config.RTSThreshold {
+		ctsTime := frameAirtime(controlResponseSize, controlRate)
+		rts := &frames.Frame{
+			Type:       frames.FrameTypeRTS,
+			DurationID: durationField(sifsTime*3 + ctsTime + dataTime + ackTime),
+			Addresses:  []frames.MAC{o.config.BSSID, o.config.Client},
+		}
+	DrainLoop:
+		for {
+			select {
+			case <-o.ctss:
+			default:
+				break DrainLoop
+			}
+		}
+		for i := 0; i < maxRTSAttempts; i++ {
+			if !o.waitForNAV() {
+				return false
+			}
+			select {
+			case o.config.Stream.Outgoing() <- OutgoingFrame{Frame: rts.Encode(), Rate: controlRate}:
+			case <-o.closeChan:
+				return false
+			}
+			select {
+			case <-o.ctss:
+				return true
+			case <-time.After(ctsTimeout):
+			case <-o.closeChan:
+				return false
+			}
+		}
+		return true
+	}
+
+	if rate > highestDSSSRate && atomic.LoadUint32(&o.erpProtection) != 0 {
+		// NOTE: the CTS is sent at a DSSS basic rate so that non-ERP stations
+		// can hear it.
+		cts := &frames.Frame{
+			Type:       frames.FrameTypeCTS,
+			DurationID: durationField(sifsTime*2 + dataTime + ackTime),
+			Addresses:  []frames.MAC{o.config.Client},
+		}
+		ctsRate := o.controlRate(highestDSSSRate)
+		select {
+		case o.config.Stream.Outgoing() <- OutgoingFrame{Frame: cts.Encode(), Rate: ctsRate}:
+		case <-o.closeChan:
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,219 @@
+package wifistack
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/gofi"
+	"github.com/unixpickle/wifistack/frames"
+)
+
+const (
+	// minstrelUpdateInterval is how often a MinstrelController recomputes
+	// its statistics.
+	minstrelUpdateInterval = time.Millisecond * 100
+
+	// minstrelEWMAWeight is the weight given to old success probabilities
+	// when new statistics are computed.
+	minstrelEWMAWeight = 0.75
+
+	// minstrelSampleFrequency is the reciprocal of the fraction of frames
+	// which are sent at a random rate.
+	minstrelSampleFrequency = 10
+
+	// minstrelAttemptsPerRate is the number of attempts made at each rate
+	// in the retry chain.
+	minstrelAttemptsPerRate = 2
+
+	// minstrelReferenceSize is the frame size used to compare the
+	// throughput of different rates.
+	minstrelReferenceSize = 1200
+)
+
+// A RateController chooses the data rate for each transmission attempt.
+//
+// A RateController is used by a single outgoing loop, but it may be queried
+// from other goroutines, so implementations should be thread-safe.
+type RateController interface {
+	// NextRate returns the rate for a transmission attempt.
+	// The attempt argument is 0 for the first transmission of a frame,
+	// and it increases by one with each retransmission.
+	NextRate(attempt int) gofi.DataRate
+
+	// ReportAttempt reports whether or not a transmission attempt at the
+	// given rate was acknowledged.
+	ReportAttempt(rate gofi.DataRate, acked bool)
+}
+
+// FixedRateController is a RateController which always uses the same rate.
+type FixedRateController struct {
+	Rate gofi.DataRate
+}
+
+// NextRate returns the fixed rate.
+func (f FixedRateController) NextRate(attempt int) gofi.DataRate {
+	return f.Rate
+}
+
+// ReportAttempt does nothing.
+func (f FixedRateController) ReportAttempt(rate gofi.DataRate, acked bool) {
+}
+
+// NegotiatedRates returns the rates which are supported both by a stream and by a BSS,
+// in ascending order.
+func NegotiatedRates(s Stream, bss frames.BSSDescription) []gofi.DataRate {
+	bssRates := map[gofi.DataRate]bool{}
+	for _, r := range bss.OperationalRates {
+		bssRates[gofi.DataRate(r)] = true
+	}
+	var res []gofi.DataRate
+	for _, r := range s.SupportedRates() {
+		if bssRates[r] {
+			res = append(res, r)
+		}
+	}
+	sortRates(res)
+	return res
+}
+
+type minstrelRate struct {
+	rate gofi.DataRate
+
+	// attempts and successes count the attempts since the last update.
+	attempts  int
+	successes int
+
+	// probability is a moving average of the success probability.
+	probability float64
+	sampled     bool
+}
+
+func (m *minstrelRate) throughput() float64 {
+	return m.probability / frameAirtime(minstrelReferenceSize, m.rate).Seconds()
+}
+
+// MinstrelController is a RateController based on the Minstrel algorithm
+// from the Linux kernel.
+//
+// It keeps a moving average of the success probability at each rate, and it
+// uses these probabilities to build a retry chain which tries the rate with
+// the best throughput, the second best throughput, the best probability,
+// and finally the lowest rate.
+// A small fraction of frames are sent at random rates to keep the
+// statistics up to date.
+type MinstrelController struct {
+	lock       sync.Mutex
+	rates      []*minstrelRate
+	chain      []int
+	sample     int
+	lastUpdate time.Time
+	random     *rand.Rand
+}
+
+// NewMinstrelController creates a MinstrelController which chooses
+// from the given rates.
+// The rates list must not be empty.
+func NewMinstrelController(rates []gofi.DataRate) *MinstrelController {
+	sorted := append([]gofi.DataRate{}, rates...)
+	sortRates(sorted)
+	res := &MinstrelController{
+		chain:      []int{0},
+		sample:     -1,
+		lastUpdate: time.Now(),
+		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, r := range sorted {
+		res.rates = append(res.rates, &minstrelRate{rate: r})
+	}
+	return res
+}
+
+// NextRate returns the rate for a transmission attempt.
+func (m *MinstrelController) NextRate(attempt int) gofi.DataRate {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if time.Since(m.lastUpdate) >= minstrelUpdateInterval {
+		m.update()
+	}
+
+	if attempt == 0 {
+		m.sample = -1
+		if len(m.rates) > 1 && m.random.Intn(minstrelSampleFrequency) == 0 {
+			m.sample = m.random.Intn(len(m.rates))
+		}
+	}
+
+	if m.sample >= 0 {
+		if attempt == 0 {
+			return m.rates[m.sample].rate
+		}
+		attempt--
+	}
+
+	idx := attempt / minstrelAttemptsPerRate
+	if idx >= len(m.chain) {
+		idx = len(m.chain) - 1
+	}
+	return m.rates[m.chain[idx]].rate
+}
+
+// ReportAttempt records the result of a transmission attempt.
+func (m *MinstrelController) ReportAttempt(rate gofi.DataRate, acked bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, r := range m.rates {
+		if r.rate == rate {
+			r.attempts++
+			if acked {
+				r.successes++
+			}
+			return
+		}
+	}
+}
+
+// update recomputes the success probabilities and the retry chain.
+func (m *MinstrelController) update() {
+	m.lastUpdate = time.Now()
+
+	for _, r := range m.rates {
+		if r.attempts == 0 {
+			continue
+		}
+		prob := float64(r.successes) / float64(r.attempts)
+		if r.sampled {
+			r.probability = minstrelEWMAWeight*r.probability + (1-minstrelEWMAWeight)*prob
+		} else {
+			r.probability = prob
+			r.sampled = true
+		}
+		r.attempts = 0
+		r.successes = 0
+	}
+
+	bestTp, secondTp, bestProb := -1, -1, -1
+	for i, r := range m.rates {
+		if !r.sampled {
+			continue
+		}
+		if bestTp < 0 || r.throughput() > m.rates[bestTp].throughput() {
+			secondTp = bestTp
+			bestTp = i
+		} else if secondTp < 0 || r.throughput() > m.rates[secondTp].throughput() {
+			secondTp = i
+		}
+		if bestProb < 0 || r.probability > m.rates[bestProb].probability {
+			bestProb = i
+		}
+	}
+
+	m.chain = nil
+	for _, idx := range []int{bestTp, secondTp, bestProb} {
+		if idx >= 0 {
+			m.chain = append(m.chain, idx)
+		}
+	}
+	m.chain = append(m.chain, 0)
+}
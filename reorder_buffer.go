@@ -0,0 +1,183 @@
+package wifistack
+
+import "time"
+
+// reorderFlushTimeout is the maximum amount of time that an MSDU will be held
+// in a reorder buffer while waiting for a missing MSDU before it.
+const reorderFlushTimeout = time.Millisecond * 100
+
+// maxReorderWindow is the largest reorder window we will accept.
+// This is the size of a compressed block ack bitmap.
+const maxReorderWindow = 64
+
+// bufferedMSDU is an MSDU waiting in a reorder buffer.
+type bufferedMSDU struct {
+	msdu    MSDU
+	arrival time.Time
+}
+
+// reorderBuffer reorders the MSDUs for one TID of a block ack agreement,
+// as described in section 9.21.7.6 of the IEEE 802.11-2012 spec.
+type reorderBuffer struct {
+	winStart int
+	winSize  int
+
+	buffered map[int]bufferedMSDU
+
+	// received records every recently received sequence number, which is
+	// used to generate block ack bitmaps.
+	received map[int]bool
+}
+
+func newReorderBuffer(startSeq, size int) *reorderBuffer {
+	if size <= 0 || size > maxReorderWindow {
+		size = maxReorderWindow
+	}
+	return &reorderBuffer{
+		winStart: startSeq & 0xfff,
+		winSize:  size,
+		buffered: map[int]bufferedMSDU{},
+		received: map[int]bool{},
+	}
+}
+
+// add adds an MSDU to the buffer and returns the MSDUs which
+// are ready to be delivered, in order.
+func (r *reorderBuffer) add(seq int, m MSDU, now time.Time) []MSDU {
+	offset := sequenceOffset(r.winStart, seq)
+	if offset >= 2048 {
+		// This is an old or duplicate MSDU.
+		return nil
+	}
+
+	r.received[seq] = true
+
+	var res []MSDU
+	if offset >= r.winSize {
+		newStart := (seq - r.winSize + 1) & 0xfff
+		res = r.releaseBefore(newStart)
+	}
+	if _, ok := r.buffered[seq]; !ok {
+		r.buffered[seq] = bufferedMSDU{msdu: m, arrival: now}
+	}
+	return append(res, r.releaseInOrder()...)
+}
+
+// markReceived records that a frame with the sequence number arrived, so
+// that it is acknowledged by block acks before its MSDU is complete.
+func (r *reorderBuffer) markReceived(seq int) {
+	if sequenceOffset(r.winStart, seq) < 2048 {
+		r.received[seq&0xfff] = true
+	}
+}
+
+// moveWindow handles a block ack request by releasing every MSDU
+// which precedes the starting sequence number.
+func (r *reorderBuffer) moveWindow(startSeq int) []MSDU {
+	if sequenceOffset(r.winStart, startSeq) >= 2048 {
+		return nil
+	}
+	res := r.releaseBefore(startSeq)
+	return append(res, r.releaseInOrder()...)
+}
+
+// flushTimedOut skips over missing MSDUs if the MSDUs after them have
+// waited for longer than reorderFlushTimeout.
+func (r *reorderBuffer) flushTimedOut(now time.Time) []MSDU {
+	var res []MSDU
+	for {
+		var oldest *bufferedMSDU
+		var oldestSeq int
+		for seq, b := range r.buffered {
+			if now.Sub(b.arrival) >= reorderFlushTimeout {
+				if oldest == nil || sequenceOffset(r.winStart, seq) <
+					sequenceOffset(r.winStart, oldestSeq) {
+					entry := b
+					oldest = &entry
+					oldestSeq = seq
+				}
+			}
+		}
+		if oldest == nil {
+			return res
+		}
+		res = append(res, r.releaseBefore(oldestSeq)...)
+		res = append(res, r.releaseInOrder()...)
+	}
+}
+
+// flushAll releases every buffered MSDU in order.
+// This is used when a block ack agreement is torn down.
+func (r *reorderBuffer) flushAll() []MSDU {
+	var res []MSDU
+	for len(r.buffered) > 0 {
+		if b, ok := r.buffered[r.winStart]; ok {
+			res = append(res, b.msdu)
+			delete(r.buffered, r.winStart)
+		}
+		r.winStart = (r.winStart + 1) & 0xfff
+	}
+	return res
+}
+
+// bitmap generates a compressed block ack bitmap starting at
+// the given sequence number.
+func (r *reorderBuffer) bitmap(startSeq int) []byte {
+	res := make([]byte, 8)
+	for i := 0; i < 64; i++ {
+		if r.received[(startSeq+i)&0xfff] {
+			res[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return res
+}
+
+// hasBuffered returns true if any MSDUs are waiting in the buffer.
+func (r *reorderBuffer) hasBuffered() bool {
+	return len(r.buffered) > 0
+}
+
+func (r *reorderBuffer) releaseBefore(seq int) []MSDU {
+	var res []MSDU
+	for r.winStart != seq&0xfff {
+		if b, ok := r.buffered[r.winStart]; ok {
+			res = append(res, b.msdu)
+			delete(r.buffered, r.winStart)
+		}
+		r.winStart = (r.winStart + 1) & 0xfff
+	}
+	r.pruneReceived()
+	return res
+}
+
+func (r *reorderBuffer) releaseInOrder() []MSDU {
+	var res []MSDU
+	for {
+		b, ok := r.buffered[r.winStart]
+		if !ok {
+			break
+		}
+		res = append(res, b.msdu)
+		delete(r.buffered, r.winStart)
+		r.winStart = (r.winStart + 1) & 0xfff
+	}
+	r.pruneReceived()
+	return res
+}
+
+// pruneReceived forgets sequence numbers which are too old to
+// appear in any block ack bitmap.
+func (r *reorderBuffer) pruneReceived() {
+	for seq := range r.received {
+		behind := sequenceOffset(seq, r.winStart)
+		if behind > maxReorderWindow && behind < 2048 {
+			delete(r.received, seq)
+		}
+	}
+}
+
+// sequenceOffset returns the distance from one 12-bit sequence number to another,
+// modulo 4096.
+func sequenceOffset(from, to int) int {
+	return (to - from) & 0xfff
+}
@@ -1,6 +1,7 @@
 package wifistack
 
 import (
+	"context"
 	"time"
 
 	"github.com/unixpickle/gofi"
@@ -17,8 +18,18 @@ const scanChannelTime = time.Second / 5
 // While the scan is running, this will continually read from and (possibly)
 // write to the stream.
 func ScanNetworks(s Stream) (descs <-chan frames.BSSDescription, cancel chan<- struct{}) {
-	descChan := make(chan frames.BSSDescription)
 	cancelChan := make(chan struct{})
+	return scanNetworks(s, cancelChan), cancelChan
+}
+
+// ScanNetworksContext is like ScanNetworks, but the scan is completed
+// early when the context is done.
+func ScanNetworksContext(ctx context.Context, s Stream) <-chan frames.BSSDescription {
+	return scanNetworks(s, ctx.Done())
+}
+
+func scanNetworks(s Stream, cancelChan <-chan struct{}) <-chan frames.BSSDescription {
+	descChan := make(chan frames.BSSDescription)
 
 	go func() {
 		defer close(descChan)
@@ -57,7 +68,11 @@ func ScanNetworks(s Stream) (descs <-chan frames.BSSDescription, cancel chan<- s
 					description := beacon.BSSDescription()
 					if !bssMap[description.BSSID] {
 						bssMap[description.BSSID] = true
-						descChan <- description
+						select {
+						case descChan <- description:
+						case <-cancelChan:
+							return
+						}
 					}
 				case <-cancelChan:
 					return
@@ -68,7 +83,7 @@ func ScanNetworks(s Stream) (descs <-chan frames.BSSDescription, cancel chan<- s
 		}
 	}()
 
-	return descChan, cancelChan
+	return descChan
 }
 
 func scanChannels(s Stream) []gofi.Channel {
@@ -0,0 +1,56 @@
+package wifistack
+
+import "sync"
+
+// A SequenceAllocator hands out the sequence numbers for the frames
+// which one station transmits, as described in section 9.3.2.10 of the
+// IEEE 802.11-2012 spec.
+//
+// Management frames, non-QoS data frames, and QoS Null frames share one
+// counter, while QoS data frames use one counter per TID.
+//
+// Every sender which transmits as the same station should share one
+// allocator, so that sequence numbers never go backwards.
+// For example, a Handshaker passes its allocator on through the Link,
+// and NewOpenMSDUStreamConfig hands it to the OpenMSDUStream.
+//
+// The zero value of SequenceAllocator is ready to use.
+type SequenceAllocator struct {
+	lock   sync.Mutex
+	shared int
+	tids   [16]int
+}
+
+// Next returns the next sequence number for a management frame,
+// a non-QoS data frame, or a QoS Null frame.
+func (s *SequenceAllocator) Next() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := s.shared
+	s.shared = (s.shared + 1) & 0xfff
+	return res
+}
+
+// NextTID returns the next sequence number for a QoS data frame.
+// If tid is negative, this is equivalent to Next().
+func (s *SequenceAllocator) NextTID(tid int) int {
+	if tid < 0 {
+		return s.Next()
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := s.tids[tid&0xf]
+	s.tids[tid&0xf] = (res + 1) & 0xfff
+	return res
+}
+
+// NextControl allocates a sequence number with Next() and returns
+// a sequence control field for the first fragment.
+func (s *SequenceAllocator) NextControl() *uint16 {
+	return sequenceControl(s.Next(), 0)
+}
+
+func sequenceControl(seq, fragment int) *uint16 {
+	res := uint16((seq&0xfff)<<4 | (fragment & 0xf))
+	return &res
+}
@@ -0,0 +1,540 @@
+package sim
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unixpickle/gofi"
+	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/frames"
+)
+
+const (
+	defaultBeaconInterval = time.Millisecond * 100
+	dsBufferSize          = 64
+
+	// capabilityESS and capabilityPrivacy are bits of the capability
+	// information field.
+	capabilityESS     = 1
+	capabilityPrivacy = 0x10
+
+	challengeTextSize = 128
+
+	statusNotAuthenticated = 1
+	statusBadAlgorithm     = 13
+	statusChallengeFailure = 15
+)
+
+// These are the rates advertised by an AccessPoint, in the format of
+// the supported rates element.
+// The 802.11b rates are basic rates.
+var (
+	apSupportedRates = []byte{0x82, 0x84, 0x8b, 0x96, 0x0c, 0x12, 0x18, 0x24}
+	apExtendedRates  = []byte{0x30, 0x48, 0x60, 0x6c}
+)
+
+// AccessPointConfig stores the configuration for an AccessPoint.
+type AccessPointConfig struct {
+	SSID    string
+	BSSID   frames.MAC
+	Channel int
+
+	// BeaconInterval is the time between beacons.
+	// If this is 0, a default value is used.
+	BeaconInterval time.Duration
+
+	// WEP makes the AP a WEP network if it is non-nil.
+	// The AP then requires shared key authentication, and it protects
+	// data frames with the cipher and drops unprotected ones.
+	WEP *wifistack.WEPCipher
+}
+
+// An AccessPoint is a simulated open or WEP access point.
+//
+// It sends beacons, accepts authentication and association from any
+// station, and bridges data between associated stations and a distribution
+// system. The distribution system is an MSDUStream, so a simulated network
+// (e.g. a router running a wifistack network stack) can sit behind the AP.
+//
+// The AP acknowledges every data frame it receives, but it never
+// retransmits the frames it sends.
+type AccessPoint struct {
+	// hasClosed is used to atomically ensure that closeChan is closed only once.
+	hasClosed uint32
+	closeChan chan struct{}
+
+	config AccessPointConfig
+	stream wifistack.Stream
+
+	sequences wifistack.SequenceAllocator
+
+	lock     sync.Mutex
+	stations map[frames.MAC]*apStation
+	nextAID  uint16
+
+	// challenges stores the challenge text which was sent to each
+	// station during shared key authentication.
+	challenges map[frames.MAC][]byte
+
+	dsIncoming chan wifistack.MSDU
+	dsOutgoing chan wifistack.MSDU
+
+	wg sync.WaitGroup
+}
+
+type apStation struct {
+	associated    bool
+	associationID uint16
+
+	// lastSequenceControl is used to drop retransmissions.
+	lastSequenceControl int
+	partial             [][]byte
+	hasLastFragment     bool
+}
+
+// NewAccessPoint starts an access point on a Stream.
+// The stream is tuned to the configured channel.
+func NewAccessPoint(s wifistack.Stream, c AccessPointConfig) (*AccessPoint, error) {
+	if c.BeaconInterval == 0 {
+		c.BeaconInterval = defaultBeaconInterval
+	}
+	if err := s.SetChannel(gofi.Channel{Number: c.Channel}); err != nil {
+		return nil, err
+	}
+	res := &AccessPoint{
+		closeChan:  make(chan struct{}),
+		config:     c,
+		stream:     s,
+		stations:   map[frames.MAC]*apStation{},
+		nextAID:    1,
+		challenges: map[frames.MAC][]byte{},
+		dsIncoming: make(chan wifistack.MSDU, dsBufferSize),
+		dsOutgoing: make(chan wifistack.MSDU),
+	}
+	res.wg.Add(3)
+	go res.beaconLoop()
+	go res.incomingLoop()
+	go res.dsLoop()
+	go func() {
+		res.wg.Wait()
+		close(res.dsIncoming)
+		close(s.Outgoing())
+	}()
+	return res, nil
+}
+
+// DS returns the distribution system side of the AP.
+//
+// Incoming MSDUs are the MSDUs which stations send to addresses outside of
+// the BSS, as well as group addressed MSDUs.
+// Outgoing MSDUs are delivered to the stations in the BSS, using SA as the
+// source address, or the BSSID if SA is zero.
+// Unicast MSDUs for stations which are not associated are dropped.
+func (a *AccessPoint) DS() wifistack.MSDUStream {
+	return apDS{a}
+}
+
+// Stations returns the addresses of the associated stations.
+func (a *AccessPoint) Stations() []frames.MAC {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var res []frames.MAC
+	for mac, s := range a.stations {
+		if s.associated {
+			res = append(res, mac)
+		}
+	}
+	return res
+}
+
+// Close stops the AP and closes its stream.
+func (a *AccessPoint) Close() {
+	if atomic.SwapUint32(&a.hasClosed, 1) == 0 {
+		close(a.closeChan)
+	}
+}
+
+func (a *AccessPoint) beaconLoop() {
+	defer a.wg.Done()
+	ticker := time.NewTicker(a.config.BeaconInterval)
+	defer ticker.Stop()
+	start := time.Now()
+	for {
+		beacon := &frames.Beacon{
+			BSSID:        a.config.BSSID,
+			Timestamp:    uint64(time.Since(start) / time.Microsecond),
+			Interval:     uint16(a.config.BeaconInterval / (time.Microsecond * 1024)),
+			Capabilities: a.capabilities(),
+			Elements:     a.elements(),
+		}
+		beacon.Elements = append(beacon.Elements, frames.Element{
+			ID:    frames.ElementIDDSSSParameterSet,
+			Value: []byte{byte(a.config.Channel)},
+		})
+		frame := beacon.EncodeToFrame()
+		frame.SequenceControl = a.sequences.NextControl()
+		if !a.send(frame) {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-a.closeChan:
+			return
+		}
+	}
+}
+
+func (a *AccessPoint) incomingLoop() {
+	defer a.wg.Done()
+	for {
+		select {
+		case packet, ok := <-a.stream.Incoming():
+			if !ok {
+				a.Close()
+				return
+			}
+			frame, err := frames.DecodeFrame(packet.Frame)
+			if err != nil || frame.Version != 0 || frame.Addresses[0] != a.config.BSSID {
+				continue
+			}
+			if !a.handleFrame(frame) {
+				return
+			}
+		case <-a.closeChan:
+			return
+		}
+	}
+}
+
+func (a *AccessPoint) handleFrame(f *frames.Frame) bool {
+	switch f.Type {
+	case frames.FrameTypeAuthentication:
+		return a.handleAuthentication(f)
+	case frames.FrameTypeAssocRequest:
+		return a.handleAssocRequest(f)
+	case frames.FrameTypeDeauthentication, frames.FrameTypeDisassoc:
+		if !a.sendAck(f.Addresses[1]) {
+			return false
+		}
+		a.lock.Lock()
+		if f.Type == frames.FrameTypeDeauthentication {
+			delete(a.stations, f.Addresses[1])
+		} else if s, ok := a.stations[f.Addresses[1]]; ok {
+			s.associated = false
+		}
+		a.lock.Unlock()
+	case frames.FrameTypeData, frames.FrameTypeQoSData:
+		return a.handleData(f)
+	case frames.FrameTypeNull, frames.FrameTypeQoSNull:
+		return a.sendAck(f.Addresses[1])
+	}
+	return true
+}
+
+func (a *AccessPoint) handleAuthentication(f *frames.Frame) bool {
+	client := f.Addresses[1]
+	encrypted := f.Encrypted
+	var auth *frames.Authentication
+	if encrypted && (a.config.WEP == nil || a.config.WEP.DecryptFrame(f) != nil) {
+		// NOTE: this must be the third frame of shared key authentication,
+		// encrypted with the wrong key.
+		auth = &frames.Authentication{
+			Algorithm:      frames.AuthAlgorithmSharedKey,
+			SequenceNumber: 3,
+		}
+	} else {
+		var err error
+		auth, err = frames.DecodeAuthentication(f)
+		if err != nil {
+			return true
+		}
+	}
+
+	response := &frames.Authentication{
+		Addresses:      []frames.MAC{client, a.config.BSSID, a.config.BSSID},
+		Algorithm:      auth.Algorithm,
+		SequenceNumber: auth.SequenceNumber + 1,
+		Elements:       frames.Elements{},
+	}
+	switch {
+	case auth.SequenceNumber == 1 && a.config.WEP == nil:
+		if auth.Algorithm != frames.AuthAlgorithmOpen {
+			response.StatusCode = statusBadAlgorithm
+		} else {
+			a.authenticate(client)
+		}
+	case auth.SequenceNumber == 1:
+		if auth.Algorithm != frames.AuthAlgorithmSharedKey {
+			response.StatusCode = statusBadAlgorithm
+		} else {
+			challenge := make([]byte, challengeTextSize)
+			rand.Read(challenge)
+			a.lock.Lock()
+			a.challenges[client] = challenge
+			a.lock.Unlock()
+			response.Elements = frames.Elements{
+				{ID: frames.ElementIDChallengeText, Value: challenge},
+			}
+		}
+	case auth.SequenceNumber == 3 && auth.Algorithm == frames.AuthAlgorithmSharedKey:
+		// NOTE: an unencrypted response fails, as does a response which
+		// was encrypted with the wrong key, since its ICV is wrong.
+		a.lock.Lock()
+		challenge := a.challenges[client]
+		delete(a.challenges, client)
+		a.lock.Unlock()
+		text := auth.Elements.Get(frames.ElementIDChallengeText)
+		if !encrypted || challenge == nil || !bytes.Equal(text, challenge) {
+			response.StatusCode = statusChallengeFailure
+		} else {
+			a.authenticate(client)
+		}
+	default:
+		return true
+	}
+
+	if !a.sendAck(client) {
+		return false
+	}
+	frame := response.EncodeToFrame()
+	frame.SequenceControl = a.sequences.NextControl()
+	return a.send(frame)
+}
+
+// authenticate adds a station which has authenticated.
+func (a *AccessPoint) authenticate(client frames.MAC) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.stations[client]; !ok {
+		a.stations[client] = &apStation{lastSequenceControl: -1}
+	}
+}
+
+func (a *AccessPoint) handleAssocRequest(f *frames.Frame) bool {
+	req, err := frames.DecodeAssocRequest(f)
+	if err != nil {
+		return true
+	}
+	if !a.sendAck(req.Client) {
+		return false
+	}
+
+	response := &frames.AssocResponse{
+		BSSID:        a.config.BSSID,
+		Client:       req.Client,
+		Capabilities: a.capabilities(),
+		Elements:     a.elements()[1:],
+	}
+
+	a.lock.Lock()
+	if s, ok := a.stations[req.Client]; !ok {
+		response.StatusCode = statusNotAuthenticated
+	} else {
+		if !s.associated {
+			s.associated = true
+			s.associationID = a.nextAID
+			a.nextAID++
+		}
+		response.AssociationID = s.associationID | 0xc000
+	}
+	a.lock.Unlock()
+
+	frame := response.EncodeToFrame()
+	frame.SequenceControl = a.sequences.NextControl()
+	return a.send(frame)
+}
+
+func (a *AccessPoint) handleData(f *frames.Frame) bool {
+	if !f.ToDS || f.FromDS || f.SequenceControl == nil {
+		return true
+	}
+	client := f.Addresses[1]
+
+	a.lock.Lock()
+	s, ok := a.stations[client]
+	if !ok || !s.associated {
+		a.lock.Unlock()
+		return true
+	}
+	a.lock.Unlock()
+
+	if !a.sendAck(client) {
+		return false
+	}
+
+	// NOTE: frames whose protection does not match the network's are
+	// acknowledged but dropped.
+	if f.Encrypted != (a.config.WEP != nil) {
+		return true
+	} else if f.Encrypted && a.config.WEP.DecryptFrame(f) != nil {
+		return true
+	}
+
+	a.lock.Lock()
+	seqControl := int(*f.SequenceControl)
+	if seqControl == s.lastSequenceControl {
+		a.lock.Unlock()
+		return true
+	}
+	if seqControl>>4 != s.lastSequenceControl>>4 {
+		s.partial = nil
+		s.hasLastFragment = false
+	}
+	s.lastSequenceControl = seqControl
+	fragment := seqControl & 0xf
+	for len(s.partial) <= fragment {
+		s.partial = append(s.partial, nil)
+	}
+	s.partial[fragment] = f.Payload
+	if !f.MoreFrag {
+		s.hasLastFragment = true
+	}
+	var payload []byte
+	if s.hasLastFragment {
+		for _, piece := range s.partial {
+			if piece == nil {
+				a.lock.Unlock()
+				return true
+			}
+			payload = append(payload, piece...)
+		}
+		s.partial = nil
+		s.hasLastFragment = false
+	}
+	a.lock.Unlock()
+
+	if payload == nil {
+		return true
+	}
+	return a.route(wifistack.MSDU{
+		Remote:      client,
+		DA:          f.Addresses[2],
+		SA:          client,
+		Transmitter: client,
+		Receiver:    a.config.BSSID,
+		Payload:     payload,
+	})
+}
+
+// route forwards an MSDU from a station to the distribution system
+// and/or to the stations of the BSS.
+func (a *AccessPoint) route(msdu wifistack.MSDU) bool {
+	if msdu.Group() {
+		select {
+		case a.dsIncoming <- msdu:
+		default:
+		}
+		return a.sendData(msdu.DA, msdu.SA, msdu.Payload)
+	}
+
+	a.lock.Lock()
+	s, ok := a.stations[msdu.DA]
+	local := ok && s.associated
+	a.lock.Unlock()
+
+	if local {
+		return a.sendData(msdu.DA, msdu.SA, msdu.Payload)
+	}
+	select {
+	case a.dsIncoming <- msdu:
+	default:
+	}
+	return true
+}
+
+func (a *AccessPoint) dsLoop() {
+	defer a.wg.Done()
+	for {
+		select {
+		case msdu, ok := <-a.dsOutgoing:
+			if !ok {
+				return
+			}
+			source := msdu.SA
+			if source == (frames.MAC{}) {
+				source = a.config.BSSID
+			}
+			if !msdu.Group() {
+				a.lock.Lock()
+				s, ok := a.stations[msdu.DA]
+				associated := ok && s.associated
+				a.lock.Unlock()
+				if !associated {
+					continue
+				}
+			}
+			if !a.sendData(msdu.DA, source, msdu.Payload) {
+				return
+			}
+		case <-a.closeChan:
+			return
+		}
+	}
+}
+
+func (a *AccessPoint) sendData(destination, source frames.MAC, payload []byte) bool {
+	frame := &frames.Frame{
+		Type:            frames.FrameTypeData,
+		FromDS:          true,
+		Addresses:       []frames.MAC{destination, a.config.BSSID, source},
+		SequenceControl: a.sequences.NextControl(),
+		Payload:         payload,
+	}
+	if a.config.WEP != nil {
+		a.config.WEP.EncryptFrame(frame)
+	}
+	return a.send(frame)
+}
+
+func (a *AccessPoint) sendAck(destination frames.MAC) bool {
+	return a.send(&frames.Frame{
+		Type:      frames.FrameTypeACK,
+		Addresses: []frames.MAC{destination},
+	})
+}
+
+func (a *AccessPoint) send(f *frames.Frame) bool {
+	select {
+	case a.stream.Outgoing() <- wifistack.OutgoingFrame{Frame: f.Encode(), Rate: 2}:
+		return true
+	case <-a.closeChan:
+		return false
+	}
+}
+
+// capabilities returns the capability information field of the AP.
+func (a *AccessPoint) capabilities() uint16 {
+	if a.config.WEP != nil {
+		return capabilityESS | capabilityPrivacy
+	}
+	return capabilityESS
+}
+
+// elements returns the SSID and rate elements of the AP.
+func (a *AccessPoint) elements() frames.Elements {
+	return frames.Elements{
+		{ID: frames.ElementIDSSID, Value: []byte(a.config.SSID)},
+		{ID: frames.ElementIDSupportedRates, Value: apSupportedRates},
+		{ID: frames.ElementIDExtendedSupportedRates, Value: apExtendedRates},
+	}
+}
+
+// apDS is the MSDUStream for the distribution system side of an AP.
+type apDS struct {
+	a *AccessPoint
+}
+
+func (d apDS) Incoming() <-chan wifistack.MSDU {
+	return d.a.dsIncoming
+}
+
+func (d apDS) Outgoing() chan<- wifistack.MSDU {
+	return d.a.dsOutgoing
+}
+
+func (d apDS) ForceClose() {
+	d.a.Close()
+}
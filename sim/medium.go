@@ -0,0 +1,153 @@
+// Package sim simulates a wireless medium and an access point in memory,
+// so that the rest of wifistack can be exercised without a radio.
+package sim
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/unixpickle/gofi"
+	"github.com/unixpickle/wifistack"
+)
+
+const (
+	streamBufferSize = 64
+	signalPower      = -40
+)
+
+// ErrUnsupportedChannel is returned when a Stream is tuned to a channel
+// which it does not support.
+var ErrUnsupportedChannel = errors.New("unsupported channel")
+
+var supportedRates = []gofi.DataRate{2, 4, 11, 12, 18, 22, 24, 36, 48, 72, 96, 108}
+
+// A Medium carries frames between simulated Streams.
+//
+// Every frame sent on a Stream is delivered to every other Stream which
+// is tuned to the same channel.
+// Frames are never lost, except when a Stream's incoming buffer is full.
+type Medium struct {
+	lock    sync.Mutex
+	streams map[*Stream]bool
+}
+
+// NewMedium creates an empty Medium.
+func NewMedium() *Medium {
+	return &Medium{streams: map[*Stream]bool{}}
+}
+
+// NewStream creates a Stream on the medium, tuned to channel 1.
+func (m *Medium) NewStream() *Stream {
+	res := &Stream{
+		medium:   m,
+		incoming: make(chan gofi.RadioPacket, streamBufferSize),
+		outgoing: make(chan wifistack.OutgoingFrame),
+		channel:  gofi.Channel{Number: 1},
+	}
+	m.lock.Lock()
+	m.streams[res] = true
+	m.lock.Unlock()
+	go res.outgoingLoop()
+	return res
+}
+
+func (m *Medium) transmit(sender *Stream, f wifistack.OutgoingFrame) {
+	channel := sender.Channel()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for s := range m.streams {
+		if s == sender || s.Channel().Number != channel.Number {
+			continue
+		}
+		packet := gofi.RadioPacket{
+			Frame: append(gofi.Frame{}, f.Frame...),
+			RadioInfo: &gofi.RadioInfo{
+				Frequency:   channelFrequency(channel.Number),
+				Rate:        f.Rate,
+				SignalPower: signalPower,
+			},
+		}
+		select {
+		case s.incoming <- packet:
+		default:
+		}
+	}
+}
+
+func (m *Medium) remove(s *Stream) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.streams, s)
+	close(s.incoming)
+}
+
+// A Stream is a wifistack.Stream which is attached to a Medium.
+type Stream struct {
+	medium *Medium
+
+	incoming chan gofi.RadioPacket
+	outgoing chan wifistack.OutgoingFrame
+
+	channelLock sync.Mutex
+	channel     gofi.Channel
+}
+
+// Incoming returns the channel of incoming packets.
+func (s *Stream) Incoming() <-chan gofi.RadioPacket {
+	return s.incoming
+}
+
+// Outgoing returns the channel of outgoing frames.
+// Closing it detaches the stream from the medium.
+func (s *Stream) Outgoing() chan<- wifistack.OutgoingFrame {
+	return s.outgoing
+}
+
+// SupportedRates returns the 802.11b and 802.11g rates.
+func (s *Stream) SupportedRates() []gofi.DataRate {
+	return append([]gofi.DataRate{}, supportedRates...)
+}
+
+// SupportedChannels returns the 2.4GHz channels 1 through 11.
+func (s *Stream) SupportedChannels() []gofi.Channel {
+	var res []gofi.Channel
+	for i := 1; i <= 11; i++ {
+		res = append(res, gofi.Channel{Number: i})
+	}
+	return res
+}
+
+// Channel returns the channel to which the stream is tuned.
+func (s *Stream) Channel() gofi.Channel {
+	s.channelLock.Lock()
+	defer s.channelLock.Unlock()
+	return s.channel
+}
+
+// SetChannel tunes the stream to a channel from SupportedChannels.
+func (s *Stream) SetChannel(c gofi.Channel) error {
+	if c.Number < 1 || c.Number > 11 {
+		return ErrUnsupportedChannel
+	}
+	s.channelLock.Lock()
+	defer s.channelLock.Unlock()
+	s.channel = c
+	return nil
+}
+
+// FirstError always returns nil, since simulated streams never fail.
+func (s *Stream) FirstError() error {
+	return nil
+}
+
+func (s *Stream) outgoingLoop() {
+	for f := range s.outgoing {
+		s.medium.transmit(s, f)
+	}
+	s.medium.remove(s)
+}
+
+func channelFrequency(number int) int {
+	return 2407 + 5*number
+}
@@ -0,0 +1,340 @@
+package wifistack
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/unixpickle/gofi"
+	"github.com/unixpickle/wifistack/frames"
+)
+
+const defaultSubscriberBufferSize = 16
+
+// ErrChannelBusy is returned when a subscriber tries to change the channel
+// while another subscriber owns it.
+var ErrChannelBusy = errors.New("channel is owned by another subscriber")
+
+// A DropPolicy determines what a StreamMux does with an incoming packet
+// when a subscriber's buffer is full.
+type DropPolicy int
+
+const (
+	// DropNewest discards the packet which did not fit in the buffer.
+	DropNewest DropPolicy = iota
+
+	// DropOldest discards the oldest buffered packet to make room.
+	DropOldest
+
+	// DropNever blocks the mux (and thus every other subscriber) until
+	// the subscriber reads from its incoming channel.
+	DropNever
+)
+
+// SubscriberConfig configures a subscriber of a StreamMux.
+type SubscriberConfig struct {
+	// Filter selects the packets which the subscriber receives.
+	// The frame argument is nil if the packet could not be decoded.
+	// If Filter is nil, every packet is received.
+	Filter func(f *frames.Frame, p gofi.RadioPacket) bool
+
+	// BufferSize is the capacity of the subscriber's incoming channel.
+	// If this is 0, a default value is used.
+	BufferSize int
+
+	// DropPolicy determines what happens when the buffer is full.
+	DropPolicy DropPolicy
+}
+
+// FrameTypeFilter generates a filter for SubscriberConfig which accepts
+// frames of any of the given types.
+func FrameTypeFilter(types ...frames.FrameType) func(*frames.Frame, gofi.RadioPacket) bool {
+	return func(f *frames.Frame, p gofi.RadioPacket) bool {
+		if f == nil {
+			return false
+		}
+		for _, t := range types {
+			if f.Type == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// AddressFilter generates a filter for SubscriberConfig which accepts
+// frames with the given address in any of their address fields.
+func AddressFilter(addr frames.MAC) func(*frames.Frame, gofi.RadioPacket) bool {
+	return func(f *frames.Frame, p gofi.RadioPacket) bool {
+		if f == nil {
+			return false
+		}
+		for _, a := range f.Addresses {
+			if a == addr {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// LinkFilter generates a filter for SubscriberConfig which accepts the
+// frames that an OpenMSDUStream for a Link needs: frames with the link's
+// BSSID or client address in any of their address fields.
+func LinkFilter(l *Link) func(*frames.Frame, gofi.RadioPacket) bool {
+	bss := AddressFilter(l.BSS.BSSID)
+	client := AddressFilter(l.Client)
+	return func(f *frames.Frame, p gofi.RadioPacket) bool {
+		return bss(f, p) || client(f, p)
+	}
+}
+
+// A StreamMux shares one Stream between multiple independent subscribers.
+//
+// Every incoming packet is delivered to every subscriber whose filter
+// accepts it, and outgoing frames from every subscriber are sent on the
+// underlying Stream.
+//
+// Only one subscriber may own the channel at once.
+// A subscriber takes ownership when it calls SetChannel, and it gives up
+// ownership when it calls ReleaseChannel or closes its outgoing channel.
+// While a subscriber owns the channel, other subscribers may only "set"
+// the channel to the one which is already tuned.
+type StreamMux struct {
+	stream Stream
+
+	lock         sync.Mutex
+	subscribers  map[*MuxSubscriber]bool
+	channelOwner *MuxSubscriber
+	dispatchDone bool
+	closed       bool
+
+	removals       chan *MuxSubscriber
+	dispatchExited chan struct{}
+
+	// senders waits for the mux and every subscriber to stop sending.
+	senders sync.WaitGroup
+}
+
+// NewStreamMux creates a StreamMux which wraps a Stream.
+// After you call this, you should only access the stream through subscribers.
+func NewStreamMux(s Stream) *StreamMux {
+	res := &StreamMux{
+		stream:         s,
+		subscribers:    map[*MuxSubscriber]bool{},
+		removals:       make(chan *MuxSubscriber),
+		dispatchExited: make(chan struct{}),
+	}
+	res.senders.Add(1)
+	go res.dispatchLoop()
+	go func() {
+		res.senders.Wait()
+		close(s.Outgoing())
+	}()
+	return res
+}
+
+// Subscribe creates a new subscriber.
+//
+// If the underlying stream has already closed, the subscriber's incoming
+// channel will be closed immediately.
+// This panics if the mux has been closed.
+func (m *StreamMux) Subscribe(c SubscriberConfig) *MuxSubscriber {
+	bufferSize := c.BufferSize
+	if bufferSize == 0 {
+		bufferSize = defaultSubscriberBufferSize
+	}
+	res := &MuxSubscriber{
+		mux:      m,
+		config:   c,
+		incoming: make(chan gofi.RadioPacket, bufferSize),
+		outgoing: make(chan OutgoingFrame),
+		done:     make(chan struct{}),
+	}
+
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		panic("subscribe to closed StreamMux")
+	}
+	if m.dispatchDone {
+		close(res.incoming)
+	} else {
+		m.subscribers[res] = true
+	}
+	m.senders.Add(1)
+	m.lock.Unlock()
+
+	go res.outgoingLoop()
+	return res
+}
+
+// Close closes the underlying stream once every subscriber has closed
+// its outgoing channel.
+func (m *StreamMux) Close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.closed {
+		m.closed = true
+		m.senders.Done()
+	}
+}
+
+func (m *StreamMux) dispatchLoop() {
+	defer func() {
+		m.lock.Lock()
+		m.dispatchDone = true
+		subs := m.subscribers
+		m.subscribers = map[*MuxSubscriber]bool{}
+		m.lock.Unlock()
+		for sub := range subs {
+			close(sub.incoming)
+		}
+		close(m.dispatchExited)
+	}()
+
+	for {
+		select {
+		case packet, ok := <-m.stream.Incoming():
+			if !ok {
+				return
+			}
+			frame, err := frames.DecodeFrame(packet.Frame)
+			if err != nil {
+				frame = nil
+			}
+			m.lock.Lock()
+			subs := make([]*MuxSubscriber, 0, len(m.subscribers))
+			for sub := range m.subscribers {
+				subs = append(subs, sub)
+			}
+			m.lock.Unlock()
+			for _, sub := range subs {
+				if sub.config.Filter == nil || sub.config.Filter(frame, packet) {
+					sub.deliver(packet)
+				}
+			}
+		case sub := <-m.removals:
+			m.lock.Lock()
+			delete(m.subscribers, sub)
+			m.lock.Unlock()
+			close(sub.incoming)
+		}
+	}
+}
+
+// A MuxSubscriber is a Stream which receives packets from a StreamMux.
+type MuxSubscriber struct {
+	mux    *StreamMux
+	config SubscriberConfig
+
+	incoming chan gofi.RadioPacket
+	outgoing chan OutgoingFrame
+
+	// done is closed once the subscriber closes its outgoing channel.
+	done chan struct{}
+}
+
+// Incoming returns the channel of incoming packets which passed
+// the subscriber's filter.
+// This channel will be closed when the subscriber or the underlying
+// stream is closed.
+func (s *MuxSubscriber) Incoming() <-chan gofi.RadioPacket {
+	return s.incoming
+}
+
+// Outgoing returns the channel of outgoing frames.
+// Closing this channel unsubscribes from the mux, but it does not
+// close the underlying stream.
+func (s *MuxSubscriber) Outgoing() chan<- OutgoingFrame {
+	return s.outgoing
+}
+
+// SupportedRates returns the supported rates of the underlying stream.
+func (s *MuxSubscriber) SupportedRates() []gofi.DataRate {
+	return s.mux.stream.SupportedRates()
+}
+
+// SupportedChannels returns the supported channels of the underlying stream.
+func (s *MuxSubscriber) SupportedChannels() []gofi.Channel {
+	return s.mux.stream.SupportedChannels()
+}
+
+// Channel returns the channel of the underlying stream.
+func (s *MuxSubscriber) Channel() gofi.Channel {
+	return s.mux.stream.Channel()
+}
+
+// SetChannel tunes the underlying stream and takes ownership of the channel.
+// If another subscriber owns the channel, this fails with ErrChannelBusy
+// unless the stream is already tuned to the requested channel.
+func (s *MuxSubscriber) SetChannel(c gofi.Channel) error {
+	m := s.mux
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.channelOwner != nil && m.channelOwner != s {
+		if m.stream.Channel() == c {
+			return nil
+		}
+		return ErrChannelBusy
+	}
+	if err := m.stream.SetChannel(c); err != nil {
+		return err
+	}
+	m.channelOwner = s
+	return nil
+}
+
+// ReleaseChannel gives up ownership of the channel, if the subscriber owns it.
+func (s *MuxSubscriber) ReleaseChannel() {
+	m := s.mux
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.channelOwner == s {
+		m.channelOwner = nil
+	}
+}
+
+// FirstError returns the first error of the underlying stream.
+func (s *MuxSubscriber) FirstError() error {
+	return s.mux.stream.FirstError()
+}
+
+func (s *MuxSubscriber) deliver(packet gofi.RadioPacket) {
+	switch s.config.DropPolicy {
+	case DropNewest:
+		select {
+		case s.incoming <- packet:
+		default:
+		}
+	case DropOldest:
+		for {
+			select {
+			case s.incoming <- packet:
+				return
+			default:
+			}
+			select {
+			case <-s.incoming:
+			default:
+			}
+		}
+	case DropNever:
+		select {
+		case s.incoming <- packet:
+		case <-s.done:
+		}
+	}
+}
+
+func (s *MuxSubscriber) outgoingLoop() {
+	for frame := range s.outgoing {
+		s.mux.stream.Outgoing() <- frame
+	}
+	close(s.done)
+	s.ReleaseChannel()
+	select {
+	case s.mux.removals <- s:
+	case <-s.mux.dispatchExited:
+	}
+	s.mux.senders.Done()
+}
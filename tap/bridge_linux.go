@@ -0,0 +1,83 @@
+package tap
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/frames"
+)
+
+// Bridge shuttles Ethernet frames between a TAP device and an MSDUStream,
+// converting them to and from LLC/SNAP encapsulated MSDUs.
+//
+// The device's MAC address is set to client, which should be the Client
+// of the MSDUStream, and the device is brought up.
+// Outgoing frames from any other source address are dropped, since the
+// AP would not accept them.
+//
+// Bridge takes ownership of the device and the stream.
+// It blocks until one of them is closed, then closes the other one and
+// returns the first error which was encountered, if any.
+// Closing the device is the usual way to stop the bridge.
+func Bridge(d *Device, s wifistack.MSDUStream, client frames.MAC) error {
+	if err := d.SetMAC(client); err != nil {
+		d.Close()
+		close(s.Outgoing())
+		s.ForceClose()
+		return err
+	}
+	if err := d.Up(); err != nil {
+		d.Close()
+		close(s.Outgoing())
+		s.ForceClose()
+		return err
+	}
+
+	ethernet := wifistack.NewEthernetStream(s, client)
+
+	var firstErr error
+	var errLock sync.Mutex
+	setErr := func(err error) {
+		errLock.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		errLock.Unlock()
+	}
+
+	incomingDone := make(chan struct{})
+	go func() {
+		defer close(incomingDone)
+		for frame := range ethernet.Incoming() {
+			if err := d.WriteFrame(frame); err != nil {
+				setErr(err)
+				break
+			}
+		}
+		d.Close()
+	}()
+
+	for {
+		frame, err := d.ReadFrame()
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				setErr(err)
+			}
+			break
+		}
+		if frame.Source != client {
+			continue
+		}
+		ethernet.Outgoing() <- frame
+	}
+
+	close(ethernet.Outgoing())
+	ethernet.ForceClose()
+	<-incomingDone
+
+	errLock.Lock()
+	defer errLock.Unlock()
+	return firstErr
+}
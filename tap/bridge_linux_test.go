@@ -0,0 +1,245 @@
+package tap
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/frames"
+	"github.com/unixpickle/wifistack/ipv4"
+	"github.com/unixpickle/wifistack/sim"
+)
+
+// namespaceEnv is set for a test binary which runs inside of the user
+// and network namespace created by inNamespace.
+const namespaceEnv = "WIFISTACK_TAP_TEST_NAMESPACE"
+
+const testTimeout = time.Second * 5
+
+var (
+	testBSSID     = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	testRouterMAC = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	testClient    = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x03}
+
+	testRouterIP = net.IPv4(10, 0, 0, 1).To4()
+	testClientIP = net.IPv4(10, 0, 0, 2).To4()
+	testMask     = net.CIDRMask(24, 32)
+)
+
+func TestDeviceCloseInterruptsRead(t *testing.T) {
+	if !inNamespace(t) {
+		return
+	}
+	device := openTestDevice(t)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := device.ReadFrame()
+		errs <- err
+	}()
+	time.Sleep(time.Millisecond * 50)
+	device.Close()
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("expected an error from ReadFrame")
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Close did not interrupt ReadFrame")
+	}
+}
+
+func TestBridgeUDPEcho(t *testing.T) {
+	if !inNamespace(t) {
+		return
+	}
+	device := openTestDevice(t)
+
+	medium := sim.NewMedium()
+	ap, err := sim.NewAccessPoint(medium.NewStream(), sim.AccessPointConfig{
+		SSID:    "wifistack",
+		BSSID:   testBSSID,
+		Channel: 6,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ap.Close()
+
+	routerEthernet := wifistack.NewEthernetStream(ap.DS(), testRouterMAC)
+	defer close(routerEthernet.Outgoing())
+	router := ipv4.NewStack(ipv4.Config{
+		Stream:     routerEthernet,
+		MAC:        testRouterMAC,
+		Address:    testRouterIP,
+		SubnetMask: testMask,
+	})
+	defer router.Close()
+	echo, err := router.ListenUDP(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 0x10000)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	msduStream := joinTestNetwork(t, medium)
+	// NOTE: the interface is brought up here, even though Bridge does it
+	// too, so that its route exists before the socket below is created.
+	if err := setAddress(device.Name(), testClientIP, testMask); err != nil {
+		device.Close()
+		t.Fatal(err)
+	}
+	if err := device.Up(); err != nil {
+		device.Close()
+		t.Fatal(err)
+	}
+	bridgeDone := make(chan error, 1)
+	go func() {
+		bridgeDone <- Bridge(device, msduStream, testClient)
+	}()
+
+	// NOTE: this socket belongs to the kernel's network stack, so its
+	// datagrams (and the ARP exchange before them) cross the bridge.
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: testRouterIP, Port: 7})
+	if err != nil {
+		device.Close()
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(testTimeout)
+	for _, size := range []int{16, 1400} {
+		message := []byte(strings.Repeat("x", size))
+		if !udpEcho(conn, message, deadline) {
+			device.Close()
+			t.Fatalf("no echo of %d bytes", size)
+		}
+	}
+
+	device.Close()
+	select {
+	case err := <-bridgeDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("closing the device did not stop the bridge")
+	}
+}
+
+// udpEcho sends a message until it is echoed back or the deadline passes.
+//
+// The first datagrams may be lost, since the kernel flushes its pending
+// ARP requests when Bridge sets the device's MAC address.
+func udpEcho(conn *net.UDPConn, message []byte, deadline time.Time) bool {
+	buf := make([]byte, 2048)
+	for time.Now().Before(deadline) {
+		if _, err := conn.Write(message); err != nil {
+			return false
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+		n, err := conn.Read(buf)
+		if err == nil && string(buf[:n]) == string(message) {
+			return true
+		}
+	}
+	return false
+}
+
+// inNamespace re-runs the calling test in a new user and network
+// namespace, where the test may create TAP devices without privileges.
+//
+// It returns true if the caller is already running in the namespace and
+// should perform the test. Otherwise, it reports the result of the
+// re-run test and returns false.
+// The test is skipped if namespaces are unavailable.
+func inNamespace(t *testing.T) bool {
+	if os.Getenv(namespaceEnv) != "" {
+		return true
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), namespaceEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+		},
+	}
+	output, err := cmd.CombinedOutput()
+	if cmd.ProcessState == nil {
+		t.Skip("cannot create user namespace:", err)
+	}
+	if strings.Contains(string(output), "--- SKIP") {
+		t.Skip(strings.TrimSpace(string(output)))
+	}
+	if err != nil {
+		t.Fatalf("test failed in namespace: %v\n%s", err, output)
+	}
+	return false
+}
+
+func openTestDevice(t *testing.T) *Device {
+	device, err := Open("")
+	if err != nil {
+		t.Skip("cannot create TAP device:", err)
+	}
+	return device
+}
+
+func joinTestNetwork(t *testing.T, medium *sim.Medium) wifistack.MSDUStream {
+	stream := medium.NewStream()
+	scanRes, _ := wifistack.ScanNetworks(stream)
+	var bss *frames.BSSDescription
+	for desc := range scanRes {
+		if desc.BSSID == testBSSID {
+			desc := desc
+			bss = &desc
+		}
+	}
+	if bss == nil {
+		t.Fatal("simulated AP not found")
+	}
+	handshaker := wifistack.Handshaker{Stream: stream, Client: testClient, BSS: *bss}
+	link, err := handshaker.HandshakeOpen(testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wifistack.NewOpenMSDUStream(wifistack.NewOpenMSDUStreamConfig(stream, link))
+}
+
+// setAddress assigns an IPv4 address and subnet mask to an interface.
+func setAddress(name string, ip net.IP, mask net.IPMask) error {
+	for _, x := range []struct {
+		request uintptr
+		value   []byte
+	}{
+		{syscall.SIOCSIFADDR, ip.To4()},
+		{syscall.SIOCSIFNETMASK, mask},
+	} {
+		req := newIfreq(name)
+		*(*uint16)(unsafe.Pointer(&req[syscall.IFNAMSIZ])) = syscall.AF_INET
+		copy(req[syscall.IFNAMSIZ+4:], x.value)
+		if err := socketIoctl(x.request, &req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// Package tap connects wifistack to the Linux network stack through
+// a TAP device, so that ordinary tools like ping, curl, and dhclient
+// can use a wifistack connection.
+//
+// Creating a TAP device requires CAP_NET_ADMIN, which an unprivileged
+// user has inside of a user and network namespace (e.g. unshare -rn).
+package tap
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/unixpickle/wifistack/frames"
+)
+
+// ifreqSize is the size of struct ifreq from <net/if.h>.
+const ifreqSize = 40
+
+// A Device is a TAP network interface.
+type Device struct {
+	file *os.File
+	name string
+}
+
+// Open creates a TAP device.
+//
+// If name is "", the kernel picks a name like "tap0".
+// The device is created without packet information headers, so every
+// read or write is exactly one Ethernet frame.
+func Open(name string) (*Device, error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, syscall.EINVAL
+	}
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: "/dev/net/tun", Err: err}
+	}
+
+	req := newIfreq(name)
+	*(*uint16)(unsafe.Pointer(&req[syscall.IFNAMSIZ])) = syscall.IFF_TAP | syscall.IFF_NO_PI
+	if err := ioctl(uintptr(fd), syscall.TUNSETIFF, &req); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// NOTE: the descriptor is handed to the runtime poller only once it is
+	// attached to an interface, since polling an unattached TUN file never
+	// reports readiness. It must be non-blocking (and file.Fd() must never
+	// be used) so that closing the file interrupts a pending read.
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	file := os.NewFile(uintptr(fd), "/dev/net/tun")
+
+	return &Device{file: file, name: req.name()}, nil
+}
+
+// Name returns the name of the network interface.
+func (d *Device) Name() string {
+	return d.name
+}
+
+// SetMAC sets the hardware address of the interface.
+func (d *Device) SetMAC(mac frames.MAC) error {
+	req := newIfreq(d.name)
+	*(*uint16)(unsafe.Pointer(&req[syscall.IFNAMSIZ])) = syscall.ARPHRD_ETHER
+	copy(req[syscall.IFNAMSIZ+2:], mac[:])
+	return socketIoctl(syscall.SIOCSIFHWADDR, &req)
+}
+
+// SetMTU sets the maximum transmission unit of the interface.
+func (d *Device) SetMTU(mtu int) error {
+	req := newIfreq(d.name)
+	*(*int32)(unsafe.Pointer(&req[syscall.IFNAMSIZ])) = int32(mtu)
+	return socketIoctl(syscall.SIOCSIFMTU, &req)
+}
+
+// Up brings the interface up.
+func (d *Device) Up() error {
+	req := newIfreq(d.name)
+	if err := socketIoctl(syscall.SIOCGIFFLAGS, &req); err != nil {
+		return err
+	}
+	*(*uint16)(unsafe.Pointer(&req[syscall.IFNAMSIZ])) |= syscall.IFF_UP
+	return socketIoctl(syscall.SIOCSIFFLAGS, &req)
+}
+
+// ReadFrame reads the next Ethernet frame which the kernel sent
+// out of the interface.
+//
+// Frames which are not Ethernet II frames are skipped.
+func (d *Device) ReadFrame() (*frames.EthernetFrame, error) {
+	buf := make([]byte, 65536)
+	for {
+		n, err := d.file.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		frame, err := frames.DecodeEthernetFrame(buf[:n])
+		if err == nil {
+			return frame, nil
+		}
+	}
+}
+
+// WriteFrame passes an Ethernet frame to the kernel as if it had
+// been received by the interface.
+func (d *Device) WriteFrame(f *frames.EthernetFrame) error {
+	_, err := d.file.Write(f.Encode())
+	return err
+}
+
+// Close destroys the interface.
+// Any pending ReadFrame will fail.
+func (d *Device) Close() error {
+	return d.file.Close()
+}
+
+type ifreq [ifreqSize]byte
+
+func newIfreq(name string) ifreq {
+	var res ifreq
+	copy(res[:syscall.IFNAMSIZ-1], name)
+	return res
+}
+
+func (i *ifreq) name() string {
+	for j, b := range i[:syscall.IFNAMSIZ] {
+		if b == 0 {
+			return string(i[:j])
+		}
+	}
+	return string(i[:syscall.IFNAMSIZ])
+}
+
+func ioctl(fd uintptr, request uintptr, req *ifreq) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request,
+		uintptr(unsafe.Pointer(req)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// socketIoctl runs an interface ioctl on a temporary socket,
+// since interface attributes cannot be changed through the TAP file.
+func socketIoctl(request uintptr, req *ifreq) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	return ioctl(uintptr(fd), request, req)
+}
@@ -0,0 +1,418 @@
+package tcp
+
+import (
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	sendBufferSize    = 0x10000
+	receiveBufferSize = 0xffff
+	defaultMSS        = 536
+	ipHeaderSize      = 20
+
+	initialRTO         = time.Second
+	minRTO             = time.Second
+	maxRTO             = time.Minute
+	clockGranularity   = time.Millisecond
+	maxSynRetries      = 5
+	maxRetransmissions = 12
+	timeWaitDuration   = time.Minute
+
+	dupAckThreshold = 3
+)
+
+var (
+	ErrConnectionRefused = errors.New("connection refused")
+	ErrConnectionReset   = errors.New("connection reset by peer")
+	ErrTimeout           = errors.New("connection timed out")
+)
+
+type state int
+
+const (
+	stateSynSent state = iota
+	stateSynReceived
+	stateEstablished
+	stateFinWait1
+	stateFinWait2
+	stateCloseWait
+	stateClosing
+	stateLastAck
+	stateTimeWait
+	stateClosed
+)
+
+// A Conn is a TCP connection.
+// It implements net.Conn.
+//
+// Retransmission timeouts follow RFC 6298, and congestion control
+// follows RFC 5681 with the NewReno modification from RFC 6582.
+type Conn struct {
+	stack    *Stack
+	id       connID
+	local    *net.TCPAddr
+	remote   *net.TCPAddr
+	listener *Listener
+
+	lock  sync.Mutex
+	state state
+	err   error
+	queue []*Segment
+
+	// changed is closed and replaced whenever something which a blocked
+	// call might be waiting for changes.
+	changed chan struct{}
+
+	closed        bool
+	writeClosed   bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// Send sequence variables from section 3.2 of RFC 793.
+	// sndMax is the highest sequence number which has been sent, which
+	// is ahead of sndNxt while lost data is being resent.
+	iss    uint32
+	sndUna uint32
+	sndNxt uint32
+	sndMax uint32
+	sndWnd int
+	sndWL1 uint32
+	sndWL2 uint32
+	mss    int
+
+	// sendBuffer contains the data starting at sndUna.
+	sendBuffer []byte
+	finQueued  bool
+	finSent    bool
+	finSeq     uint32
+
+	// Receive sequence variables.
+	irs           uint32
+	rcvNxt        uint32
+	advertised    int
+	receiveBuffer []byte
+	outOfOrder    []*Segment
+	finReceived   bool
+	timeWaitTimer *time.Timer
+
+	// Congestion control state.
+	cwnd       int
+	ssthresh   int
+	dupAcks    int
+	recover    uint32
+	inRecovery bool
+
+	// Round-trip time estimation state.
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	timing   bool
+	rttSeq   uint32
+	rttStart time.Time
+	retries  int
+
+	timer           *time.Timer
+	timerGeneration int
+}
+
+func newConn(s *Stack, local, remote *net.TCPAddr) *Conn {
+	res := &Conn{
+		stack:    s,
+		local:    local,
+		remote:   remote,
+		changed:  make(chan struct{}),
+		iss:      rand.Uint32(),
+		mss:      defaultMSS,
+		cwnd:     defaultMSS,
+		ssthresh: math.MaxInt32,
+		rto:      initialRTO,
+	}
+	res.id = connID{localPort: local.Port, remotePort: remote.Port}
+	copy(res.id.remoteIP[:], remote.IP.To4())
+	res.sndUna = res.iss
+	res.sndNxt = res.iss
+	res.sndMax = res.iss
+	res.recover = res.iss
+	return res
+}
+
+// Read reads data from the connection.
+// It returns io.EOF once the remote end has closed the connection and
+// all of its data has been read.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.unlock()
+	for {
+		if c.closed {
+			return 0, net.ErrClosed
+		}
+		if len(b) == 0 {
+			return 0, nil
+		}
+		if len(c.receiveBuffer) > 0 {
+			n := copy(b, c.receiveBuffer)
+			c.receiveBuffer = c.receiveBuffer[n:]
+			if len(c.receiveBuffer) == 0 {
+				c.receiveBuffer = nil
+			}
+			c.windowUpdate()
+			return n, nil
+		}
+		if c.finReceived {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if !c.wait(c.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Write queues data to be sent on the connection.
+// It blocks while the send buffer is full.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.unlock()
+	written := 0
+	for {
+		if c.closed {
+			return written, net.ErrClosed
+		}
+		if c.err != nil {
+			return written, c.err
+		}
+		if c.writeClosed || (c.state != stateEstablished && c.state != stateCloseWait) {
+			return written, net.ErrClosed
+		}
+		if written == len(b) {
+			return written, nil
+		}
+		if space := sendBufferSize - len(c.sendBuffer); space > 0 {
+			n := len(b) - written
+			if n > space {
+				n = space
+			}
+			c.sendBuffer = append(c.sendBuffer, b[written:written+n]...)
+			written += n
+			c.output()
+			continue
+		}
+		if !c.wait(c.writeDeadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Close closes the connection.
+//
+// Buffered data is still sent, followed by a FIN, but no more data
+// can be read or written.
+func (c *Conn) Close() error {
+	c.lock.Lock()
+	defer c.unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.receiveBuffer = nil
+	c.shutdownWrite()
+	return nil
+}
+
+// CloseWrite shuts down the sending side of the connection.
+// Buffered data is still sent, followed by a FIN, but the connection
+// can still be read from.
+func (c *Conn) CloseWrite() error {
+	c.lock.Lock()
+	defer c.unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.shutdownWrite()
+	return nil
+}
+
+// LocalAddr returns the local address of the connection.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the remote address of the connection.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline sets both the read and write deadlines.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Read calls, including calls
+// which are already blocked.
+// A zero value means Read will not time out.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.unlock()
+	c.readDeadline = t
+	c.notify()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write calls, including calls
+// which are already blocked.
+// A zero value means Write will not time out.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.unlock()
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+// unlock releases the lock and then sends the queued segments, so that
+// segments are never sent while the lock is held.
+func (c *Conn) unlock() {
+	queue := c.queue
+	c.queue = nil
+	c.lock.Unlock()
+	c.stack.send(c.local, c.remote, queue)
+}
+
+// notify wakes up any blocked calls.
+//
+// The caller must hold the lock.
+func (c *Conn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait releases the lock until the connection changes or the deadline
+// passes. It returns false if the deadline passed.
+//
+// The caller must hold the lock.
+func (c *Conn) wait(deadline time.Time) bool {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false
+		}
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	changed := c.changed
+	c.unlock()
+	defer c.lock.Lock()
+	select {
+	case <-changed:
+		return true
+	case <-timeout:
+		return false
+	}
+}
+
+// connect sends the initial SYN of an active open.
+//
+// The caller must hold the lock.
+func (c *Conn) connect() {
+	c.state = stateSynSent
+	c.sendSyn()
+	c.startTimer()
+}
+
+// handleSyn handles the SYN which created a passive connection.
+//
+// The caller must hold the lock.
+func (c *Conn) handleSyn(seg *Segment) {
+	c.state = stateSynReceived
+	c.irs = seg.Seq
+	c.rcvNxt = seg.Seq + 1
+	c.setPeerMSS(seg)
+	c.sendSyn()
+	c.startTimer()
+}
+
+// abort resets the connection.
+func (c *Conn) abort(err error) {
+	c.lock.Lock()
+	defer c.unlock()
+	c.reset(err)
+}
+
+// reset sends a reset if the remote end may know about the connection,
+// and then terminates the connection.
+//
+// The caller must hold the lock.
+func (c *Conn) reset(err error) {
+	switch c.state {
+	case stateSynReceived, stateEstablished, stateFinWait1, stateFinWait2, stateCloseWait:
+		c.queue = append(c.queue, &Segment{
+			SourcePort:      c.local.Port,
+			DestinationPort: c.remote.Port,
+			Seq:             c.sndNxt,
+			Flags:           FlagRST,
+		})
+	}
+	c.terminate(err)
+}
+
+// terminate moves the connection to the closed state and removes it
+// from the stack.
+//
+// The caller must hold the lock.
+func (c *Conn) terminate(err error) {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	if c.err == nil {
+		c.err = err
+	}
+	c.stopTimer()
+	if c.timeWaitTimer != nil {
+		c.timeWaitTimer.Stop()
+	}
+	c.sendBuffer = nil
+	c.outOfOrder = nil
+	c.stack.remove(c)
+	c.notify()
+}
+
+// shutdownWrite queues a FIN after the buffered data.
+//
+// The caller must hold the lock.
+func (c *Conn) shutdownWrite() {
+	if c.writeClosed {
+		return
+	}
+	c.writeClosed = true
+	switch c.state {
+	case stateSynSent, stateSynReceived:
+		c.reset(net.ErrClosed)
+		return
+	case stateEstablished:
+		c.state = stateFinWait1
+	case stateCloseWait:
+		c.state = stateLastAck
+	default:
+		return
+	}
+	c.finQueued = true
+	c.output()
+	c.notify()
+}
@@ -0,0 +1,467 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/frames"
+	"github.com/unixpickle/wifistack/ipv4"
+	"github.com/unixpickle/wifistack/sim"
+)
+
+const (
+	testTimeout = time.Second * 10
+	testPort    = 80
+)
+
+var (
+	testBSSID     = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	testRouterMAC = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	testClient    = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x03}
+
+	testRouterIP = net.IPv4(10, 0, 0, 1).To4()
+	testClientIP = net.IPv4(10, 0, 0, 2).To4()
+	testMask     = net.CIDRMask(24, 32)
+)
+
+func TestConnBulkTransfer(t *testing.T) {
+	n := newTestNetwork(t)
+	defer n.Close()
+	client, server := n.Connect(t)
+
+	data := testData(0x40000)
+	go func() {
+		client.Write(data)
+		client.CloseWrite()
+	}()
+	received := readAll(t, server)
+	if !bytes.Equal(received, data) {
+		t.Fatalf("received %d bytes which do not match", len(received))
+	}
+
+	// Echo the data back and close from the server's side.
+	go func() {
+		server.Write(received)
+		server.Close()
+	}()
+	if echoed := readAll(t, client); !bytes.Equal(echoed, data) {
+		t.Fatalf("echoed %d bytes which do not match", len(echoed))
+	}
+	client.Close()
+
+	waitFor(t, "server to close", func() bool {
+		var closed bool
+		withLock(server, func() {
+			closed = server.state == stateClosed && server.err == nil
+		})
+		return closed
+	})
+	withLock(client, func() {
+		if client.state != stateTimeWait {
+			t.Errorf("expected client in TIME-WAIT but got state %d", client.state)
+		}
+	})
+}
+
+func TestConnSynRetransmission(t *testing.T) {
+	n := newTestNetwork(t)
+	defer n.Close()
+
+	n.Drop(func(seg *Segment) bool {
+		return seg.Flags&FlagSYN != 0
+	})
+	start := time.Now()
+	n.Connect(t)
+	if elapsed := time.Since(start); elapsed < initialRTO {
+		t.Errorf("handshake took %v, before the first retransmission", elapsed)
+	}
+}
+
+func TestConnFastRetransmit(t *testing.T) {
+	n := newTestNetwork(t)
+	defer n.Close()
+	client, server := n.Connect(t)
+
+	var lostSeq uint32
+	withLock(client, func() {
+		lostSeq = client.iss + 1 + uint32(client.mss*8)
+	})
+	n.Drop(func(seg *Segment) bool {
+		return seg.Seq == lostSeq && len(seg.Payload) > 0
+	})
+
+	data := testData(0x40000)
+	start := time.Now()
+	go func() {
+		client.Write(data)
+		client.CloseWrite()
+	}()
+	if received := readAll(t, server); !bytes.Equal(received, data) {
+		t.Fatalf("received %d bytes which do not match", len(received))
+	}
+
+	// NOTE: the segments after the lost one arrive out of order, so the
+	// server sends duplicate ACKs and the loss is repaired without
+	// waiting for the retransmission timer.
+	if elapsed := time.Since(start); elapsed >= initialRTO {
+		t.Errorf("transfer took %v, so the loss was not repaired by fast retransmit", elapsed)
+	}
+	withLock(client, func() {
+		if client.ssthresh == math.MaxInt32 {
+			t.Error("congestion window was not reduced after the loss")
+		}
+	})
+}
+
+func TestConnRetransmissionTimeout(t *testing.T) {
+	n := newTestNetwork(t)
+	defer n.Close()
+	client, server := n.Connect(t)
+
+	// NOTE: a lone segment is followed by nothing which could produce
+	// duplicate ACKs, so only the retransmission timer can resend it.
+	n.Drop(func(seg *Segment) bool {
+		return len(seg.Payload) > 0
+	})
+	data := testData(1000)
+	start := time.Now()
+	if _, err := client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, len(data))
+	server.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, err := io.ReadFull(server, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received data does not match")
+	}
+	if elapsed := time.Since(start); elapsed < minRTO {
+		t.Errorf("data arrived after %v, before the retransmission timeout", elapsed)
+	}
+
+	waitFor(t, "data to be acknowledged", func() bool {
+		var acked bool
+		withLock(client, func() {
+			acked = client.sndUna == client.sndMax
+		})
+		return acked
+	})
+	withLock(client, func() {
+		if client.rto < 2*minRTO {
+			t.Errorf("expected backed off RTO but got %v", client.rto)
+		}
+		if client.ssthresh != 2*client.mss {
+			t.Errorf("expected ssthresh %d but got %d", 2*client.mss, client.ssthresh)
+		}
+	})
+}
+
+func TestConnZeroWindowProbe(t *testing.T) {
+	n := newTestNetwork(t)
+	defer n.Close()
+	client, server := n.Connect(t)
+
+	data := testData(receiveBufferSize + 0x8000)
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := client.Write(data)
+		writeErr <- err
+	}()
+
+	waitFor(t, "window to close", func() bool {
+		var closed bool
+		withLock(client, func() {
+			closed = client.sndWnd == 0
+		})
+		return closed
+	})
+
+	// Let at least one probe time out before the window opens.
+	time.Sleep(minRTO + minRTO/2)
+	withLock(client, func() {
+		if client.sndMax-client.sndUna != 1 {
+			t.Errorf("expected a one byte probe in flight but got %d bytes",
+				client.sndMax-client.sndUna)
+		}
+		if client.rto < 2*minRTO {
+			t.Errorf("expected backed off probe timer but got %v", client.rto)
+		}
+	})
+
+	received := make([]byte, len(data))
+	server.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, err := io.ReadFull(server, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received data does not match")
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnHTTP(t *testing.T) {
+	n := newTestNetwork(t)
+	defer n.Close()
+
+	page := testData(100000)
+	go http.Serve(n.listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(page)
+	}))
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				tcpAddr, err := net.ResolveTCPAddr(network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return n.client.Dial(ctx, tcpAddr)
+			},
+		},
+		Timeout: testTimeout,
+	}
+	defer client.CloseIdleConnections()
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://" + testRouterIP.String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status: %s", resp.Status)
+		}
+		if !bytes.Equal(body, page) {
+			t.Fatalf("received %d bytes which do not match the page", len(body))
+		}
+	}
+}
+
+// A testNetwork connects a TCP stack on a simulated station to a TCP
+// stack on the distribution system of a simulated AP.
+type testNetwork struct {
+	ap              *sim.AccessPoint
+	router          *ipv4.Stack
+	station         *ipv4.Stack
+	routerEthernet  *wifistack.EthernetStream
+	stationEthernet *wifistack.EthernetStream
+	server          *Stack
+	client          *Stack
+	listener        *Listener
+	drops           *dropStream
+}
+
+func newTestNetwork(t *testing.T) *testNetwork {
+	medium := sim.NewMedium()
+	ap, err := sim.NewAccessPoint(medium.NewStream(), sim.AccessPointConfig{
+		SSID:    "wifistack",
+		BSSID:   testBSSID,
+		Channel: 6,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &testNetwork{ap: ap}
+	res.routerEthernet = wifistack.NewEthernetStream(ap.DS(), testRouterMAC)
+	res.router = ipv4.NewStack(ipv4.Config{
+		Stream:     res.routerEthernet,
+		MAC:        testRouterMAC,
+		Address:    testRouterIP,
+		SubnetMask: testMask,
+	})
+	res.server = NewStack(res.router)
+	res.listener, err = res.server.Listen(testPort)
+	if err != nil {
+		res.Close()
+		t.Fatal(err)
+	}
+
+	stream := medium.NewStream()
+	scanRes, _ := wifistack.ScanNetworks(stream)
+	var bss *frames.BSSDescription
+	for desc := range scanRes {
+		if desc.BSSID == testBSSID {
+			desc := desc
+			bss = &desc
+		}
+	}
+	if bss == nil {
+		res.Close()
+		t.Fatal("simulated AP not found")
+	}
+	handshaker := wifistack.Handshaker{Stream: stream, Client: testClient, BSS: *bss}
+	link, err := handshaker.HandshakeOpen(testTimeout)
+	if err != nil {
+		res.Close()
+		t.Fatal(err)
+	}
+	res.drops = newDropStream(wifistack.NewOpenMSDUStream(
+		wifistack.NewOpenMSDUStreamConfig(stream, link)))
+	res.stationEthernet = wifistack.NewEthernetStream(res.drops, testClient)
+	res.station = ipv4.NewStack(ipv4.Config{
+		Stream:     res.stationEthernet,
+		MAC:        testClient,
+		Address:    testClientIP,
+		SubnetMask: testMask,
+	})
+	res.client = NewStack(res.station)
+	return res
+}
+
+// Connect opens a connection from the station to the router.
+func (n *testNetwork) Connect(t *testing.T) (client, server *Conn) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := n.listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	client, err := n.client.Dial(ctx, &net.TCPAddr{IP: testRouterIP, Port: testPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case conn := <-accepted:
+		return client, conn.(*Conn)
+	case <-time.After(testTimeout):
+		t.Fatal("connection was not accepted")
+	}
+	return nil, nil
+}
+
+// Drop causes the station to drop the first outgoing segment for which
+// f returns true.
+func (n *testNetwork) Drop(f func(seg *Segment) bool) {
+	n.drops.SetFilter(f)
+}
+
+func (n *testNetwork) Close() {
+	if n.client != nil {
+		n.client.Close()
+		n.station.Close()
+		close(n.stationEthernet.Outgoing())
+	}
+	if n.listener != nil {
+		n.listener.Close()
+	}
+	n.server.Close()
+	n.router.Close()
+	close(n.routerEthernet.Outgoing())
+	n.ap.Close()
+}
+
+// A dropStream is a wifistack.MSDUStream which drops the outgoing
+// MSDU carrying a chosen TCP segment.
+//
+// NOTE: MSDUs are dropped above the 802.11 layer, since the 802.11
+// layer resends lost frames until they are acknowledged.
+type dropStream struct {
+	wifistack.MSDUStream
+	outgoing chan wifistack.MSDU
+
+	lock   sync.Mutex
+	filter func(seg *Segment) bool
+}
+
+func newDropStream(s wifistack.MSDUStream) *dropStream {
+	res := &dropStream{
+		MSDUStream: s,
+		outgoing:   make(chan wifistack.MSDU),
+	}
+	go res.outgoingLoop()
+	return res
+}
+
+func (d *dropStream) Outgoing() chan<- wifistack.MSDU {
+	return d.outgoing
+}
+
+// SetFilter sets a function which chooses one segment to drop.
+func (d *dropStream) SetFilter(f func(seg *Segment) bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.filter = f
+}
+
+func (d *dropStream) outgoingLoop() {
+	defer close(d.MSDUStream.Outgoing())
+	for msdu := range d.outgoing {
+		if !d.shouldDrop(msdu) {
+			d.MSDUStream.Outgoing() <- msdu
+		}
+	}
+}
+
+func (d *dropStream) shouldDrop(msdu wifistack.MSDU) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.filter == nil {
+		return false
+	}
+	etherType, payload, err := frames.DecodeLLCSNAP(msdu.Payload)
+	if err != nil || etherType != frames.EtherTypeIPv4 {
+		return false
+	}
+	packet, err := ipv4.DecodePacket(payload)
+	if err != nil || packet.Protocol != ipv4.ProtocolTCP {
+		return false
+	}
+	seg, err := DecodeSegment(packet.Payload, packet.Source, packet.Destination)
+	if err != nil || !d.filter(seg) {
+		return false
+	}
+	d.filter = nil
+	return true
+}
+
+// withLock calls f while holding the connection's lock.
+func withLock(c *Conn, f func()) {
+	c.lock.Lock()
+	defer c.unlock()
+	f()
+}
+
+func waitFor(t *testing.T, what string, f func() bool) {
+	deadline := time.Now().Add(testTimeout)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func readAll(t *testing.T, c *Conn) []byte {
+	c.SetReadDeadline(time.Now().Add(testTimeout))
+	data, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func testData(size int) []byte {
+	res := make([]byte, size)
+	rand.Read(res)
+	return res
+}
@@ -0,0 +1,82 @@
+package tcp
+
+import (
+	"net"
+	"sync"
+)
+
+// A Listener accepts incoming TCP connections on a port.
+// It implements net.Listener.
+type Listener struct {
+	stack   *Stack
+	port    int
+	backlog chan *Conn
+
+	lock     sync.Mutex
+	isClosed bool
+	closed   chan struct{}
+}
+
+// Accept waits for the next connection which has completed its
+// handshake.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.backlog:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening and resets any connections which have not
+// been accepted.
+func (l *Listener) Close() error {
+	l.lock.Lock()
+	if l.isClosed {
+		l.lock.Unlock()
+		return nil
+	}
+	l.isClosed = true
+	close(l.closed)
+	l.lock.Unlock()
+
+	l.stack.lock.Lock()
+	if l.stack.listeners[l.port] == l {
+		delete(l.stack.listeners, l.port)
+	}
+	l.stack.lock.Unlock()
+
+	for {
+		select {
+		case c := <-l.backlog:
+			c.abort(net.ErrClosed)
+		default:
+			return nil
+		}
+	}
+}
+
+// Addr returns the local address of the listener.
+func (l *Listener) Addr() net.Addr {
+	return &net.TCPAddr{IP: l.stack.ip.Address(), Port: l.port}
+}
+
+func (l *Listener) hasRoom() bool {
+	return len(l.backlog) < cap(l.backlog)
+}
+
+// enqueue adds an established connection to the backlog.
+// It returns false if the connection could not be queued.
+func (l *Listener) enqueue(c *Conn) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.isClosed {
+		return false
+	}
+	select {
+	case l.backlog <- c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,412 @@
+package tcp
+
+import (
+	"sort"
+	"time"
+)
+
+// handleSegment processes an incoming segment, following the
+// "SEGMENT ARRIVES" event in section 3.9 of RFC 793.
+//
+// The caller must hold the lock.
+func (c *Conn) handleSegment(seg *Segment) {
+	switch c.state {
+	case stateClosed:
+		return
+	case stateSynSent:
+		c.handleSynSent(seg)
+		return
+	}
+
+	if !c.acceptable(seg) {
+		if seg.Flags&FlagRST == 0 {
+			c.sendAck()
+		}
+		return
+	}
+
+	if seg.Flags&FlagRST != 0 {
+		c.terminate(ErrConnectionReset)
+		return
+	}
+
+	if seg.Flags&FlagSYN != 0 {
+		// NOTE: rather than resetting the connection, we send a
+		// challenge ACK as described in section 4.2 of RFC 5961.
+		c.sendAck()
+		return
+	}
+
+	if seg.Flags&FlagACK == 0 {
+		return
+	}
+
+	if c.state == stateSynReceived {
+		if !seqLT(c.sndUna, seg.Ack) || !seqLE(seg.Ack, c.sndMax) {
+			c.queue = append(c.queue, resetFor(seg))
+			return
+		}
+		c.state = stateEstablished
+		c.sndWL1 = seg.Seq - 1
+		if c.listener != nil && !c.listener.enqueue(c) {
+			c.reset(ErrConnectionReset)
+			return
+		}
+		c.notify()
+	}
+
+	if !c.handleAck(seg) {
+		return
+	}
+
+	switch c.state {
+	case stateEstablished, stateFinWait1, stateFinWait2:
+		c.handleData(seg)
+	case stateTimeWait:
+		// NOTE: this is a retransmitted FIN, so our ACK must have been
+		// lost; we acknowledge it again and restart the 2 MSL timeout.
+		if seg.Flags&FlagFIN != 0 {
+			c.sendAck()
+			c.enterTimeWait()
+		}
+	}
+}
+
+// handleSynSent processes a segment in the SYN-SENT state.
+//
+// The caller must hold the lock.
+func (c *Conn) handleSynSent(seg *Segment) {
+	hasAck := seg.Flags&FlagACK != 0
+	if hasAck && (!seqGT(seg.Ack, c.iss) || seqGT(seg.Ack, c.sndMax)) {
+		if seg.Flags&FlagRST == 0 {
+			c.queue = append(c.queue, resetFor(seg))
+		}
+		return
+	}
+	if seg.Flags&FlagRST != 0 {
+		if hasAck {
+			c.terminate(ErrConnectionRefused)
+		}
+		return
+	}
+	if seg.Flags&FlagSYN == 0 {
+		return
+	}
+
+	c.irs = seg.Seq
+	c.rcvNxt = seg.Seq + 1
+	c.setPeerMSS(seg)
+	c.sndWnd = seg.Window
+	c.sndWL1 = seg.Seq
+	c.sndWL2 = seg.Ack
+
+	if !hasAck {
+		// NOTE: this is a simultaneous open, so we resend our SYN along
+		// with an ACK.
+		c.state = stateSynReceived
+		c.sendSyn()
+		c.startTimer()
+		return
+	}
+
+	c.updateRTT(seg.Ack)
+	c.sndUna = seg.Ack
+	c.stopTimer()
+	c.retries = 0
+	c.state = stateEstablished
+	c.sendAck()
+	c.notify()
+}
+
+// acceptable checks if a segment overlaps the receive window, as
+// described in section 3.3 of RFC 793.
+//
+// The caller must hold the lock.
+func (c *Conn) acceptable(seg *Segment) bool {
+	length := seg.length()
+	window := c.receiveWindow()
+	if window == 0 {
+		// NOTE: a segment with data may still be accepted so that its
+		// ACK can be processed, but its data is discarded.
+		return seg.Seq == c.rcvNxt
+	}
+	if length == 0 {
+		return inWindow(seg.Seq, c.rcvNxt, window)
+	}
+	return inWindow(seg.Seq, c.rcvNxt, window) ||
+		inWindow(seg.Seq+uint32(length)-1, c.rcvNxt, window)
+}
+
+// handleAck processes the acknowledgment and window of a segment.
+// It returns false if the rest of the segment should be ignored.
+//
+// The caller must hold the lock.
+func (c *Conn) handleAck(seg *Segment) bool {
+	if seqGT(seg.Ack, c.sndMax) {
+		c.sendAck()
+		return false
+	}
+	if seqLT(seg.Ack, c.sndUna) {
+		return true
+	}
+
+	windowChanged := false
+	if seqLT(c.sndWL1, seg.Seq) || (c.sndWL1 == seg.Seq && seqLE(c.sndWL2, seg.Ack)) {
+		windowChanged = c.sndWnd != seg.Window
+		c.sndWnd = seg.Window
+		c.sndWL1 = seg.Seq
+		c.sndWL2 = seg.Ack
+	}
+
+	if seg.Ack == c.sndUna {
+		// NOTE: this is the definition of a duplicate ACK from section 2
+		// of RFC 5681.
+		if len(seg.Payload) == 0 && seg.Flags&(FlagSYN|FlagFIN) == 0 && !windowChanged &&
+			c.sndMax != c.sndUna {
+			c.duplicateAck()
+		}
+		c.output()
+		return true
+	}
+
+	c.newAck(seg.Ack)
+	c.output()
+	return true
+}
+
+// newAck handles an ACK which acknowledges new data.
+//
+// The caller must hold the lock.
+func (c *Conn) newAck(ack uint32) {
+	acked := int(ack - c.sndUna)
+	c.updateRTT(ack)
+
+	finAcked := c.finSent && seqGT(ack, c.finSeq)
+	dataAcked := acked
+	if dataAcked > len(c.sendBuffer) {
+		dataAcked = len(c.sendBuffer)
+	}
+	c.sendBuffer = c.sendBuffer[dataAcked:]
+	if len(c.sendBuffer) == 0 {
+		c.sendBuffer = nil
+	}
+	c.sndUna = ack
+	if seqLT(c.sndNxt, ack) {
+		c.sndNxt = ack
+	}
+	c.retries = 0
+
+	c.updateCongestionWindow(ack, acked)
+
+	if c.sndUna == c.sndMax {
+		c.stopTimer()
+	} else {
+		c.startTimer()
+	}
+
+	if finAcked {
+		switch c.state {
+		case stateFinWait1:
+			c.state = stateFinWait2
+		case stateClosing:
+			c.enterTimeWait()
+		case stateLastAck:
+			c.terminate(nil)
+		}
+	}
+	c.notify()
+}
+
+// updateCongestionWindow grows the congestion window after new data is
+// acknowledged, or handles a partial acknowledgment during fast
+// recovery as described in section 3.2 of RFC 6582.
+//
+// The caller must hold the lock.
+func (c *Conn) updateCongestionWindow(ack uint32, acked int) {
+	if c.inRecovery {
+		if seqGE(ack, c.recover) {
+			c.inRecovery = false
+			c.dupAcks = 0
+			c.cwnd = c.flightSize() + c.mss
+			if c.ssthresh < c.cwnd {
+				c.cwnd = c.ssthresh
+			}
+		} else {
+			c.retransmitFirst()
+			c.cwnd -= acked
+			if acked >= c.mss {
+				c.cwnd += c.mss
+			}
+			if c.cwnd < c.mss {
+				c.cwnd = c.mss
+			}
+		}
+		return
+	}
+
+	c.dupAcks = 0
+	if c.cwnd < c.ssthresh {
+		if acked > c.mss {
+			acked = c.mss
+		}
+		c.cwnd += acked
+	} else {
+		increase := c.mss * c.mss / c.cwnd
+		if increase < 1 {
+			increase = 1
+		}
+		c.cwnd += increase
+	}
+	if c.cwnd > sendBufferSize {
+		c.cwnd = sendBufferSize
+	}
+}
+
+// duplicateAck handles a duplicate ACK, entering fast retransmit and
+// fast recovery as described in section 3.2 of RFC 6582.
+//
+// The caller must hold the lock.
+func (c *Conn) duplicateAck() {
+	c.dupAcks++
+	if c.inRecovery {
+		c.cwnd += c.mss
+		return
+	}
+	if c.dupAcks != dupAckThreshold || !seqGT(c.sndUna, c.recover) {
+		return
+	}
+	c.inRecovery = true
+	c.recover = c.sndMax
+	c.ssthresh = c.flightSize() / 2
+	if c.ssthresh < 2*c.mss {
+		c.ssthresh = 2 * c.mss
+	}
+	c.retransmitFirst()
+	c.cwnd = c.ssthresh + dupAckThreshold*c.mss
+}
+
+// handleData processes the data and FIN of a segment.
+//
+// The caller must hold the lock.
+func (c *Conn) handleData(seg *Segment) {
+	seq := seg.Seq
+	data := seg.Payload
+	finSeq := seq + uint32(len(data))
+
+	if seqLT(seq, c.rcvNxt) {
+		skip := int(c.rcvNxt - seq)
+		if skip > len(data) {
+			skip = len(data)
+		}
+		data = data[skip:]
+		seq += uint32(skip)
+	}
+	fin := seg.Flags&FlagFIN != 0
+	if window := c.receiveWindow() - int(seq-c.rcvNxt); len(data) > window {
+		if window < 0 {
+			window = 0
+		}
+		data = data[:window]
+		fin = false
+	}
+
+	if len(data) > 0 {
+		if seq == c.rcvNxt {
+			c.receive(data)
+			c.reassemble()
+		} else {
+			c.addOutOfOrder(seq, data)
+		}
+	}
+
+	if fin && finSeq == c.rcvNxt {
+		c.rcvNxt++
+		c.finReceived = true
+		c.outOfOrder = nil
+		switch c.state {
+		case stateEstablished:
+			c.state = stateCloseWait
+		case stateFinWait1:
+			// Our FIN has not been acknowledged, or else we would be
+			// in FIN-WAIT-2.
+			c.state = stateClosing
+		case stateFinWait2:
+			c.enterTimeWait()
+		}
+		c.notify()
+	}
+
+	// NOTE: we acknowledge every segment immediately rather than
+	// delaying ACKs, which keeps the remote congestion window growing
+	// and makes out-of-order segments produce duplicate ACKs.
+	if len(seg.Payload) > 0 || seg.Flags&FlagFIN != 0 {
+		c.sendAck()
+	}
+}
+
+// receive adds in-order data to the receive buffer.
+//
+// The caller must hold the lock.
+func (c *Conn) receive(data []byte) {
+	c.rcvNxt += uint32(len(data))
+	if c.closed {
+		// NOTE: once the connection is closed, data is acknowledged
+		// but discarded.
+		return
+	}
+	c.receiveBuffer = append(c.receiveBuffer, data...)
+	c.notify()
+}
+
+// addOutOfOrder stores data which arrived ahead of rcvNxt.
+//
+// The caller must hold the lock.
+func (c *Conn) addOutOfOrder(seq uint32, data []byte) {
+	for _, existing := range c.outOfOrder {
+		if existing.Seq == seq && len(existing.Payload) >= len(data) {
+			return
+		}
+	}
+	seg := &Segment{Seq: seq, Payload: append([]byte{}, data...)}
+	c.outOfOrder = append(c.outOfOrder, seg)
+	sort.Slice(c.outOfOrder, func(i, j int) bool {
+		return seqLT(c.outOfOrder[i].Seq, c.outOfOrder[j].Seq)
+	})
+}
+
+// reassemble moves out-of-order data which is now in order into the
+// receive buffer.
+//
+// The caller must hold the lock.
+func (c *Conn) reassemble() {
+	for len(c.outOfOrder) > 0 {
+		next := c.outOfOrder[0]
+		if seqGT(next.Seq, c.rcvNxt) {
+			return
+		}
+		c.outOfOrder = c.outOfOrder[1:]
+		end := next.Seq + uint32(len(next.Payload))
+		if seqGT(end, c.rcvNxt) {
+			c.receive(next.Payload[c.rcvNxt-next.Seq:])
+		}
+	}
+}
+
+// enterTimeWait moves to the TIME-WAIT state and (re)starts the timer
+// which eventually closes the connection.
+//
+// The caller must hold the lock.
+func (c *Conn) enterTimeWait() {
+	c.state = stateTimeWait
+	c.stopTimer()
+	if c.timeWaitTimer != nil {
+		c.timeWaitTimer.Stop()
+	}
+	c.timeWaitTimer = time.AfterFunc(timeWaitDuration, func() {
+		c.lock.Lock()
+		defer c.unlock()
+		if c.state == stateTimeWait {
+			c.terminate(nil)
+		}
+	})
+}
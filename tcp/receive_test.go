@@ -0,0 +1,147 @@
+package tcp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestConnReassembly(t *testing.T) {
+	c := newTestConn()
+	c.state = stateEstablished
+	c.rcvNxt = 1000
+
+	data := testData(100)
+	segment := func(start, end int) *Segment {
+		return &Segment{
+			Seq:     1000 + uint32(start),
+			Flags:   FlagACK,
+			Payload: data[start:end],
+		}
+	}
+
+	// NOTE: the segments overlap each other and arrive out of order,
+	// including a duplicate of an out-of-order segment.
+	for _, seg := range []*Segment{
+		segment(60, 100),
+		segment(20, 50),
+		segment(20, 40),
+		segment(40, 70),
+	} {
+		c.handleData(seg)
+		if len(c.receiveBuffer) != 0 {
+			t.Fatal("out-of-order data was delivered early")
+		}
+	}
+	if len(c.outOfOrder) != 3 {
+		t.Fatalf("expected 3 out-of-order segments but got %d", len(c.outOfOrder))
+	}
+	for i := 1; i < len(c.outOfOrder); i++ {
+		if !seqLT(c.outOfOrder[i-1].Seq, c.outOfOrder[i].Seq) {
+			t.Fatal("out-of-order segments are not sorted")
+		}
+	}
+	for _, seg := range c.queue {
+		if seg.Ack != 1000 {
+			t.Fatalf("expected duplicate ACK for 1000 but got %d", seg.Ack)
+		}
+	}
+
+	c.handleData(segment(0, 30))
+	if !bytes.Equal(c.receiveBuffer, data) {
+		t.Fatal("reassembled data does not match")
+	}
+	if len(c.outOfOrder) != 0 {
+		t.Fatal("out-of-order segments were not consumed")
+	}
+	if c.rcvNxt != 1100 {
+		t.Fatalf("expected rcvNxt 1100 but got %d", c.rcvNxt)
+	}
+	if ack := c.queue[len(c.queue)-1].Ack; ack != 1100 {
+		t.Fatalf("expected ACK for 1100 but got %d", ack)
+	}
+}
+
+func TestConnCongestionWindow(t *testing.T) {
+	c := newTestConn()
+	c.mss = 1000
+	c.cwnd = 4000
+	c.ssthresh = 8000
+
+	// Slow start grows the window by at most one MSS per ACK.
+	c.updateCongestionWindow(c.sndUna, 3000)
+	if c.cwnd != 5000 {
+		t.Fatalf("expected cwnd 5000 but got %d", c.cwnd)
+	}
+	c.updateCongestionWindow(c.sndUna, 500)
+	if c.cwnd != 5500 {
+		t.Fatalf("expected cwnd 5500 but got %d", c.cwnd)
+	}
+
+	// Congestion avoidance grows it by about one MSS per window.
+	c.cwnd = 10000
+	c.updateCongestionWindow(c.sndUna, 1000)
+	if c.cwnd != 10100 {
+		t.Fatalf("expected cwnd 10100 but got %d", c.cwnd)
+	}
+}
+
+func TestConnFastRecovery(t *testing.T) {
+	c := newTestConn()
+	c.state = stateEstablished
+	c.mss = 1000
+	c.cwnd = 10000
+	c.sndUna = c.iss + 1
+	c.sendBuffer = testData(10000)
+	c.sndNxt = c.sndUna + 10000
+	c.sndMax = c.sndNxt
+
+	for i := 0; i < dupAckThreshold; i++ {
+		if c.inRecovery {
+			t.Fatalf("entered recovery after %d duplicate ACKs", i)
+		}
+		c.duplicateAck()
+	}
+	if !c.inRecovery {
+		t.Fatal("did not enter fast recovery")
+	}
+	if c.ssthresh != 5000 || c.cwnd != 8000 {
+		t.Fatalf("unexpected ssthresh %d and cwnd %d", c.ssthresh, c.cwnd)
+	}
+	if len(c.queue) != 1 || c.queue[0].Seq != c.sndUna {
+		t.Fatal("first unacknowledged segment was not retransmitted")
+	}
+
+	// Further duplicate ACKs inflate the window.
+	c.duplicateAck()
+	if c.cwnd != 9000 {
+		t.Fatalf("expected cwnd 9000 but got %d", c.cwnd)
+	}
+
+	// A partial ACK retransmits the next segment and deflates the window.
+	c.newAck(c.sndUna + 2000)
+	if !c.inRecovery {
+		t.Fatal("left recovery after a partial ACK")
+	}
+	if c.cwnd != 8000 {
+		t.Fatalf("expected cwnd 8000 but got %d", c.cwnd)
+	}
+	if last := c.queue[len(c.queue)-1]; last.Seq != c.sndUna || len(last.Payload) != c.mss {
+		t.Fatal("partial ACK did not retransmit the next segment")
+	}
+
+	// A full ACK ends recovery with the window at ssthresh.
+	c.newAck(c.sndMax)
+	if c.inRecovery {
+		t.Fatal("did not leave recovery")
+	}
+	if c.cwnd != 1000 {
+		t.Fatalf("expected cwnd 1000 but got %d", c.cwnd)
+	}
+	c.stopTimer()
+}
+
+func newTestConn() *Conn {
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: testPort}
+	return newConn(&Stack{}, addr, addr)
+}
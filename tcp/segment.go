@@ -0,0 +1,160 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/unixpickle/wifistack/ipv4"
+)
+
+// These are the control flags of a TCP segment.
+const (
+	FlagFIN = 1 << iota
+	FlagSYN
+	FlagRST
+	FlagPSH
+	FlagACK
+	FlagURG
+)
+
+const (
+	headerSize = 20
+
+	optionEnd = 0
+	optionNOP = 1
+	optionMSS = 2
+)
+
+var (
+	ErrBadSegment  = errors.New("invalid TCP segment")
+	ErrBadChecksum = errors.New("bad TCP checksum")
+)
+
+// A Segment is a TCP segment, as described in section 3.1 of RFC 793.
+type Segment struct {
+	SourcePort      int
+	DestinationPort int
+	Seq             uint32
+	Ack             uint32
+	Flags           int
+	Window          int
+	Urgent          int
+	Options         []byte
+	Payload         []byte
+}
+
+// DecodeSegment decodes a TCP segment and verifies its checksum using
+// the addresses from the IPv4 header.
+func DecodeSegment(data []byte, source, destination net.IP) (*Segment, error) {
+	if len(data) < headerSize {
+		return nil, ErrBadSegment
+	}
+	size := int(data[12]>>4) * 4
+	if size < headerSize || size > len(data) {
+		return nil, ErrBadSegment
+	}
+	sum := ipv4.PseudoHeaderSum(source, destination, ipv4.ProtocolTCP, len(data))
+	if ipv4.Checksum(data, sum) != 0 {
+		return nil, ErrBadChecksum
+	}
+	return &Segment{
+		SourcePort:      int(binary.BigEndian.Uint16(data[0:2])),
+		DestinationPort: int(binary.BigEndian.Uint16(data[2:4])),
+		Seq:             binary.BigEndian.Uint32(data[4:8]),
+		Ack:             binary.BigEndian.Uint32(data[8:12]),
+		Flags:           int(data[13] & 0x3f),
+		Window:          int(binary.BigEndian.Uint16(data[14:16])),
+		Urgent:          int(binary.BigEndian.Uint16(data[18:20])),
+		Options:         append([]byte{}, data[headerSize:size]...),
+		Payload:         data[size:],
+	}, nil
+}
+
+// Encode generates the binary representation of the segment, including
+// a checksum computed with the addresses from the IPv4 header.
+//
+// The options are padded to a multiple of four bytes.
+func (s *Segment) Encode(source, destination net.IP) []byte {
+	options := s.Options
+	for len(options)%4 != 0 {
+		options = append(options, optionEnd)
+	}
+	size := headerSize + len(options)
+	res := make([]byte, size+len(s.Payload))
+	binary.BigEndian.PutUint16(res[0:2], uint16(s.SourcePort))
+	binary.BigEndian.PutUint16(res[2:4], uint16(s.DestinationPort))
+	binary.BigEndian.PutUint32(res[4:8], s.Seq)
+	binary.BigEndian.PutUint32(res[8:12], s.Ack)
+	res[12] = byte(size/4) << 4
+	res[13] = byte(s.Flags & 0x3f)
+	binary.BigEndian.PutUint16(res[14:16], uint16(s.Window))
+	binary.BigEndian.PutUint16(res[18:20], uint16(s.Urgent))
+	copy(res[headerSize:], options)
+	copy(res[size:], s.Payload)
+	sum := ipv4.PseudoHeaderSum(source, destination, ipv4.ProtocolTCP, len(res))
+	binary.BigEndian.PutUint16(res[16:18], ipv4.Checksum(res, sum))
+	return res
+}
+
+// MSS returns the value of the maximum segment size option, if present.
+func (s *Segment) MSS() (int, bool) {
+	options := s.Options
+	for len(options) > 0 {
+		switch options[0] {
+		case optionEnd:
+			return 0, false
+		case optionNOP:
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || int(options[1]) < 2 || int(options[1]) > len(options) {
+			return 0, false
+		}
+		if options[0] == optionMSS && options[1] == 4 {
+			return int(binary.BigEndian.Uint16(options[2:4])), true
+		}
+		options = options[options[1]:]
+	}
+	return 0, false
+}
+
+// length returns the amount of sequence space the segment occupies.
+func (s *Segment) length() int {
+	res := len(s.Payload)
+	if s.Flags&FlagSYN != 0 {
+		res++
+	}
+	if s.Flags&FlagFIN != 0 {
+		res++
+	}
+	return res
+}
+
+func mssOption(mss int) []byte {
+	return []byte{optionMSS, 4, byte(mss >> 8), byte(mss)}
+}
+
+// These functions compare sequence numbers modulo 2^32, as described
+// in section 3.3 of RFC 793.
+
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func seqLE(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+func seqGT(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+func seqGE(a, b uint32) bool {
+	return int32(a-b) >= 0
+}
+
+// inWindow checks if seq is in [start, start+size).
+func inWindow(seq, start uint32, size int) bool {
+	return seqLE(start, seq) && seqLT(seq, start+uint32(size))
+}
@@ -0,0 +1,323 @@
+package tcp
+
+import (
+	"time"
+)
+
+// sendSyn sends the SYN (or SYN-ACK) which opens the connection.
+//
+// The caller must hold the lock.
+func (c *Conn) sendSyn() {
+	flags := FlagSYN
+	if c.state == stateSynReceived {
+		flags |= FlagACK
+	}
+	seg := c.makeSegment(flags, c.iss, nil)
+	seg.Options = mssOption(c.stack.ip.MTU() - ipHeaderSize - headerSize)
+	c.queue = append(c.queue, seg)
+	c.sndNxt = c.iss + 1
+	c.sndMax = c.sndNxt
+}
+
+// setPeerMSS uses the MSS option of a SYN to choose the segment size.
+//
+// NOTE: if the option is absent, section 4.2.2.6 of RFC 1122 says to
+// assume 536 bytes.
+//
+// The caller must hold the lock.
+func (c *Conn) setPeerMSS(seg *Segment) {
+	mss := defaultMSS
+	if peer, ok := seg.MSS(); ok {
+		mss = peer
+	}
+	if local := c.stack.ip.MTU() - ipHeaderSize - headerSize; mss > local {
+		mss = local
+	}
+	c.mss = mss
+
+	// NOTE: this is the initial window from section 3.1 of RFC 5681.
+	if mss > 2190 {
+		c.cwnd = 2 * mss
+	} else if mss > 1095 {
+		c.cwnd = 3 * mss
+	} else {
+		c.cwnd = 4 * mss
+	}
+}
+
+// makeSegment creates a segment with the connection's ports and
+// receive window, and with the current acknowledgment if the ACK flag
+// is set.
+//
+// The caller must hold the lock.
+func (c *Conn) makeSegment(flags int, seq uint32, payload []byte) *Segment {
+	res := &Segment{
+		SourcePort:      c.local.Port,
+		DestinationPort: c.remote.Port,
+		Seq:             seq,
+		Flags:           flags,
+		Window:          c.receiveWindow(),
+		Payload:         payload,
+	}
+	if flags&FlagACK != 0 {
+		res.Ack = c.rcvNxt
+	}
+	c.advertised = res.Window
+	return res
+}
+
+// sendAck sends an acknowledgment without any data.
+//
+// The caller must hold the lock.
+func (c *Conn) sendAck() {
+	c.queue = append(c.queue, c.makeSegment(FlagACK, c.sndNxt, nil))
+}
+
+// receiveWindow returns the amount of free space in the receive buffer.
+//
+// The caller must hold the lock.
+func (c *Conn) receiveWindow() int {
+	return receiveBufferSize - len(c.receiveBuffer)
+}
+
+// windowUpdate advertises a larger window once enough of the receive
+// buffer has been read, as described in section 4.2.3.3 of RFC 1122.
+//
+// The caller must hold the lock.
+func (c *Conn) windowUpdate() {
+	switch c.state {
+	case stateEstablished, stateFinWait1, stateFinWait2:
+	default:
+		return
+	}
+	threshold := receiveBufferSize / 2
+	if c.mss < threshold {
+		threshold = c.mss
+	}
+	if c.receiveWindow()-c.advertised >= threshold {
+		c.sendAck()
+	}
+}
+
+// output sends as much buffered data as the send window and the
+// congestion window allow, followed by a FIN if one is queued.
+//
+// The caller must hold the lock.
+func (c *Conn) output() {
+	switch c.state {
+	case stateEstablished, stateCloseWait, stateFinWait1, stateClosing, stateLastAck:
+	default:
+		return
+	}
+
+	for {
+		inFlight := int(c.sndNxt - c.sndUna)
+		offset := inFlight
+		if offset > len(c.sendBuffer) {
+			offset = len(c.sendBuffer)
+		}
+		unsent := len(c.sendBuffer) - offset
+
+		if unsent == 0 {
+			if c.finQueued && (!c.finSent || c.sndNxt == c.finSeq) {
+				c.finSent = true
+				c.finSeq = c.sndNxt
+				c.queue = append(c.queue, c.makeSegment(FlagFIN|FlagACK, c.sndNxt, nil))
+				c.advance(1)
+			}
+			return
+		}
+
+		window := c.cwnd
+		if c.sndWnd < window {
+			window = c.sndWnd
+		}
+		size := window - inFlight
+		if size > unsent {
+			size = unsent
+		}
+		if size > c.mss {
+			size = c.mss
+		}
+
+		probe := false
+		if size <= 0 {
+			// NOTE: when the remote window is closed and nothing is in
+			// flight, we probe it with one byte, which is retransmitted
+			// with backoff until the window opens (section 3.7 of RFC 793).
+			if c.sndWnd != 0 || inFlight != 0 {
+				return
+			}
+			size = 1
+			probe = true
+		} else if size < c.mss && size < unsent && inFlight > 0 {
+			// NOTE: this is the sender side of silly window syndrome
+			// avoidance from section 4.2.3.4 of RFC 1122.
+			return
+		}
+
+		flags := FlagACK
+		if size == unsent {
+			flags |= FlagPSH
+		}
+		c.queue = append(c.queue, c.makeSegment(flags, c.sndNxt,
+			c.sendBuffer[offset:offset+size]))
+		c.advance(size)
+		if probe {
+			return
+		}
+	}
+}
+
+// advance moves sndNxt forward after a segment is sent, starting the
+// retransmission timer and an RTT measurement if necessary.
+//
+// The caller must hold the lock.
+func (c *Conn) advance(size int) {
+	newData := c.sndNxt == c.sndMax
+	c.sndNxt += uint32(size)
+	if seqGT(c.sndNxt, c.sndMax) {
+		c.sndMax = c.sndNxt
+	}
+
+	// NOTE: following Karn's algorithm, only new data is timed.
+	if newData && !c.timing {
+		c.timing = true
+		c.rttSeq = c.sndNxt - 1
+		c.rttStart = time.Now()
+	}
+	if c.timer == nil {
+		c.startTimer()
+	}
+}
+
+// retransmitFirst resends the first unacknowledged segment.
+//
+// The caller must hold the lock.
+func (c *Conn) retransmitFirst() {
+	c.timing = false
+	if len(c.sendBuffer) > 0 {
+		size := len(c.sendBuffer)
+		if size > c.mss {
+			size = c.mss
+		}
+		c.queue = append(c.queue, c.makeSegment(FlagACK, c.sndUna, c.sendBuffer[:size]))
+	} else if c.finSent {
+		c.queue = append(c.queue, c.makeSegment(FlagFIN|FlagACK, c.finSeq, nil))
+	}
+}
+
+// flightSize returns the amount of data which has been sent but not
+// acknowledged.
+//
+// The caller must hold the lock.
+func (c *Conn) flightSize() int {
+	return int(c.sndMax - c.sndUna)
+}
+
+// updateRTT takes an RTT measurement, as described in section 2 of
+// RFC 6298.
+//
+// The caller must hold the lock.
+func (c *Conn) updateRTT(ack uint32) {
+	if !c.timing || !seqGT(ack, c.rttSeq) {
+		return
+	}
+	c.timing = false
+	rtt := time.Since(c.rttStart)
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		delta := c.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	variance := 4 * c.rttvar
+	if variance < clockGranularity {
+		variance = clockGranularity
+	}
+	c.rto = c.srtt + variance
+	if c.rto < minRTO {
+		c.rto = minRTO
+	} else if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+}
+
+// startTimer (re)starts the retransmission timer.
+//
+// The caller must hold the lock.
+func (c *Conn) startTimer() {
+	c.stopTimer()
+	generation := c.timerGeneration
+	c.timer = time.AfterFunc(c.rto, func() {
+		c.lock.Lock()
+		defer c.unlock()
+		if c.timerGeneration == generation {
+			c.timer = nil
+			c.retransmitTimeout()
+		}
+	})
+}
+
+// stopTimer stops the retransmission timer.
+//
+// The caller must hold the lock.
+func (c *Conn) stopTimer() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.timerGeneration++
+}
+
+// retransmitTimeout handles the expiration of the retransmission timer,
+// as described in section 5 of RFC 6298.
+//
+// The caller must hold the lock.
+func (c *Conn) retransmitTimeout() {
+	c.retries++
+	switch c.state {
+	case stateSynSent, stateSynReceived:
+		if c.retries > maxSynRetries {
+			c.reset(ErrTimeout)
+			return
+		}
+		c.sendSyn()
+	case stateClosed, stateTimeWait:
+		return
+	default:
+		if c.sndMax == c.sndUna {
+			return
+		}
+		if c.retries > maxRetransmissions {
+			c.reset(ErrTimeout)
+			return
+		}
+
+		// NOTE: section 3.1 of RFC 5681 and section 4 of RFC 6582
+		// describe the congestion state after a timeout.
+		c.ssthresh = c.flightSize() / 2
+		if c.ssthresh < 2*c.mss {
+			c.ssthresh = 2 * c.mss
+		}
+		c.cwnd = c.mss
+		c.dupAcks = 0
+		c.inRecovery = false
+		c.recover = c.sndMax
+		c.timing = false
+
+		// Resend everything from the first unacknowledged byte.
+		c.sndNxt = c.sndUna
+		c.output()
+	}
+	c.rto *= 2
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+	c.startTimer()
+}
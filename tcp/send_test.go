@@ -0,0 +1,77 @@
+package tcp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnUpdateRTT(t *testing.T) {
+	c := newTestConn()
+
+	measure := func(rtt time.Duration) {
+		c.timing = true
+		c.rttSeq = c.sndUna
+		c.rttStart = time.Now().Add(-rtt)
+		c.updateRTT(c.sndUna + 1)
+	}
+
+	measure(time.Millisecond * 100)
+	if c.srtt < time.Millisecond*100 || c.srtt > time.Millisecond*150 {
+		t.Fatalf("unexpected first SRTT %v", c.srtt)
+	}
+	if c.rto != minRTO {
+		t.Fatalf("expected RTO to be clamped to %v but got %v", minRTO, c.rto)
+	}
+
+	// NOTE: large variations in the RTT push the RTO above its minimum.
+	for i := 0; i < 4; i++ {
+		measure(time.Millisecond * 900)
+	}
+	if c.rto <= minRTO {
+		t.Fatalf("expected RTO above %v but got %v", minRTO, c.rto)
+	}
+	expected := c.srtt + 4*c.rttvar
+	if c.rto != expected {
+		t.Fatalf("expected RTO %v but got %v", expected, c.rto)
+	}
+
+	// Acknowledgments which do not cover the timed segment are ignored.
+	srtt := c.srtt
+	c.timing = true
+	c.rttSeq = c.sndUna + 10
+	c.rttStart = time.Now()
+	c.updateRTT(c.sndUna + 5)
+	if !c.timing || c.srtt != srtt {
+		t.Fatal("measurement was taken before the timed segment was acknowledged")
+	}
+}
+
+func TestConnRetransmitTimeout(t *testing.T) {
+	c := newTestConn()
+	c.state = stateEstablished
+	c.mss = 1000
+	c.cwnd = 8000
+	c.sndWnd = 0x10000
+	c.sendBuffer = testData(6000)
+	c.sndNxt = c.sndUna + 6000
+	c.sndMax = c.sndNxt
+	defer c.stopTimer()
+
+	c.retransmitTimeout()
+	if c.cwnd != c.mss || c.ssthresh != 3000 {
+		t.Fatalf("unexpected cwnd %d and ssthresh %d", c.cwnd, c.ssthresh)
+	}
+	if c.rto != 2*initialRTO {
+		t.Fatalf("expected RTO %v but got %v", 2*initialRTO, c.rto)
+	}
+	if len(c.queue) != 1 || c.queue[0].Seq != c.sndUna || len(c.queue[0].Payload) != c.mss {
+		t.Fatal("expected one segment to be resent from sndUna")
+	}
+
+	for i := 0; i < 10; i++ {
+		c.retransmitTimeout()
+	}
+	if c.rto != maxRTO {
+		t.Fatalf("expected RTO to be clamped to %v but got %v", maxRTO, c.rto)
+	}
+}
@@ -0,0 +1,283 @@
+// Package tcp implements TCP on top of an ipv4.Stack.
+//
+// Connections implement net.Conn and listeners implement net.Listener,
+// so they can be used with packages like net/http.
+package tcp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/unixpickle/wifistack/ipv4"
+)
+
+const (
+	ephemeralPortMin = 49152
+	ephemeralPortMax = 65535
+	listenBacklog    = 16
+)
+
+var (
+	ErrPortInUse   = errors.New("TCP port in use")
+	ErrNoFreePorts = errors.New("no free TCP ports")
+	ErrNoAddress   = errors.New("no local IPv4 address")
+	ErrStackClosed = errors.New("TCP stack closed")
+)
+
+// A Stack manages the TCP connections and listeners of an ipv4.Stack.
+type Stack struct {
+	ip *ipv4.Stack
+
+	lock      sync.Mutex
+	closed    bool
+	conns     map[connID]*Conn
+	listeners map[int]*Listener
+	nextPort  int
+}
+
+type connID struct {
+	localPort  int
+	remoteIP   [4]byte
+	remotePort int
+}
+
+// NewStack creates a Stack and registers it as the TCP handler of
+// an ipv4.Stack.
+// You should call Close before closing the ipv4.Stack.
+func NewStack(ip *ipv4.Stack) *Stack {
+	res := &Stack{
+		ip:        ip,
+		conns:     map[connID]*Conn{},
+		listeners: map[int]*Listener{},
+		nextPort:  ephemeralPortMin + rand.Intn(ephemeralPortMax-ephemeralPortMin+1),
+	}
+	ip.HandleProtocol(ipv4.ProtocolTCP, res.handlePacket)
+	return res
+}
+
+// Dial opens a connection to a remote address.
+//
+// The context only applies to the handshake; once Dial returns, the
+// connection is unaffected by the context.
+func (s *Stack) Dial(ctx context.Context, addr *net.TCPAddr) (*Conn, error) {
+	remoteIP := addr.IP.To4()
+	if remoteIP == nil {
+		return nil, &net.AddrError{Err: "not an IPv4 address", Addr: addr.String()}
+	}
+	localIP := s.ip.Address()
+	if localIP == nil {
+		return nil, ErrNoAddress
+	}
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil, ErrStackClosed
+	}
+	port, err := s.allocatePort(remoteIP, addr.Port)
+	if err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+	c := newConn(s, &net.TCPAddr{IP: localIP, Port: port},
+		&net.TCPAddr{IP: remoteIP, Port: addr.Port})
+	s.conns[c.id] = c
+	s.lock.Unlock()
+
+	c.lock.Lock()
+	c.connect()
+	for {
+		if c.state != stateSynSent && c.state != stateSynReceived {
+			break
+		}
+		changed := c.changed
+		c.unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			c.abort(ctx.Err())
+			return nil, ctx.Err()
+		}
+		c.lock.Lock()
+	}
+	err = c.err
+	c.unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Listen creates a listener on a local port.
+// If port is 0, an ephemeral port is chosen.
+func (s *Stack) Listen(port int) (*Listener, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil, ErrStackClosed
+	}
+	if port == 0 {
+		var err error
+		port, err = s.allocatePort(nil, 0)
+		if err != nil {
+			return nil, err
+		}
+	} else if _, ok := s.listeners[port]; ok {
+		return nil, ErrPortInUse
+	}
+
+	res := &Listener{
+		stack:   s,
+		port:    port,
+		backlog: make(chan *Conn, listenBacklog),
+		closed:  make(chan struct{}),
+	}
+	s.listeners[port] = res
+	return res, nil
+}
+
+// Close closes every listener, resets every connection, and stops
+// handling TCP packets.
+func (s *Stack) Close() {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	var listeners []*Listener
+	for _, l := range s.listeners {
+		listeners = append(listeners, l)
+	}
+	var conns []*Conn
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.lock.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+	for _, c := range conns {
+		c.abort(ErrStackClosed)
+	}
+	s.ip.HandleProtocol(ipv4.ProtocolTCP, nil)
+}
+
+// allocatePort finds an ephemeral port which is not used by a listener
+// or by a connection to the remote address.
+// If remoteIP is nil, the port must not be used by any connection.
+//
+// The caller must hold the lock.
+func (s *Stack) allocatePort(remoteIP net.IP, remotePort int) (int, error) {
+	used := map[int]bool{}
+	for id := range s.conns {
+		if remoteIP == nil || (id.remotePort == remotePort && net.IP(id.remoteIP[:]).Equal(remoteIP)) {
+			used[id.localPort] = true
+		}
+	}
+	for i := ephemeralPortMin; i <= ephemeralPortMax; i++ {
+		port := s.nextPort
+		s.nextPort++
+		if s.nextPort > ephemeralPortMax {
+			s.nextPort = ephemeralPortMin
+		}
+		if _, ok := s.listeners[port]; !ok && !used[port] {
+			return port, nil
+		}
+	}
+	return 0, ErrNoFreePorts
+}
+
+func (s *Stack) remove(c *Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conns[c.id] == c {
+		delete(s.conns, c.id)
+	}
+}
+
+func (s *Stack) send(local, remote *net.TCPAddr, segments []*Segment) {
+	for _, seg := range segments {
+		s.ip.Send(remote.IP, ipv4.ProtocolTCP, seg.Encode(local.IP, remote.IP))
+	}
+}
+
+func (s *Stack) handlePacket(p *ipv4.Packet) {
+	localIP := s.ip.Address()
+	if localIP == nil || !p.Destination.Equal(localIP) {
+		return
+	}
+	seg, err := DecodeSegment(p.Payload, p.Source, p.Destination)
+	if err != nil {
+		return
+	}
+
+	id := connID{localPort: seg.DestinationPort, remotePort: seg.SourcePort}
+	copy(id.remoteIP[:], p.Source.To4())
+
+	s.lock.Lock()
+	c := s.conns[id]
+	l := s.listeners[seg.DestinationPort]
+	s.lock.Unlock()
+
+	local := &net.TCPAddr{IP: p.Destination, Port: seg.DestinationPort}
+	remote := &net.TCPAddr{IP: p.Source, Port: seg.SourcePort}
+
+	if c != nil {
+		c.lock.Lock()
+		c.handleSegment(seg)
+		c.unlock()
+	} else if l != nil && seg.Flags&(FlagSYN|FlagACK|FlagRST) == FlagSYN {
+		s.accept(l, local, remote, seg)
+	} else if seg.Flags&FlagRST == 0 {
+		s.send(local, remote, []*Segment{resetFor(seg)})
+	}
+}
+
+// accept creates a connection in response to a SYN for a listener.
+func (s *Stack) accept(l *Listener, local, remote *net.TCPAddr, seg *Segment) {
+	// NOTE: like most implementations, we ignore SYNs rather than
+	// resetting them when the backlog is full, so that the remote end
+	// retries once there is room.
+	if !l.hasRoom() {
+		return
+	}
+
+	c := newConn(s, local, remote)
+	c.listener = l
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.conns[c.id] = c
+	s.lock.Unlock()
+
+	c.lock.Lock()
+	c.handleSyn(seg)
+	c.unlock()
+}
+
+// resetFor generates a reset for a segment which does not belong to a
+// connection, as described in section 3.4 of RFC 793.
+func resetFor(seg *Segment) *Segment {
+	res := &Segment{
+		SourcePort:      seg.DestinationPort,
+		DestinationPort: seg.SourcePort,
+	}
+	if seg.Flags&FlagACK != 0 {
+		res.Seq = seg.Ack
+		res.Flags = FlagRST
+	} else {
+		res.Ack = seg.Seq + uint32(seg.length())
+		res.Flags = FlagRST | FlagACK
+	}
+	return res
+}
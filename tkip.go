@@ -0,0 +1,448 @@
+package wifistack
+
+import (
+	"crypto/rc4"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/wifistack/frames"
+)
+
+// These are the sizes of the keys which a TKIPCipher is created from.
+const (
+	TKIPPTKSize = 64
+	TKIPGTKSize = 32
+)
+
+const (
+	tkipTKSize      = 16
+	tkipHeaderSize  = 8
+	tkipICVSize     = 4
+	tkipExtIV       = 0x20
+	tkipKeyIDShift  = 6
+	tkipMaxKeyIndex = 3
+	tkipRC4KeySize  = 16
+	tkipPhase1Loops = 8
+
+	// tkipReplayCounters is the number of receive sequence counters per
+	// key, one for each TID. Non-QoS frames use the counter of TID 0.
+	tkipReplayCounters = 16
+
+	// tkipCountermeasuresTime is both the window in which a second MIC
+	// failure starts countermeasures and the duration of the
+	// countermeasures, as described in section 11.4.2.4.1 of the IEEE
+	// 802.11-2012 spec.
+	tkipCountermeasuresTime = time.Minute
+)
+
+var (
+	ErrTKIPKeySize         = errors.New("invalid TKIP key size")
+	ErrTKIPKeyIndex        = errors.New("invalid TKIP key index")
+	ErrTKIPNoKey           = errors.New("no TKIP key for frame")
+	ErrTKIPFormat          = errors.New("malformed TKIP frame")
+	ErrTKIPReplay          = errors.New("TKIP replay detected")
+	ErrTKIPICV             = errors.New("TKIP ICV mismatch")
+	ErrTKIPMIC             = errors.New("TKIP Michael MIC failure")
+	ErrTKIPCountermeasures = errors.New("TKIP countermeasures in effect")
+)
+
+// tkipSbox is the S-box of the TKIP key mixing functions, which is
+// built from the AES S-box.
+var tkipSbox = newTKIPSbox()
+
+// TKIPConfig stores the keys and callbacks of a TKIPCipher.
+//
+// The keys come from the 4-way and group key handshakes of a WPA
+// network, which are not performed by this package.
+type TKIPConfig struct {
+	// PTK is the pairwise transient key, which contains the KCK, the
+	// KEK, the temporal key, and the two Michael keys.
+	PTK []byte
+
+	// GTK is the group temporal key, followed by the two Michael keys.
+	// It may be nil, in which case group addressed frames are dropped
+	// until SetGroupKey is called.
+	GTK []byte
+
+	// GTKIndex is the key ID of the GTK, from 1 to 3.
+	GTKIndex int
+
+	// GTKRSC is the receive sequence counter of the GTK, which is
+	// provided along with the key.
+	GTKRSC uint64
+
+	// ReplayCounter is the last key replay counter which the station
+	// used in an EAPOL-Key frame.
+	// MIC failure reports use larger replay counters.
+	ReplayCounter uint64
+
+	// OnMICFailure is called with a Michael MIC failure report for the
+	// AP whenever a received MSDU fails its MIC check.
+	// The report should be sent on the MSDU stream.
+	//
+	// It is called from the stream's incoming loop, so it should not
+	// block, e.g. by sending the report from another goroutine.
+	OnMICFailure func(report MSDU)
+
+	// OnCountermeasures is called when two MIC failures occur within a
+	// minute. The station should then send the second report and
+	// deauthenticate.
+	//
+	// For the next minute, the cipher drops incoming frames and refuses
+	// to protect outgoing MSDUs, except for EAPOL frames.
+	OnCountermeasures func()
+}
+
+// A TKIPCipher encrypts and decrypts frames with TKIP, and protects
+// MSDUs with the Michael MIC, as described in section 11.4.2 of the
+// IEEE 802.11-2012 spec.
+//
+// It is used by stations, which send every frame with the pairwise key
+// and receive group addressed frames with the group key.
+type TKIPCipher struct {
+	config TKIPConfig
+	kck    []byte
+
+	lock           sync.Mutex
+	pairwise       *tkipKey
+	group          *tkipKey
+	groupIndex     int
+	tsc            uint64
+	replayCounter  uint64
+	lastMICFailure time.Time
+	blockedUntil   time.Time
+}
+
+type tkipKey struct {
+	tk    []byte
+	txMIC []byte
+	rxMIC []byte
+
+	rsc     [tkipReplayCounters]uint64
+	lastTSC uint64
+}
+
+// NewTKIPCipher creates a TKIPCipher from a configuration.
+func NewTKIPCipher(c TKIPConfig) (*TKIPCipher, error) {
+	if len(c.PTK) != TKIPPTKSize {
+		return nil, ErrTKIPKeySize
+	}
+	// NOTE: the PTK consists of the KCK, the KEK, the TK, and then the
+	// Michael keys of the authenticator and the supplicant.
+	res := &TKIPCipher{
+		config: c,
+		kck:    append([]byte{}, c.PTK[:16]...),
+		pairwise: &tkipKey{
+			tk:    append([]byte{}, c.PTK[32:48]...),
+			rxMIC: append([]byte{}, c.PTK[48:56]...),
+			txMIC: append([]byte{}, c.PTK[56:64]...),
+		},
+		replayCounter: c.ReplayCounter,
+	}
+	if c.GTK != nil {
+		if err := res.SetGroupKey(c.GTK, c.GTKIndex, c.GTKRSC); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// NewTKIPMSDUStream creates an MSDUStream for a WPA network whose
+// ciphers are TKIP.
+// It is an OpenMSDUStream whose data frames and MSDUs are protected by
+// a TKIPCipher, so unprotected data frames are dropped.
+func NewTKIPMSDUStream(c OpenMSDUStreamConfig, cipher *TKIPCipher) *OpenMSDUStream {
+	c.Cipher = cipher
+	return NewOpenMSDUStream(c)
+}
+
+// SetGroupKey installs a new group key, such as one from a group key
+// handshake, along with its key ID and receive sequence counter.
+func (t *TKIPCipher) SetGroupKey(gtk []byte, index int, rsc uint64) error {
+	if len(gtk) != TKIPGTKSize {
+		return ErrTKIPKeySize
+	}
+	if index < 1 || index > tkipMaxKeyIndex {
+		return ErrTKIPKeyIndex
+	}
+	key := &tkipKey{
+		tk:    append([]byte{}, gtk[:16]...),
+		rxMIC: append([]byte{}, gtk[16:24]...),
+	}
+	for i := range key.rsc {
+		key.rsc[i] = rsc
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.group = key
+	t.groupIndex = index
+	return nil
+}
+
+// EncryptFrame encrypts a frame with the pairwise key and the next TSC.
+func (t *TKIPCipher) EncryptFrame(f *frames.Frame) error {
+	t.lock.Lock()
+	t.tsc++
+	tsc := t.tsc
+	key := t.pairwise
+	t.lock.Unlock()
+
+	iv16 := uint16(tsc)
+	iv32 := uint32(tsc >> 16)
+	payload := make([]byte, 0, tkipHeaderSize+len(f.Payload)+tkipICVSize)
+	payload = append(payload, byte(iv16>>8), (byte(iv16>>8)|tkipExtIV)&0x7f, byte(iv16), tkipExtIV)
+	payload = binary.LittleEndian.AppendUint32(payload, iv32)
+	payload = append(payload, f.Payload...)
+	payload = binary.LittleEndian.AppendUint32(payload, crc32.ChecksumIEEE(f.Payload))
+
+	stream := tkipStream(key.tk, f.Addresses[1], iv32, iv16)
+	stream.XORKeyStream(payload[tkipHeaderSize:], payload[tkipHeaderSize:])
+	f.Payload = payload
+	f.Encrypted = true
+	return nil
+}
+
+// DecryptFrame decrypts a frame with the pairwise key, or with the
+// group key if the frame is group addressed, and checks its ICV and TSC.
+func (t *TKIPCipher) DecryptFrame(f *frames.Frame) error {
+	if len(f.Payload) < tkipHeaderSize+tkipICVSize || f.Payload[3]&tkipExtIV == 0 {
+		return ErrTKIPFormat
+	}
+	header := f.Payload[:tkipHeaderSize]
+	iv16 := uint16(header[0])<<8 | uint16(header[2])
+	iv32 := binary.LittleEndian.Uint32(header[4:])
+	tsc := uint64(iv32)<<16 | uint64(iv16)
+	counter := 0
+	if f.QoSControl != nil {
+		counter = int(*f.QoSControl & 0xf)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if time.Now().Before(t.blockedUntil) {
+		return ErrTKIPCountermeasures
+	}
+	key := t.pairwise
+	if f.Addresses[0][0]&1 != 0 {
+		if t.group == nil || int(header[3]>>tkipKeyIDShift) != t.groupIndex {
+			return ErrTKIPNoKey
+		}
+		key = t.group
+	}
+	if tsc <= key.rsc[counter] {
+		return ErrTKIPReplay
+	}
+
+	plaintext := make([]byte, len(f.Payload)-tkipHeaderSize)
+	stream := tkipStream(key.tk, f.Addresses[1], iv32, iv16)
+	stream.XORKeyStream(plaintext, f.Payload[tkipHeaderSize:])
+	icvIndex := len(plaintext) - tkipICVSize
+	if crc32.ChecksumIEEE(plaintext[:icvIndex]) != binary.LittleEndian.Uint32(plaintext[icvIndex:]) {
+		return ErrTKIPICV
+	}
+
+	// NOTE: the counter is updated once the ICV is verified, rather than
+	// once the MSDU's MIC is verified, so a forged fragment may cause
+	// later fragments of the same MSDU to be dropped.
+	key.rsc[counter] = tsc
+	key.lastTSC = tsc
+	f.Payload = plaintext[:icvIndex]
+	f.Encrypted = false
+	return nil
+}
+
+// ProtectMSDU appends the Michael MIC to an outgoing MSDU.
+// During countermeasures, only EAPOL MSDUs are protected.
+func (t *TKIPCipher) ProtectMSDU(m *MSDU) error {
+	t.lock.Lock()
+	blocked := time.Now().Before(t.blockedUntil)
+	key := t.pairwise
+	t.lock.Unlock()
+	if blocked {
+		if etherType, _, err := frames.DecodeLLCSNAP(m.Payload); err != nil ||
+			etherType != frames.EtherTypeEAPOL {
+			return ErrTKIPCountermeasures
+		}
+	}
+	mic := michaelMIC(key.txMIC, m.DA, m.SA, m.Priority, m.Payload)
+	m.Payload = append(append([]byte{}, m.Payload...), mic...)
+	return nil
+}
+
+// VerifyMSDU checks and removes the Michael MIC of an incoming MSDU.
+// A MIC failure is reported through the configuration's callbacks.
+func (t *TKIPCipher) VerifyMSDU(m *MSDU) error {
+	if len(m.Payload) < michaelMICSize {
+		return ErrTKIPFormat
+	}
+	t.lock.Lock()
+	key := t.pairwise
+	if m.Group() {
+		key = t.group
+	}
+	t.lock.Unlock()
+	if key == nil {
+		return ErrTKIPNoKey
+	}
+
+	micIndex := len(m.Payload) - michaelMICSize
+	mic := michaelMIC(key.rxMIC, m.DA, m.SA, m.Priority, m.Payload[:micIndex])
+	if subtle.ConstantTimeCompare(mic, m.Payload[micIndex:]) != 1 {
+		t.micFailure(m, key)
+		return ErrTKIPMIC
+	}
+	m.Payload = m.Payload[:micIndex]
+	return nil
+}
+
+// micFailure reports a MIC failure and starts countermeasures if it is
+// the second failure within a minute.
+func (t *TKIPCipher) micFailure(m *MSDU, key *tkipKey) {
+	now := time.Now()
+	t.lock.Lock()
+	countermeasures := !t.lastMICFailure.IsZero() &&
+		now.Sub(t.lastMICFailure) < tkipCountermeasuresTime
+	t.lastMICFailure = now
+	if countermeasures {
+		t.blockedUntil = now.Add(tkipCountermeasuresTime)
+	}
+
+	// NOTE: this is the Michael MIC Failure Report from section
+	// 11.6.6.6 of the IEEE 802.11-2012 spec.
+	t.replayCounter++
+	report := &frames.EAPOLKey{
+		DescriptorType: frames.EAPOLKeyDescriptorWPA,
+		KeyInfo:        frames.KeyInfoVersionHMACMD5 | frames.KeyInfoError | frames.KeyInfoRequest,
+		ReplayCounter:  t.replayCounter,
+		RSC:            key.lastTSC,
+	}
+	if key == t.pairwise {
+		report.KeyInfo |= frames.KeyInfoPairwise
+	}
+	report.SetMIC(t.kck)
+	t.lock.Unlock()
+
+	if t.config.OnMICFailure != nil {
+		t.config.OnMICFailure(MSDU{
+			Remote:  m.Transmitter,
+			DA:      m.Transmitter,
+			Payload: frames.EncodeLLCSNAP(frames.EtherTypeEAPOL, report.Encode()),
+		})
+	}
+	if countermeasures && t.config.OnCountermeasures != nil {
+		t.config.OnCountermeasures()
+	}
+}
+
+// tkipStream creates the RC4 keystream for a frame from the temporal
+// key, the transmitter address, and the TSC.
+func tkipStream(tk []byte, ta frames.MAC, iv32 uint32, iv16 uint16) *rc4.Cipher {
+	res, _ := rc4.NewCipher(tkipPhase2(tk, tkipPhase1(tk, ta, iv32), iv16))
+	return res
+}
+
+// tkipPhase1 computes the TTAK from the temporal key, the transmitter
+// address, and the upper 32 bits of the TSC, as described in section
+// 11.4.2.5 of the IEEE 802.11-2012 spec.
+func tkipPhase1(tk []byte, ta frames.MAC, iv32 uint32) [5]uint16 {
+	ttak := [5]uint16{
+		uint16(iv32),
+		uint16(iv32 >> 16),
+		binary.LittleEndian.Uint16(ta[0:]),
+		binary.LittleEndian.Uint16(ta[2:]),
+		binary.LittleEndian.Uint16(ta[4:]),
+	}
+	for i := 0; i < tkipPhase1Loops; i++ {
+		j := 2 * (i & 1)
+		ttak[0] += tkipS(ttak[4] ^ tk16(tk, j))
+		ttak[1] += tkipS(ttak[0] ^ tk16(tk, 4+j))
+		ttak[2] += tkipS(ttak[1] ^ tk16(tk, 8+j))
+		ttak[3] += tkipS(ttak[2] ^ tk16(tk, 12+j))
+		ttak[4] += tkipS(ttak[3]^tk16(tk, j)) + uint16(i)
+	}
+	return ttak
+}
+
+// tkipPhase2 computes the per-frame RC4 key from the TTAK and the lower
+// 16 bits of the TSC.
+func tkipPhase2(tk []byte, ttak [5]uint16, iv16 uint16) []byte {
+	var ppk [6]uint16
+	copy(ppk[:], ttak[:])
+	ppk[5] = ttak[4] + iv16
+
+	ppk[0] += tkipS(ppk[5] ^ tk16(tk, 0))
+	ppk[1] += tkipS(ppk[0] ^ tk16(tk, 2))
+	ppk[2] += tkipS(ppk[1] ^ tk16(tk, 4))
+	ppk[3] += tkipS(ppk[2] ^ tk16(tk, 6))
+	ppk[4] += tkipS(ppk[3] ^ tk16(tk, 8))
+	ppk[5] += tkipS(ppk[4] ^ tk16(tk, 10))
+	ppk[0] += bits.RotateLeft16(ppk[5]^tk16(tk, 12), -1)
+	ppk[1] += bits.RotateLeft16(ppk[0]^tk16(tk, 14), -1)
+	ppk[2] += bits.RotateLeft16(ppk[1], -1)
+	ppk[3] += bits.RotateLeft16(ppk[2], -1)
+	ppk[4] += bits.RotateLeft16(ppk[3], -1)
+	ppk[5] += bits.RotateLeft16(ppk[4], -1)
+
+	// NOTE: the first three octets are the WEP seed, which avoids the
+	// known weak RC4 keys.
+	key := make([]byte, 4, tkipRC4KeySize)
+	key[0] = byte(iv16 >> 8)
+	key[1] = (byte(iv16>>8) | tkipExtIV) & 0x7f
+	key[2] = byte(iv16)
+	key[3] = byte((ppk[5] ^ tk16(tk, 0)) >> 1)
+	for _, x := range ppk {
+		key = binary.LittleEndian.AppendUint16(key, x)
+	}
+	return key
+}
+
+func tk16(tk []byte, i int) uint16 {
+	return binary.LittleEndian.Uint16(tk[i:])
+}
+
+func tkipS(x uint16) uint16 {
+	return tkipSbox[x&0xff] ^ bits.ReverseBytes16(tkipSbox[x>>8])
+}
+
+// newTKIPSbox computes the TKIP S-box, whose entries combine the AES
+// S-box value s as 2s in the high octet and 3s in the low octet.
+func newTKIPSbox() [256]uint16 {
+	var aes [256]byte
+	p, q := byte(1), byte(1)
+	for {
+		// p is multiplied by 3, and q is divided by 3, so that q is
+		// always the multiplicative inverse of p.
+		p ^= xtime(p)
+		q ^= q << 1
+		q ^= q << 2
+		q ^= q << 4
+		if q&0x80 != 0 {
+			q ^= 0x09
+		}
+		aes[p] = q ^ bits.RotateLeft8(q, 1) ^ bits.RotateLeft8(q, 2) ^
+			bits.RotateLeft8(q, 3) ^ bits.RotateLeft8(q, 4) ^ 0x63
+		if p == 1 {
+			break
+		}
+	}
+	aes[0] = 0x63
+
+	var res [256]uint16
+	for i, s := range aes {
+		res[i] = uint16(xtime(s))<<8 | uint16(xtime(s)^s)
+	}
+	return res
+}
+
+// xtime multiplies a value by 2 in the AES field.
+func xtime(x byte) byte {
+	if x&0x80 != 0 {
+		return x<<1 ^ 0x1b
+	}
+	return x << 1
+}
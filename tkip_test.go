@@ -0,0 +1,216 @@
+package wifistack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/unixpickle/wifistack/frames"
+)
+
+var (
+	testTKIPBSSID  = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	testTKIPClient = frames.MAC{0x02, 0x00, 0x00, 0x00, 0x00, 0x03}
+)
+
+func TestTKIPKeyMixing(t *testing.T) {
+	// NOTE: these are the TKIP mixing function test vectors from annex
+	// M of the IEEE 802.11-2012 spec.
+	vectors := []struct {
+		tk     string
+		ta     frames.MAC
+		iv32   uint32
+		iv16   uint16
+		ttak   [5]uint16
+		rc4Key string
+	}{
+		{
+			tk:     "000102030405060708090a0b0c0d0e0f",
+			ta:     frames.MAC{0x10, 0x22, 0x33, 0x44, 0x55, 0x66},
+			iv32:   0,
+			iv16:   0,
+			ttak:   [5]uint16{0x3dd2, 0x016e, 0x76f4, 0x8697, 0xb2e8},
+			rc4Key: "00200033ea8d2f60ca6d1374234a660b",
+		},
+		{
+			tk:     "000102030405060708090a0b0c0d0e0f",
+			ta:     frames.MAC{0x10, 0x22, 0x33, 0x44, 0x55, 0x66},
+			iv32:   0,
+			iv16:   1,
+			ttak:   [5]uint16{0x3dd2, 0x016e, 0x76f4, 0x8697, 0xb2e8},
+			rc4Key: "00200190ffdc314389a9d9d074fd20aa",
+		},
+		{
+			tk:     "63893b250840b8ae0bd0fa7e61d2783e",
+			ta:     frames.MAC{0x64, 0xf2, 0xea, 0xed, 0xdc, 0x25},
+			iv32:   0x20dcfd43,
+			iv16:   0xffff,
+			ttak:   [5]uint16{0x7c67, 0x49d7, 0x9724, 0xb5e9, 0xb4f1},
+			rc4Key: "ff7fff93810fc6e58f5dd326251544ce",
+		},
+		{
+			tk:     "63893b250840b8ae0bd0fa7e61d2783e",
+			ta:     frames.MAC{0x64, 0xf2, 0xea, 0xed, 0xdc, 0x25},
+			iv32:   0x20dcfd44,
+			iv16:   0,
+			ttak:   [5]uint16{0x5a5d, 0x73a8, 0xa859, 0x2ec1, 0xdc8b},
+			rc4Key: "002000498ca471fcfbfaa16e3610f005",
+		},
+	}
+	for i, v := range vectors {
+		tk, _ := hex.DecodeString(v.tk)
+		ttak := tkipPhase1(tk, v.ta, v.iv32)
+		if ttak != v.ttak {
+			t.Errorf("vector %d: expected TTAK %04x but got %04x", i, v.ttak, ttak)
+			continue
+		}
+		expected, _ := hex.DecodeString(v.rc4Key)
+		if key := tkipPhase2(tk, ttak, v.iv16); !bytes.Equal(key, expected) {
+			t.Errorf("vector %d: expected RC4 key %x but got %x", i, expected, key)
+		}
+	}
+}
+
+func TestTKIPReplay(t *testing.T) {
+	sender := newTestTKIPCipher(t, TKIPConfig{})
+	receiver := newTestTKIPCipher(t, TKIPConfig{})
+
+	var encrypted []*frames.Frame
+	for i := 0; i < 3; i++ {
+		f := newTestTKIPFrame()
+		if err := sender.EncryptFrame(f); err != nil {
+			t.Fatal(err)
+		}
+		encrypted = append(encrypted, f)
+	}
+	decrypt := func(i int, tid uint16) error {
+		f := *encrypted[i]
+		f.Payload = append([]byte{}, f.Payload...)
+		if tid != 0 {
+			f.Type = frames.FrameTypeQoSData
+			f.QoSControl = &tid
+		}
+		return receiver.DecryptFrame(&f)
+	}
+
+	if err := decrypt(1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := decrypt(0, 0); err != ErrTKIPReplay {
+		t.Fatalf("expected ErrTKIPReplay for an older TSC but got %v", err)
+	}
+	if err := decrypt(1, 0); err != ErrTKIPReplay {
+		t.Fatalf("expected ErrTKIPReplay for a repeated TSC but got %v", err)
+	}
+	if err := decrypt(2, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// NOTE: every TID has its own replay counter.
+	if err := decrypt(0, 5); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTKIPCountermeasures(t *testing.T) {
+	var reports []MSDU
+	var countermeasures int
+	c := newTestTKIPCipher(t, TKIPConfig{
+		OnMICFailure: func(report MSDU) {
+			reports = append(reports, report)
+		},
+		OnCountermeasures: func() {
+			countermeasures++
+		},
+	})
+
+	payload := frames.EncodeLLCSNAP(frames.EtherTypeIPv4, []byte("hello, world"))
+	incoming := func(valid bool) MSDU {
+		mic := michaelMIC(c.pairwise.rxMIC, testTKIPClient, testTKIPBSSID, 0, payload)
+		if !valid {
+			mic[0] ^= 1
+		}
+		return MSDU{
+			Remote:      testTKIPBSSID,
+			DA:          testTKIPClient,
+			SA:          testTKIPBSSID,
+			Transmitter: testTKIPBSSID,
+			Payload:     append(append([]byte{}, payload...), mic...),
+		}
+	}
+
+	m := incoming(true)
+	if err := c.VerifyMSDU(&m); err != nil || !bytes.Equal(m.Payload, payload) {
+		t.Fatalf("valid MIC was rejected: %v", err)
+	}
+
+	m = incoming(false)
+	if err := c.VerifyMSDU(&m); err != ErrTKIPMIC {
+		t.Fatalf("expected ErrTKIPMIC but got %v", err)
+	}
+	if len(reports) != 1 || countermeasures != 0 {
+		t.Fatalf("unexpected %d reports and %d countermeasures", len(reports), countermeasures)
+	}
+	if etherType, _, err := frames.DecodeLLCSNAP(reports[0].Payload); err != nil ||
+		etherType != frames.EtherTypeEAPOL || reports[0].DA != testTKIPBSSID {
+		t.Fatal("MIC failure report is not an EAPOL frame for the AP")
+	}
+
+	// NOTE: a failure more than a minute after the last one does not
+	// start countermeasures.
+	c.lock.Lock()
+	c.lastMICFailure = time.Now().Add(-tkipCountermeasuresTime - time.Second)
+	c.lock.Unlock()
+	m = incoming(false)
+	if err := c.VerifyMSDU(&m); err != ErrTKIPMIC {
+		t.Fatalf("expected ErrTKIPMIC but got %v", err)
+	}
+	if len(reports) != 2 || countermeasures != 0 {
+		t.Fatalf("unexpected %d reports and %d countermeasures", len(reports), countermeasures)
+	}
+
+	m = incoming(false)
+	if err := c.VerifyMSDU(&m); err != ErrTKIPMIC {
+		t.Fatalf("expected ErrTKIPMIC but got %v", err)
+	}
+	if len(reports) != 3 || countermeasures != 1 {
+		t.Fatalf("unexpected %d reports and %d countermeasures", len(reports), countermeasures)
+	}
+
+	f := newTestTKIPFrame()
+	newTestTKIPCipher(t, TKIPConfig{}).EncryptFrame(f)
+	if err := c.DecryptFrame(f); err != ErrTKIPCountermeasures {
+		t.Fatalf("expected ErrTKIPCountermeasures but got %v", err)
+	}
+	outgoing := MSDU{DA: testTKIPBSSID, Payload: payload}
+	if err := c.ProtectMSDU(&outgoing); err != ErrTKIPCountermeasures {
+		t.Fatalf("expected ErrTKIPCountermeasures but got %v", err)
+	}
+	outgoing.Payload = frames.EncodeLLCSNAP(frames.EtherTypeEAPOL, []byte{1, 3, 0, 0})
+	if err := c.ProtectMSDU(&outgoing); err != nil {
+		t.Fatalf("EAPOL MSDU was blocked: %v", err)
+	}
+}
+
+func newTestTKIPCipher(t *testing.T, c TKIPConfig) *TKIPCipher {
+	c.PTK = make([]byte, TKIPPTKSize)
+	for i := range c.PTK {
+		c.PTK[i] = byte(i)
+	}
+	res, err := NewTKIPCipher(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func newTestTKIPFrame() *frames.Frame {
+	return &frames.Frame{
+		Type:            frames.FrameTypeData,
+		FromDS:          true,
+		Addresses:       []frames.MAC{testTKIPClient, testTKIPBSSID, testTKIPBSSID},
+		SequenceControl: new(uint16),
+		Payload:         frames.EncodeLLCSNAP(frames.EtherTypeIPv4, []byte("hello, world")),
+	}
+}
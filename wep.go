@@ -0,0 +1,147 @@
+package wifistack
+
+import (
+	"crypto/rc4"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/unixpickle/wifistack/frames"
+)
+
+// These are the sizes of WEP keys, not including the 24-bit IV.
+const (
+	WEP40KeySize  = 5
+	WEP104KeySize = 13
+)
+
+const (
+	wepIVSize     = 3
+	wepHeaderSize = wepIVSize + 1
+	wepICVSize    = 4
+	wepKeyCount   = 4
+	wepKeyIDShift = 6
+	wepMaxIV      = 1 << 24
+	wepOverhead   = wepHeaderSize + wepICVSize
+)
+
+var (
+	ErrWEPKeySize  = errors.New("WEP keys must be 5 or 13 bytes")
+	ErrWEPKeyIndex = errors.New("invalid WEP key index")
+	ErrWEPNoKey    = errors.New("no WEP key for key ID")
+	ErrWEPICV      = errors.New("WEP ICV mismatch")
+)
+
+// A WEPCipher encrypts and decrypts frames with WEP, as described in
+// section 11.2.2 of the IEEE 802.11-2012 spec.
+//
+// WEP is broken and should only be used for legacy networks.
+type WEPCipher struct {
+	keys       [wepKeyCount][]byte
+	txKeyIndex int
+
+	// iv is the last IV which was used, in its lower 24 bits.
+	iv uint32
+}
+
+// NewWEPCipher creates a WEPCipher from up to four default keys, which
+// are indexed by the key ID of each frame.
+// Outgoing frames are encrypted with keys[txKeyIndex].
+//
+// Unused keys should be nil, and every other key must be 40 or 104
+// bits long.
+func NewWEPCipher(keys [4][]byte, txKeyIndex int) (*WEPCipher, error) {
+	if txKeyIndex < 0 || txKeyIndex >= wepKeyCount || keys[txKeyIndex] == nil {
+		return nil, ErrWEPKeyIndex
+	}
+	res := &WEPCipher{
+		txKeyIndex: txKeyIndex,
+
+		// NOTE: IVs start at a random value so that restarting the
+		// cipher does not immediately reuse the previous keystreams.
+		iv: uint32(rand.Intn(wepMaxIV)),
+	}
+	for i, key := range keys {
+		if key == nil {
+			continue
+		}
+		if len(key) != WEP40KeySize && len(key) != WEP104KeySize {
+			return nil, ErrWEPKeySize
+		}
+		res.keys[i] = append([]byte{}, key...)
+	}
+	return res, nil
+}
+
+// NewWEPMSDUStream creates an MSDUStream for a WEP network.
+// It is an OpenMSDUStream whose data frames are protected by a
+// WEPCipher, so unprotected data frames are dropped.
+func NewWEPMSDUStream(c OpenMSDUStreamConfig, cipher *WEPCipher) *OpenMSDUStream {
+	c.Cipher = cipher
+	return NewOpenMSDUStream(c)
+}
+
+// ParseWEPKey parses a WEP key in one of the formats which are common
+// in AP configuration pages: 5 or 13 ASCII characters, or 10 or 26
+// hexadecimal digits.
+func ParseWEPKey(s string) ([]byte, error) {
+	switch len(s) {
+	case WEP40KeySize, WEP104KeySize:
+		return []byte(s), nil
+	case WEP40KeySize * 2, WEP104KeySize * 2:
+		return hex.DecodeString(s)
+	default:
+		return nil, ErrWEPKeySize
+	}
+}
+
+// EncryptFrame encrypts a frame with the transmit key and the next IV.
+func (w *WEPCipher) EncryptFrame(f *frames.Frame) error {
+	iv := atomic.AddUint32(&w.iv, 1) % wepMaxIV
+	payload := make([]byte, wepHeaderSize, len(f.Payload)+wepOverhead)
+	payload[0] = byte(iv >> 16)
+	payload[1] = byte(iv >> 8)
+	payload[2] = byte(iv)
+	payload[3] = byte(w.txKeyIndex << wepKeyIDShift)
+	payload = append(payload, f.Payload...)
+	payload = binary.LittleEndian.AppendUint32(payload, crc32.ChecksumIEEE(f.Payload))
+
+	stream := wepStream(payload[:wepIVSize], w.keys[w.txKeyIndex])
+	stream.XORKeyStream(payload[wepHeaderSize:], payload[wepHeaderSize:])
+	f.Payload = payload
+	f.Encrypted = true
+	return nil
+}
+
+// DecryptFrame decrypts a frame with the key selected by its key ID and
+// checks its ICV.
+func (w *WEPCipher) DecryptFrame(f *frames.Frame) error {
+	if len(f.Payload) < wepOverhead {
+		return frames.ErrBufferUnderflow
+	}
+	key := w.keys[f.Payload[3]>>wepKeyIDShift]
+	if key == nil {
+		return ErrWEPNoKey
+	}
+	plaintext := make([]byte, len(f.Payload)-wepHeaderSize)
+	wepStream(f.Payload[:wepIVSize], key).XORKeyStream(plaintext, f.Payload[wepHeaderSize:])
+
+	icvIndex := len(plaintext) - wepICVSize
+	if crc32.ChecksumIEEE(plaintext[:icvIndex]) != binary.LittleEndian.Uint32(plaintext[icvIndex:]) {
+		return ErrWEPICV
+	}
+	f.Payload = plaintext[:icvIndex]
+	f.Encrypted = false
+	return nil
+}
+
+// wepStream creates the RC4 keystream for an IV, which is seeded with
+// the IV followed by the key.
+func wepStream(iv, key []byte) *rc4.Cipher {
+	seed := append(append([]byte{}, iv...), key...)
+	res, _ := rc4.NewCipher(seed)
+	return res
+}
@@ -0,0 +1,101 @@
+package wifistack_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/unixpickle/wifistack"
+	"github.com/unixpickle/wifistack/frames"
+)
+
+func TestWEPRoundTrip(t *testing.T) {
+	for _, key := range [][]byte{[]byte("abcde"), []byte("0123456789abc")} {
+		var keys [4][]byte
+		keys[2] = key
+		sender, err := wifistack.NewWEPCipher(keys, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiver, err := wifistack.NewWEPCipher(keys, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		plaintext := frames.EncodeLLCSNAP(frames.EtherTypeIPv4, []byte("hello, world"))
+		f := &frames.Frame{
+			Type:            frames.FrameTypeData,
+			ToDS:            true,
+			Addresses:       []frames.MAC{testBSSID, testClient, testBSSID},
+			SequenceControl: new(uint16),
+			Payload:         append([]byte{}, plaintext...),
+		}
+		if err := sender.EncryptFrame(f); err != nil {
+			t.Fatal(err)
+		}
+		if !f.Encrypted || len(f.Payload) != len(plaintext)+8 {
+			t.Fatalf("unexpected encrypted frame: %v, %d bytes", f.Encrypted, len(f.Payload))
+		}
+		if keyID := f.Payload[3] >> 6; keyID != 2 {
+			t.Fatalf("expected key ID 2 but got %d", keyID)
+		}
+		if bytes.Contains(f.Payload, plaintext[8:]) {
+			t.Fatal("payload was not encrypted")
+		}
+
+		// NOTE: the frame goes through its wire encoding, since the
+		// protected flag must survive it.
+		decoded, err := frames.DecodeFrame(f.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := receiver.DecryptFrame(decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Encrypted || !bytes.Equal(decoded.Payload, plaintext) {
+			t.Fatalf("bad decryption: %x", decoded.Payload)
+		}
+	}
+}
+
+func TestWEPICVMismatch(t *testing.T) {
+	cipher, err := wifistack.NewWEPCipher([4][]byte{[]byte("abcde")}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := wifistack.NewWEPCipher([4][]byte{[]byte("edcba")}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypt := func() *frames.Frame {
+		f := &frames.Frame{Type: frames.FrameTypeData, Payload: []byte("hello, world")}
+		if err := cipher.EncryptFrame(f); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	t.Run("Corrupted", func(t *testing.T) {
+		f := encrypt()
+		f.Payload[6] ^= 1
+		if err := cipher.DecryptFrame(f); err != wifistack.ErrWEPICV {
+			t.Fatalf("expected ErrWEPICV but got %v", err)
+		}
+		if !f.Encrypted {
+			t.Fatal("rejected frame was marked as decrypted")
+		}
+	})
+
+	t.Run("WrongKey", func(t *testing.T) {
+		if err := otherKey.DecryptFrame(encrypt()); err != wifistack.ErrWEPICV {
+			t.Fatalf("expected ErrWEPICV but got %v", err)
+		}
+	})
+
+	t.Run("NoKey", func(t *testing.T) {
+		f := encrypt()
+		f.Payload[3] = 1 << 6
+		if err := cipher.DecryptFrame(f); err != wifistack.ErrWEPNoKey {
+			t.Fatalf("expected ErrWEPNoKey but got %v", err)
+		}
+	})
+}
@@ -0,0 +1,234 @@
+// Package wifinet provides an interface like the net package's on top
+// of wifistack's IP layers, so that Go programs can make connections
+// over a wifistack association.
+package wifinet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/unixpickle/wifistack/ipv4"
+	"github.com/unixpickle/wifistack/tcp"
+)
+
+var (
+	ErrNoResolver      = errors.New("no resolver for host names")
+	ErrNoAddresses     = errors.New("no IPv4 addresses for host")
+	ErrNonLocalAddress = errors.New("address is not local")
+)
+
+// A Dialer makes connections over a wifistack association.
+//
+// The DialContext method has the same signature as the net.Dialer
+// method of the same name, so it can be used directly as the
+// DialContext of an http.Transport or the Dial of a net.Resolver.
+//
+// Only IPv4 is supported, so the networks "tcp", "tcp4", "udp", and
+// "udp4" are accepted.
+type Dialer struct {
+	// IP is the IPv4 stack on which connections are made.
+	IP *ipv4.Stack
+
+	// TCP is the TCP stack of IP.
+	// If this is nil, only UDP may be used.
+	TCP *tcp.Stack
+
+	// Timeout is the maximum amount of time a dial may take.
+	// If this is 0, there is no timeout besides that of the context.
+	Timeout time.Duration
+
+	// Resolver is used to look up host names.
+	// If this is nil, addresses must contain IP addresses.
+	//
+	// To keep lookups off of the host's network, the resolver should
+	// use a Dial function which dials through a Dialer, such as the
+	// NetResolver of a dns.Resolver whose Dial is this Dialer's
+	// DialContext.
+	Resolver *net.Resolver
+}
+
+// Dial connects to an address.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to an address using the provided context.
+//
+// If the host is a name which resolves to multiple addresses, they are
+// tried in order until one succeeds.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	opError := func(err error) error {
+		return &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	if err := d.checkNetwork(network); err != nil {
+		return nil, opError(err)
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, opError(err)
+	}
+	port, err := lookupPort(ctx, network, portStr)
+	if err != nil {
+		return nil, opError(err)
+	}
+	ips, err := d.lookupHost(ctx, host)
+	if err != nil {
+		return nil, opError(err)
+	}
+
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := d.dialIP(ctx, network, ip, port)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// Listen creates a TCP listener.
+// The address may only contain an unspecified or local IP address.
+func (d *Dialer) Listen(network, address string) (net.Listener, error) {
+	opError := func(err error) error {
+		return &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	if network != "tcp" && network != "tcp4" {
+		return nil, opError(net.UnknownNetworkError(network))
+	}
+	if err := d.checkNetwork(network); err != nil {
+		return nil, opError(err)
+	}
+	port, err := d.localPort(network, address)
+	if err != nil {
+		return nil, opError(err)
+	}
+	res, err := d.TCP.Listen(port)
+	if err != nil {
+		return nil, opError(err)
+	}
+	return res, nil
+}
+
+// ListenPacket creates a UDP socket.
+// The address may only contain an unspecified or local IP address.
+func (d *Dialer) ListenPacket(network, address string) (net.PacketConn, error) {
+	opError := func(err error) error {
+		return &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	if network != "udp" && network != "udp4" {
+		return nil, opError(net.UnknownNetworkError(network))
+	}
+	port, err := d.localPort(network, address)
+	if err != nil {
+		return nil, opError(err)
+	}
+	res, err := d.IP.ListenUDP(port)
+	if err != nil {
+		return nil, opError(err)
+	}
+	return res, nil
+}
+
+func (d *Dialer) checkNetwork(network string) error {
+	switch network {
+	case "tcp", "tcp4":
+		if d.TCP == nil {
+			return net.UnknownNetworkError(network)
+		}
+	case "udp", "udp4":
+	default:
+		return net.UnknownNetworkError(network)
+	}
+	return nil
+}
+
+func (d *Dialer) dialIP(ctx context.Context, network string, ip net.IP,
+	port int) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4":
+		addr := &net.TCPAddr{IP: ip, Port: port}
+		conn, err := d.TCP.Dial(ctx, addr)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Addr: addr, Err: err}
+		}
+		return conn, nil
+	default:
+		addr := &net.UDPAddr{IP: ip, Port: port}
+		conn, err := d.IP.ListenUDP(0)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Addr: addr, Err: err}
+		}
+		return &udpConn{UDPConn: conn, remote: addr}, nil
+	}
+}
+
+// lookupHost resolves a host to IPv4 addresses.
+func (d *Dialer) lookupHost(ctx context.Context, host string) ([]net.IP, error) {
+	if host == "" {
+		return nil, &net.AddrError{Err: "missing host", Addr: host}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() == nil {
+			return nil, &net.AddrError{Err: "not an IPv4 address", Addr: host}
+		}
+		return []net.IP{ip.To4()}, nil
+	}
+	if d.Resolver == nil {
+		return nil, &net.DNSError{Err: ErrNoResolver.Error(), Name: host}
+	}
+	ips, err := d.Resolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: ErrNoAddresses.Error(), Name: host}
+	}
+	return ips, nil
+}
+
+// localPort parses a local address and checks that its IP address, if
+// any, belongs to this host.
+func (d *Dialer) localPort(network, address string) (int, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return 0, err
+	}
+	if host != "" {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return 0, &net.AddrError{Err: "not an IP address", Addr: host}
+		}
+		if !ip.IsUnspecified() && !ip.Equal(d.IP.Address()) {
+			return 0, ErrNonLocalAddress
+		}
+	}
+	return lookupPort(context.Background(), network, portStr)
+}
+
+func lookupPort(ctx context.Context, network, port string) (int, error) {
+	if num, err := strconv.Atoi(port); err == nil {
+		if num < 0 || num > 0xffff {
+			return 0, &net.AddrError{Err: "invalid port", Addr: port}
+		}
+		return num, nil
+	}
+	// NOTE: named ports are looked up in the local services database,
+	// which does not touch the network.
+	return net.DefaultResolver.LookupPort(ctx, network, port)
+}
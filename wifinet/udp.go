@@ -0,0 +1,50 @@
+package wifinet
+
+import (
+	"net"
+
+	"github.com/unixpickle/wifistack/ipv4"
+)
+
+// A udpConn is a UDP socket which is connected to a remote address.
+//
+// It implements both net.Conn and net.PacketConn, like *net.UDPConn, so
+// that a net.Resolver treats it as a datagram connection.
+type udpConn struct {
+	*ipv4.UDPConn
+	remote *net.UDPAddr
+}
+
+// Read reads the next datagram from the remote address, dropping
+// datagrams from any other address.
+func (u *udpConn) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := u.UDPConn.ReadFrom(b)
+		if err != nil {
+			return n, err
+		}
+		source := addr.(*net.UDPAddr)
+		if source.Port == u.remote.Port && source.IP.Equal(u.remote.IP) {
+			return n, nil
+		}
+	}
+}
+
+// Write sends a datagram to the remote address.
+func (u *udpConn) Write(b []byte) (int, error) {
+	return u.UDPConn.WriteTo(b, u.remote)
+}
+
+// RemoteAddr returns the remote address.
+func (u *udpConn) RemoteAddr() net.Addr {
+	return u.remote
+}
+
+// ReadFrom is like Read, but it also returns the remote address.
+func (u *udpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := u.Read(b)
+	if err != nil {
+		return n, nil, err
+	}
+	return n, u.remote, nil
+}
@@ -0,0 +1,45 @@
+package wifistack
+
+import (
+	"errors"
+
+	"github.com/unixpickle/wifistack/frames"
+)
+
+var ErrNoSupportedCipher = errors.New("no supported WPA cipher")
+
+// SelectWPACiphers chooses the ciphers and AKM suite for joining a WPA
+// network, given the WPA element which its AP advertises.
+// The result should be sent in the association request by setting
+// Handshaker.WPA.
+//
+// TKIP is the only supported cipher, so the AP must use it as the group
+// cipher and offer it as a pairwise cipher.
+// PSK authentication is preferred to 802.1X authentication.
+func SelectWPACiphers(ap *frames.WPAElement) (*frames.WPAElement, error) {
+	if ap == nil || ap.GroupCipher != frames.WPACipherTKIP ||
+		!containsSuite(ap.PairwiseCiphers, frames.WPACipherTKIP) {
+		return nil, ErrNoSupportedCipher
+	}
+	akm := frames.WPAAKMPSK
+	if !containsSuite(ap.AKMs, akm) {
+		if !containsSuite(ap.AKMs, frames.WPAAKM8021X) {
+			return nil, ErrNoSupportedCipher
+		}
+		akm = frames.WPAAKM8021X
+	}
+	return &frames.WPAElement{
+		GroupCipher:     frames.WPACipherTKIP,
+		PairwiseCiphers: []int{frames.WPACipherTKIP},
+		AKMs:            []int{akm},
+	}, nil
+}
+
+func containsSuite(suites []int, suite int) bool {
+	for _, s := range suites {
+		if s == suite {
+			return true
+		}
+	}
+	return false
+}